@@ -5,25 +5,98 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/pat"
 )
 
+// requestInfo holds data collected while serving a request, reported in the
+// access log once the request is done.
+type requestInfo struct {
+	user     string
+	instance string
+	plan     string
+}
+
+// requestUser returns the name of the user authenticated in the request.
+func requestUser(r *http.Request) string {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+		return info.user
+	}
+	return ""
+}
+
+func setRequestInfo(r *http.Request, instance, plan string) {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+		info.instance = instance
+		info.plan = plan
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// handler wraps the handlers of the service API, called by tsuru.
 func handler(fn http.HandlerFunc) http.HandlerFunc {
+	return authHandler(RoleService, fn)
+}
+
+// adminHandler wraps the handlers of the admin API, which can't be called
+// with the credentials used by tsuru.
+func adminHandler(fn http.HandlerFunc) http.HandlerFunc {
+	return authHandler(RoleAdmin, fn)
+}
+
+func authHandler(role string, fn http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if config.Username != "" && config.Password != "" {
-			if username, password, ok := r.BasicAuth(); !ok || username != config.Username || password != config.Password {
-				w.Header().Add("WWW-Authenticate", `Basic realm="diaats"`)
-				w.WriteHeader(http.StatusUnauthorized)
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		var info requestInfo
+		ctx := withRequestID(r.Context(), requestID)
+		ctx = context.WithValue(ctx, requestInfoKey, &info)
+		r = r.WithContext(ctx)
+		w.Header().Set("X-Request-ID", requestID)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		defer func() {
+			loggerFromContext(ctx).Info("request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", recorder.status,
+				"duration", time.Since(start),
+				"user", info.user,
+				"instance", info.instance,
+				"plan", info.plan,
+			)
+		}()
+		if creds := credentials(); len(creds) > 0 {
+			cred := authenticate(r, creds)
+			if cred == nil {
+				recorder.Header().Add("WWW-Authenticate", `Basic realm="diaats"`)
+				recorder.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			info.user = cred.Username
+			if !cred.allows(role) {
+				http.Error(recorder, "forbidden", http.StatusForbidden)
 				return
 			}
 		}
-		fn.ServeHTTP(w, r)
+		fn.ServeHTTP(recorder, r)
 	})
 }
 
@@ -38,16 +111,41 @@ func createInstance(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "please provide the name of the plan", http.StatusBadRequest)
 		return
 	}
+	setRequestInfo(r, name, planName)
 	plan, err := getPlan(planName)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err = CreateInstance(name, plan)
+	evt := newEvent(r, EventCreate, name)
+	evt.Plan = plan.Name
+	opts := CreateOptions{
+		Team:              r.FormValue("team"),
+		Source:            r.FormValue("parameters.source"),
+		MaintenanceWindow: r.FormValue("parameters.maintenance-window"),
+	}
+	if opts.MaintenanceWindow != "" {
+		if _, err = parseWindow(opts.MaintenanceWindow); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	err = CreateInstance(r.Context(), name, plan, opts)
+	if instance, getErr := storage.GetInstance(name); err == nil && getErr == nil {
+		evt.DockerHost = instance.DockerHost
+	}
+	evt.Done(r.Context(), err)
 	if err != nil {
 		status := http.StatusInternalServerError
-		if err == ErrInstanceAlreadyExists {
+		switch err {
+		case ErrInstanceAlreadyExists:
 			status = http.StatusConflict
+		case ErrSourceNotFound, ErrSnapshotNotFound, ErrSourcePlanMismatch, ErrNotSupportedBySwarm, ErrSwarmVolumes, ErrSpreadInstance:
+			status = http.StatusBadRequest
+		case ErrSourceForbidden:
+			status = http.StatusForbidden
+		case ErrNoHostAvailable, ErrNoMatchingHost, ErrSourceHostCordoned, ErrSourceHostConstraints, ErrInsufficientCapacity, ErrShuttingDown:
+			status = http.StatusServiceUnavailable
 		}
 		http.Error(w, err.Error(), status)
 		return
@@ -57,8 +155,11 @@ func createInstance(w http.ResponseWriter, r *http.Request) {
 
 func bindApp(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get(":name")
-	instance, err := GetInstance(name)
+	setRequestInfo(r, name, "")
+	evt := newEvent(r, EventBind, name)
+	instance, err := GetInstance(r.Context(), name)
 	if err != nil {
+		evt.Done(r.Context(), err)
 		status := http.StatusInternalServerError
 		if err == ErrInstanceNotFound {
 			status = http.StatusNotFound
@@ -66,29 +167,75 @@ func bindApp(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), status)
 		return
 	}
+	evt.Plan = instance.Plan.Name
+	evt.DockerHost = instance.DockerHost
+	defer func() { evt.Done(r.Context(), err) }()
+	if instance.State == StateCreating {
+		err = ErrInstanceCreating
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
 	encodedEndpoints, _ := json.Marshal(instance.Endpoints())
 	encodedEnvs, _ := json.Marshal(instance.EnvMap())
-	envVarName := fmt.Sprintf("DIAATS_%s_INSTANCE", strings.ToUpper(instance.Plan.Name))
-	dockerEnvVarName := fmt.Sprintf("DIAATS_%s_DOCKER_ENVS", strings.ToUpper(instance.Plan.Name))
+	setRequestInfo(r, name, instance.Plan.Name)
+	envVarName := fmt.Sprintf("DIAATS_%s_INSTANCE", envName(instance.Plan.Name))
+	dockerEnvVarName := fmt.Sprintf("DIAATS_%s_DOCKER_ENVS", envName(instance.Plan.Name))
 	data := map[string]string{
 		envVarName:       string(encodedEndpoints),
 		dockerEnvVarName: string(encodedEnvs),
 	}
+	for name, endpoint := range instance.NamedEndpoints() {
+		data[fmt.Sprintf("DIAATS_%s_%s_ENDPOINT", envName(instance.Plan.Name), envName(name))] = endpoint
+	}
+	if instance.Plan.URL != "" {
+		var connURL string
+		connURL, err = renderURL(instance)
+		if err != nil {
+			loggerFromContext(r.Context()).Error("failed to render connection URL", "instance", name, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data[fmt.Sprintf("DIAATS_%s_URL", envName(instance.Plan.Name))] = connURL
+	}
 	err = json.NewEncoder(w).Encode(data)
 	if err != nil {
-		log.Printf("ERROR - failed to encode JSON: %s", err)
+		loggerFromContext(r.Context()).Error("failed to encode JSON", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
+func unbindApp(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	setRequestInfo(r, name, "")
+	evt := newEvent(r, EventUnbind, name)
+	instance, err := GetInstance(r.Context(), name)
+	if err == nil {
+		setRequestInfo(r, name, instance.Plan.Name)
+		evt.Plan = instance.Plan.Name
+		evt.DockerHost = instance.DockerHost
+	}
+	evt.Done(r.Context(), err)
+}
+
 func removeInstance(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get(":name")
-	err := DestroyInstance(name)
+	setRequestInfo(r, name, "")
+	evt := newEvent(r, EventRemove, name)
+	if instance, err := GetInstance(r.Context(), name); err == nil {
+		setRequestInfo(r, name, instance.Plan.Name)
+		evt.Plan = instance.Plan.Name
+		evt.DockerHost = instance.DockerHost
+	}
+	err := DestroyInstance(r.Context(), name)
+	evt.Done(r.Context(), err)
 	if err != nil {
 		status := http.StatusInternalServerError
-		if err == ErrInstanceNotFound {
+		switch err {
+		case ErrInstanceNotFound:
 			status = http.StatusNotFound
+		case ErrShuttingDown:
+			status = http.StatusServiceUnavailable
 		}
 		http.Error(w, err.Error(), status)
 		return
@@ -97,7 +244,8 @@ func removeInstance(w http.ResponseWriter, r *http.Request) {
 
 func instanceStatus(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get(":name")
-	_, err := GetInstance(name)
+	setRequestInfo(r, name, "")
+	instance, err := GetInstance(r.Context(), name)
 	if err != nil {
 		status := http.StatusInternalServerError
 		if err == ErrInstanceNotFound {
@@ -106,6 +254,30 @@ func instanceStatus(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), status)
 		return
 	}
+	setRequestInfo(r, name, instance.Plan.Name)
+	if instance.State == StateCreating {
+		http.Error(w, ErrInstanceCreating.Error(), http.StatusAccepted)
+		return
+	}
+	health, err := instanceHealth(r.Context(), instance)
+	if err != nil {
+		loggerFromContext(r.Context()).Error("failed to get container health", "instance", name, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch health {
+	case HealthStarting:
+		w.WriteHeader(http.StatusAccepted)
+		return
+	case HealthUnhealthy:
+		http.Error(w, "container is unhealthy", http.StatusInternalServerError)
+		return
+	}
+	if err = checkReady(r.Context(), instance); err != nil {
+		loggerFromContext(r.Context()).Warn("instance not ready", "instance", name, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -121,15 +293,491 @@ func listPlans(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func listEvents(w http.ResponseWriter, r *http.Request) {
+	filter := EventFilter{
+		Instance:   r.FormValue("instance"),
+		Plan:       r.FormValue("plan"),
+		DockerHost: r.FormValue("host"),
+		Kind:       r.FormValue("kind"),
+		Limit:      100,
+	}
+	var err error
+	if since := r.FormValue("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			http.Error(w, "invalid value for since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if until := r.FormValue("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			http.Error(w, "invalid value for until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := r.FormValue("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	events, err := ListEvents(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// instanceInfo is the representation of an instance in the admin API.
+type instanceInfo struct {
+	Name        string    `json:"name"`
+	Plan        string    `json:"plan"`
+	Team        string    `json:"team,omitempty"`
+	State       string    `json:"state"`
+	DockerHost  string    `json:"dockerHost"`
+	ContainerID string    `json:"containerID"`
+	Containers  []string  `json:"containers"`
+	Endpoints   []string  `json:"endpoints"`
+	CreatedAt   time.Time `json:"createdAt"`
+
+	UpdateAvailable bool `json:"updateAvailable"`
+}
+
+func listInstances(w http.ResponseWriter, r *http.Request) {
+	filter := InstanceFilter{
+		Plan:       r.FormValue("plan"),
+		DockerHost: r.FormValue("host"),
+		State:      r.FormValue("state"),
+		Team:       r.FormValue("team"),
+		Sort:       r.FormValue("sort"),
+		Limit:      100,
+	}
+	var err error
+	if since := r.FormValue("created_since"); since != "" {
+		if filter.CreatedSince, err = time.Parse(time.RFC3339, since); err != nil {
+			http.Error(w, "invalid value for created_since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if until := r.FormValue("created_until"); until != "" {
+		if filter.CreatedUntil, err = time.Parse(time.RFC3339, until); err != nil {
+			http.Error(w, "invalid value for created_until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if offset := r.FormValue("offset"); offset != "" {
+		if filter.Offset, err = strconv.Atoi(offset); err != nil || filter.Offset < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := r.FormValue("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, _, err = filter.sortField(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	instances, total, err := storage.ListInstances(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := struct {
+		Instances []instanceInfo `json:"instances"`
+		Total     int            `json:"total"`
+		Offset    int            `json:"offset"`
+		Limit     int            `json:"limit"`
+	}{Instances: make([]instanceInfo, len(instances)), Total: total, Offset: filter.Offset, Limit: filter.Limit}
+	for i, instance := range instances {
+		result.Instances[i] = instanceInfo{
+			Name:        instance.Name,
+			Plan:        instance.Plan.Name,
+			Team:        instance.Team,
+			State:       instance.State,
+			DockerHost:  instance.DockerHost,
+			ContainerID: instance.ContainerID,
+			Containers:  instance.containerIDs(),
+			Endpoints:   instance.Endpoints(),
+			CreatedAt:   instance.CreatedAt,
+
+			UpdateAvailable: instance.UpdateAvailable(),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// backupStatus returns the HTTP status for errors of backup operations.
+func backupStatus(err error) int {
+	switch err {
+	case ErrInstanceNotFound, ErrBackupNotFound:
+		return http.StatusNotFound
+	case ErrBackupNotSupported, ErrRestoreNotSupported, ErrNotSupportedBySwarm:
+		return http.StatusBadRequest
+	case ErrBackupsDisabled:
+		return http.StatusNotImplemented
+	case ErrShuttingDown:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func listBackups(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	setRequestInfo(r, name, "")
+	if backups == nil {
+		http.Error(w, ErrBackupsDisabled.Error(), backupStatus(ErrBackupsDisabled))
+		return
+	}
+	instance, err := GetInstance(r.Context(), name)
+	if err != nil {
+		http.Error(w, err.Error(), backupStatus(err))
+		return
+	}
+	setRequestInfo(r, name, instance.Plan.Name)
+	list, err := backups.List(instance.backupKey())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if list == nil {
+		list = []Backup{}
+	}
+	for i := range list {
+		list[i].Instance = name
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(list)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func createBackup(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	setRequestInfo(r, name, "")
+	evt := newEvent(r, EventBackup, name)
+	instance, err := GetInstance(r.Context(), name)
+	if err != nil {
+		evt.Done(r.Context(), err)
+		http.Error(w, err.Error(), backupStatus(err))
+		return
+	}
+	setRequestInfo(r, name, instance.Plan.Name)
+	evt.Plan = instance.Plan.Name
+	evt.DockerHost = instance.DockerHost
+	backup, err := BackupInstance(r.Context(), instance)
+	evt.Done(r.Context(), err)
+	if err != nil {
+		http.Error(w, err.Error(), backupStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(backup)
+}
+
+func restoreBackup(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	setRequestInfo(r, name, "")
+	evt := newEvent(r, EventRestore, name)
+	instance, err := GetInstance(r.Context(), name)
+	if err != nil {
+		evt.Done(r.Context(), err)
+		http.Error(w, err.Error(), backupStatus(err))
+		return
+	}
+	setRequestInfo(r, name, instance.Plan.Name)
+	evt.Plan = instance.Plan.Name
+	evt.DockerHost = instance.DockerHost
+	err = RestoreInstance(r.Context(), instance, r.URL.Query().Get(":id"))
+	evt.Done(r.Context(), err)
+	if err != nil {
+		http.Error(w, err.Error(), backupStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listSnapshots(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	setRequestInfo(r, name, "")
+	instance, err := GetInstance(r.Context(), name)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrInstanceNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	setRequestInfo(r, name, instance.Plan.Name)
+	snapshots := instance.Snapshots
+	if snapshots == nil {
+		snapshots = []Snapshot{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(snapshots)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func createSnapshot(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	setRequestInfo(r, name, "")
+	evt := newEvent(r, EventSnapshot, name)
+	instance, err := GetInstance(r.Context(), name)
+	if err != nil {
+		evt.Done(r.Context(), err)
+		status := http.StatusInternalServerError
+		if err == ErrInstanceNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	setRequestInfo(r, name, instance.Plan.Name)
+	evt.Plan = instance.Plan.Name
+	evt.DockerHost = instance.DockerHost
+	snapshot, err := SnapshotInstance(r.Context(), instance)
+	evt.Done(r.Context(), err)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrNotSupportedBySwarm || err == ErrSpreadInstance {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+func removeSnapshot(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	setRequestInfo(r, name, "")
+	err := RemoveSnapshot(r.Context(), name, r.URL.Query().Get(":id"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrInstanceNotFound || err == ErrSnapshotNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	setRequestInfo(r, name, "")
+	window := r.FormValue("window")
+	if window != "" {
+		if _, err := parseWindow(window); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	err := SetMaintenanceWindow(r.Context(), name, window)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrInstanceNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listOperations(w http.ResponseWriter, r *http.Request) {
+	operations, err := ListOperations()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(operations)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func queueOperation(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	setRequestInfo(r, name, "")
+	kind := r.FormValue("kind")
+	if operationRunners[kind] == nil {
+		http.Error(w, fmt.Sprintf("invalid operation %q", kind), http.StatusBadRequest)
+		return
+	}
+	reason := r.FormValue("reason")
+	if reason == "" {
+		reason = "requested by " + actorFromRequest(r)
+	}
+	op, err := QueueOperation(r.Context(), name, kind, reason)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case ErrInstanceNotFound:
+			status = http.StatusNotFound
+		case ErrNotSupportedBySwarm, ErrStatefulInstance, ErrSpreadInstance:
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(op)
+}
+
+func cancelOperation(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	setRequestInfo(r, name, "")
+	err := CancelOperation(r.Context(), name, r.URL.Query().Get(":id"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrInstanceNotFound || err == ErrOperationNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listHosts(w http.ResponseWriter, r *http.Request) {
+	hosts, err := ListHosts(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(hosts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func hostStatus(err error) int {
+	switch err {
+	case ErrHostNotFound, ErrNoDrain:
+		return http.StatusNotFound
+	case ErrDrainInProgress:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func getHost(w http.ResponseWriter, r *http.Request) {
+	host, err := GetHost(r.Context(), r.URL.Query().Get(":host"))
+	if err != nil {
+		http.Error(w, err.Error(), hostStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(host)
+}
+
+// hostHandler resolves the Docker host named in the path of host
+// operations, recording an event of the given kind for it.
+func hostHandler(kind string, fn func(w http.ResponseWriter, r *http.Request, name string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get(":host")
+		host, err := findHostByName(name)
+		if err != nil {
+			http.Error(w, err.Error(), hostStatus(err))
+			return
+		}
+		evt := newEvent(r, kind, "")
+		evt.DockerHost = host.Address
+		err = fn(w, r, name)
+		evt.Done(r.Context(), err)
+		if err != nil {
+			http.Error(w, err.Error(), hostStatus(err))
+		}
+	}
+}
+
+func cordonHost(w http.ResponseWriter, r *http.Request, name string) error {
+	err := CordonHost(r.Context(), name)
+	if err == nil {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return err
+}
+
+func uncordonHost(w http.ResponseWriter, r *http.Request, name string) error {
+	err := UncordonHost(r.Context(), name)
+	if err == nil {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return err
+}
+
+func drainHostHandler(w http.ResponseWriter, r *http.Request, name string) error {
+	drain, err := DrainHost(r.Context(), name, actorFromRequest(r))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(drain)
+	return nil
+}
+
+func abortDrain(w http.ResponseWriter, r *http.Request, name string) error {
+	drain, err := AbortDrain(r.Context(), name)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(drain)
+	return nil
+}
+
 func buildMuxer() http.Handler {
 	m := pat.New()
 	m.Post("/resources/{name}/bind-app", handler(bindApp))
-	m.Delete("/resources/{name}/bind-app", handler(func(http.ResponseWriter, *http.Request) {}))
+	m.Delete("/resources/{name}/bind-app", handler(unbindApp))
 	m.Post("/resources/{name}/bind", handler(func(http.ResponseWriter, *http.Request) {}))
 	m.Delete("/resources/{name}/bind", handler(func(http.ResponseWriter, *http.Request) {}))
 	m.Get("/resources/{name}/status", handler(instanceStatus))
 	m.Delete("/resources/{name}", handler(removeInstance))
 	m.Get("/resources/plans", handler(listPlans))
 	m.Post("/resources", handler(createInstance))
+	m.Get("/admin/events", adminHandler(listEvents))
+	m.Post("/admin/instances/{name}/backups/{id}/restore", adminHandler(restoreBackup))
+	m.Get("/admin/instances/{name}/backups", adminHandler(listBackups))
+	m.Post("/admin/instances/{name}/backups", adminHandler(createBackup))
+	m.Delete("/admin/instances/{name}/snapshots/{id}", adminHandler(removeSnapshot))
+	m.Get("/admin/instances/{name}/snapshots", adminHandler(listSnapshots))
+	m.Post("/admin/instances/{name}/snapshots", adminHandler(createSnapshot))
+	m.Put("/admin/instances/{name}/maintenance-window", adminHandler(setMaintenanceWindow))
+	m.Delete("/admin/instances/{name}/operations/{id}", adminHandler(cancelOperation))
+	m.Post("/admin/instances/{name}/operations", adminHandler(queueOperation))
+	m.Get("/admin/instances", adminHandler(listInstances))
+	m.Get("/admin/operations", adminHandler(listOperations))
+	m.Post("/admin/hosts/{host}/cordon", adminHandler(hostHandler(EventCordon, cordonHost)))
+	m.Delete("/admin/hosts/{host}/cordon", adminHandler(hostHandler(EventUncordon, uncordonHost)))
+	m.Post("/admin/hosts/{host}/drain", adminHandler(hostHandler(EventDrain, drainHostHandler)))
+	m.Delete("/admin/hosts/{host}/drain", adminHandler(hostHandler(EventDrainAbort, abortDrain)))
+	m.Get("/admin/hosts/{host}", adminHandler(getHost))
+	m.Get("/admin/hosts", adminHandler(listHosts))
 	return m
 }
@@ -5,9 +5,13 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 
@@ -26,22 +30,30 @@ type S struct {
 	server *dtesting.DockerServer
 }
 
+func (s *S) SetUpSuite(c *check.C) {
+	logger = newLogger(io.Discard, "error")
+}
+
 func (s *S) SetUpTest(c *check.C) {
 	var err error
 	config.Username = ""
 	config.Password = ""
-	config.MongoURL = "mongodb://127.0.0.1:27017/diaats"
-	config.DBName = "diaats"
 	s.server, err = dtesting.NewServer("127.0.0.1:0", nil, nil)
 	c.Assert(err, check.IsNil)
 	config.DockerHost = s.server.URL()
-	coll, err := connect()
-	c.Assert(err, check.IsNil)
-	coll.RemoveAll(nil)
+	config.DockerHosts = nil
+	config.HostConfig = nil
+	config.NetworkIsolation = ""
+	config.Provisioner = ""
+	storage = newMemoryStorage()
+	backups = nil
+	shuttingDown = false
+	hostMemories.hosts = make(map[string]cachedMemory)
 }
 
 func (s *S) TearDownTest(c *check.C) {
 	s.server.Stop()
+	stdout = os.Stdout
 }
 
 func (*S) TestHandlerSuccess(c *check.C) {
@@ -123,13 +135,50 @@ func (*S) TestHandlerWrongCredentials(c *check.C) {
 	c.Assert(called, check.Equals, false)
 }
 
+func (*S) TestHandlerRequestID(c *check.C) {
+	var buf bytes.Buffer
+	old := logger
+	defer func() { logger = old }()
+	logger = newLogger(&buf, "info")
+	var requestID string
+	h := handler(func(w http.ResponseWriter, r *http.Request) {
+		requestID = requestIDFromContext(r.Context())
+		setRequestInfo(r, "mycache", "supermemcached")
+		w.WriteHeader(http.StatusAccepted)
+	})
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("X-Request-ID", "req-1")
+	h.ServeHTTP(recorder, request)
+	c.Assert(requestID, check.Equals, "req-1")
+	c.Assert(recorder.Header().Get("X-Request-ID"), check.Equals, "req-1")
+	var entry map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &entry)
+	c.Assert(err, check.IsNil)
+	c.Assert(entry["msg"], check.Equals, "request")
+	c.Assert(entry["request_id"], check.Equals, "req-1")
+	c.Assert(entry["status"], check.Equals, float64(http.StatusAccepted))
+	c.Assert(entry["instance"], check.Equals, "mycache")
+	c.Assert(entry["plan"], check.Equals, "supermemcached")
+}
+
+func (*S) TestHandlerGeneratesRequestID(c *check.C) {
+	h := handler(func(w http.ResponseWriter, r *http.Request) {})
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/", nil)
+	c.Assert(err, check.IsNil)
+	h.ServeHTTP(recorder, request)
+	c.Assert(recorder.Header().Get("X-Request-ID"), check.Not(check.Equals), "")
+}
+
 func (*S) TestCreateInstanceHandler(c *check.C) {
 	client, err := docker.NewClient(config.DockerHost)
 	c.Assert(err, check.IsNil)
 	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
 	c.Assert(err, check.IsNil)
 	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached"}}
-	body := strings.NewReader("name=mycache&plan=supermemcached")
+	body := strings.NewReader("name=mycache&plan=supermemcached&team=myteam")
 	request, err := http.NewRequest("POST", "/resources", body)
 	c.Assert(err, check.IsNil)
 	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
@@ -137,9 +186,12 @@ func (*S) TestCreateInstanceHandler(c *check.C) {
 	handler := buildMuxer()
 	handler.ServeHTTP(recorder, request)
 	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
-	defer DestroyInstance("mycache")
-	_, err = GetInstance("mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	instance, err := GetInstance(context.Background(), "mycache")
 	c.Assert(err, check.IsNil)
+	c.Assert(instance.Team, check.Equals, "myteam")
+	c.Assert(instance.State, check.Equals, StateRunning)
+	c.Assert(instance.CreatedAt.IsZero(), check.Equals, false)
 }
 
 func (*S) TestCreateInstanceHandlerDuplicate(c *check.C) {
@@ -148,9 +200,9 @@ func (*S) TestCreateInstanceHandlerDuplicate(c *check.C) {
 	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
 	c.Assert(err, check.IsNil)
 	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached"}}
-	err = CreateInstance("mycache", &config.Plans[0])
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
 	c.Assert(err, check.IsNil)
-	defer DestroyInstance("mycache")
+	defer DestroyInstance(context.Background(), "mycache")
 	body := strings.NewReader("name=mycache&plan=supermemcached")
 	request, err := http.NewRequest("POST", "/resources", body)
 	c.Assert(err, check.IsNil)
@@ -184,9 +236,9 @@ func (*S) TestBindAppHandler(c *check.C) {
 	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
 	c.Assert(err, check.IsNil)
 	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached"}}
-	err = CreateInstance("mycache", &config.Plans[0])
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
 	c.Assert(err, check.IsNil)
-	defer DestroyInstance("mycache")
+	defer DestroyInstance(context.Background(), "mycache")
 	request, err := http.NewRequest("POST", "/resources/mycache/bind-app", strings.NewReader(""))
 	c.Assert(err, check.IsNil)
 	recorder := httptest.NewRecorder()
@@ -201,6 +253,26 @@ func (*S) TestBindAppHandler(c *check.C) {
 	c.Assert(result, check.DeepEquals, expected)
 }
 
+func (*S) TestBindAppHandlerPlanEnvName(c *check.C) {
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
+	c.Assert(err, check.IsNil)
+	config.Plans = []Plan{{Name: "super-memcached", Image: "memcached"}}
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycache")
+	request, err := http.NewRequest("POST", "/resources/mycache/bind-app", strings.NewReader(""))
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	buildMuxer().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var result map[string]string
+	err = json.Unmarshal(recorder.Body.Bytes(), &result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, map[string]string{"DIAATS_SUPER_MEMCACHED_INSTANCE": "[]", "DIAATS_SUPER_MEMCACHED_DOCKER_ENVS": "{}"})
+}
+
 func (*S) TestBindAppHandlerNotFound(c *check.C) {
 	request, err := http.NewRequest("POST", "/resources/mycache/bind-app", strings.NewReader(""))
 	c.Assert(err, check.IsNil)
@@ -217,16 +289,16 @@ func (*S) TestRemoveInstanceHandler(c *check.C) {
 	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
 	c.Assert(err, check.IsNil)
 	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached"}}
-	err = CreateInstance("mycache", &config.Plans[0])
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
 	c.Assert(err, check.IsNil)
-	defer DestroyInstance("mycache")
+	defer DestroyInstance(context.Background(), "mycache")
 	request, err := http.NewRequest("DELETE", "/resources/mycache", strings.NewReader(""))
 	c.Assert(err, check.IsNil)
 	recorder := httptest.NewRecorder()
 	handler := buildMuxer()
 	handler.ServeHTTP(recorder, request)
 	c.Assert(recorder.Code, check.Equals, http.StatusOK)
-	_, err = GetInstance("mycache")
+	_, err = GetInstance(context.Background(), "mycache")
 	c.Assert(err, check.Equals, ErrInstanceNotFound)
 }
 
@@ -246,9 +318,9 @@ func (*S) TestInstanceStatusHandler(c *check.C) {
 	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
 	c.Assert(err, check.IsNil)
 	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached"}}
-	err = CreateInstance("mycache", &config.Plans[0])
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
 	c.Assert(err, check.IsNil)
-	defer DestroyInstance("mycache")
+	defer DestroyInstance(context.Background(), "mycache")
 	request, err := http.NewRequest("GET", "/resources/mycache/status", strings.NewReader(""))
 	c.Assert(err, check.IsNil)
 	recorder := httptest.NewRecorder()
@@ -288,3 +360,95 @@ func (*S) TestPlansHandler(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Assert(got, check.DeepEquals, expected)
 }
+
+func (*S) TestListEventsHandler(c *check.C) {
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
+	c.Assert(err, check.IsNil)
+	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached"}}
+	body := strings.NewReader("name=mycache&plan=supermemcached&user=someone@example.com")
+	request, err := http.NewRequest("POST", "/resources", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	handler := buildMuxer()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	request, err = http.NewRequest("DELETE", "/resources/mycache", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	request, err = http.NewRequest("GET", "/admin/events?instance=mycache&plan=supermemcached", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var events []Event
+	err = json.NewDecoder(recorder.Body).Decode(&events)
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 3)
+	c.Assert(events[0].Kind, check.Equals, EventRemove)
+	c.Assert(events[0].Success, check.Equals, true)
+	c.Assert(events[1].Kind, check.Equals, EventStatusChange)
+	c.Assert(events[1].Status, check.Equals, StateRunning)
+	c.Assert(events[2].Kind, check.Equals, EventCreate)
+	c.Assert(events[2].Actor, check.Equals, "someone@example.com")
+	c.Assert(events[2].DockerHost, check.Equals, config.DockerHost)
+}
+
+func (*S) TestListEventsHandlerInvalidTime(c *check.C) {
+	request, err := http.NewRequest("GET", "/admin/events?since=yesterday", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	buildMuxer().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestListInstancesHandler(c *check.C) {
+	instance := s.createTestInstance(c, "mycache")
+	err := storage.InsertInstance(&Instance{Name: "othercache", Plan: Plan{Name: "redis"}, DockerHost: "tcp://10.0.0.1:2375", State: StateRunning})
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("GET", "/admin/instances?plan=supermemcached", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	buildMuxer().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var result struct {
+		Instances []instanceInfo
+		Total     int
+		Offset    int
+		Limit     int
+	}
+	err = json.NewDecoder(recorder.Body).Decode(&result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Total, check.Equals, 1)
+	c.Assert(result.Limit, check.Equals, 100)
+	c.Assert(result.Instances, check.HasLen, 1)
+	c.Assert(result.Instances[0].Name, check.Equals, "mycache")
+	c.Assert(result.Instances[0].State, check.Equals, StateRunning)
+	c.Assert(result.Instances[0].ContainerID, check.Equals, instance.ContainerID)
+	c.Assert(result.Instances[0].Endpoints, check.DeepEquals, []string{})
+	request, err = http.NewRequest("GET", "/admin/instances?sort=-name&limit=1", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	buildMuxer().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	err = json.NewDecoder(recorder.Body).Decode(&result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Total, check.Equals, 2)
+	c.Assert(result.Instances, check.HasLen, 1)
+	c.Assert(result.Instances[0].Name, check.Equals, "othercache")
+	c.Assert(result.Instances[0].Endpoints, check.DeepEquals, []string{})
+}
+
+func (*S) TestListInstancesHandlerInvalidParameters(c *check.C) {
+	for _, query := range []string{"sort=password", "offset=-1", "limit=0", "created_since=yesterday"} {
+		request, err := http.NewRequest("GET", "/admin/instances?"+query, nil)
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		buildMuxer().ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, http.StatusBadRequest, check.Commentf(query))
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Roles of API credentials. The service role is used by tsuru, and is only
+// allowed to call the service API. The admin role is only allowed to call
+// the admin API.
+const (
+	RoleService = "service"
+	RoleAdmin   = "admin"
+)
+
+const (
+	hashPrefix     = "pbkdf2-sha256"
+	hashIterations = 100000
+)
+
+// Credential is a user of the API. It authenticates either with basic
+// authentication, using Username and Password, or with a bearer token.
+// Password and Token may be stored in plain text or hashed with
+// hashSecret. Hashed tokens are sent as "<username>:<token>", so the
+// credential is found without hashing the token for every credential.
+type Credential struct {
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Role     string `json:"role"`
+}
+
+func (c *Credential) allows(role string) bool {
+	return c.Role == role
+}
+
+// credentials returns all configured credentials, including the one defined
+// by API_USERNAME and API_PASSWORD.
+func credentials() []Credential {
+	creds := config.Credentials
+	if config.Username != "" && config.Password != "" {
+		creds = append([]Credential{{Username: config.Username, Password: config.Password, Role: RoleService}}, creds...)
+	}
+	return creds
+}
+
+// authenticate returns the credential used in the request, or nil if the
+// request doesn't carry valid credentials. Only the secret of the
+// credential with the given username is checked, so each request hashes at
+// most one secret. Requests for unknown usernames, or for credentials
+// stored in plain text, hash a dummy secret, so the time to reject them
+// doesn't reveal which usernames exist.
+func authenticate(r *http.Request, creds []Credential) *Credential {
+	if token, ok := bearerToken(r); ok {
+		return authenticateToken(token, creds)
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil
+	}
+	found, stored := findCredential(creds, username, func(c *Credential) string { return c.Password })
+	return checkCredential(found, stored, password)
+}
+
+// authenticateToken returns the credential with the given bearer token.
+// Tokens stored in plain text are cheap to compare, so all of them are
+// checked against the whole token; hashed ones are only checked against the
+// secret of a "<username>:<token>" token.
+func authenticateToken(token string, creds []Credential) *Credential {
+	for i := range creds {
+		if creds[i].Token != "" && !isHashed(creds[i].Token) && subtle.ConstantTimeCompare([]byte(creds[i].Token), []byte(token)) == 1 {
+			return &creds[i]
+		}
+	}
+	username, secret, _ := strings.Cut(token, ":")
+	found, stored := findCredential(creds, username, func(c *Credential) string { return c.Token })
+	return checkCredential(found, stored, secret)
+}
+
+// findCredential returns the first credential with the given username and
+// a secret, as returned by secret, along with the secret, or nil.
+func findCredential(creds []Credential, username string, secret func(*Credential) string) (*Credential, string) {
+	var found *Credential
+	var stored string
+	for i := range creds {
+		userMatch := subtle.ConstantTimeCompare([]byte(creds[i].Username), []byte(username)) == 1
+		if userMatch && secret(&creds[i]) != "" && found == nil {
+			found, stored = &creds[i], secret(&creds[i])
+		}
+	}
+	return found, stored
+}
+
+// checkCredential returns found when given matches its stored secret,
+// hashing the dummy secret when found is nil or its secret isn't hashed.
+func checkCredential(found *Credential, stored, given string) *Credential {
+	if found == nil || !isHashed(stored) {
+		checkHash(dummyHash(), given)
+	}
+	if found == nil || !checkSecret(stored, given) {
+		return nil
+	}
+	return found
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return header[len(prefix):], true
+}
+
+// hashSecret returns a salted PBKDF2 hash of secret, in the format accepted
+// by checkSecret.
+func hashSecret(secret string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, secret, salt, hashIterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("%s$%d$%s$%s", hashPrefix, hashIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// dummyHash is the hash checked by requests that have no hashed secret to
+// check.
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := hashSecret("diaats")
+	return hash
+})
+
+func isHashed(secret string) bool {
+	return strings.HasPrefix(secret, hashPrefix+"$")
+}
+
+// maxVerifiedSecrets bounds the size of verifiedSecrets, which is emptied
+// when full.
+const maxVerifiedSecrets = 1024
+
+// verifiedSecrets holds the SHA-256 of the hashed secrets and the secrets
+// that matched them, so clients sending the same credentials on every
+// request only pay for PBKDF2 once.
+var (
+	verifiedMut     sync.Mutex
+	verifiedSecrets = make(map[[sha256.Size]byte]struct{})
+)
+
+// checkSecret compares the given secret with the stored one in constant
+// time. The stored secret is either in plain text or a hash generated by
+// hashSecret.
+func checkSecret(stored, given string) bool {
+	if !isHashed(stored) {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(given)) == 1
+	}
+	sum := sha256.Sum256([]byte(stored + "\x00" + given))
+	verifiedMut.Lock()
+	_, ok := verifiedSecrets[sum]
+	verifiedMut.Unlock()
+	if ok {
+		return true
+	}
+	if !checkHash(stored, given) {
+		return false
+	}
+	verifiedMut.Lock()
+	if len(verifiedSecrets) >= maxVerifiedSecrets {
+		clear(verifiedSecrets)
+	}
+	verifiedSecrets[sum] = struct{}{}
+	verifiedMut.Unlock()
+	return true
+}
+
+// checkHash compares the given secret with a hash generated by hashSecret.
+func checkHash(stored, given string) bool {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 4 {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := enc.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, given, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
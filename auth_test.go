@@ -0,0 +1,151 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+
+	"gopkg.in/check.v1"
+)
+
+func (*S) TestCheckSecret(c *check.C) {
+	c.Assert(checkSecret("s3cr3t", "s3cr3t"), check.Equals, true)
+	c.Assert(checkSecret("s3cr3t", "s3cr3"), check.Equals, false)
+	hash, err := hashSecret("s3cr3t")
+	c.Assert(err, check.IsNil)
+	c.Assert(hash, check.Matches, `pbkdf2-sha256\$100000\$[^$]+\$[^$]+`)
+	c.Assert(checkSecret(hash, "s3cr3t"), check.Equals, true)
+	c.Assert(checkSecret(hash, "wrong"), check.Equals, false)
+	c.Assert(checkSecret(hash, hash), check.Equals, false)
+	c.Assert(checkSecret("pbkdf2-sha256$abc$def", "s3cr3t"), check.Equals, false)
+}
+
+func (*S) TestAuthenticate(c *check.C) {
+	hash, err := hashSecret("admin123")
+	c.Assert(err, check.IsNil)
+	creds := []Credential{
+		{Username: "tsuru", Password: "tsuru123", Role: RoleService},
+		{Username: "admin", Password: hash, Role: RoleAdmin},
+		{Username: "robot", Token: "t0k3n", Role: RoleAdmin},
+	}
+	request, err := http.NewRequest("GET", "/", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(authenticate(request, creds), check.IsNil)
+	request.SetBasicAuth("tsuru", "tsuru123")
+	c.Assert(authenticate(request, creds), check.Equals, &creds[0])
+	request.SetBasicAuth("admin", "admin123")
+	c.Assert(authenticate(request, creds), check.Equals, &creds[1])
+	request.SetBasicAuth("admin", "tsuru123")
+	c.Assert(authenticate(request, creds), check.IsNil)
+	request.SetBasicAuth("robot", "")
+	c.Assert(authenticate(request, creds), check.IsNil)
+	request.Header.Set("Authorization", "Bearer t0k3n")
+	c.Assert(authenticate(request, creds), check.Equals, &creds[2])
+	request.Header.Set("Authorization", "bearer wrong")
+	c.Assert(authenticate(request, creds), check.IsNil)
+}
+
+func (*S) TestCredentials(c *check.C) {
+	config.Username = "tsuru"
+	config.Password = "tsuru123"
+	config.Credentials = []Credential{{Username: "admin", Password: "admin123", Role: RoleAdmin}}
+	defer func() { config.Credentials = nil }()
+	c.Assert(credentials(), check.DeepEquals, []Credential{
+		{Username: "tsuru", Password: "tsuru123", Role: RoleService},
+		{Username: "admin", Password: "admin123", Role: RoleAdmin},
+	})
+	config.Username = ""
+	c.Assert(credentials(), check.DeepEquals, config.Credentials)
+}
+
+func (*S) TestAdminHandler(c *check.C) {
+	config.Username = "tsuru"
+	config.Password = "tsuru123"
+	config.Credentials = []Credential{
+		{Username: "admin", Password: "admin123", Role: RoleAdmin},
+		{Username: "robot", Token: "t0k3n", Role: RoleAdmin},
+	}
+	defer func() { config.Credentials = nil }()
+	var user string
+	h := adminHandler(func(w http.ResponseWriter, r *http.Request) {
+		user = requestUser(r)
+	})
+	request, err := http.NewRequest("GET", "/admin/events", nil)
+	c.Assert(err, check.IsNil)
+	request.SetBasicAuth("tsuru", "tsuru123")
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(user, check.Equals, "")
+	request.SetBasicAuth("admin", "admin123")
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(user, check.Equals, "admin")
+	request.Header.Set("Authorization", "Bearer t0k3n")
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(user, check.Equals, "robot")
+}
+
+func (*S) TestHandlerRejectsAdminCredentials(c *check.C) {
+	config.Username = "tsuru"
+	config.Password = "tsuru123"
+	config.Credentials = []Credential{{Username: "admin", Password: "admin123", Role: RoleAdmin}}
+	defer func() { config.Credentials = nil }()
+	var called bool
+	h := handler(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	request, err := http.NewRequest("GET", "/", nil)
+	c.Assert(err, check.IsNil)
+	request.SetBasicAuth("admin", "admin123")
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(called, check.Equals, false)
+	request.SetBasicAuth("tsuru", "tsuru123")
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(called, check.Equals, true)
+}
+
+func (*S) TestCheckSecretCachesVerifications(c *check.C) {
+	hash, err := hashSecret("s3cr3t")
+	c.Assert(err, check.IsNil)
+	c.Assert(checkSecret(hash, "s3cr3t"), check.Equals, true)
+	sum := sha256.Sum256([]byte(hash + "\x00" + "s3cr3t"))
+	verifiedMut.Lock()
+	_, ok := verifiedSecrets[sum]
+	verifiedMut.Unlock()
+	c.Assert(ok, check.Equals, true)
+	c.Assert(checkSecret(hash, "s3cr3t"), check.Equals, true)
+	c.Assert(checkSecret(hash, "wrong"), check.Equals, false)
+}
+
+func (*S) TestAuthenticateHashedToken(c *check.C) {
+	hash, err := hashSecret("t0k3n")
+	c.Assert(err, check.IsNil)
+	creds := []Credential{
+		{Username: "tsuru", Token: "plain", Role: RoleService},
+		{Username: "robot", Token: hash, Role: RoleAdmin},
+	}
+	request, err := http.NewRequest("GET", "/", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "Bearer robot:t0k3n")
+	c.Assert(authenticate(request, creds), check.Equals, &creds[1])
+	request.Header.Set("Authorization", "Bearer t0k3n")
+	c.Assert(authenticate(request, creds), check.IsNil)
+	request.Header.Set("Authorization", "Bearer tsuru:t0k3n")
+	c.Assert(authenticate(request, creds), check.IsNil)
+	request.Header.Set("Authorization", "Bearer tsuru:plain")
+	c.Assert(authenticate(request, creds), check.Equals, &creds[0])
+	request.Header.Set("Authorization", "Bearer plain")
+	c.Assert(authenticate(request, creds), check.Equals, &creds[0])
+}
@@ -0,0 +1,411 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	backupActor         = "diaats-backup-scheduler"
+	backupCheckInterval = time.Minute
+
+	// backupIDFormat is the format of backup IDs, which are timestamps that
+	// sort in chronological order.
+	backupIDFormat = "20060102T150405.000000Z"
+)
+
+var backupIDRegexp = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}\.[0-9]{6}Z$`)
+
+var (
+	ErrBackupsDisabled     = errors.New("backups are disabled, BACKUP_STORE is not defined")
+	ErrBackupNotSupported  = errors.New("the plan of the instance doesn't define a backup command")
+	ErrRestoreNotSupported = errors.New("the plan of the instance doesn't define a restore command")
+	ErrBackupNotFound      = errors.New("backup not found")
+)
+
+// backups is the store of backup artifacts, nil when backups are disabled.
+var backups BackupStore
+
+// BackupConfig defines how the data of the instances of a plan is backed up
+// and restored. Command runs in the container and writes the backup to its
+// standard output, and RestoreCommand reads a backup from its standard input.
+type BackupConfig struct {
+	Command        []string `json:"command"`
+	RestoreCommand []string `json:"restoreCommand,omitempty"`
+
+	// Interval is how often instances are backed up, as accepted by
+	// time.ParseDuration. Instances are only backed up on demand when it's
+	// empty.
+	Interval string `json:"interval,omitempty"`
+
+	// Retain is the number of backups kept for each instance when taking
+	// scheduled backups. Zero keeps every backup.
+	Retain int `json:"retain,omitempty"`
+}
+
+func (b *BackupConfig) validate() error {
+	if len(b.Command) == 0 {
+		return errors.New("backup requires a command")
+	}
+	if b.Interval != "" {
+		if d, err := time.ParseDuration(b.Interval); err != nil || d <= 0 {
+			return fmt.Errorf("invalid backup interval %q", b.Interval)
+		}
+	}
+	if b.Retain < 0 {
+		return fmt.Errorf("invalid backup retain %d", b.Retain)
+	}
+	return nil
+}
+
+func (b *BackupConfig) interval() time.Duration {
+	d, _ := time.ParseDuration(b.Interval)
+	return d
+}
+
+// backupKey returns the key of the backups of the instance in the backup
+// store. Backups are keyed by the ID of the instance, under its name, so an
+// instance created with the name of a removed one doesn't see its backups.
+// Instances without an ID keep the backups keyed by their names.
+func (i *Instance) backupKey() string {
+	if i.ID == "" {
+		return i.Name
+	}
+	return i.Name + "/" + i.ID
+}
+
+// Backup is an artifact stored in the backup store.
+type Backup struct {
+	ID        string    `json:"id"`
+	Instance  string    `json:"instance"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// BackupStore stores the backups of instances.
+type BackupStore interface {
+	// Save stores a new backup of the instance, read from r.
+	Save(instance string, r io.Reader) (*Backup, error)
+
+	// Open returns the contents of a backup, or ErrBackupNotFound.
+	Open(instance, id string) (io.ReadCloser, error)
+
+	// List returns the backups of the instance, most recent first.
+	List(instance string) ([]Backup, error)
+
+	// Delete removes a backup, or returns ErrBackupNotFound.
+	Delete(instance, id string) error
+}
+
+// openBackupStore opens the store at the given location, which may be a
+// directory or a file:// URL. Backups are disabled when it's empty.
+func openBackupStore(location string) (BackupStore, error) {
+	if location == "" {
+		return nil, nil
+	}
+	if strings.Contains(location, "://") {
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "file" {
+			return nil, fmt.Errorf("unsupported backup store %q", u.Scheme)
+		}
+		location = u.Path
+	}
+	return newLocalBackupStore(location)
+}
+
+// localBackupStore keeps backups in a directory, in files named
+// <key>/<id>.backup, where key is given by Instance.backupKey.
+type localBackupStore struct {
+	dir string
+}
+
+func newLocalBackupStore(dir string) (*localBackupStore, error) {
+	if dir == "" {
+		return nil, errors.New("missing directory for the backup store")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &localBackupStore{dir: dir}, nil
+}
+
+func (s *localBackupStore) path(instance, id string) string {
+	return filepath.Join(s.dir, instance, id+".backup")
+}
+
+func (s *localBackupStore) Save(instance string, r io.Reader) (*Backup, error) {
+	if err := os.MkdirAll(filepath.Join(s.dir, instance), 0700); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	backup := Backup{ID: now.Format(backupIDFormat), Instance: instance, CreatedAt: now}
+	path := s.path(instance, backup.ID)
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	backup.Size, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return nil, err
+	}
+	return &backup, nil
+}
+
+func (s *localBackupStore) Open(instance, id string) (io.ReadCloser, error) {
+	if !backupIDRegexp.MatchString(id) {
+		return nil, ErrBackupNotFound
+	}
+	f, err := os.Open(s.path(instance, id))
+	if os.IsNotExist(err) {
+		return nil, ErrBackupNotFound
+	}
+	return f, err
+}
+
+func (s *localBackupStore) List(instance string) ([]Backup, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, instance))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result []Backup
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".backup")
+		if !backupIDRegexp.MatchString(id) || id+".backup" != entry.Name() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		createdAt, _ := time.Parse(backupIDFormat, id)
+		result = append(result, Backup{ID: id, Instance: instance, Size: info.Size(), CreatedAt: createdAt})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID > result[j].ID
+	})
+	return result, nil
+}
+
+func (s *localBackupStore) Delete(instance, id string) error {
+	if !backupIDRegexp.MatchString(id) {
+		return ErrBackupNotFound
+	}
+	err := os.Remove(s.path(instance, id))
+	if os.IsNotExist(err) {
+		return ErrBackupNotFound
+	}
+	return err
+}
+
+// execCommand runs cmd in the given container, feeding it stdin when it's
+// not nil and copying its standard output to stdout. It fails when the
+// command exits with a non-zero status, including its standard error in the
+// error.
+func execCommand(client *docker.Client, id string, cmd []string, stdin io.Reader, stdout io.Writer) error {
+	exec, err := client.CreateExec(docker.CreateExecOptions{
+		Container:    id,
+		Cmd:          cmd,
+		AttachStdin:  stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	err = client.StartExec(exec.ID, docker.StartExecOptions{
+		InputStream:  stdin,
+		OutputStream: stdout,
+		ErrorStream:  &stderr,
+	})
+	if err != nil {
+		return err
+	}
+	result, err := client.InspectExec(exec.ID)
+	if err != nil {
+		return err
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("%s exited with status %d: %s", strings.Join(cmd, " "), result.ExitCode, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// BackupInstance runs the backup command of the plan in the container of the
+// instance, saving its output in the backup store.
+func BackupInstance(ctx context.Context, instance *Instance) (*Backup, error) {
+	done, err := trackOperation()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if backups == nil {
+		return nil, ErrBackupsDisabled
+	}
+	if instance.isService() {
+		return nil, ErrNotSupportedBySwarm
+	}
+	if instance.Plan.Backup == nil {
+		return nil, ErrBackupNotSupported
+	}
+	client, err := dockerClient(instance.DockerHost)
+	if err != nil {
+		return nil, err
+	}
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(execCommand(client, instance.ContainerID, instance.Plan.Backup.Command, nil, w))
+	}()
+	backup, err := backups.Save(instance.backupKey(), r)
+	r.Close()
+	if err != nil {
+		loggerFromContext(ctx).Error("failed to back up instance", "instance", instance.Name, "error", err)
+		return nil, err
+	}
+	backup.Instance = instance.Name
+	loggerFromContext(ctx).Info("instance backed up", "instance", instance.Name, "backup", backup.ID, "size", backup.Size)
+	return backup, nil
+}
+
+// RestoreInstance feeds the given backup to the restore command of the plan,
+// run in the container of the instance.
+func RestoreInstance(ctx context.Context, instance *Instance, id string) error {
+	done, err := trackOperation()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if backups == nil {
+		return ErrBackupsDisabled
+	}
+	if instance.isService() {
+		return ErrNotSupportedBySwarm
+	}
+	if instance.Plan.Backup == nil || len(instance.Plan.Backup.RestoreCommand) == 0 {
+		return ErrRestoreNotSupported
+	}
+	r, err := backups.Open(instance.backupKey(), id)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	client, err := dockerClient(instance.DockerHost)
+	if err != nil {
+		return err
+	}
+	err = execCommand(client, instance.ContainerID, instance.Plan.Backup.RestoreCommand, r, io.Discard)
+	if err != nil {
+		loggerFromContext(ctx).Error("failed to restore instance", "instance", instance.Name, "backup", id, "error", err)
+		return err
+	}
+	loggerFromContext(ctx).Info("instance restored", "instance", instance.Name, "backup", id)
+	return nil
+}
+
+// runBackups takes the scheduled backups every interval until ctx is
+// canceled.
+func runBackups(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			scheduleBackups(ctx, time.Now())
+		}
+	}
+}
+
+// scheduleBackups backs up the running instances whose latest backup is
+// older than the interval of their plans, and removes the backups beyond the
+// number retained by the plans.
+func scheduleBackups(ctx context.Context, now time.Time) {
+	log := loggerFromContext(ctx)
+	instances, _, err := storage.ListInstances(InstanceFilter{State: StateRunning})
+	if err != nil {
+		log.Error("failed to list instances for backup", "error", err)
+		return
+	}
+	for i := range instances {
+		instance := &instances[i]
+		cfg := instance.Plan.Backup
+		if cfg == nil || cfg.interval() == 0 {
+			continue
+		}
+		// The backups of an instance are claimed with a lease, so replicas
+		// of the API don't back it up twice.
+		release, ok := claimWork(ctx, "backups-"+instance.Name)
+		if !ok {
+			continue
+		}
+		scheduleInstanceBackup(ctx, instance, now)
+		release()
+	}
+}
+
+// scheduleInstanceBackup backs up the instance when its latest backup is
+// older than the interval of its plan and removes the backups beyond the
+// retention.
+func scheduleInstanceBackup(ctx context.Context, instance *Instance, now time.Time) {
+	log := loggerFromContext(ctx)
+	cfg := instance.Plan.Backup
+	// The list is read after claiming the lease, as another replica may
+	// have backed the instance up since it was listed.
+	list, err := backups.List(instance.backupKey())
+	if err != nil {
+		log.Error("failed to list backups", "instance", instance.Name, "error", err)
+		return
+	}
+	if len(list) == 0 || now.Sub(list[0].CreatedAt) >= cfg.interval() {
+		evt := startEvent(ctx, EventBackup, instance.Name, backupActor)
+		evt.Plan = instance.Plan.Name
+		evt.DockerHost = instance.DockerHost
+		backup, err := BackupInstance(ctx, instance)
+		evt.Done(ctx, err)
+		if err != nil {
+			return
+		}
+		list = append([]Backup{*backup}, list...)
+	}
+	if cfg.Retain == 0 || len(list) <= cfg.Retain {
+		return
+	}
+	for _, backup := range list[cfg.Retain:] {
+		if err = backups.Delete(instance.backupKey(), backup.ID); err != nil {
+			log.Error("failed to remove old backup", "instance", instance.Name, "backup", backup.ID, "error", err)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// handleExec makes the fake Docker server run exec commands with fn, which
+// receives the command and its standard input, and returns its standard
+// output and exit status.
+func (s *S) handleExec(fn func(cmd []string, stdin []byte) (string, int)) {
+	var mut sync.Mutex
+	exitCodes := map[string]int{}
+	inspect := func(id string) (map[string]interface{}, int) {
+		recorder := httptest.NewRecorder()
+		s.server.DefaultHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/exec/"+id+"/json", nil))
+		var exec map[string]interface{}
+		json.Unmarshal(recorder.Body.Bytes(), &exec)
+		return exec, recorder.Code
+	}
+	s.server.CustomHandler("/exec/[^/]+/start", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Split(r.URL.Path, "/")[2]
+		exec, code := inspect(id)
+		if code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		process := exec["ProcessConfig"].(map[string]interface{})
+		cmd := []string{process["entrypoint"].(string)}
+		args, _ := process["arguments"].([]interface{})
+		for _, arg := range args {
+			cmd = append(cmd, arg.(string))
+		}
+		io.Copy(io.Discard, r.Body)
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n")
+		rw.Flush()
+		stdin, _ := io.ReadAll(rw)
+		output, exitCode := fn(cmd, stdin)
+		mut.Lock()
+		exitCodes[id] = exitCode
+		mut.Unlock()
+		if len(output) > 0 {
+			header := []byte{1, 0, 0, 0, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(header[4:], uint32(len(output)))
+			rw.Write(header)
+			rw.WriteString(output)
+		}
+		rw.Flush()
+	}))
+	s.server.CustomHandler("/exec/[^/]+/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Split(r.URL.Path, "/")[2]
+		exec, code := inspect(id)
+		if code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		mut.Lock()
+		exec["ExitCode"] = exitCodes[id]
+		mut.Unlock()
+		json.NewEncoder(w).Encode(exec)
+	}))
+}
+
+// useBackupStore stores the backups of the test in a temporary directory.
+func useBackupStore(c *check.C) {
+	var err error
+	backups, err = openBackupStore(c.MkDir())
+	c.Assert(err, check.IsNil)
+}
+
+// backupPlan returns a plan with the given backup configuration.
+func backupPlan(cfg *BackupConfig) Plan {
+	return Plan{Name: "redis", Image: "redis", Backup: cfg}
+}
+
+func (*S) TestBackupConfigValidate(c *check.C) {
+	cfg := BackupConfig{Command: []string{"redis-cli", "--rdb", "-"}, Interval: "24h", Retain: 7}
+	c.Assert(cfg.validate(), check.IsNil)
+	cfg = BackupConfig{}
+	c.Assert(cfg.validate(), check.ErrorMatches, "backup requires a command")
+	cfg = BackupConfig{Command: []string{"dump"}, Interval: "daily"}
+	c.Assert(cfg.validate(), check.ErrorMatches, `invalid backup interval "daily"`)
+	cfg = BackupConfig{Command: []string{"dump"}, Retain: -1}
+	c.Assert(cfg.validate(), check.ErrorMatches, "invalid backup retain -1")
+}
+
+func (*S) TestOpenBackupStore(c *check.C) {
+	store, err := openBackupStore("")
+	c.Assert(err, check.IsNil)
+	c.Assert(store, check.IsNil)
+	dir := c.MkDir()
+	store, err = openBackupStore("file://" + dir)
+	c.Assert(err, check.IsNil)
+	c.Assert(store, check.DeepEquals, &localBackupStore{dir: dir})
+	store, err = openBackupStore(dir)
+	c.Assert(err, check.IsNil)
+	c.Assert(store, check.DeepEquals, &localBackupStore{dir: dir})
+	_, err = openBackupStore("s3://bucket/backups")
+	c.Assert(err, check.ErrorMatches, `unsupported backup store "s3"`)
+}
+
+func (*S) TestLocalBackupStore(c *check.C) {
+	store, err := newLocalBackupStore(c.MkDir())
+	c.Assert(err, check.IsNil)
+	first, err := store.Save("mydb", strings.NewReader("first"))
+	c.Assert(err, check.IsNil)
+	c.Assert(first.Size, check.Equals, int64(5))
+	time.Sleep(time.Millisecond)
+	second, err := store.Save("mydb", strings.NewReader("second"))
+	c.Assert(err, check.IsNil)
+	list, err := store.List("mydb")
+	c.Assert(err, check.IsNil)
+	c.Assert(list, check.HasLen, 2)
+	c.Assert(list[0].ID, check.Equals, second.ID)
+	c.Assert(list[0].CreatedAt.Equal(second.CreatedAt), check.Equals, true)
+	c.Assert(list[1].ID, check.Equals, first.ID)
+	r, err := store.Open("mydb", first.ID)
+	c.Assert(err, check.IsNil)
+	data, err := io.ReadAll(r)
+	r.Close()
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "first")
+	c.Assert(store.Delete("mydb", first.ID), check.IsNil)
+	_, err = store.Open("mydb", first.ID)
+	c.Assert(err, check.Equals, ErrBackupNotFound)
+	c.Assert(store.Delete("mydb", first.ID), check.Equals, ErrBackupNotFound)
+	_, err = store.Open("mydb", "../../etc/passwd")
+	c.Assert(err, check.Equals, ErrBackupNotFound)
+	list, err = store.List("otherdb")
+	c.Assert(err, check.IsNil)
+	c.Assert(list, check.HasLen, 0)
+}
+
+func (s *S) TestLocalBackupStoreFailedSave(c *check.C) {
+	dir := c.MkDir()
+	store, err := newLocalBackupStore(dir)
+	c.Assert(err, check.IsNil)
+	r, w := io.Pipe()
+	go func() {
+		w.Write([]byte("partial"))
+		w.CloseWithError(io.ErrUnexpectedEOF)
+	}()
+	_, err = store.Save("mydb", r)
+	c.Assert(err, check.Equals, io.ErrUnexpectedEOF)
+	files, err := os.ReadDir(filepath.Join(dir, "mydb"))
+	c.Assert(err, check.IsNil)
+	c.Assert(files, check.HasLen, 0)
+}
+
+func (s *S) TestBackupAndRestoreInstance(c *check.C) {
+	var restored []byte
+	var commands [][]string
+	s.handleExec(func(cmd []string, stdin []byte) (string, int) {
+		commands = append(commands, cmd)
+		if cmd[0] == "restore" {
+			restored = stdin
+			return "", 0
+		}
+		return "backup data", 0
+	})
+	useBackupStore(c)
+	instance := s.createInstanceWithPlan(c, "mydb", backupPlan(&BackupConfig{Command: []string{"dump", "--all"}, RestoreCommand: []string{"restore"}}))
+	defer DestroyInstance(context.Background(), "mydb")
+	backup, err := BackupInstance(context.Background(), instance)
+	c.Assert(err, check.IsNil)
+	c.Assert(backup.Instance, check.Equals, "mydb")
+	c.Assert(backup.Size, check.Equals, int64(len("backup data")))
+	err = RestoreInstance(context.Background(), instance, backup.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(restored), check.Equals, "backup data")
+	c.Assert(commands, check.DeepEquals, [][]string{{"dump", "--all"}, {"restore"}})
+	err = RestoreInstance(context.Background(), instance, "20160102T150405.000000Z")
+	c.Assert(err, check.Equals, ErrBackupNotFound)
+}
+
+func (s *S) TestBackupInstanceCommandFailure(c *check.C) {
+	s.handleExec(func(cmd []string, stdin []byte) (string, int) {
+		return "partial", 1
+	})
+	useBackupStore(c)
+	instance := s.createInstanceWithPlan(c, "mydb", backupPlan(&BackupConfig{Command: []string{"dump"}}))
+	defer DestroyInstance(context.Background(), "mydb")
+	_, err := BackupInstance(context.Background(), instance)
+	c.Assert(err, check.ErrorMatches, "dump exited with status 1: .*")
+	list, err := backups.List(instance.backupKey())
+	c.Assert(err, check.IsNil)
+	c.Assert(list, check.HasLen, 0)
+}
+
+func (s *S) TestBackupInstanceErrors(c *check.C) {
+	useBackupStore(c)
+	instance := s.createInstanceWithPlan(c, "mydb", backupPlan(nil))
+	defer DestroyInstance(context.Background(), "mydb")
+	_, err := BackupInstance(context.Background(), instance)
+	c.Assert(err, check.Equals, ErrBackupNotSupported)
+	err = RestoreInstance(context.Background(), instance, "20160102T150405.000000Z")
+	c.Assert(err, check.Equals, ErrRestoreNotSupported)
+	instance.Plan.Backup = &BackupConfig{Command: []string{"dump"}}
+	err = RestoreInstance(context.Background(), instance, "20160102T150405.000000Z")
+	c.Assert(err, check.Equals, ErrRestoreNotSupported)
+	backups = nil
+	_, err = BackupInstance(context.Background(), instance)
+	c.Assert(err, check.Equals, ErrBackupsDisabled)
+}
+
+func (s *S) TestBackupHandlers(c *check.C) {
+	var restored []byte
+	s.handleExec(func(cmd []string, stdin []byte) (string, int) {
+		if cmd[0] == "restore" {
+			restored = stdin
+		}
+		return "backup data", 0
+	})
+	useBackupStore(c)
+	s.createInstanceWithPlan(c, "mydb", backupPlan(&BackupConfig{Command: []string{"dump"}, RestoreCommand: []string{"restore"}}))
+	defer DestroyInstance(context.Background(), "mydb")
+	handler := buildMuxer()
+	request, err := http.NewRequest("POST", "/admin/instances/mydb/backups", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	var backup Backup
+	err = json.NewDecoder(recorder.Body).Decode(&backup)
+	c.Assert(err, check.IsNil)
+	c.Assert(backup.Size, check.Equals, int64(len("backup data")))
+	request, err = http.NewRequest("GET", "/admin/instances/mydb/backups", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var list []Backup
+	err = json.NewDecoder(recorder.Body).Decode(&list)
+	c.Assert(err, check.IsNil)
+	c.Assert(list, check.HasLen, 1)
+	c.Assert(list[0].ID, check.Equals, backup.ID)
+	request, err = http.NewRequest("POST", "/admin/instances/mydb/backups/"+backup.ID+"/restore", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNoContent)
+	c.Assert(string(restored), check.Equals, "backup data")
+	events, err := ListEvents(EventFilter{Instance: "mydb"})
+	c.Assert(err, check.IsNil)
+	var kinds []string
+	for _, evt := range events {
+		kinds = append(kinds, evt.Kind)
+	}
+	c.Assert(kinds, check.DeepEquals, []string{EventRestore, EventBackup, EventStatusChange})
+}
+
+func (s *S) TestBackupsOfRemovedInstance(c *check.C) {
+	s.handleExec(func(cmd []string, stdin []byte) (string, int) {
+		return "backup data", 0
+	})
+	cfg := &BackupConfig{Command: []string{"dump"}, RestoreCommand: []string{"restore"}}
+	useBackupStore(c)
+	instance := s.createInstanceWithPlan(c, "mydb", backupPlan(cfg))
+	c.Assert(instance.ID, check.Not(check.Equals), "")
+	backup, err := BackupInstance(context.Background(), instance)
+	c.Assert(err, check.IsNil)
+	err = DestroyInstance(context.Background(), "mydb")
+	c.Assert(err, check.IsNil)
+	instance = s.createInstanceWithPlan(c, "mydb", backupPlan(cfg))
+	defer DestroyInstance(context.Background(), "mydb")
+	list, err := backups.List(instance.backupKey())
+	c.Assert(err, check.IsNil)
+	c.Assert(list, check.HasLen, 0)
+	err = RestoreInstance(context.Background(), instance, backup.ID)
+	c.Assert(err, check.Equals, ErrBackupNotFound)
+}
+
+func (*S) TestBackupKeyWithoutID(c *check.C) {
+	instance := Instance{Name: "mydb"}
+	c.Assert(instance.backupKey(), check.Equals, "mydb")
+	instance.ID = "5f1a"
+	c.Assert(instance.backupKey(), check.Equals, "mydb/5f1a")
+}
+
+func (s *S) TestBackupHandlersErrors(c *check.C) {
+	useBackupStore(c)
+	s.createInstanceWithPlan(c, "mydb", backupPlan(nil))
+	defer DestroyInstance(context.Background(), "mydb")
+	var tests = []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/admin/instances/unknown/backups", http.StatusNotFound},
+		{"POST", "/admin/instances/unknown/backups", http.StatusNotFound},
+		{"POST", "/admin/instances/mydb/backups", http.StatusBadRequest},
+		{"POST", "/admin/instances/mydb/backups/20160102T150405.000000Z/restore", http.StatusBadRequest},
+	}
+	handler := buildMuxer()
+	for _, t := range tests {
+		request, err := http.NewRequest(t.method, t.path, nil)
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, t.code, check.Commentf("%s %s", t.method, t.path))
+	}
+	backups = nil
+	request, err := http.NewRequest("GET", "/admin/instances/mydb/backups", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotImplemented)
+}
+
+func (s *S) TestScheduleBackups(c *check.C) {
+	var dumps int
+	s.handleExec(func(cmd []string, stdin []byte) (string, int) {
+		dumps++
+		return "backup data", 0
+	})
+	useBackupStore(c)
+	instance := s.createInstanceWithPlan(c, "mydb", backupPlan(&BackupConfig{Command: []string{"dump"}, Interval: "1h", Retain: 2}))
+	defer DestroyInstance(context.Background(), "mydb")
+	for i := 0; i < 2; i++ {
+		_, err := backups.Save(instance.backupKey(), bytes.NewReader(nil))
+		c.Assert(err, check.IsNil)
+		time.Sleep(time.Millisecond)
+	}
+	scheduleBackups(context.Background(), time.Now())
+	c.Assert(dumps, check.Equals, 0)
+	scheduleBackups(context.Background(), time.Now().Add(time.Hour))
+	c.Assert(dumps, check.Equals, 1)
+	list, err := backups.List(instance.backupKey())
+	c.Assert(err, check.IsNil)
+	c.Assert(list, check.HasLen, 2)
+	c.Assert(list[0].Size, check.Equals, int64(len("backup data")))
+	events, err := ListEvents(EventFilter{Instance: "mydb", Kind: EventBackup})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].Actor, check.Equals, backupActor)
+	c.Assert(events[0].Success, check.Equals, true)
+}
+
+func (s *S) TestScheduleBackupsClaimedElsewhere(c *check.C) {
+	var dumps int
+	s.handleExec(func(cmd []string, stdin []byte) (string, int) {
+		dumps++
+		return "backup data", 0
+	})
+	useBackupStore(c)
+	s.createInstanceWithPlan(c, "mydb", backupPlan(&BackupConfig{Command: []string{"dump"}, Interval: "1h"}))
+	defer DestroyInstance(context.Background(), "mydb")
+	ok, err := storage.AcquireLease("backups-mydb", "other-process", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, true)
+	defer storage.ReleaseLease("backups-mydb", "other-process")
+	scheduleBackups(context.Background(), time.Now())
+	c.Assert(dumps, check.Equals, 0)
+}
@@ -0,0 +1,183 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrInsufficientCapacity = errors.New("no Docker host has enough memory for the instance")
+
+// HostCapacity is the memory of a Docker host available to instances, in
+// bytes. Memory is zero when the memory of the host is unknown, in which
+// case it isn't enforced.
+type HostCapacity struct {
+	Memory      int64 `json:"memory"`
+	Allocatable int64 `json:"allocatable"`
+	Used        int64 `json:"used"`
+}
+
+// fits reports whether an instance with the given memory limit fits in the
+// host.
+func (c *HostCapacity) fits(memory int64) bool {
+	return c.Memory == 0 || c.Used+memory <= c.Allocatable
+}
+
+// memoryLimit returns the memory limit of the containers of the member,
+// which defaults to the one in DOCKER_CONFIG.
+func (m *PlanMember) memoryLimit() int64 {
+	if m.Memory > 0 {
+		return m.Memory
+	}
+	if config.HostConfig != nil {
+		return config.HostConfig.Memory
+	}
+	return 0
+}
+
+// memory returns the sum of the memory limits of the containers of an
+// instance of the plan. Containers without a limit aren't accounted.
+func (p *Plan) memory() int64 {
+	var total int64
+	for _, spec := range p.containerSpecs("") {
+		total += spec.member.memoryLimit()
+	}
+	return total
+}
+
+// memoryIn returns the memory limit of the containers of the instance in the
+// Docker host at address.
+func (i *Instance) memoryIn(address string) int64 {
+	if !i.isSpread() {
+		return i.Plan.memory()
+	}
+	var total int64
+	specs := i.Plan.containerSpecs(i.Name)
+	for n := range i.Containers {
+		if n < len(specs) && i.containerHost(&i.Containers[n]) == address {
+			total += specs[n].member.memoryLimit()
+		}
+	}
+	return total
+}
+
+// placementMut serializes the placement of instances, so concurrent
+// placements don't overcommit a host.
+var placementMut sync.Mutex
+
+// pendingMemory tracks the memory of the instances placed in each host
+// whose records aren't stored yet. New instances release it once their
+// records, which account for their memory, are stored, and moved instances
+// once they're moved.
+var pendingMemory = struct {
+	sync.Mutex
+	hosts map[string]int64
+}{hosts: make(map[string]int64)}
+
+// reserveMemory accounts memory as used in the host at address until the
+// returned function is first called.
+func reserveMemory(address string, memory int64) func() {
+	pendingMemory.Lock()
+	pendingMemory.hosts[address] += memory
+	pendingMemory.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			pendingMemory.Lock()
+			defer pendingMemory.Unlock()
+			pendingMemory.hosts[address] -= memory
+			if pendingMemory.hosts[address] <= 0 {
+				delete(pendingMemory.hosts, address)
+			}
+		})
+	}
+}
+
+// hostMemoryTTL is how long the memory reported by the Docker API of a
+// host is cached, and hostMemoryRetry how long a failure to get it is.
+const (
+	hostMemoryTTL   = 5 * time.Minute
+	hostMemoryRetry = 30 * time.Second
+)
+
+// hostMemories caches the memory of the hosts, by address, so placing
+// instances doesn't call the Docker API of every host.
+var hostMemories = struct {
+	sync.Mutex
+	hosts map[string]cachedMemory
+}{hosts: make(map[string]cachedMemory)}
+
+type cachedMemory struct {
+	memory  int64
+	expires time.Time
+}
+
+// hostCapacity returns the capacity of the Docker host, taking the memory
+// of the host from the configuration or from the Docker API. Hosts whose
+// memory can't be found are reported with unknown memory. Swarm services
+// don't use the memory of the host, as their tasks run in the nodes of the
+// cluster.
+func hostCapacity(ctx context.Context, host *DockerHost) (*HostCapacity, error) {
+	return hostCapacityWithMemory(host, hostMemory(ctx, host))
+}
+
+// hostCapacityWithMemory returns the capacity of the Docker host with the
+// given memory, as returned by hostMemory.
+func hostCapacityWithMemory(host *DockerHost, memory int64) (*HostCapacity, error) {
+	capacity := HostCapacity{Memory: memory}
+	ratio := config.MemoryOvercommit
+	if ratio <= 0 {
+		ratio = 1
+	}
+	capacity.Allocatable = int64(float64(capacity.Memory) * ratio)
+	instances, _, err := storage.ListInstances(InstanceFilter{DockerHost: host.Address})
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		if !instance.isService() {
+			capacity.Used += instance.memoryIn(host.Address)
+		}
+	}
+	pendingMemory.Lock()
+	capacity.Used += pendingMemory.hosts[host.Address]
+	pendingMemory.Unlock()
+	return &capacity, nil
+}
+
+// hostMemory returns the total memory of the host, from the configuration
+// or as reported by the Docker API, or zero when it fails. The memory
+// reported by the Docker API is cached in hostMemories.
+func hostMemory(ctx context.Context, host *DockerHost) int64 {
+	if host.Memory > 0 {
+		return host.Memory
+	}
+	now := time.Now()
+	hostMemories.Lock()
+	cached, ok := hostMemories.hosts[host.Address]
+	hostMemories.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.memory
+	}
+	cached = cachedMemory{expires: now.Add(hostMemoryRetry)}
+	client, err := host.client()
+	if err == nil {
+		var info struct{ MemTotal int64 }
+		if err = dockerRequest(ctx, client, http.MethodGet, "/info", nil, &info); err == nil {
+			cached = cachedMemory{memory: info.MemTotal, expires: now.Add(hostMemoryTTL)}
+		}
+	}
+	if err != nil {
+		loggerFromContext(ctx).Warn("failed to get host memory, capacity not enforced", "docker_host", host.Address, "error", err)
+	}
+	hostMemories.Lock()
+	hostMemories.hosts[host.Address] = cached
+	hostMemories.Unlock()
+	return cached.memory
+}
@@ -0,0 +1,199 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+const mb = 1 << 20
+
+func (*S) TestPlanMemory(c *check.C) {
+	plan := Plan{Name: "memcached", Image: "memcached"}
+	c.Assert(plan.memory(), check.Equals, int64(0))
+	config.HostConfig = &docker.HostConfig{Memory: 128 * mb}
+	c.Assert(plan.memory(), check.Equals, int64(128*mb))
+	plan.Memory = 256 * mb
+	c.Assert(plan.memory(), check.Equals, int64(256*mb))
+	plan = Plan{Name: "es", Members: []PlanMember{
+		{Name: "node", Image: "elasticsearch", Replicas: 3, Memory: 512 * mb, ClientFacing: true},
+		{Name: "exporter", Image: "exporter"},
+	}}
+	c.Assert(plan.memory(), check.Equals, int64(3*512*mb+128*mb))
+}
+
+func (*S) TestMemberHostConfigMemory(c *check.C) {
+	config.HostConfig = &docker.HostConfig{Memory: 128 * mb, PublishAllPorts: true}
+	member := PlanMember{Image: "memcached", ClientFacing: true}
+	c.Assert(member.hostConfig(""), check.Equals, config.HostConfig)
+	member.Memory = 256 * mb
+	hostConfig := member.hostConfig("")
+	c.Assert(hostConfig.Memory, check.Equals, int64(256*mb))
+	c.Assert(hostConfig.PublishAllPorts, check.Equals, true)
+	c.Assert(config.HostConfig.Memory, check.Equals, int64(128*mb))
+}
+
+func (*S) TestValidatePlansMemory(c *check.C) {
+	plans := []Plan{
+		{Name: "memcached", Image: "memcached", Memory: -1},
+		{Name: "es", Members: []PlanMember{{Name: "node", Image: "elasticsearch", Memory: -1, ClientFacing: true}}},
+	}
+	errs := validatePlans(plans)
+	c.Assert(errs, check.HasLen, 2)
+	c.Assert(errs[0], check.ErrorMatches, `plan "memcached": invalid memory limit`)
+	c.Assert(errs[1], check.ErrorMatches, `plan "es": member "node": invalid memory limit`)
+}
+
+func (s *S) TestHostCapacity(c *check.C) {
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	config.Plans[0].Memory = 256 * mb
+	instance, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	instance.Plan.Memory = 256 * mb
+	err = storage.UpdateInstance(instance)
+	c.Assert(err, check.IsNil)
+	host := DockerHost{Address: config.DockerHost, Memory: 1024 * mb}
+	capacity, err := hostCapacity(context.Background(), &host)
+	c.Assert(err, check.IsNil)
+	c.Assert(*capacity, check.Equals, HostCapacity{Memory: 1024 * mb, Allocatable: 1024 * mb, Used: 256 * mb})
+	config.MemoryOvercommit = 1.5
+	defer func() { config.MemoryOvercommit = 0 }()
+	release := reserveMemory(config.DockerHost, 512*mb)
+	capacity, err = hostCapacity(context.Background(), &host)
+	c.Assert(err, check.IsNil)
+	c.Assert(*capacity, check.Equals, HostCapacity{Memory: 1024 * mb, Allocatable: 1536 * mb, Used: 768 * mb})
+	c.Assert(capacity.fits(768*mb), check.Equals, true)
+	c.Assert(capacity.fits(769*mb), check.Equals, false)
+	release()
+	capacity, err = hostCapacity(context.Background(), &host)
+	c.Assert(err, check.IsNil)
+	c.Assert(capacity.Used, check.Equals, int64(256*mb))
+}
+
+func (s *S) TestHostCapacityFromDockerInfo(c *check.C) {
+	s.server.CustomHandler("/info", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]int64{"MemTotal": 2048 * mb})
+	}))
+	capacity, err := hostCapacity(context.Background(), &DockerHost{Address: config.DockerHost})
+	c.Assert(err, check.IsNil)
+	c.Assert(capacity.Memory, check.Equals, int64(2048*mb))
+	c.Assert(capacity.Allocatable, check.Equals, int64(2048*mb))
+}
+
+func (s *S) TestHostMemoryCached(c *check.C) {
+	var calls int
+	s.server.CustomHandler("/info", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		json.NewEncoder(w).Encode(map[string]int64{"MemTotal": 2048 * mb})
+	}))
+	host := DockerHost{Address: config.DockerHost}
+	c.Assert(hostMemory(context.Background(), &host), check.Equals, int64(2048*mb))
+	c.Assert(hostMemory(context.Background(), &host), check.Equals, int64(2048*mb))
+	c.Assert(calls, check.Equals, 1)
+	hostMemories.hosts[host.Address] = cachedMemory{memory: 2048 * mb, expires: time.Now().Add(-time.Second)}
+	c.Assert(hostMemory(context.Background(), &host), check.Equals, int64(2048*mb))
+	c.Assert(calls, check.Equals, 2)
+}
+
+func (s *S) TestHostCapacityCreatingInstance(c *check.C) {
+	config.DockerHosts = []DockerHost{{Address: config.DockerHost, Memory: 1024 * mb}}
+	plan := Plan{Name: "memcached", Image: "memcached", Memory: 256 * mb}
+	address, release, err := chooseHost(context.Background(), &plan, "")
+	c.Assert(err, check.IsNil)
+	defer release()
+	p := provisioning{
+		instance:      &Instance{Name: "mycache", Plan: plan, DockerHost: address, State: StateCreating},
+		releaseMemory: release,
+	}
+	err = reserveInstance(context.Background(), &p)
+	c.Assert(err, check.IsNil)
+	capacity, err := hostCapacity(context.Background(), &config.DockerHosts[0])
+	c.Assert(err, check.IsNil)
+	c.Assert(capacity.Used, check.Equals, int64(256*mb))
+}
+
+func (s *S) TestChooseHostPrefersKnownCapacity(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	config.DockerHosts[1].Memory = 1024 * mb
+	instance := s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	c.Assert(instance.DockerHost, check.Equals, config.DockerHosts[1].Address)
+	address, release, err := chooseHost(context.Background(), &config.Plans[0], "")
+	c.Assert(err, check.IsNil)
+	release()
+	c.Assert(address, check.Equals, config.DockerHosts[1].Address)
+}
+
+func (s *S) TestHostCapacityUnknown(c *check.C) {
+	capacity, err := hostCapacity(context.Background(), &DockerHost{Address: config.DockerHost})
+	c.Assert(err, check.IsNil)
+	c.Assert(capacity.Memory, check.Equals, int64(0))
+	c.Assert(capacity.fits(1024*mb), check.Equals, true)
+}
+
+func (s *S) TestChooseHostCapacity(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	config.DockerHosts[0].Memory = 300 * mb
+	config.DockerHosts[1].Memory = 600 * mb
+	s.createTestInstance(c, "first")
+	config.Plans[0].Memory = 256 * mb
+	plan := &config.Plans[0]
+	for _, name := range []string{"second", "third", "fourth"} {
+		err := CreateInstance(context.Background(), name, plan, CreateOptions{})
+		c.Assert(err, check.IsNil)
+		defer DestroyInstance(context.Background(), name)
+	}
+	DestroyInstance(context.Background(), "first")
+	var tests = []struct {
+		name, host string
+	}{
+		{"second", config.DockerHosts[1].Address},
+		{"third", config.DockerHosts[0].Address},
+		{"fourth", config.DockerHosts[1].Address},
+	}
+	for _, t := range tests {
+		instance, err := GetInstance(context.Background(), t.name)
+		c.Assert(err, check.IsNil)
+		c.Check(instance.DockerHost, check.Equals, t.host, check.Commentf(t.name))
+	}
+	err := CreateInstance(context.Background(), "fifth", plan, CreateOptions{})
+	c.Assert(err, check.Equals, ErrInsufficientCapacity)
+	_, err = GetInstance(context.Background(), "fifth")
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
+	request, err := http.NewRequest("POST", "/resources", strings.NewReader("name=fifth&plan=supermemcached"))
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	buildMuxer().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusServiceUnavailable)
+}
+
+func (s *S) TestHostHandlersCapacity(c *check.C) {
+	config.DockerHosts = []DockerHost{{Address: config.DockerHost, Memory: 1024 * mb}}
+	config.HostConfig = &docker.HostConfig{Memory: 256 * mb}
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	request, err := http.NewRequest("GET", "/admin/hosts", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	buildMuxer().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var hosts []HostInfo
+	err = json.NewDecoder(recorder.Body).Decode(&hosts)
+	c.Assert(err, check.IsNil)
+	c.Assert(hosts, check.HasLen, 1)
+	c.Assert(*hosts[0].Capacity, check.Equals, HostCapacity{Memory: 1024 * mb, Allocatable: 1024 * mb, Used: 256 * mb})
+}
@@ -0,0 +1,267 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// cliActor is the actor recorded in events triggered by the command line.
+const cliActor = "diaats-cli"
+
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+)
+
+type command struct {
+	// name is the full name of the command, including the group, like
+	// "instance inspect".
+	name  string
+	usage string
+	help  string
+
+	// needsConfig and needsStorage tell whether the configuration must be
+	// loaded and the storage opened before running the command.
+	needsConfig  bool
+	needsStorage bool
+	run          func(ctx context.Context, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: "serve", usage: "[-l address]", help: "Start the HTTP API", needsConfig: true, needsStorage: true, run: serveCmd},
+		{name: "migrate", help: "Apply pending storage migrations", needsConfig: true, needsStorage: true, run: migrateCmd},
+		{name: "instances list", help: "List all instances", needsConfig: true, needsStorage: true, run: listInstancesCmd},
+		{name: "instance inspect", usage: "<name>", help: "Show the details of an instance", needsConfig: true, needsStorage: true, run: inspectInstanceCmd},
+		{name: "instance remove", usage: "<name>", help: "Remove an instance and its container", needsConfig: true, needsStorage: true, run: removeInstanceCmd},
+		{name: "plans validate", help: "Check the plans defined in IMAGE_PLANS", needsConfig: true, run: validatePlansCmd},
+		{name: "reconcile", usage: "[--dry-run]", help: "Remove containers that don't belong to any instance", needsConfig: true, needsStorage: true, run: reconcileCmd},
+		{name: "credentials hash", help: "Hash a password or token read from stdin, for API_CREDENTIALS", run: hashCredentialCmd},
+		{name: "help", help: "Show this help", run: helpCmd},
+	}
+}
+
+// findCommand returns the command named by the first arguments in args, and
+// the remaining arguments. Calling diaats without a command, or only with
+// flags, runs the server.
+func findCommand(args []string) (*command, []string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return &commands[0], args, nil
+	}
+	for i := range commands {
+		parts := strings.Fields(commands[i].name)
+		if len(args) >= len(parts) && strings.Join(args[:len(parts)], " ") == commands[i].name {
+			return &commands[i], args[len(parts):], nil
+		}
+	}
+	return nil, nil, fmt.Errorf("unknown command %q, run %q for usage", strings.Join(args, " "), "diaats help")
+}
+
+// runCommand runs the command line given in args, loading the configuration
+// and opening the storage when the command needs it.
+func runCommand(ctx context.Context, args []string) error {
+	cmd, args, err := findCommand(args)
+	if err != nil {
+		return err
+	}
+	if cmd.needsConfig {
+		loadConfig()
+	}
+	if cmd.needsStorage {
+		storage, err = openStorage()
+		if err != nil {
+			return fmt.Errorf("failed to open storage: %s", err)
+		}
+		defer storage.Close()
+		backups, err = openBackupStore(config.BackupStore)
+		if err != nil {
+			return fmt.Errorf("failed to open backup store: %s", err)
+		}
+	}
+	return cmd.run(ctx, args)
+}
+
+func serveCmd(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	listen := flags.String("l", "0.0.0.0:8080", "Address to bind")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if errs := validatePlans(config.Plans); len(errs) > 0 {
+		for _, err := range errs {
+			logger.Error("invalid plan", "error", err)
+		}
+		return fmt.Errorf("%d invalid plan(s)", len(errs))
+	}
+	if err := migrateCmd(ctx, nil); err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	startWorker(ctx, func(ctx context.Context) {
+		newHealthMonitor().run(ctx, config.HealthCheckInterval)
+	})
+	startWorker(ctx, func(ctx context.Context) {
+		(&imageUpdater{}).run(ctx, config.ImageUpdateInterval)
+	})
+	startWorker(ctx, func(ctx context.Context) {
+		runOperations(ctx, operationCheckInterval)
+	})
+	startWorker(ctx, func(ctx context.Context) {
+		runDrains(ctx, drainCheckInterval)
+	})
+	if backups != nil {
+		startWorker(ctx, func(ctx context.Context) {
+			runBackups(ctx, backupCheckInterval)
+		})
+	}
+	return listenAndServe(ctx, *listen, buildMuxer())
+}
+
+func migrateCmd(ctx context.Context, args []string) error {
+	applied, err := runMigrations(ctx, storage)
+	if err != nil {
+		return fmt.Errorf("failed to run migrations (applied: %v): %s", applied, err)
+	}
+	if len(applied) > 0 {
+		logger.Info("migrations done", "applied", applied)
+	}
+	return nil
+}
+
+func listInstancesCmd(ctx context.Context, args []string) error {
+	instances, _, err := storage.ListInstances(InstanceFilter{})
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPLAN\tSTATE\tDOCKER HOST\tCONTAINER")
+	for _, instance := range instances {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", instance.Name, instance.Plan.Name, instance.State, instance.DockerHost, instance.ContainerID)
+	}
+	return w.Flush()
+}
+
+func inspectInstanceCmd(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: diaats instance inspect <name>")
+	}
+	instance, err := GetInstance(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	data := struct {
+		*Instance
+		Endpoints []string
+	}{Instance: instance, Endpoints: instance.Endpoints()}
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(data)
+}
+
+func removeInstanceCmd(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: diaats instance remove <name>")
+	}
+	evt := startEvent(ctx, EventRemove, args[0], cliActor)
+	if instance, err := GetInstance(ctx, args[0]); err == nil {
+		evt.Plan = instance.Plan.Name
+		evt.DockerHost = instance.DockerHost
+	}
+	err := DestroyInstance(ctx, args[0])
+	evt.Done(ctx, err)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "instance %q removed\n", args[0])
+	return nil
+}
+
+func validatePlansCmd(ctx context.Context, args []string) error {
+	errs := validatePlans(config.Plans)
+	for _, err := range errs {
+		fmt.Fprintln(stdout, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d invalid plan(s)", len(errs))
+	}
+	fmt.Fprintf(stdout, "%d plan(s) OK\n", len(config.Plans))
+	return nil
+}
+
+func reconcileCmd(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "Only report, don't remove anything")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	report, err := Reconcile(ctx, *dryRun)
+	if err != nil {
+		return err
+	}
+	action := "removed"
+	if *dryRun {
+		action = "would remove"
+	}
+	for _, orphan := range report.OrphanContainers {
+		fmt.Fprintf(stdout, "%s orphan container %s (%s) on %s\n", action, orphan.Name, orphan.ID, orphan.DockerHost)
+	}
+	for _, name := range report.MissingContainers {
+		fmt.Fprintf(stdout, "container of instance %q is missing\n", name)
+	}
+	for _, name := range report.UnhealthyInstances {
+		fmt.Fprintf(stdout, "container of instance %q is unhealthy\n", name)
+	}
+	for _, name := range report.StaleInstances {
+		fmt.Fprintf(stdout, "instance %q is stuck in %s\n", name, StateCreating)
+	}
+	if report.RemoveFailures > 0 {
+		return fmt.Errorf("failed to remove %d orphan container(s)", report.RemoveFailures)
+	}
+	if len(report.MissingContainers) > 0 {
+		return fmt.Errorf("%d instance(s) with missing containers", len(report.MissingContainers))
+	}
+	return nil
+}
+
+func hashCredentialCmd(ctx context.Context, args []string) error {
+	secret, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	secret = strings.TrimRight(secret, "\r\n")
+	if secret == "" {
+		return errors.New("please provide the secret in the standard input")
+	}
+	hash, err := hashSecret(secret)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, hash)
+	return nil
+}
+
+func helpCmd(ctx context.Context, args []string) error {
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "Usage: diaats <command> [args]\n\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", cmd.name, cmd.usage, cmd.help)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+func (*S) TestFindCommand(c *check.C) {
+	cmd, args, err := findCommand(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(cmd.name, check.Equals, "serve")
+	c.Assert(args, check.HasLen, 0)
+	cmd, args, err = findCommand([]string{"-l", "0.0.0.0:8888"})
+	c.Assert(err, check.IsNil)
+	c.Assert(cmd.name, check.Equals, "serve")
+	c.Assert(args, check.DeepEquals, []string{"-l", "0.0.0.0:8888"})
+	cmd, args, err = findCommand([]string{"instance", "inspect", "mycache"})
+	c.Assert(err, check.IsNil)
+	c.Assert(cmd.name, check.Equals, "instance inspect")
+	c.Assert(args, check.DeepEquals, []string{"mycache"})
+	cmd, args, err = findCommand([]string{"reconcile", "--dry-run"})
+	c.Assert(err, check.IsNil)
+	c.Assert(cmd.name, check.Equals, "reconcile")
+	c.Assert(args, check.DeepEquals, []string{"--dry-run"})
+	_, _, err = findCommand([]string{"instance", "explode"})
+	c.Assert(err, check.ErrorMatches, `unknown command "instance explode", .*`)
+}
+
+// createInstanceWithPlan pulls the image of the plan, makes it the only plan
+// and creates an instance of it.
+func (s *S) createInstanceWithPlan(c *check.C, name string, plan Plan) *Instance {
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	repository, tag := docker.ParseRepositoryTag(plan.Image)
+	err = client.PullImage(docker.PullImageOptions{Repository: repository, Tag: tag}, docker.AuthConfiguration{})
+	c.Assert(err, check.IsNil)
+	config.Plans = []Plan{plan}
+	err = CreateInstance(context.Background(), name, &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	instance, err := storage.GetInstance(name)
+	c.Assert(err, check.IsNil)
+	return instance
+}
+
+func (s *S) createTestInstance(c *check.C, name string) *Instance {
+	return s.createInstanceWithPlan(c, name, Plan{Name: "supermemcached", Image: "memcached"})
+}
+
+func (s *S) TestListInstancesCmd(c *check.C) {
+	instance := s.createTestInstance(c, "mycache")
+	var buf bytes.Buffer
+	stdout = &buf
+	err := listInstancesCmd(context.Background(), nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, "NAME +PLAN +STATE +DOCKER HOST +CONTAINER *\nmycache +supermemcached +running +"+config.DockerHost+" +"+instance.ContainerID+" *\n")
+}
+
+func (s *S) TestInspectInstanceCmd(c *check.C) {
+	instance := s.createTestInstance(c, "mycache")
+	var buf bytes.Buffer
+	stdout = &buf
+	err := inspectInstanceCmd(context.Background(), []string{"mycache"})
+	c.Assert(err, check.IsNil)
+	var got map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &got)
+	c.Assert(err, check.IsNil)
+	c.Assert(got["Name"], check.Equals, "mycache")
+	c.Assert(got["ContainerID"], check.Equals, instance.ContainerID)
+	err = inspectInstanceCmd(context.Background(), []string{"othercache"})
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
+	err = inspectInstanceCmd(context.Background(), nil)
+	c.Assert(err, check.ErrorMatches, "usage: .*")
+}
+
+func (s *S) TestRemoveInstanceCmd(c *check.C) {
+	s.createTestInstance(c, "mycache")
+	var buf bytes.Buffer
+	stdout = &buf
+	err := removeInstanceCmd(context.Background(), []string{"mycache"})
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "instance \"mycache\" removed\n")
+	_, err = storage.GetInstance("mycache")
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
+	events, err := ListEvents(EventFilter{Instance: "mycache", Kind: EventRemove})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].Actor, check.Equals, cliActor)
+	c.Assert(events[0].Plan, check.Equals, "supermemcached")
+}
+
+func (*S) TestValidatePlansCmd(c *check.C) {
+	var buf bytes.Buffer
+	stdout = &buf
+	config.Plans = []Plan{{Name: "memcached", Image: "memcached"}, {Name: "memcached"}}
+	err := validatePlansCmd(context.Background(), nil)
+	c.Assert(err, check.ErrorMatches, "2 invalid plan.*")
+	c.Assert(buf.String(), check.Equals, "plan \"memcached\": duplicate name\nplan \"memcached\": missing image\n")
+	buf.Reset()
+	config.Plans = config.Plans[:1]
+	err = validatePlansCmd(context.Background(), nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "1 plan(s) OK\n")
+}
+
+func (*S) TestServeCmdInvalidPlans(c *check.C) {
+	config.Plans = []Plan{{Name: "memcached"}}
+	err := serveCmd(context.Background(), []string{"-l", "127.0.0.1:0"})
+	c.Assert(err, check.ErrorMatches, "1 invalid plan.*")
+}
+
+func (s *S) TestReconcileCmdDryRun(c *check.C) {
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	s.createTestInstance(c, "mycache")
+	orphan, err := client.CreateContainer(docker.CreateContainerOptions{
+		Name:   "diaats-supermemcached-ghost",
+		Config: &docker.Config{Image: "memcached"},
+	})
+	c.Assert(err, check.IsNil)
+	var buf bytes.Buffer
+	stdout = &buf
+	err = reconcileCmd(context.Background(), []string{"--dry-run"})
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "would remove orphan container diaats-supermemcached-ghost ("+orphan.ID+") on "+config.DockerHost+"\n")
+	_, err = client.InspectContainer(orphan.ID)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestReconcileCmdMissingContainers(c *check.C) {
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	instance := s.createTestInstance(c, "mycache")
+	err = client.RemoveContainer(docker.RemoveContainerOptions{ID: instance.ContainerID, Force: true})
+	c.Assert(err, check.IsNil)
+	var buf bytes.Buffer
+	stdout = &buf
+	err = reconcileCmd(context.Background(), []string{"--dry-run"})
+	c.Assert(err, check.ErrorMatches, "1 instance\\(s\\) with missing containers")
+	c.Assert(buf.String(), check.Equals, "container of instance \"mycache\" is missing\n")
+}
+
+func (*S) TestHashCredentialCmd(c *check.C) {
+	var buf bytes.Buffer
+	stdout = &buf
+	stdin = strings.NewReader("s3cr3t\n")
+	defer func() { stdin = os.Stdin }()
+	err := hashCredentialCmd(context.Background(), nil)
+	c.Assert(err, check.IsNil)
+	hash := strings.TrimSpace(buf.String())
+	c.Assert(checkSecret(hash, "s3cr3t"), check.Equals, true)
+	stdin = strings.NewReader("")
+	err = hashCredentialCmd(context.Background(), nil)
+	c.Assert(err, check.ErrorMatches, "please provide the secret in the standard input")
+}
@@ -7,76 +7,318 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 )
 
 var config struct {
-	DockerHost string
-	Username   string
-	Password   string
-	HostConfig *docker.HostConfig
-	Plans      []Plan
-	MongoURL   string
-	DBName     string
+	DockerHost  string
+	DockerHosts []DockerHost
+	Username    string
+	Password    string
+	Credentials []Credential
+	HostConfig  *docker.HostConfig
+	Plans       []Plan
+	Storage     string
+	StoragePath string
+	MongoURL    string
+	DBName      string
+
+	TLSCertFile string
+	TLSKeyFile  string
+
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	ShutdownTimeout time.Duration
+
+	// Provisioner is the provisioner of new instances, either
+	// ProvisionerContainers or ProvisionerSwarm. The zero value behaves
+	// like ProvisionerContainers.
+	Provisioner string
+
+	// NetworkIsolation is one of NetworkInstance, NetworkTeam and
+	// NetworkNone. loadConfig defaults it to NetworkInstance.
+	NetworkIsolation string
+
+	// HealthCheckInterval is how often the health of the containers is
+	// checked, for restarting unhealthy containers.
+	HealthCheckInterval time.Duration
+
+	// ImageUpdateInterval is how often the registry is checked for updates
+	// of the images of plans with an update policy.
+	ImageUpdateInterval time.Duration
+
+	// MemoryOvercommit is the ratio between the sum of the memory limits
+	// of the instances of a host and its memory, beyond which the host
+	// doesn't get new instances. The zero value behaves like 1.
+	MemoryOvercommit float64
+
+	// BackupStore is the location of the backup store, as accepted by
+	// openBackupStore.
+	BackupStore string
 }
 
 type Plan struct {
-	Name  string   `json:"plan"`
-	Image string   `json:"image"`
-	Args  []string `json:"args"`
+	Name        string          `json:"plan"`
+	Image       string          `json:"image"`
+	Args        []string        `json:"args"`
+	Readiness   *ReadinessCheck `json:"readiness,omitempty"`
+	Healthcheck *Healthcheck    `json:"healthcheck,omitempty"`
+
+	// Memory is the memory limit of the container, in bytes, overriding
+	// the one in DOCKER_CONFIG. Members of multi-container plans define
+	// their own limits.
+	Memory int64 `json:"memory,omitempty"`
+
+	// Ports are the container ports published by the instances. When
+	// empty, every port exposed by the image is published.
+	Ports []PlanPort `json:"ports,omitempty"`
+
+	// Members are the containers of multi-container plans, which are
+	// always connected to a network, as described in networkFor. Image,
+	// Args and Ports are ignored when Members is set.
+	Members []PlanMember `json:"members,omitempty"`
+
+	// Network is the name of a Docker network shared by all instances of
+	// the plan, overriding NETWORK_ISOLATION. It's created when missing, and
+	// never removed.
+	Network string `json:"network,omitempty"`
+
+	// URL is the template of the connection URL returned on bind, rendered
+	// by renderURL.
+	URL string `json:"url,omitempty"`
+
+	// URLCredentials names the environment variables holding the
+	// credentials referenced by URL.
+	URLCredentials *URLCredentials `json:"urlCredentials,omitempty"`
+
+	// Backup defines how the data of the instances is backed up and
+	// restored.
+	Backup *BackupConfig `json:"backup,omitempty"`
+
+	// Placement restricts and ranks the Docker hosts of the instances.
+	Placement *Placement `json:"placement,omitempty"`
+
+	// Updates is the policy for updating the instances when the images of
+	// the plan are updated in the registry. Instances aren't updated when
+	// it's nil.
+	Updates *UpdatePolicy `json:"updates,omitempty"`
 }
 
 func (p *Plan) ToMap() map[string]string {
+	description := "Run containers of the image " + p.Image
+	if p.isGroup() {
+		description = "Run a group of containers: " + describeMembers(p.Members)
+	}
 	return map[string]string{
 		"name":        p.Name,
-		"description": "Run containers of the image " + p.Image,
+		"description": description,
 	}
 }
 
 func loadConfig() {
 	config.DockerHost = os.Getenv("DOCKER_HOST")
 	if config.DockerHost == "" {
-		log.Fatal("DOCKER_HOST is required")
+		fatal("DOCKER_HOST is required")
+	}
+	defaultHost := DockerHost{Address: config.DockerHost}
+	if certPath := os.Getenv("DOCKER_CERT_PATH"); certPath != "" {
+		defaultHost.setCertPath(certPath)
+	}
+	config.DockerHosts = []DockerHost{defaultHost}
+	if hosts := os.Getenv("DOCKER_HOSTS"); hosts != "" {
+		var extra []DockerHost
+		if err := json.Unmarshal([]byte(hosts), &extra); err != nil {
+			fatal("failed to parse DOCKER_HOSTS", "error", err)
+		}
+		config.DockerHosts = append(config.DockerHosts, extra...)
+	}
+	names := make(map[string]bool)
+	for _, host := range config.DockerHosts {
+		if host.Address == "" {
+			fatal("Docker hosts in DOCKER_HOSTS must have an address")
+		}
+		if names[host.name()] {
+			fatal("duplicate Docker host", "host", host.name())
+		}
+		names[host.name()] = true
+	}
+	config.Provisioner = os.Getenv("PROVISIONER")
+	switch config.Provisioner {
+	case "":
+		config.Provisioner = ProvisionerContainers
+	case ProvisionerContainers, ProvisionerSwarm:
+	default:
+		fatal("invalid PROVISIONER", "value", config.Provisioner)
+	}
+	config.TLSCertFile = os.Getenv("TLS_CERT_FILE")
+	config.TLSKeyFile = os.Getenv("TLS_KEY_FILE")
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		fatal("TLS_CERT_FILE and TLS_KEY_FILE must be defined together")
 	}
 	config.Username = os.Getenv("API_USERNAME")
 	config.Password = os.Getenv("API_PASSWORD")
+	config.Credentials = nil
+	if creds := os.Getenv("API_CREDENTIALS"); creds != "" {
+		err := json.Unmarshal([]byte(creds), &config.Credentials)
+		if err != nil {
+			fatal("failed to parse API_CREDENTIALS", "error", err)
+		}
+		for _, cred := range config.Credentials {
+			if cred.Role != RoleService && cred.Role != RoleAdmin {
+				fatal("invalid role for API credential", "role", cred.Role, "username", cred.Username)
+			}
+		}
+	}
 	hostConfigJSON := os.Getenv("DOCKER_CONFIG")
 	config.HostConfig = new(docker.HostConfig)
 	if hostConfigJSON != "" {
 		config.HostConfig = new(docker.HostConfig)
 		err := json.Unmarshal([]byte(hostConfigJSON), config.HostConfig)
 		if err != nil {
-			log.Fatalf("Failed to parse HOST_CONFIG: %s", err)
+			fatal("failed to parse DOCKER_CONFIG", "error", err)
 		}
 	}
 	config.HostConfig.PublishAllPorts = true
 	imagePlans := os.Getenv("IMAGE_PLANS")
 	if imagePlans == "" {
-		log.Fatal("IMAGE_PLANS is required")
+		fatal("IMAGE_PLANS is required")
 	}
 	err := json.Unmarshal([]byte(imagePlans), &config.Plans)
 	if err != nil {
-		log.Fatalf("Failed to parse IMAGE_PLANS: %s", err)
+		fatal("failed to parse IMAGE_PLANS", "error", err)
 	}
+	config.ReadTimeout = durationFromEnv("HTTP_READ_TIMEOUT", 30*time.Second)
+	config.WriteTimeout = durationFromEnv("HTTP_WRITE_TIMEOUT", 5*time.Minute)
+	config.ShutdownTimeout = durationFromEnv("SHUTDOWN_TIMEOUT", 5*time.Minute)
+	config.HealthCheckInterval = durationFromEnv("HEALTH_CHECK_INTERVAL", 30*time.Second)
+	config.NetworkIsolation = os.Getenv("NETWORK_ISOLATION")
+	switch config.NetworkIsolation {
+	case "":
+		config.NetworkIsolation = NetworkInstance
+	case NetworkInstance, NetworkTeam, NetworkNone:
+	default:
+		fatal("invalid NETWORK_ISOLATION", "value", config.NetworkIsolation)
+	}
+	config.ImageUpdateInterval = durationFromEnv("IMAGE_UPDATE_INTERVAL", time.Hour)
+	config.BackupStore = os.Getenv("BACKUP_STORE")
+	config.MemoryOvercommit = 1
+	if ratio := os.Getenv("MEMORY_OVERCOMMIT"); ratio != "" {
+		value, err := strconv.ParseFloat(ratio, 64)
+		if err != nil || value <= 0 {
+			fatal("invalid MEMORY_OVERCOMMIT", "value", ratio)
+		}
+		config.MemoryOvercommit = value
+	}
+	config.Storage = os.Getenv("STORAGE")
+	config.StoragePath = os.Getenv("STORAGE_PATH")
+	if config.Storage == "" || config.Storage == "mongodb" {
+		loadMongoConfig()
+	}
+}
+
+func loadMongoConfig() {
 	config.MongoURL = os.Getenv("MONGODB_URL")
 	if config.MongoURL == "" {
-		log.Fatal("MONGODB_URL is required")
+		fatal("MONGODB_URL is required")
 	}
 	config.DBName = os.Getenv("MONGODB_DB_NAME")
 	if config.DBName == "" {
 		url_, err := url.Parse(config.MongoURL)
 		if err != nil {
-			log.Fatalf("Failed to parse MONGODB_URL: %s", err)
+			fatal("failed to parse MONGODB_URL", "error", err)
 		}
 		config.DBName = strings.TrimLeft(url_.Path, "/")
 	}
 }
 
+// durationFromEnv parses the duration in the given environment variable,
+// returning def when it's not defined.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		fatal("failed to parse duration", "variable", name, "error", err)
+	}
+	return d
+}
+
+// validatePlans checks that every plan has a unique name and an image.
+func validatePlans(plans []Plan) []error {
+	var errs []error
+	names := make(map[string]bool, len(plans))
+	for i, plan := range plans {
+		if plan.Name == "" {
+			errs = append(errs, fmt.Errorf("plan #%d: missing name", i))
+		} else if names[plan.Name] {
+			errs = append(errs, fmt.Errorf("plan %q: duplicate name", plan.Name))
+		}
+		names[plan.Name] = true
+		if plan.isGroup() {
+			for _, err := range validateMembers(plan.Members) {
+				errs = append(errs, fmt.Errorf("plan %q: %s", plan.Name, err))
+			}
+		} else if plan.Image == "" {
+			errs = append(errs, fmt.Errorf("plan %q: missing image", plan.Name))
+		}
+		if plan.Memory < 0 {
+			errs = append(errs, fmt.Errorf("plan %q: invalid memory limit", plan.Name))
+		}
+		if plan.Readiness != nil {
+			if err := plan.Readiness.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("plan %q: %s", plan.Name, err))
+			}
+		}
+		for _, err := range validatePorts(plan.Ports) {
+			errs = append(errs, fmt.Errorf("plan %q: %s", plan.Name, err))
+		}
+		if r := plan.Readiness; r != nil && r.Port != "" && !plan.publishes(r.Port) {
+			errs = append(errs, fmt.Errorf("plan %q: readiness check port %s is not published", plan.Name, r.Port))
+		}
+		if err := validateURLTemplate(&plan); err != nil {
+			errs = append(errs, fmt.Errorf("plan %q: %s", plan.Name, err))
+		}
+		if plan.Healthcheck != nil {
+			if err := plan.Healthcheck.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("plan %q: %s", plan.Name, err))
+			}
+		}
+		if plan.Backup != nil {
+			if err := plan.Backup.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("plan %q: %s", plan.Name, err))
+			}
+		}
+		if plan.Updates != nil {
+			if err := plan.Updates.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("plan %q: %s", plan.Name, err))
+			}
+		}
+		if plan.Placement != nil {
+			if err := plan.Placement.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("plan %q: %s", plan.Name, err))
+			}
+			for _, err := range validateSpread(&plan) {
+				errs = append(errs, fmt.Errorf("plan %q: %s", plan.Name, err))
+			}
+		}
+		if config.Provisioner == ProvisionerSwarm {
+			for _, err := range validateSwarmPlan(&plan) {
+				errs = append(errs, fmt.Errorf("plan %q: %s", plan.Name, err))
+			}
+		}
+	}
+	return errs
+}
+
 func getPlan(name string) (*Plan, error) {
 	for _, plan := range config.Plans {
 		if plan.Name == name {
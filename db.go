@@ -4,18 +4,286 @@
 
 package main
 
-import "gopkg.in/mgo.v2"
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	sessionMut sync.Mutex
+	session    *mgo.Session
+)
 
 type collection struct {
 	*mgo.Collection
 	*mgo.Session
 }
 
+// openSession dials MongoDB. The resulting session is shared by the whole
+// process, and each call to connect works on a copy of it. Calling
+// openSession again is a no-op.
+func openSession() error {
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	return dial()
+}
+
+func dial() error {
+	if session != nil {
+		return nil
+	}
+	s, err := mgo.DialWithTimeout(config.MongoURL, 30e9)
+	if err != nil {
+		return err
+	}
+	session = s
+	return nil
+}
+
+// closeSession closes the shared session. A later call to connect dials
+// MongoDB again.
+func closeSession() {
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	if session != nil {
+		session.Close()
+		session = nil
+	}
+}
+
 func connect() (*collection, error) {
-	session, err := mgo.DialWithTimeout(config.MongoURL, 30e9)
+	return connectTo("instances")
+}
+
+func connectEvents() (*collection, error) {
+	return connectTo("events")
+}
+
+func connectHosts() (*collection, error) {
+	return connectTo("hosts")
+}
+
+func connectTo(name string) (*collection, error) {
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	if err := dial(); err != nil {
+		return nil, err
+	}
+	s := session.Copy()
+	coll := s.DB(config.DBName).C(name)
+	return &collection{coll, s}, nil
+}
+
+// mongoStorage stores instances, hosts and events in MongoDB.
+type mongoStorage struct{}
+
+func newMongoStorage() (*mongoStorage, error) {
+	if err := openSession(); err != nil {
+		return nil, err
+	}
+	return &mongoStorage{}, nil
+}
+
+func (mongoStorage) GetInstance(name string) (*Instance, error) {
+	coll, err := connect()
+	if err != nil {
+		return nil, err
+	}
+	defer coll.Close()
+	var instance Instance
+	err = coll.Find(bson.M{"name": name}).One(&instance)
+	if err == mgo.ErrNotFound {
+		return nil, ErrInstanceNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
-	coll := session.DB(config.DBName).C("instances")
-	return &collection{coll, session}, nil
+	return &instance, nil
+}
+
+func (mongoStorage) InsertInstance(instance *Instance) error {
+	coll, err := connect()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	err = coll.Insert(instance)
+	if mgo.IsDup(err) {
+		return ErrInstanceAlreadyExists
+	}
+	return err
+}
+
+func (mongoStorage) UpdateInstance(instance *Instance) error {
+	coll, err := connect()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	updated := *instance
+	updated.Revision++
+	err = coll.Update(revisionQuery(bson.M{"name": instance.Name}, instance.Revision), &updated)
+	if err == mgo.ErrNotFound {
+		var n int
+		if n, err = coll.Find(bson.M{"name": instance.Name}).Count(); err == nil && n == 0 {
+			return ErrInstanceNotFound
+		}
+		if err == nil {
+			return ErrConflict
+		}
+	}
+	if err != nil {
+		return err
+	}
+	instance.Revision = updated.Revision
+	return nil
+}
+
+// revisionQuery restricts query to the documents with the given revision.
+// Documents stored before revisions were introduced have revision 0.
+func revisionQuery(query bson.M, revision int) bson.M {
+	if revision == 0 {
+		query["$or"] = []bson.M{{"revision": 0}, {"revision": bson.M{"$exists": false}}}
+	} else {
+		query["revision"] = revision
+	}
+	return query
+}
+
+func (mongoStorage) DeleteInstance(name string) error {
+	coll, err := connect()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	err = coll.Remove(bson.M{"name": name})
+	if err == mgo.ErrNotFound {
+		return ErrInstanceNotFound
+	}
+	return err
+}
+
+func (mongoStorage) ListInstances(filter InstanceFilter) ([]Instance, int, error) {
+	field, desc, err := filter.sortField()
+	if err != nil {
+		return nil, 0, err
+	}
+	if desc {
+		field = "-" + field
+	}
+	coll, err := connect()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer coll.Close()
+	query := coll.Find(filter.query())
+	total, err := query.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+	query = query.Sort(field, "name").Skip(filter.Offset)
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	instances := []Instance{}
+	err = query.All(&instances)
+	return instances, total, err
+}
+
+func (mongoStorage) ListHosts() ([]HostState, error) {
+	coll, err := connectHosts()
+	if err != nil {
+		return nil, err
+	}
+	defer coll.Close()
+	hosts := []HostState{}
+	err = coll.Find(nil).Sort("address").All(&hosts)
+	return hosts, err
+}
+
+// UpdateHost upserts the state of the host only when it has the same
+// revision. When the stored state has another revision, the upsert tries to
+// insert a document with the same address, which is unique.
+func (mongoStorage) UpdateHost(host *HostState) error {
+	coll, err := connectHosts()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	updated := *host
+	updated.Revision++
+	_, err = coll.Upsert(revisionQuery(bson.M{"address": host.Address}, host.Revision), &updated)
+	if mgo.IsDup(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	host.Revision = updated.Revision
+	return nil
+}
+
+func (mongoStorage) InsertEvent(evt *Event) error {
+	coll, err := connectEvents()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	return coll.Insert(evt)
+}
+
+func (mongoStorage) ListEvents(filter EventFilter) ([]Event, error) {
+	coll, err := connectEvents()
+	if err != nil {
+		return nil, err
+	}
+	defer coll.Close()
+	query := coll.Find(filter.query()).Sort("-starttime")
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	events := []Event{}
+	err = query.All(&events)
+	return events, err
+}
+
+// AcquireLease upserts the lease document only when it's free, expired or
+// already held by owner. When it's held by another owner, the upsert tries to
+// insert a document with the same _id, and fails with a duplicate key error.
+func (mongoStorage) AcquireLease(name, owner string, ttl time.Duration) (bool, error) {
+	coll, err := connectTo("leases")
+	if err != nil {
+		return false, err
+	}
+	defer coll.Close()
+	now := time.Now().UTC()
+	_, err = coll.Upsert(
+		bson.M{"_id": name, "$or": []bson.M{{"owner": owner}, {"expires": bson.M{"$lte": now}}}},
+		bson.M{"$set": bson.M{"owner": owner, "expires": now.Add(ttl)}},
+	)
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (mongoStorage) ReleaseLease(name, owner string) error {
+	coll, err := connectTo("leases")
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	err = coll.Remove(bson.M{"_id": name, "owner": owner})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (mongoStorage) Close() error {
+	closeSession()
+	return nil
 }
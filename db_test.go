@@ -5,15 +5,73 @@
 package main
 
 import (
+	"context"
+
 	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
 )
 
-func (*S) TestConnect(c *check.C) {
+var _ = check.Suite(&MongoSuite{})
+
+// MongoSuite holds the tests that need a MongoDB server running on
+// localhost.
+type MongoSuite struct{}
+
+func (*MongoSuite) SetUpTest(c *check.C) {
 	config.MongoURL = "mongodb://127.0.0.1:27017/diaats"
 	config.DBName = "diaats"
+	for _, name := range []string{"instances", "hosts", "events", "leases"} {
+		coll, err := connectTo(name)
+		c.Assert(err, check.IsNil)
+		coll.RemoveAll(nil)
+		coll.Close()
+	}
+	s, err := newMongoStorage()
+	c.Assert(err, check.IsNil)
+	_, err = runMigrations(context.Background(), s)
+	c.Assert(err, check.IsNil)
+}
+
+func (*MongoSuite) TestConnect(c *check.C) {
 	coll, err := connect()
 	c.Assert(err, check.IsNil)
 	defer coll.Close()
 	c.Assert(coll.Database.Name, check.Equals, config.DBName)
 	c.Assert(coll.Name, check.Equals, "instances")
 }
+
+func (*MongoSuite) TestConnectEvents(c *check.C) {
+	coll, err := connectEvents()
+	c.Assert(err, check.IsNil)
+	defer coll.Close()
+	c.Assert(coll.Database.Name, check.Equals, config.DBName)
+	c.Assert(coll.Name, check.Equals, "events")
+}
+
+func (*MongoSuite) TestConnectUniqueNameIndex(c *check.C) {
+	coll, err := connect()
+	c.Assert(err, check.IsNil)
+	defer coll.Close()
+	err = coll.Insert(Instance{Name: "mycache"})
+	c.Assert(err, check.IsNil)
+	err = coll.Insert(Instance{Name: "mycache"})
+	c.Assert(mgo.IsDup(err), check.Equals, true)
+}
+
+func (*MongoSuite) TestConnectCopiesSession(c *check.C) {
+	coll1, err := connect()
+	c.Assert(err, check.IsNil)
+	coll2, err := connect()
+	c.Assert(err, check.IsNil)
+	c.Assert(coll1.Session, check.Not(check.Equals), coll2.Session)
+	coll1.Close()
+	err = coll2.Ping()
+	c.Assert(err, check.IsNil)
+	coll2.Close()
+}
+
+func (*MongoSuite) TestMongoStorage(c *check.C) {
+	s, err := newMongoStorage()
+	c.Assert(err, check.IsNil)
+	testStorage(c, s)
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// DockerHost is a Docker host where instances are created.
+type DockerHost struct {
+	Address string `json:"address"`
+
+	// Name identifies the host in the API. Defaults to the host and port
+	// of Address.
+	Name string `json:"name,omitempty"`
+
+	// Memory is the memory of the host available to instances, in bytes.
+	// Defaults to the memory reported by the Docker API.
+	Memory int64 `json:"memory,omitempty"`
+
+	// Labels describe the host, like its datacenter or the type of its
+	// disks, and are matched by the placement constraints of plans.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// CACert, Cert and Key are paths to PEM files used for mutual TLS with
+	// the Docker host. They're all empty when the host doesn't use TLS.
+	CACert string `json:"caCert,omitempty"`
+	Cert   string `json:"cert,omitempty"`
+	Key    string `json:"key,omitempty"`
+}
+
+// setCertPath fills the TLS settings of the host with the files in dir,
+// following the layout used by the Docker CLI for DOCKER_CERT_PATH.
+func (h *DockerHost) setCertPath(dir string) {
+	h.CACert = filepath.Join(dir, "ca.pem")
+	h.Cert = filepath.Join(dir, "cert.pem")
+	h.Key = filepath.Join(dir, "key.pem")
+}
+
+// dockerClients caches the clients of the Docker hosts, by address and TLS
+// settings, so their connections are reused.
+var dockerClients = struct {
+	sync.Mutex
+	clients map[[4]string]*docker.Client
+}{clients: make(map[[4]string]*docker.Client)}
+
+func (h *DockerHost) client() (*docker.Client, error) {
+	key := [4]string{h.Address, h.Cert, h.Key, h.CACert}
+	dockerClients.Lock()
+	defer dockerClients.Unlock()
+	if client, ok := dockerClients.clients[key]; ok {
+		return client, nil
+	}
+	var client *docker.Client
+	var err error
+	if h.Cert != "" {
+		client, err = docker.NewTLSClient(h.Address, h.Cert, h.Key, h.CACert)
+	} else {
+		client, err = docker.NewClient(h.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dockerClients.clients[key] = client
+	return client, nil
+}
+
+// findDockerHost returns the configured Docker host with the given address.
+// Hosts that aren't configured anymore, like the host of an instance created
+// before a configuration change, are returned without TLS settings.
+func findDockerHost(addr string) *DockerHost {
+	for i := range config.DockerHosts {
+		if config.DockerHosts[i].Address == addr {
+			return &config.DockerHosts[i]
+		}
+	}
+	return &DockerHost{Address: addr}
+}
+
+// dockerClient returns a client for the Docker host at addr.
+func dockerClient(addr string) (*docker.Client, error) {
+	return findDockerHost(addr).client()
+}
@@ -0,0 +1,121 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// writeTestCerts writes to dir a CA (ca.pem), a client certificate signed by
+// it (cert.pem and key.pem, the layout of DOCKER_CERT_PATH) and a server
+// certificate for 127.0.0.1 (server-cert.pem and server-key.pem).
+func writeTestCerts(c *check.C, dir string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	caTemplate := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "diaats test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, &caTemplate, &caTemplate, &caKey.PublicKey, caKey)
+	c.Assert(err, check.IsNil)
+	caCert, err := x509.ParseCertificate(caDER)
+	c.Assert(err, check.IsNil)
+	writePEM(c, filepath.Join(dir, "ca.pem"), "CERTIFICATE", caDER)
+	for i, name := range []string{"", "server-"} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		c.Assert(err, check.IsNil)
+		template := x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: "diaats test " + name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &template, caCert, &key.PublicKey, caKey)
+		c.Assert(err, check.IsNil)
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		c.Assert(err, check.IsNil)
+		writePEM(c, filepath.Join(dir, name+"cert.pem"), "CERTIFICATE", der)
+		writePEM(c, filepath.Join(dir, name+"key.pem"), "EC PRIVATE KEY", keyDER)
+	}
+}
+
+func writePEM(c *check.C, path, blockType string, data []byte) {
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600)
+	c.Assert(err, check.IsNil)
+}
+
+func (*S) TestFindDockerHost(c *check.C) {
+	config.DockerHosts = []DockerHost{
+		{Address: "tcp://10.0.0.1:2376", CACert: "/certs/ca.pem", Cert: "/certs/cert.pem", Key: "/certs/key.pem"},
+		{Address: "tcp://10.0.0.2:2375"},
+	}
+	defer func() { config.DockerHosts = nil }()
+	c.Assert(findDockerHost("tcp://10.0.0.1:2376"), check.Equals, &config.DockerHosts[0])
+	c.Assert(*findDockerHost("tcp://10.0.0.3:2375"), check.DeepEquals, DockerHost{Address: "tcp://10.0.0.3:2375"})
+}
+
+func (*S) TestDockerHostSetCertPath(c *check.C) {
+	var host DockerHost
+	host.setCertPath("/etc/docker/certs")
+	c.Assert(host, check.DeepEquals, DockerHost{
+		CACert: "/etc/docker/certs/ca.pem",
+		Cert:   "/etc/docker/certs/cert.pem",
+		Key:    "/etc/docker/certs/key.pem",
+	})
+}
+
+func (s *S) TestDockerClientTLS(c *check.C) {
+	dir := c.MkDir()
+	writeTestCerts(c, dir)
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server-cert.pem"), filepath.Join(dir, "server-key.pem"))
+	c.Assert(err, check.IsNil)
+	caData, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	c.Assert(err, check.IsNil)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caData)
+	server := httptest.NewUnstartedServer(s.server)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	defer server.Close()
+	addr := "tcp://" + strings.TrimPrefix(server.URL, "https://")
+	host := DockerHost{Address: addr}
+	host.setCertPath(dir)
+	config.DockerHosts = []DockerHost{host}
+	defer func() { config.DockerHosts = nil }()
+	client, err := dockerClient(addr)
+	c.Assert(err, check.IsNil)
+	c.Assert(client.TLSConfig, check.NotNil)
+	c.Assert(client.Ping(), check.IsNil)
+	client, err = (&DockerHost{Address: addr}).client()
+	c.Assert(err, check.IsNil)
+	c.Assert(client.Ping(), check.NotNil)
+}
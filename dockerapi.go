@@ -0,0 +1,101 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// dockerRequestTimeout bounds the requests sent by dockerRequest, so a Docker
+// daemon that stops responding doesn't block its callers.
+const dockerRequestTimeout = 30 * time.Second
+
+// unixClients are the HTTP clients of the Docker daemons listening on unix
+// sockets, by socket path, so their connections are reused.
+var unixClients = struct {
+	sync.Mutex
+	clients map[string]*http.Client
+}{clients: make(map[string]*http.Client)}
+
+func unixClient(socket string) *http.Client {
+	unixClients.Lock()
+	defer unixClients.Unlock()
+	if client, ok := unixClients.clients[socket]; ok {
+		return client
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+		IdleConnTimeout: 90 * time.Second,
+	}}
+	unixClients.clients[socket] = client
+	return client
+}
+
+// dockerRequest sends a request to the Docker API using the settings of the
+// given client. It's used for the parts of the API that go-dockerclient
+// doesn't support yet, like health checks. The body of the request is
+// encoded as JSON, and the response is decoded into out, when it's not nil.
+// The request is canceled with ctx or after dockerRequestTimeout.
+func dockerRequest(ctx context.Context, client *docker.Client, method, path string, in, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, dockerRequestTimeout)
+	defer cancel()
+	endpoint, err := url.Parse(client.Endpoint())
+	if err != nil {
+		return err
+	}
+	httpClient := client.HTTPClient
+	switch endpoint.Scheme {
+	case "unix":
+		httpClient = unixClient(endpoint.Path)
+		endpoint = &url.URL{Scheme: "http", Host: "docker"}
+	case "tcp":
+		endpoint.Scheme = "http"
+		if client.TLSConfig != nil {
+			endpoint.Scheme = "https"
+		}
+	}
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(endpoint.String(), "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		return &docker.Error{Status: resp.StatusCode, Message: string(data)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,517 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// States of a drain.
+const (
+	DrainRunning = "running"
+	DrainDone    = "done"
+	DrainFailed  = "failed"
+	DrainAborted = "aborted"
+)
+
+const drainCheckInterval = 10 * time.Second
+
+var (
+	ErrDrainInProgress  = errors.New("host is being drained")
+	ErrNoDrain          = errors.New("host is not being drained")
+	ErrStatefulInstance = errors.New("instance keeps data in its host and can't be moved")
+)
+
+// Drain is the move of every instance of a Docker host to other hosts.
+type Drain struct {
+	State      string    `json:"state"`
+	Actor      string    `json:"actor,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+
+	// Aborting is set when the drain is aborted, which happens on its next
+	// check, canceling the pending moves.
+	Aborting bool `json:"aborting,omitempty"`
+
+	// Total is the number of instances in the host when the drain started,
+	// Pending are the ones whose moves are queued, and Instances are the
+	// ones the drain already tried to move.
+	Total     int               `json:"total"`
+	Pending   []string          `json:"pending"`
+	Instances []DrainedInstance `json:"instances"`
+}
+
+// DrainedInstance is the outcome of the move of an instance by a drain.
+// DockerHost is the address of its new host, empty when the move failed.
+type DrainedInstance struct {
+	Name       string `json:"name"`
+	DockerHost string `json:"dockerHost,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func (d *Drain) running() bool {
+	return d != nil && d.State == DrainRunning
+}
+
+// known reports whether the drain already queued or tried to move the named
+// instance.
+func (d *Drain) known(name string) bool {
+	for _, pending := range d.Pending {
+		if pending == name {
+			return true
+		}
+	}
+	for _, instance := range d.Instances {
+		if instance.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// DrainHost cordons the Docker host with the given name and records its
+// drain, which queues the moves of its instances to other hosts on its next
+// check. The moves run in the maintenance windows of the instances.
+// Instances that keep data the move can't carry aren't moved, and Swarm
+// services aren't either, as Swarm places their tasks.
+func DrainHost(ctx context.Context, name, actor string) (*Drain, error) {
+	host, err := findHostByName(name)
+	if err != nil {
+		return nil, err
+	}
+	instances, _, err := storage.ListInstances(InstanceFilter{DockerHost: host.Address})
+	if err != nil {
+		return nil, err
+	}
+	var total int
+	for i := range instances {
+		if !instances[i].isService() {
+			total++
+		}
+	}
+	drain := &Drain{
+		State:     DrainRunning,
+		Actor:     actor,
+		StartedAt: time.Now().UTC(),
+		Total:     total,
+		Pending:   []string{},
+		Instances: []DrainedInstance{},
+	}
+	_, err = modifyHost(host.Address, func(state *HostState) error {
+		if state.Drain.running() {
+			return ErrDrainInProgress
+		}
+		state.Cordoned = true
+		state.Drain = drain
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	loggerFromContext(ctx).Info("host drain started", "docker_host", host.Address, "instances", total)
+	return drain, nil
+}
+
+// AbortDrain aborts the drain of the Docker host with the given name. The
+// queued moves are canceled, the instance being moved finishes moving, and
+// the host stays cordoned.
+func AbortDrain(ctx context.Context, name string) (*Drain, error) {
+	host, err := findHostByName(name)
+	if err != nil {
+		return nil, err
+	}
+	state, err := modifyHost(host.Address, func(state *HostState) error {
+		if !state.Drain.running() {
+			return ErrNoDrain
+		}
+		state.Drain.Aborting = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	loggerFromContext(ctx).Info("host drain aborted", "docker_host", host.Address)
+	return state.Drain, nil
+}
+
+// runDrains runs the pending drains every interval until ctx is canceled.
+func runDrains(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			drainHosts(ctx)
+		}
+	}
+}
+
+// drainHosts runs the pending drains, including the ones interrupted by a
+// restart of the server.
+func drainHosts(ctx context.Context) {
+	hosts, err := storage.ListHosts()
+	if err != nil {
+		loggerFromContext(ctx).Error("failed to list hosts", "error", err)
+		return
+	}
+	for _, host := range hosts {
+		if !host.Drain.running() {
+			continue
+		}
+		// The drain is claimed with a lease, so replicas of the API don't
+		// move the same instances.
+		if release, ok := claimWork(ctx, "drain-"+host.Address); ok {
+			drainHost(ctx, host.Address)
+			release()
+		}
+	}
+}
+
+// drainHost queues the moves of the running instances of the Docker host at
+// address that the drain doesn't know yet, recording the ones that can't be
+// moved as failed, and records the outcome of the queued moves. The drain is
+// done once no move is pending, and fails when an instance wasn't moved.
+func drainHost(ctx context.Context, address string) {
+	log := loggerFromContext(ctx).With("docker_host", address)
+	state, err := getHostState(address)
+	if err != nil {
+		log.Error("failed to get host state", "error", err)
+		return
+	}
+	drain := state.Drain
+	if !drain.running() {
+		return
+	}
+	if drain.Aborting {
+		for _, name := range drain.Pending {
+			cancelMove(ctx, name)
+		}
+		finishDrain(ctx, address, DrainAborted)
+		return
+	}
+	instances, _, err := storage.ListInstances(InstanceFilter{DockerHost: address, State: StateRunning})
+	if err != nil {
+		log.Error("failed to list instances", "error", err)
+		return
+	}
+	var queued []string
+	var results []DrainedInstance
+	for i := range instances {
+		instance := &instances[i]
+		if instance.isService() || drain.known(instance.Name) {
+			continue
+		}
+		_, err = QueueOperation(ctx, instance.Name, OperationMove, "drain of "+address)
+		if err != nil {
+			log.Error("failed to queue move", "instance", instance.Name, "error", err)
+			results = append(results, DrainedInstance{Name: instance.Name, Error: err.Error()})
+			continue
+		}
+		queued = append(queued, instance.Name)
+	}
+	finished := make(map[string]bool)
+	for _, name := range drain.Pending {
+		result, done := moveOutcome(ctx, name, address)
+		finished[name] = done
+		if result != nil {
+			results = append(results, *result)
+		}
+	}
+	state, err = modifyHost(address, func(state *HostState) error {
+		drain := state.Drain
+		if !drain.running() || drain.Aborting {
+			return errNoChange
+		}
+		pending := append(drain.Pending, queued...)
+		drain.Pending = []string{}
+		for _, name := range pending {
+			if !finished[name] {
+				drain.Pending = append(drain.Pending, name)
+			}
+		}
+		drain.Instances = append(drain.Instances, results...)
+		if len(drain.Pending) > 0 {
+			return nil
+		}
+		drain.State = DrainDone
+		for _, instance := range drain.Instances {
+			if instance.Error != "" {
+				drain.State = DrainFailed
+			}
+		}
+		drain.FinishedAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		log.Error("failed to record drain progress", "error", err)
+		return
+	}
+	if !state.Drain.running() {
+		log.Info("host drain finished", "state", state.Drain.State)
+	}
+}
+
+// moveOutcome returns the outcome of the queued move of the named instance
+// out of the host at address, and whether it's finished. Failed moves are
+// canceled, so they aren't retried after the drain reports them. No outcome
+// is returned for instances removed during the drain.
+func moveOutcome(ctx context.Context, name, address string) (*DrainedInstance, bool) {
+	instance, err := storage.GetInstance(name)
+	if err == ErrInstanceNotFound {
+		return nil, true
+	}
+	if err != nil {
+		loggerFromContext(ctx).Error("failed to find instance", "instance", name, "error", err)
+		return nil, false
+	}
+	if instance.DockerHost != address {
+		return &DrainedInstance{Name: name, DockerHost: instance.DockerHost}, true
+	}
+	for _, op := range instance.Operations {
+		if op.Kind != OperationMove {
+			continue
+		}
+		if op.LastError == "" {
+			return nil, false
+		}
+		if err = CancelOperation(ctx, name, op.ID); err != nil && err != ErrOperationNotFound {
+			loggerFromContext(ctx).Error("failed to cancel move", "instance", name, "error", err)
+		}
+		return &DrainedInstance{Name: name, Error: op.LastError}, true
+	}
+	return &DrainedInstance{Name: name, Error: "move canceled"}, true
+}
+
+// cancelMove cancels the queued move of the named instance, if any.
+func cancelMove(ctx context.Context, name string) {
+	instance, err := storage.GetInstance(name)
+	if err != nil {
+		return
+	}
+	for _, op := range instance.Operations {
+		if op.Kind == OperationMove {
+			if err = CancelOperation(ctx, name, op.ID); err != nil && err != ErrOperationNotFound {
+				loggerFromContext(ctx).Error("failed to cancel move", "instance", name, "error", err)
+			}
+		}
+	}
+}
+
+func finishDrain(ctx context.Context, address, status string) {
+	_, err := modifyHost(address, func(state *HostState) error {
+		state.Drain.State = status
+		state.Drain.Aborting = false
+		state.Drain.FinishedAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		loggerFromContext(ctx).Error("failed to finish drain", "docker_host", address, "error", err)
+		return
+	}
+	loggerFromContext(ctx).Info("host drain finished", "docker_host", address, "state", status)
+}
+
+// moveSteps are the steps executed by MoveInstance, in order. The instance
+// only changes hosts in the last step, so it keeps running in its old host
+// when a step fails.
+var moveSteps = []step{
+	{name: "pull images", forward: pullImages},
+	{name: "create volumes", forward: createMovedVolumes, backward: removeVolumes},
+	{name: "create network", forward: createNetwork, backward: removeNetwork},
+	{name: "create containers", forward: createContainers, backward: removeContainers},
+	{name: "copy volumes", forward: copyMovedVolumes, backward: startStoppedContainers},
+	{name: "start containers", forward: startContainers},
+	{name: "inspect containers", forward: inspectContainers},
+	{name: "record images", forward: recordImages},
+	{name: "wait for readiness", forward: waitContainerReady},
+	{name: "save instance", forward: saveInstance},
+}
+
+// MoveInstance recreates the containers of the instance in the Docker host
+// at address, from the images of its plan, copying the data of their volumes,
+// and removes the old ones. The containers with volumes are stopped while
+// their data is copied. The instance gets new host ports, and loses its
+// snapshots, which are local to the old host. Instances that keep data the
+// move can't carry aren't moved, as checked by checkMovable.
+func MoveInstance(ctx context.Context, instance *Instance, address string) error {
+	done, err := trackOperation()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err = checkMovable(instance); err != nil {
+		return err
+	}
+	oldClient, err := dockerClient(instance.DockerHost)
+	if err != nil {
+		return err
+	}
+	client, err := dockerClient(address)
+	if err != nil {
+		return err
+	}
+	moved := *instance
+	moved.DockerHost = address
+	moved.Network, moved.NetworkScope = "", ""
+	p := provisioning{
+		client:     client,
+		instance:   &moved,
+		plan:       &moved.Plan,
+		specs:      moved.Plan.containerSpecs(moved.Name),
+		from:       instance,
+		fromClient: oldClient,
+		log:        loggerFromContext(ctx).With("instance", instance.Name, "plan", instance.Plan.Name),
+	}
+	if err = runSteps(ctx, moveSteps, &p); err != nil {
+		return err
+	}
+	for _, id := range instance.containerIDs() {
+		err = oldClient.RemoveContainer(docker.RemoveContainerOptions{ID: id, Force: true})
+		if err != nil {
+			p.log.Error("failed to remove Docker container", "container", id, "docker_host", instance.DockerHost, "error", err)
+		}
+	}
+	for _, container := range instance.Containers {
+		if err = removeVolumeList(oldClient, container.Volumes); err != nil {
+			p.log.Error("failed to remove volumes", "container", container.ID, "docker_host", instance.DockerHost, "error", err)
+		}
+	}
+	if err = releaseNetwork(oldClient, instance); err != nil {
+		p.log.Error("failed to remove Docker network", "network", instance.Network, "docker_host", instance.DockerHost, "error", err)
+	}
+	var snapshots []Snapshot
+	_, err = modifyInstance(instance.Name, func(instance *Instance) error {
+		snapshots = instance.Snapshots
+		instance.Snapshots = nil
+		return nil
+	})
+	if err != nil {
+		p.log.Error("failed to remove snapshots", "error", err)
+	}
+	for i := range snapshots {
+		removeSnapshotData(ctx, oldClient, &snapshots[i])
+	}
+	p.log.Info("instance moved", "from", instance.DockerHost, "to", address, "container", moved.ContainerID)
+	return nil
+}
+
+// checkMovable returns ErrStatefulInstance when the instance keeps data in
+// its Docker host that MoveInstance can't carry to another host: clones,
+// which run images committed in the host, and containers with mounts other
+// than their named volumes, such as binds and the anonymous volumes of
+// containers created before named volumes.
+func checkMovable(instance *Instance) error {
+	if instance.isService() {
+		return ErrNotSupportedBySwarm
+	}
+	if instance.isSpread() {
+		return ErrSpreadInstance
+	}
+	if instance.Source != "" {
+		return ErrStatefulInstance
+	}
+	client, err := dockerClient(instance.DockerHost)
+	if err != nil {
+		return err
+	}
+	for i, id := range instance.containerIDs() {
+		container, err := client.InspectContainer(id)
+		if err != nil {
+			return err
+		}
+		var volumes []InstanceVolume
+		if i < len(instance.Containers) {
+			volumes = instance.Containers[i].Volumes
+		}
+	mounts:
+		for _, mount := range container.Mounts {
+			for _, volume := range volumes {
+				if mount.Name == volume.Name {
+					continue mounts
+				}
+			}
+			return ErrStatefulInstance
+		}
+	}
+	return nil
+}
+
+// createMovedVolumes creates, in the new host of an instance being moved, the
+// named volumes its containers have in the old host.
+func createMovedVolumes(ctx context.Context, p *provisioning) error {
+	p.volumes = make([][]InstanceVolume, len(p.specs))
+	for i := range p.specs {
+		if i >= len(p.from.Containers) {
+			continue
+		}
+		for _, volume := range p.from.Containers[i].Volumes {
+			if _, err := p.client.CreateVolume(docker.CreateVolumeOptions{Name: volume.Name}); err != nil {
+				removeVolumes(ctx, p)
+				return err
+			}
+			p.volumes[i] = append(p.volumes[i], volume)
+		}
+	}
+	return nil
+}
+
+// copyMovedVolumes stops the old containers of an instance being moved that
+// have volumes, so their data doesn't change anymore, and copies it into the
+// new containers, which are created but not started yet.
+func copyMovedVolumes(ctx context.Context, p *provisioning) error {
+	for i, volumes := range p.volumes {
+		if len(volumes) == 0 {
+			continue
+		}
+		id := p.from.Containers[i].ID
+		err := p.fromClient.StopContainer(id, 10)
+		if _, ok := err.(*docker.ContainerNotRunning); err != nil && !ok {
+			startStoppedContainers(ctx, p)
+			return err
+		}
+		p.stopped = append(p.stopped, id)
+		for _, volume := range volumes {
+			if err = copyVolumeAcross(p.fromClient, id, p.client, p.containers[i].ID, volume.Path); err != nil {
+				startStoppedContainers(ctx, p)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// startStoppedContainers starts again the old containers stopped by
+// copyMovedVolumes, when the move fails.
+func startStoppedContainers(ctx context.Context, p *provisioning) error {
+	var lastErr error
+	for _, id := range p.stopped {
+		if err := p.fromClient.StartContainer(id, nil); err != nil {
+			p.log.Error("failed to start Docker container", "container", id, "docker_host", p.from.DockerHost, "error", err)
+			lastErr = err
+		}
+	}
+	p.stopped = nil
+	return lastErr
+}
+
+// moveInstance moves the instance to the Docker host chosen for its plan,
+// running the move operations queued by drains.
+func moveInstance(ctx context.Context, instance *Instance) error {
+	address, release, err := chooseHost(ctx, &instance.Plan, instance.Team)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if address == instance.DockerHost {
+		return ErrNoHostAvailable
+	}
+	return MoveInstance(ctx, instance, address)
+}
@@ -0,0 +1,289 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestMoveInstance(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	instance := s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	_, err := SnapshotInstance(context.Background(), instance)
+	c.Assert(err, check.IsNil)
+	instance, err = GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	err = MoveInstance(context.Background(), instance, other.URL())
+	c.Assert(err, check.IsNil)
+	moved, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(moved.DockerHost, check.Equals, other.URL())
+	c.Assert(moved.ContainerID, check.Not(check.Equals), instance.ContainerID)
+	c.Assert(moved.HostPorts, check.HasLen, len(instance.HostPorts))
+	c.Assert(moved.Snapshots, check.HasLen, 0)
+	client, err := docker.NewClient(other.URL())
+	c.Assert(err, check.IsNil)
+	_, err = client.InspectContainer(moved.ContainerID)
+	c.Assert(err, check.IsNil)
+	oldClient, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	_, err = oldClient.InspectContainer(instance.ContainerID)
+	c.Assert(err, check.FitsTypeOf, &docker.NoSuchContainer{})
+	_, err = oldClient.InspectImage(instance.Snapshots[0].Images[0])
+	c.Assert(err, check.Equals, docker.ErrNoSuchImage)
+}
+
+func (s *S) TestMoveInstanceFailure(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	instance := s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	other.PrepareFailure("start-error", "/containers/.*/start")
+	err := MoveInstance(context.Background(), instance, other.URL())
+	c.Assert(err, check.NotNil)
+	current, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(current.DockerHost, check.Equals, config.DockerHost)
+	c.Assert(current.ContainerID, check.Equals, instance.ContainerID)
+	client, err := docker.NewClient(other.URL())
+	c.Assert(err, check.IsNil)
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(containers, check.HasLen, 0)
+}
+
+func (s *S) TestMoveInstanceVolumes(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	s.createDataImage(c)
+	instance := s.createInstanceWithPlan(c, "mydb", Plan{Name: "data", Image: "memcached-data"})
+	defer DestroyInstance(context.Background(), "mydb")
+	volumes := instance.Containers[0].Volumes
+	c.Assert(volumes, check.HasLen, 2)
+	downloads := s.recordArchives()
+	uploads := recordServerArchives(other)
+	removed := s.recordVolumeRemovals()
+	err := MoveInstance(context.Background(), instance, other.URL())
+	c.Assert(err, check.IsNil)
+	moved, err := GetInstance(context.Background(), "mydb")
+	c.Assert(err, check.IsNil)
+	c.Assert(moved.DockerHost, check.Equals, other.URL())
+	c.Assert(moved.Containers[0].Volumes, check.DeepEquals, volumes)
+	old, id := instance.Containers[0].ID, moved.Containers[0].ID
+	c.Assert(downloads(), check.DeepEquals, []string{"GET " + old + " /data", "GET " + old + " /logs"})
+	c.Assert(uploads(), check.DeepEquals, []string{"PUT " + id + " / contents of /data", "PUT " + id + " / contents of /logs"})
+	client, err := docker.NewClient(other.URL())
+	c.Assert(err, check.IsNil)
+	for _, volume := range volumes {
+		_, err = client.InspectVolume(volume.Name)
+		c.Assert(err, check.IsNil)
+	}
+	c.Assert(removed(), check.DeepEquals, []string{volumes[0].Name, volumes[1].Name})
+}
+
+func (s *S) TestMoveInstanceVolumesFailure(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	s.createDataImage(c)
+	instance := s.createInstanceWithPlan(c, "mydb", Plan{Name: "data", Image: "memcached-data"})
+	defer DestroyInstance(context.Background(), "mydb")
+	s.recordArchives()
+	recordServerArchives(other)
+	other.PrepareFailure("start-error", "/containers/.*/start")
+	err := MoveInstance(context.Background(), instance, other.URL())
+	c.Assert(err, check.NotNil)
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	container, err := client.InspectContainer(instance.Containers[0].ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(container.State.Running, check.Equals, true)
+	current, err := GetInstance(context.Background(), "mydb")
+	c.Assert(err, check.IsNil)
+	c.Assert(current.DockerHost, check.Equals, config.DockerHost)
+}
+
+func (s *S) TestMoveInstanceStateful(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	instance := s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	instance.Source = "othercache"
+	err := MoveInstance(context.Background(), instance, other.URL())
+	c.Assert(err, check.Equals, ErrStatefulInstance)
+}
+
+func (s *S) TestDrainHost(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	s.createTestInstance(c, "first")
+	defer DestroyInstance(context.Background(), "first")
+	s.createTestInstance(c, "second")
+	defer DestroyInstance(context.Background(), "second")
+	s.createTestInstance(c, "third")
+	defer DestroyInstance(context.Background(), "third")
+	name := config.DockerHosts[0].name()
+	drain, err := DrainHost(context.Background(), name, "admin")
+	c.Assert(err, check.IsNil)
+	c.Assert(drain.State, check.Equals, DrainRunning)
+	c.Assert(drain.Total, check.Equals, 2)
+	c.Assert(drain.Pending, check.HasLen, 0)
+	operations, err := ListOperations()
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 0)
+	drainHosts(context.Background())
+	host, err := GetHost(context.Background(), name)
+	c.Assert(err, check.IsNil)
+	c.Assert(host.Drain.Pending, check.DeepEquals, []string{"first", "third"})
+	operations, err = ListOperations()
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 2)
+	c.Assert(operations[0].Kind, check.Equals, OperationMove)
+	_, err = DrainHost(context.Background(), name, "admin")
+	c.Assert(err, check.Equals, ErrDrainInProgress)
+	err = UncordonHost(context.Background(), name)
+	c.Assert(err, check.Equals, ErrDrainInProgress)
+	scheduleOperations(context.Background(), time.Now())
+	drainHosts(context.Background())
+	host, err = GetHost(context.Background(), name)
+	c.Assert(err, check.IsNil)
+	c.Assert(host.Cordoned, check.Equals, true)
+	c.Assert(host.Instances, check.Equals, 0)
+	c.Assert(host.Drain.Pending, check.HasLen, 0)
+	c.Assert(host.Drain.State, check.Equals, DrainDone)
+	c.Assert(host.Drain.Instances, check.DeepEquals, []DrainedInstance{
+		{Name: "first", DockerHost: other.URL()},
+		{Name: "third", DockerHost: other.URL()},
+	})
+	instances, _, err := storage.ListInstances(InstanceFilter{DockerHost: other.URL()})
+	c.Assert(err, check.IsNil)
+	c.Assert(instances, check.HasLen, 3)
+	events, err := ListEvents(EventFilter{Kind: EventMove})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 2)
+	c.Assert(events[0].Actor, check.Equals, schedulerActor)
+	c.Assert(events[0].DockerHost, check.Equals, config.DockerHost)
+	err = UncordonHost(context.Background(), name)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestDrainHostFailure(c *check.C) {
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	name := dockerHosts()[0].name()
+	_, err := DrainHost(context.Background(), name, "admin")
+	c.Assert(err, check.IsNil)
+	drainHosts(context.Background())
+	scheduleOperations(context.Background(), time.Now())
+	drainHosts(context.Background())
+	host, err := GetHost(context.Background(), name)
+	c.Assert(err, check.IsNil)
+	c.Assert(host.Instances, check.Equals, 1)
+	c.Assert(host.Drain.State, check.Equals, DrainFailed)
+	c.Assert(host.Drain.Instances, check.DeepEquals, []DrainedInstance{
+		{Name: "mycache", Error: ErrNoHostAvailable.Error()},
+	})
+	operations, err := ListOperations()
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 0)
+}
+
+func (s *S) TestDrainHostStateful(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	s.createTestInstance(c, "mydb")
+	defer DestroyInstance(context.Background(), "mydb")
+	_, err := modifyInstance("mydb", func(instance *Instance) error {
+		instance.Source = "othercache"
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	name := config.DockerHosts[0].name()
+	_, err = DrainHost(context.Background(), name, "admin")
+	c.Assert(err, check.IsNil)
+	drainHosts(context.Background())
+	host, err := GetHost(context.Background(), name)
+	c.Assert(err, check.IsNil)
+	drain := host.Drain
+	c.Assert(drain.State, check.Equals, DrainFailed)
+	c.Assert(drain.Pending, check.HasLen, 0)
+	c.Assert(drain.Instances, check.DeepEquals, []DrainedInstance{
+		{Name: "mydb", Error: ErrStatefulInstance.Error()},
+	})
+	operations, err := ListOperations()
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 0)
+}
+
+func (s *S) TestAbortDrain(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	name := config.DockerHosts[0].name()
+	_, err := AbortDrain(context.Background(), name)
+	c.Assert(err, check.Equals, ErrNoDrain)
+	_, err = DrainHost(context.Background(), name, "admin")
+	c.Assert(err, check.IsNil)
+	drain, err := AbortDrain(context.Background(), name)
+	c.Assert(err, check.IsNil)
+	c.Assert(drain.Aborting, check.Equals, true)
+	drainHosts(context.Background())
+	host, err := GetHost(context.Background(), name)
+	c.Assert(err, check.IsNil)
+	c.Assert(host.Cordoned, check.Equals, true)
+	c.Assert(host.Instances, check.Equals, 1)
+	c.Assert(host.Drain.State, check.Equals, DrainAborted)
+	c.Assert(host.Drain.Instances, check.HasLen, 0)
+	operations, err := ListOperations()
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 0)
+}
+
+func (s *S) TestDrainHandlers(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	name := config.DockerHosts[0].name()
+	handler := buildMuxer()
+	request, err := http.NewRequest("POST", "/admin/hosts/"+name+"/drain", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusAccepted)
+	var drain Drain
+	err = json.NewDecoder(recorder.Body).Decode(&drain)
+	c.Assert(err, check.IsNil)
+	c.Assert(drain.State, check.Equals, DrainRunning)
+	c.Assert(drain.Total, check.Equals, 1)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusConflict)
+	request, err = http.NewRequest("DELETE", "/admin/hosts/"+name+"/drain", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusAccepted)
+	drainHosts(context.Background())
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+	events, err := ListEvents(EventFilter{DockerHost: config.DockerHost})
+	c.Assert(err, check.IsNil)
+	var kinds []string
+	for _, evt := range events {
+		kinds = append(kinds, evt.Kind)
+	}
+	c.Assert(kinds[:4], check.DeepEquals, []string{EventDrainAbort, EventDrainAbort, EventDrain, EventDrain})
+}
@@ -0,0 +1,182 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Kinds of operations recorded in the event history.
+const (
+	EventCreate          = "create"
+	EventBind            = "bind"
+	EventUnbind          = "unbind"
+	EventStatusChange    = "status-change"
+	EventRestart         = "restart"
+	EventBackup          = "backup"
+	EventRestore         = "restore"
+	EventSnapshot        = "snapshot"
+	EventRecreate        = "recreate"
+	EventUpdateAvailable = "update-available"
+	EventMove            = "move"
+	EventCordon          = "cordon"
+	EventUncordon        = "uncordon"
+	EventDrain           = "drain"
+	EventDrainAbort      = "drain-abort"
+	EventRemove          = "remove"
+)
+
+// Statuses recorded by status change events, besides StateRunning.
+const (
+	StatusUnhealthy = "unhealthy"
+	StatusHealthy   = "healthy"
+	StatusFailed    = "failed"
+)
+
+// Event is an entry in the history of operations executed on instances.
+// Status is the new status of the instance in status change events.
+type Event struct {
+	ID         bson.ObjectId `bson:"_id" json:"id"`
+	Kind       string        `json:"kind"`
+	Instance   string        `json:"instance"`
+	Plan       string        `json:"plan,omitempty"`
+	DockerHost string        `bson:"dockerhost" json:"dockerHost,omitempty"`
+	Actor      string        `json:"actor,omitempty"`
+	RequestID  string        `bson:"requestid" json:"requestID,omitempty"`
+	StartTime  time.Time     `bson:"starttime" json:"startTime"`
+	EndTime    time.Time     `bson:"endtime" json:"endTime"`
+	Success    bool          `json:"success"`
+	Error      string        `json:"error,omitempty"`
+	Status     string        `json:"status,omitempty"`
+}
+
+// EventFilter restricts the events returned by ListEvents. Zero values match
+// everything.
+type EventFilter struct {
+	Instance   string
+	Plan       string
+	DockerHost string
+	Kind       string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+}
+
+func (f *EventFilter) query() bson.M {
+	query := bson.M{}
+	if f.Instance != "" {
+		query["instance"] = f.Instance
+	}
+	if f.Plan != "" {
+		query["plan"] = f.Plan
+	}
+	if f.DockerHost != "" {
+		query["dockerhost"] = f.DockerHost
+	}
+	if f.Kind != "" {
+		query["kind"] = f.Kind
+	}
+	timeRange := bson.M{}
+	if !f.Since.IsZero() {
+		timeRange["$gte"] = f.Since
+	}
+	if !f.Until.IsZero() {
+		timeRange["$lte"] = f.Until
+	}
+	if len(timeRange) > 0 {
+		query["starttime"] = timeRange
+	}
+	return query
+}
+
+func (f *EventFilter) match(e *Event) bool {
+	if f.Instance != "" && e.Instance != f.Instance {
+		return false
+	}
+	if f.Plan != "" && e.Plan != f.Plan {
+		return false
+	}
+	if f.DockerHost != "" && e.DockerHost != f.DockerHost {
+		return false
+	}
+	if f.Kind != "" && e.Kind != f.Kind {
+		return false
+	}
+	if !f.Since.IsZero() && e.StartTime.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.StartTime.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// newEvent starts an event of the given kind for the named instance, taking
+// the actor and the request ID from r.
+func newEvent(r *http.Request, kind, instance string) *Event {
+	return startEvent(r.Context(), kind, instance, actorFromRequest(r))
+}
+
+// startEvent starts an event of the given kind for the named instance.
+func startEvent(ctx context.Context, kind, instance, actor string) *Event {
+	return &Event{
+		ID:        bson.NewObjectId(),
+		Kind:      kind,
+		Instance:  instance,
+		Actor:     actor,
+		RequestID: requestIDFromContext(ctx),
+		StartTime: time.Now().UTC(),
+	}
+}
+
+// recordStatusChange records the change of the status of the instance,
+// which failed with cause when it isn't nil.
+func recordStatusChange(ctx context.Context, instance *Instance, status, actor string, cause error) {
+	evt := startEvent(ctx, EventStatusChange, instance.Name, actor)
+	evt.Plan = instance.Plan.Name
+	evt.DockerHost = instance.DockerHost
+	evt.Status = status
+	evt.Done(ctx, cause)
+}
+
+// actorFromRequest identifies who triggered the request: the tsuru user or
+// app when tsuru sends them, falling back to the API user.
+func actorFromRequest(r *http.Request) string {
+	if user := r.FormValue("user"); user != "" {
+		return user
+	}
+	if app := r.FormValue("app-name"); app != "" {
+		return "app:" + app
+	}
+	if user := requestUser(r); user != "" {
+		return user
+	}
+	if username, _, ok := r.BasicAuth(); ok {
+		return username
+	}
+	return ""
+}
+
+// Done stores the event with the outcome of the operation. Failures to store
+// the event are logged and don't affect the operation.
+func (e *Event) Done(ctx context.Context, err error) {
+	e.EndTime = time.Now().UTC()
+	e.Success = err == nil
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if err = storage.InsertEvent(e); err != nil {
+		loggerFromContext(ctx).Error("failed to store event", "event", e.Kind, "instance", e.Instance, "error", err)
+	}
+}
+
+// ListEvents returns the events matching the given filter, most recent first.
+func ListEvents(filter EventFilter) ([]Event, error) {
+	return storage.ListEvents(filter)
+}
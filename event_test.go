@@ -0,0 +1,72 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (*S) TestEventFilterQuery(c *check.C) {
+	since := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	filter := EventFilter{Instance: "mycache", Plan: "memcached", DockerHost: "tcp://localhost:2375", Since: since}
+	expected := bson.M{
+		"instance":   "mycache",
+		"plan":       "memcached",
+		"dockerhost": "tcp://localhost:2375",
+		"starttime":  bson.M{"$gte": since},
+	}
+	c.Assert(filter.query(), check.DeepEquals, expected)
+	c.Assert((&EventFilter{}).query(), check.DeepEquals, bson.M{})
+}
+
+func (*S) TestNewEvent(c *check.C) {
+	request, err := http.NewRequest("POST", "/resources/mycache/bind-app?app-name=myapp", nil)
+	c.Assert(err, check.IsNil)
+	request = request.WithContext(withRequestID(request.Context(), "req-1"))
+	evt := newEvent(request, EventBind, "mycache")
+	c.Assert(evt.Kind, check.Equals, EventBind)
+	c.Assert(evt.Instance, check.Equals, "mycache")
+	c.Assert(evt.Actor, check.Equals, "app:myapp")
+	c.Assert(evt.RequestID, check.Equals, "req-1")
+	c.Assert(evt.StartTime.IsZero(), check.Equals, false)
+}
+
+func (*S) TestActorFromRequest(c *check.C) {
+	request, err := http.NewRequest("POST", "/resources?user=someone@example.com", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(actorFromRequest(request), check.Equals, "someone@example.com")
+	request, err = http.NewRequest("DELETE", "/resources/mycache", nil)
+	c.Assert(err, check.IsNil)
+	request.SetBasicAuth("admin", "admin123")
+	c.Assert(actorFromRequest(request), check.Equals, "admin")
+}
+
+func (*S) TestEventDoneAndListEvents(c *check.C) {
+	request, err := http.NewRequest("DELETE", "/resources/mycache", nil)
+	c.Assert(err, check.IsNil)
+	evt := newEvent(request, EventRemove, "mycache")
+	evt.Plan = "memcached"
+	evt.Done(context.Background(), errors.New("something went wrong"))
+	other := newEvent(request, EventCreate, "othercache")
+	other.Done(context.Background(), nil)
+	events, err := ListEvents(EventFilter{Instance: "mycache"})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].Kind, check.Equals, EventRemove)
+	c.Assert(events[0].Plan, check.Equals, "memcached")
+	c.Assert(events[0].Success, check.Equals, false)
+	c.Assert(events[0].Error, check.Equals, "something went wrong")
+	events, err = ListEvents(EventFilter{})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 2)
+	c.Assert(events[0].Instance, check.Equals, "othercache")
+	c.Assert(events[0].Success, check.Equals, true)
+}
@@ -0,0 +1,256 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileStorage is an embedded storage for deployments that don't want to run
+// MongoDB. It keeps the data in memory and writes it through to a directory:
+// instances and hosts are saved to instances.json and hosts.json on every
+// change, and events are appended to events.jsonl, one per line. Files are
+// written before the change is applied in memory, so a failed write leaves
+// both unchanged.
+type fileStorage struct {
+	*memoryStorage
+	dir string
+
+	// writeMut serializes writes, so the files on disk always reflect the
+	// last change applied in memory.
+	writeMut sync.Mutex
+}
+
+// maxFileEvents is the number of events kept by the file storage. Older
+// events are dropped when the history grows 10% beyond it.
+var maxFileEvents = 10000
+
+func newFileStorage(dir string) (*fileStorage, error) {
+	if dir == "" {
+		return nil, errors.New("STORAGE_PATH is required for the file storage")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := fileStorage{memoryStorage: newMemoryStorage(), dir: dir}
+	if err := loadRecords(s.instancesPath(), s.instances); err != nil {
+		return nil, err
+	}
+	if err := loadRecords(s.hostsPath(), s.hosts); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.eventsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if f != nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			if line := scanner.Bytes(); len(line) > 0 {
+				s.events = append(s.events, append([]byte(nil), line...))
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if len(s.events) > maxFileEvents {
+		s.events = s.events[len(s.events)-maxFileEvents:]
+	}
+	return &s, nil
+}
+
+// loadRecords reads the JSON object in path into records, leaving records
+// empty when the file doesn't exist.
+func loadRecords(path string, records map[string][]byte) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	var values map[string]json.RawMessage
+	if err = json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	for key, value := range values {
+		records[key] = value
+	}
+	return nil
+}
+
+func (s *fileStorage) instancesPath() string {
+	return filepath.Join(s.dir, "instances.json")
+}
+
+func (s *fileStorage) hostsPath() string {
+	return filepath.Join(s.dir, "hosts.json")
+}
+
+func (s *fileStorage) eventsPath() string {
+	return filepath.Join(s.dir, "events.jsonl")
+}
+
+func (s *fileStorage) InsertInstance(instance *Instance) error {
+	s.writeMut.Lock()
+	defer s.writeMut.Unlock()
+	if s.hasRecord(s.instances, instance.Name) {
+		return ErrInstanceAlreadyExists
+	}
+	if err := s.saveRecord(s.instancesPath(), s.instances, instance.Name, instance); err != nil {
+		return err
+	}
+	return s.memoryStorage.InsertInstance(instance)
+}
+
+func (s *fileStorage) UpdateInstance(instance *Instance) error {
+	s.writeMut.Lock()
+	defer s.writeMut.Unlock()
+	s.mut.RLock()
+	revision, ok := recordRevision(s.instances, instance.Name)
+	s.mut.RUnlock()
+	if !ok {
+		return ErrInstanceNotFound
+	}
+	if revision != instance.Revision {
+		return ErrConflict
+	}
+	updated := *instance
+	updated.Revision++
+	if err := s.saveRecord(s.instancesPath(), s.instances, instance.Name, &updated); err != nil {
+		return err
+	}
+	return s.memoryStorage.UpdateInstance(instance)
+}
+
+func (s *fileStorage) DeleteInstance(name string) error {
+	s.writeMut.Lock()
+	defer s.writeMut.Unlock()
+	if !s.hasRecord(s.instances, name) {
+		return ErrInstanceNotFound
+	}
+	if err := s.saveRecord(s.instancesPath(), s.instances, name, nil); err != nil {
+		return err
+	}
+	return s.memoryStorage.DeleteInstance(name)
+}
+
+func (s *fileStorage) UpdateHost(host *HostState) error {
+	s.writeMut.Lock()
+	defer s.writeMut.Unlock()
+	s.mut.RLock()
+	revision, _ := recordRevision(s.hosts, host.Address)
+	s.mut.RUnlock()
+	if revision != host.Revision {
+		return ErrConflict
+	}
+	updated := *host
+	updated.Revision++
+	if err := s.saveRecord(s.hostsPath(), s.hosts, host.Address, &updated); err != nil {
+		return err
+	}
+	return s.memoryStorage.UpdateHost(host)
+}
+
+func (s *fileStorage) InsertEvent(evt *Event) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	s.writeMut.Lock()
+	defer s.writeMut.Unlock()
+	f, err := os.OpenFile(s.eventsPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = s.memoryStorage.InsertEvent(evt); err != nil {
+		return err
+	}
+	s.mut.RLock()
+	n := len(s.events)
+	s.mut.RUnlock()
+	if n > maxFileEvents+maxFileEvents/10 {
+		return s.compactEvents()
+	}
+	return nil
+}
+
+// compactEvents drops the oldest events, keeping the last maxFileEvents in
+// events.jsonl and in memory. The caller must hold writeMut.
+func (s *fileStorage) compactEvents() error {
+	s.mut.RLock()
+	events := s.events[len(s.events)-maxFileEvents:]
+	s.mut.RUnlock()
+	var buf bytes.Buffer
+	for _, data := range events {
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	tmp := s.eventsPath() + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.eventsPath()); err != nil {
+		return err
+	}
+	s.mut.Lock()
+	s.events = append([][]byte(nil), events...)
+	s.mut.Unlock()
+	return nil
+}
+
+func (s *fileStorage) hasRecord(records map[string][]byte, key string) bool {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	_, ok := records[key]
+	return ok
+}
+
+// saveRecord atomically replaces the file in path with the given records,
+// with the one identified by key replaced by value, or removed when value
+// is nil. It doesn't change records, which must be updated by the caller
+// once the file is written. The caller must hold writeMut.
+func (s *fileStorage) saveRecord(path string, records map[string][]byte, key string, value interface{}) error {
+	s.mut.RLock()
+	values := make(map[string]json.RawMessage, len(records)+1)
+	for k, data := range records {
+		values[k] = data
+	}
+	s.mut.RUnlock()
+	if value == nil {
+		delete(values, key)
+	} else {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		values[key] = data
+	}
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
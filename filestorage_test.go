@@ -0,0 +1,89 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (*S) TestFileStorage(c *check.C) {
+	s, err := newFileStorage(c.MkDir())
+	c.Assert(err, check.IsNil)
+	testStorage(c, s)
+}
+
+func (*S) TestFileStorageReload(c *check.C) {
+	dir := c.MkDir()
+	s, err := newFileStorage(dir)
+	c.Assert(err, check.IsNil)
+	err = s.InsertInstance(&Instance{Name: "mycache", ContainerID: "abc123"})
+	c.Assert(err, check.IsNil)
+	err = s.InsertInstance(&Instance{Name: "othercache"})
+	c.Assert(err, check.IsNil)
+	err = s.DeleteInstance("othercache")
+	c.Assert(err, check.IsNil)
+	err = s.InsertEvent(&Event{ID: bson.NewObjectId(), Kind: EventCreate, Instance: "mycache", StartTime: time.Now()})
+	c.Assert(err, check.IsNil)
+	err = s.UpdateHost(&HostState{Address: "tcp://10.0.0.1:2375", Cordoned: true})
+	c.Assert(err, check.IsNil)
+	s, err = newFileStorage(dir)
+	c.Assert(err, check.IsNil)
+	instances, _, err := s.ListInstances(InstanceFilter{})
+	c.Assert(err, check.IsNil)
+	c.Assert(instances, check.HasLen, 1)
+	c.Assert(instances[0].Name, check.Equals, "mycache")
+	c.Assert(instances[0].ContainerID, check.Equals, "abc123")
+	events, err := s.ListEvents(EventFilter{})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].Instance, check.Equals, "mycache")
+	hosts, err := s.ListHosts()
+	c.Assert(err, check.IsNil)
+	c.Assert(hosts, check.DeepEquals, []HostState{{Address: "tcp://10.0.0.1:2375", Revision: 1, Cordoned: true}})
+}
+
+func (*S) TestFileStorageWriteFailure(c *check.C) {
+	dir := c.MkDir()
+	s, err := newFileStorage(dir)
+	c.Assert(err, check.IsNil)
+	err = os.Mkdir(filepath.Join(dir, "instances.json.tmp"), 0700)
+	c.Assert(err, check.IsNil)
+	err = s.InsertInstance(&Instance{Name: "mycache"})
+	c.Assert(err, check.NotNil)
+	_, err = s.GetInstance("mycache")
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
+}
+
+func (*S) TestFileStorageCompactEvents(c *check.C) {
+	defer func(n int) { maxFileEvents = n }(maxFileEvents)
+	maxFileEvents = 10
+	dir := c.MkDir()
+	s, err := newFileStorage(dir)
+	c.Assert(err, check.IsNil)
+	start := time.Now()
+	for i := 0; i < 12; i++ {
+		err = s.InsertEvent(&Event{ID: bson.NewObjectId(), Kind: EventCreate, Instance: "mycache", StartTime: start.Add(time.Duration(i) * time.Second)})
+		c.Assert(err, check.IsNil)
+	}
+	events, err := s.ListEvents(EventFilter{})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 10)
+	c.Assert(events[9].StartTime.Equal(start.Add(2*time.Second)), check.Equals, true)
+	s, err = newFileStorage(dir)
+	c.Assert(err, check.IsNil)
+	events, err = s.ListEvents(EventFilter{})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 10)
+}
+
+func (*S) TestFileStorageNoPath(c *check.C) {
+	_, err := newFileStorage("")
+	c.Assert(err, check.ErrorMatches, "STORAGE_PATH is required for the file storage")
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Health states reported by Docker for containers with a health check.
+// Containers without a health check have no health state.
+const (
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+const healthActor = "diaats-health-monitor"
+
+// Healthcheck configures the Docker health check of the containers of a
+// plan. When Test is empty, the HEALTHCHECK defined by the image is used;
+// otherwise, it's overridden by Test, in the format used by the Docker API
+// (for example, ["CMD-SHELL", "curl -f http://localhost:9200"]).
+type Healthcheck struct {
+	Test     []string `json:"test,omitempty"`
+	Interval string   `json:"interval,omitempty"`
+	Timeout  string   `json:"timeout,omitempty"`
+	Retries  int      `json:"retries,omitempty"`
+
+	// RestartAfter is how long a container may stay unhealthy before it's
+	// restarted, as accepted by time.ParseDuration. Containers aren't
+	// restarted when it's empty.
+	RestartAfter string `json:"restartAfter,omitempty"`
+}
+
+func (h *Healthcheck) validate() error {
+	for _, d := range []struct{ name, value string }{
+		{"interval", h.Interval},
+		{"timeout", h.Timeout},
+		{"restartAfter", h.RestartAfter},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v <= 0 {
+			return fmt.Errorf("invalid healthcheck %s %q", d.name, d.value)
+		}
+	}
+	if h.Retries < 0 {
+		return fmt.Errorf("invalid healthcheck retries %d", h.Retries)
+	}
+	return nil
+}
+
+func (h *Healthcheck) restartAfter() time.Duration {
+	d, _ := time.ParseDuration(h.RestartAfter)
+	return d
+}
+
+// healthConfig is the health check in the format of the Docker API.
+type healthConfig struct {
+	Test     []string `json:",omitempty"`
+	Interval int64    `json:",omitempty"`
+	Timeout  int64    `json:",omitempty"`
+	Retries  int      `json:",omitempty"`
+}
+
+func (h *Healthcheck) apiConfig() *healthConfig {
+	interval, _ := time.ParseDuration(h.Interval)
+	timeout, _ := time.ParseDuration(h.Timeout)
+	return &healthConfig{Test: h.Test, Interval: int64(interval), Timeout: int64(timeout), Retries: h.Retries}
+}
+
+// createContainerWithHealthcheck creates a container like
+// docker.Client.CreateContainer, also setting its health check.
+func createContainerWithHealthcheck(ctx context.Context, client *docker.Client, opts docker.CreateContainerOptions, health *healthConfig) (*docker.Container, error) {
+	body := struct {
+		*docker.Config
+		HostConfig  *docker.HostConfig `json:",omitempty"`
+		Healthcheck *healthConfig      `json:",omitempty"`
+	}{opts.Config, opts.HostConfig, health}
+	var result struct{ ID string }
+	err := dockerRequest(ctx, client, http.MethodPost, "/containers/create?name="+url.QueryEscape(opts.Name), body, &result)
+	if e, ok := err.(*docker.Error); ok && e.Status == http.StatusConflict {
+		return nil, docker.ErrContainerAlreadyExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &docker.Container{ID: result.ID}, nil
+}
+
+// containerHealth returns the health state of the given container, or an
+// empty string if it has no health check.
+func containerHealth(ctx context.Context, client *docker.Client, id string) (string, error) {
+	var container struct {
+		State struct {
+			Health *struct{ Status string }
+		}
+	}
+	err := dockerRequest(ctx, client, http.MethodGet, "/containers/"+url.PathEscape(id)+"/json", nil, &container)
+	if e, ok := err.(*docker.Error); ok && e.Status == http.StatusNotFound {
+		return "", &docker.NoSuchContainer{ID: id}
+	}
+	if err != nil || container.State.Health == nil {
+		return "", err
+	}
+	return container.State.Health.Status, nil
+}
+
+// instanceHealth returns the health state of the container of the instance,
+// or of its services.
+func instanceHealth(ctx context.Context, instance *Instance) (string, error) {
+	if instance.isService() {
+		return serviceInstanceHealth(ctx, instance)
+	}
+	client, err := dockerClient(instance.DockerHost)
+	if err != nil {
+		return "", err
+	}
+	return containerHealth(ctx, client, instance.ContainerID)
+}
+
+// healthMonitor restarts the containers of instances that stay unhealthy
+// longer than the RestartAfter setting of their plans. The time an instance
+// became unhealthy is kept in its record, so that any replica may carry on
+// the monitoring of another.
+type healthMonitor struct{}
+
+func newHealthMonitor() *healthMonitor {
+	return &healthMonitor{}
+}
+
+// run checks the instances every interval until ctx is canceled.
+func (m *healthMonitor) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.check(ctx, time.Now())
+		}
+	}
+}
+
+// check restarts the containers that have been unhealthy since before now
+// minus the RestartAfter setting of their plans. Instances being checked by
+// another replica are skipped.
+func (m *healthMonitor) check(ctx context.Context, now time.Time) {
+	log := loggerFromContext(ctx)
+	instances, _, err := storage.ListInstances(InstanceFilter{State: StateRunning})
+	if err != nil {
+		log.Error("failed to list instances for health monitoring", "error", err)
+		return
+	}
+	for i := range instances {
+		instance := &instances[i]
+		release, ok := claimWork(ctx, "health-"+instance.Name)
+		if !ok {
+			continue
+		}
+		m.checkInstance(ctx, instance, now)
+		release()
+	}
+}
+
+func (m *healthMonitor) checkInstance(ctx context.Context, instance *Instance, now time.Time) {
+	log := loggerFromContext(ctx)
+	hc := instance.Plan.Healthcheck
+	if hc == nil || hc.restartAfter() == 0 || instance.isService() {
+		if !instance.UnhealthySince.IsZero() {
+			m.setUnhealthySince(ctx, instance.Name, time.Time{})
+		}
+		return
+	}
+	health, err := instanceHealth(ctx, instance)
+	if err != nil {
+		log.Error("failed to get container health", "instance", instance.Name, "error", err)
+		return
+	}
+	since := instance.UnhealthySince
+	if health != HealthUnhealthy {
+		if !since.IsZero() && m.setUnhealthySince(ctx, instance.Name, time.Time{}) {
+			recordStatusChange(ctx, instance, StatusHealthy, healthActor, nil)
+		}
+		return
+	}
+	if since.IsZero() {
+		if m.setUnhealthySince(ctx, instance.Name, now) {
+			recordStatusChange(ctx, instance, StatusUnhealthy, healthActor, nil)
+		}
+		return
+	}
+	if now.Sub(since) < hc.restartAfter() {
+		return
+	}
+	if m.setUnhealthySince(ctx, instance.Name, time.Time{}) {
+		m.restart(ctx, instance)
+	}
+}
+
+// setUnhealthySince saves the time the instance became unhealthy, returning
+// whether it was saved.
+func (m *healthMonitor) setUnhealthySince(ctx context.Context, name string, since time.Time) bool {
+	var changed bool
+	_, err := modifyInstance(name, func(instance *Instance) error {
+		changed = !instance.UnhealthySince.Equal(since)
+		if !changed {
+			return errNoChange
+		}
+		instance.UnhealthySince = since
+		return nil
+	})
+	if err != nil {
+		loggerFromContext(ctx).Error("failed to save instance health", "instance", name, "error", err)
+		return false
+	}
+	return changed
+}
+
+func (m *healthMonitor) restart(ctx context.Context, instance *Instance) {
+	evt := startEvent(ctx, EventRestart, instance.Name, healthActor)
+	evt.Plan = instance.Plan.Name
+	evt.DockerHost = instance.DockerHost
+	client, err := dockerClient(instance.DockerHost)
+	if err == nil {
+		err = client.RestartContainer(instance.ContainerID, 10)
+	}
+	if err != nil {
+		loggerFromContext(ctx).Error("failed to restart unhealthy container", "instance", instance.Name, "container", instance.ContainerID, "error", err)
+	} else {
+		loggerFromContext(ctx).Warn("restarted unhealthy container", "instance", instance.Name, "container", instance.ContainerID)
+	}
+	evt.Done(ctx, err)
+}
@@ -0,0 +1,159 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// setContainerHealth makes the fake Docker server report the given health
+// state when inspecting containers.
+func (s *S) setContainerHealth(status string) {
+	s.server.CustomHandler("/containers/.+/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := httptest.NewRecorder()
+		s.server.DefaultHandler().ServeHTTP(recorder, r)
+		var container map[string]interface{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &container); err != nil {
+			w.WriteHeader(recorder.Code)
+			w.Write(recorder.Body.Bytes())
+			return
+		}
+		state, _ := container["State"].(map[string]interface{})
+		state["Health"] = map[string]interface{}{"Status": status}
+		json.NewEncoder(w).Encode(container)
+	}))
+}
+
+func (*S) TestHealthcheckValidate(c *check.C) {
+	hc := Healthcheck{Test: []string{"CMD", "true"}, Interval: "10s", Timeout: "2s", Retries: 3, RestartAfter: "5m"}
+	c.Assert(hc.validate(), check.IsNil)
+	hc = Healthcheck{Interval: "often"}
+	c.Assert(hc.validate(), check.ErrorMatches, `invalid healthcheck interval "often"`)
+	hc = Healthcheck{Retries: -1}
+	c.Assert(hc.validate(), check.ErrorMatches, "invalid healthcheck retries -1")
+}
+
+func (s *S) TestCreateInstanceOverridesHealthcheck(c *check.C) {
+	var body map[string]interface{}
+	s.server.CustomHandler("/containers/create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &body)
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		s.server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	s.createInstanceWithPlan(c, "mycache", Plan{Name: "supermemcached", Image: "memcached", Healthcheck: &Healthcheck{Test: []string{"CMD", "true"}, Interval: "10s", Retries: 3}})
+	defer DestroyInstance(context.Background(), "mycache")
+	c.Assert(body["Image"], check.Equals, "memcached")
+	c.Assert(body["Healthcheck"], check.DeepEquals, map[string]interface{}{
+		"Test":     []interface{}{"CMD", "true"},
+		"Interval": float64(10 * time.Second),
+		"Retries":  float64(3),
+	})
+	instance, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.State, check.Equals, StateRunning)
+}
+
+func (s *S) TestInstanceStatusHandlerHealth(c *check.C) {
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	var tests = []struct {
+		health string
+		code   int
+	}{
+		{HealthStarting, http.StatusAccepted},
+		{HealthHealthy, http.StatusNoContent},
+		{HealthUnhealthy, http.StatusInternalServerError},
+	}
+	for _, t := range tests {
+		s.setContainerHealth(t.health)
+		request, err := http.NewRequest("GET", "/resources/mycache/status", nil)
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		buildMuxer().ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, t.code, check.Commentf("health %s", t.health))
+	}
+}
+
+func (s *S) TestHealthMonitorRestartsUnhealthyContainers(c *check.C) {
+	s.createInstanceWithPlan(c, "mycache", Plan{Name: "supermemcached", Image: "memcached", Healthcheck: &Healthcheck{RestartAfter: "1m"}})
+	defer DestroyInstance(context.Background(), "mycache")
+	instance, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	var restarts int
+	s.server.CustomHandler("/containers/"+instance.ContainerID+"/restart", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		restarts++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	s.setContainerHealth(HealthUnhealthy)
+	now := time.Now()
+	newHealthMonitor().check(context.Background(), now)
+	instance, err = GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.UnhealthySince.Equal(now), check.Equals, true)
+	newHealthMonitor().check(context.Background(), now.Add(30*time.Second))
+	c.Assert(restarts, check.Equals, 0)
+	newHealthMonitor().check(context.Background(), now.Add(time.Minute))
+	c.Assert(restarts, check.Equals, 1)
+	instance, err = GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.UnhealthySince.IsZero(), check.Equals, true)
+	events, err := ListEvents(EventFilter{Kind: EventRestart})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].Instance, check.Equals, "mycache")
+	c.Assert(events[0].Actor, check.Equals, healthActor)
+	c.Assert(events[0].Success, check.Equals, true)
+}
+
+func (s *S) TestHealthMonitorForgetsRecoveredContainers(c *check.C) {
+	s.createInstanceWithPlan(c, "mycache", Plan{Name: "supermemcached", Image: "memcached", Healthcheck: &Healthcheck{RestartAfter: "1m"}})
+	defer DestroyInstance(context.Background(), "mycache")
+	monitor := newHealthMonitor()
+	now := time.Now()
+	s.setContainerHealth(HealthUnhealthy)
+	monitor.check(context.Background(), now)
+	s.setContainerHealth(HealthHealthy)
+	monitor.check(context.Background(), now.Add(30*time.Second))
+	s.setContainerHealth(HealthUnhealthy)
+	monitor.check(context.Background(), now.Add(time.Minute))
+	events, err := ListEvents(EventFilter{Kind: EventRestart})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 0)
+	events, err = ListEvents(EventFilter{Kind: EventStatusChange})
+	c.Assert(err, check.IsNil)
+	var statuses []string
+	for _, evt := range events {
+		statuses = append(statuses, evt.Status)
+	}
+	c.Assert(statuses, check.DeepEquals, []string{StatusUnhealthy, StatusHealthy, StatusUnhealthy, StateRunning})
+}
+
+func (s *S) TestHealthMonitorClaimedElsewhere(c *check.C) {
+	s.createInstanceWithPlan(c, "mycache", Plan{Name: "supermemcached", Image: "memcached", Healthcheck: &Healthcheck{RestartAfter: "1m"}})
+	defer DestroyInstance(context.Background(), "mycache")
+	s.setContainerHealth(HealthUnhealthy)
+	ok, err := storage.AcquireLease("health-mycache", "other-process", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, true)
+	newHealthMonitor().check(context.Background(), time.Now())
+	instance, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.UnhealthySince.IsZero(), check.Equals, true)
+	err = storage.ReleaseLease("health-mycache", "other-process")
+	c.Assert(err, check.IsNil)
+	newHealthMonitor().check(context.Background(), time.Now())
+	instance, err = GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.UnhealthySince.IsZero(), check.Equals, false)
+}
@@ -0,0 +1,413 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+)
+
+var (
+	ErrHostNotFound       = errors.New("Docker host not found")
+	ErrNoHostAvailable    = errors.New("no Docker host available for new instances")
+	ErrSourceHostCordoned = errors.New("the Docker host of the source instance is cordoned")
+)
+
+// HostState is the scheduling state of a Docker host. Hosts without a
+// stored state accept new instances.
+type HostState struct {
+	Address  string `json:"address"`
+	Revision int    `json:"revision"`
+
+	// Cordoned hosts don't get new instances.
+	Cordoned bool `json:"cordoned"`
+
+	// Drain is the current or the last drain of the host.
+	Drain *Drain `json:"drain,omitempty"`
+}
+
+// HostInfo describes a configured Docker host, as returned by ListHosts.
+type HostInfo struct {
+	HostState
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Instances int               `json:"instances"`
+	Capacity  *HostCapacity     `json:"capacity"`
+}
+
+// name returns the name of the host used in the API: the name given in the
+// configuration, or the host and port of its address.
+func (h *DockerHost) name() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	if url_, err := url.Parse(h.Address); err == nil && url_.Host != "" {
+		return url_.Host
+	}
+	return h.Address
+}
+
+// dockerHosts returns the configured Docker hosts, falling back to
+// DOCKER_HOST.
+func dockerHosts() []DockerHost {
+	if len(config.DockerHosts) == 0 {
+		return []DockerHost{{Address: config.DockerHost}}
+	}
+	return config.DockerHosts
+}
+
+// findHostByName returns the configured Docker host with the given name.
+func findHostByName(name string) (*DockerHost, error) {
+	hosts := dockerHosts()
+	for i := range hosts {
+		if hosts[i].name() == name {
+			return &hosts[i], nil
+		}
+	}
+	return nil, ErrHostNotFound
+}
+
+// hostStates returns the stored states of the Docker hosts by address.
+func hostStates() (map[string]*HostState, error) {
+	hosts, err := storage.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]*HostState, len(hosts))
+	for i := range hosts {
+		states[hosts[i].Address] = &hosts[i]
+	}
+	return states, nil
+}
+
+// getHostState returns the state of the Docker host at address.
+func getHostState(address string) (*HostState, error) {
+	states, err := hostStates()
+	if err != nil {
+		return nil, err
+	}
+	if state, ok := states[address]; ok {
+		return state, nil
+	}
+	return &HostState{Address: address}, nil
+}
+
+// modifyHost applies fn to the state of the Docker host at address and
+// saves it, unless fn fails or returns errNoChange. Like modifyInstance, fn
+// is applied again when the state changes in the meantime.
+func modifyHost(address string, fn func(host *HostState) error) (*HostState, error) {
+	for attempt := 1; ; attempt++ {
+		host, err := getHostState(address)
+		if err != nil {
+			return nil, err
+		}
+		if err = fn(host); err == errNoChange {
+			return host, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = storage.UpdateHost(host)
+		if err == ErrConflict && attempt < maxModifyAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return host, nil
+	}
+}
+
+// ListHosts returns the configured Docker hosts, with their states, number
+// of instances and capacity.
+func ListHosts(ctx context.Context) ([]HostInfo, error) {
+	states, err := hostStates()
+	if err != nil {
+		return nil, err
+	}
+	hosts := dockerHosts()
+	result := make([]HostInfo, len(hosts))
+	for i := range hosts {
+		info, err := hostInfo(ctx, &hosts[i], states[hosts[i].Address])
+		if err != nil {
+			return nil, err
+		}
+		result[i] = *info
+	}
+	return result, nil
+}
+
+// GetHost returns the configured Docker host with the given name.
+func GetHost(ctx context.Context, name string) (*HostInfo, error) {
+	host, err := findHostByName(name)
+	if err != nil {
+		return nil, err
+	}
+	state, err := getHostState(host.Address)
+	if err != nil {
+		return nil, err
+	}
+	return hostInfo(ctx, host, state)
+}
+
+func hostInfo(ctx context.Context, host *DockerHost, state *HostState) (*HostInfo, error) {
+	info := HostInfo{HostState: HostState{Address: host.Address}, Name: host.name(), Labels: host.Labels}
+	if state != nil {
+		info.HostState = *state
+	}
+	_, count, err := storage.ListInstances(InstanceFilter{DockerHost: host.Address, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	info.Instances = count
+	if info.Capacity, err = hostCapacity(ctx, host); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// CordonHost stops scheduling new instances to the Docker host with the
+// given name. Instances already in the host keep running.
+func CordonHost(ctx context.Context, name string) error {
+	return setCordoned(ctx, name, true)
+}
+
+// UncordonHost allows new instances in the Docker host with the given name
+// again. Hosts can't be uncordoned while they're drained.
+func UncordonHost(ctx context.Context, name string) error {
+	return setCordoned(ctx, name, false)
+}
+
+func setCordoned(ctx context.Context, name string, cordoned bool) error {
+	host, err := findHostByName(name)
+	if err != nil {
+		return err
+	}
+	_, err = modifyHost(host.Address, func(state *HostState) error {
+		if !cordoned && state.Drain.running() {
+			return ErrDrainInProgress
+		}
+		if state.Cordoned == cordoned {
+			return errNoChange
+		}
+		state.Cordoned = cordoned
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	loggerFromContext(ctx).Info("host scheduling changed", "docker_host", host.Address, "cordoned", cordoned)
+	return nil
+}
+
+// chooseHost returns the address of the Docker host for a new instance of
+// the plan, owned by team: among the uncordoned hosts matching the placement
+// constraints of the plan with room for the instance, the one with the best
+// score, as ranked by scoreHost, in the order of the configuration when
+// there's a tie. Hosts whose memory is unknown are only chosen when no host
+// with known memory has room. The memory of the instance is reserved in the
+// host until the returned function is called.
+func chooseHost(ctx context.Context, plan *Plan, team string) (string, func(), error) {
+	// The memory of the hosts is looked up before locking, as it may call
+	// the Docker API of each host.
+	hosts := dockerHosts()
+	memories := make([]int64, len(hosts))
+	for i := range hosts {
+		memories[i] = hostMemory(ctx, &hosts[i])
+	}
+	placementMut.Lock()
+	defer placementMut.Unlock()
+	states, err := hostStates()
+	if err != nil {
+		return "", nil, err
+	}
+	memory := plan.memory()
+	var best string
+	var bestScore hostScore
+	var bestKnown, matched, full bool
+	for i := range hosts {
+		host := &hosts[i]
+		if state := states[host.Address]; state != nil && state.Cordoned {
+			continue
+		}
+		if !plan.Placement.matches(host) {
+			continue
+		}
+		matched = true
+		capacity, err := hostCapacityWithMemory(host, memories[i])
+		if err != nil {
+			return "", nil, err
+		}
+		if !capacity.fits(memory) {
+			full = true
+			continue
+		}
+		known := capacity.Memory > 0
+		if bestKnown && !known {
+			continue
+		}
+		score, err := scoreHost(host.Address, plan, team)
+		if err != nil {
+			return "", nil, err
+		}
+		if best == "" || known && !bestKnown || score.less(bestScore) {
+			best, bestScore, bestKnown = host.Address, score, known
+		}
+	}
+	switch {
+	case best != "":
+		return best, reserveMemory(best, memory), nil
+	case full:
+		return "", nil, ErrInsufficientCapacity
+	case !matched && plan.Placement != nil && len(plan.Placement.Constraints) > 0:
+		return "", nil, ErrNoMatchingHost
+	}
+	return "", nil, ErrNoHostAvailable
+}
+
+// placeInstance returns the address of the Docker host for a new instance
+// of the plan, as chooseHost does. Clones are placed in the host of their
+// source, where the images of its snapshots are.
+func placeInstance(ctx context.Context, plan *Plan, opts CreateOptions) (string, func(), error) {
+	if opts.Source == "" {
+		return chooseHost(ctx, plan, opts.Team)
+	}
+	name, _ := splitSource(opts.Source)
+	source, err := storage.GetInstance(name)
+	if err == ErrInstanceNotFound {
+		// Creating the instance fails when the source is resolved.
+		return chooseHost(ctx, plan, opts.Team)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	host := findDockerHost(source.DockerHost)
+	total := hostMemory(ctx, host)
+	placementMut.Lock()
+	defer placementMut.Unlock()
+	state, err := getHostState(source.DockerHost)
+	if err != nil {
+		return "", nil, err
+	}
+	if state.Cordoned {
+		return "", nil, ErrSourceHostCordoned
+	}
+	if !plan.Placement.matches(host) {
+		return "", nil, ErrSourceHostConstraints
+	}
+	memory := plan.memory()
+	capacity, err := hostCapacityWithMemory(host, total)
+	if err != nil {
+		return "", nil, err
+	}
+	if !capacity.fits(memory) {
+		return "", nil, ErrInsufficientCapacity
+	}
+	return source.DockerHost, reserveMemory(source.DockerHost, memory), nil
+}
+
+// spreadContainers returns the addresses of the Docker hosts for the
+// containers of a new instance of a plan whose containers are spread across
+// hosts, in the order of its container specs. Each container goes to the
+// eligible host, as in chooseHost, with the fewest containers of the same
+// member of the instance, then with the fewest containers of the instance,
+// then ranked like chooseHost does. Containers share hosts when there are
+// fewer hosts than replicas.
+func spreadContainers(ctx context.Context, plan *Plan, team string) ([]string, func(), error) {
+	hosts := dockerHosts()
+	memories := make([]int64, len(hosts))
+	for i := range hosts {
+		memories[i] = hostMemory(ctx, &hosts[i])
+	}
+	placementMut.Lock()
+	defer placementMut.Unlock()
+	states, err := hostStates()
+	if err != nil {
+		return nil, nil, err
+	}
+	type candidate struct {
+		address  string
+		capacity *HostCapacity
+		score    hostScore
+	}
+	var candidates []candidate
+	for i := range hosts {
+		host := &hosts[i]
+		if state := states[host.Address]; state != nil && state.Cordoned {
+			continue
+		}
+		if !plan.Placement.matches(host) {
+			continue
+		}
+		capacity, err := hostCapacityWithMemory(host, memories[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		score, err := scoreHost(host.Address, plan, team)
+		if err != nil {
+			return nil, nil, err
+		}
+		candidates = append(candidates, candidate{address: host.Address, capacity: capacity, score: score})
+	}
+	if len(candidates) == 0 {
+		if len(plan.Placement.Constraints) > 0 {
+			return nil, nil, ErrNoMatchingHost
+		}
+		return nil, nil, ErrNoHostAvailable
+	}
+	specs := plan.containerSpecs("")
+	result := make([]string, len(specs))
+	reserved := make(map[string]int64)
+	containers := make(map[string]int)
+	members := make(map[[2]string]int)
+	for n, spec := range specs {
+		memory := spec.member.memoryLimit()
+		best := -1
+		var bestScore [2]int
+		var bestKnown bool
+		for k, c := range candidates {
+			if !c.capacity.fits(reserved[c.address] + memory) {
+				continue
+			}
+			known := c.capacity.Memory > 0
+			if bestKnown && !known {
+				continue
+			}
+			score := [2]int{members[[2]string{c.address, spec.member.Name}], containers[c.address]}
+			switch {
+			case best < 0, known && !bestKnown:
+			case score[0] != bestScore[0]:
+				if score[0] > bestScore[0] {
+					continue
+				}
+			case score[1] != bestScore[1]:
+				if score[1] > bestScore[1] {
+					continue
+				}
+			case !c.score.less(candidates[best].score):
+				continue
+			}
+			best, bestScore, bestKnown = k, score, known
+		}
+		if best < 0 {
+			return nil, nil, ErrInsufficientCapacity
+		}
+		address := candidates[best].address
+		result[n] = address
+		reserved[address] += memory
+		containers[address]++
+		members[[2]string{address, spec.member.Name}]++
+	}
+	releases := make([]func(), 0, len(reserved))
+	for address, memory := range reserved {
+		releases = append(releases, reserveMemory(address, memory))
+	}
+	return result, func() {
+		for _, release := range releases {
+			release()
+		}
+	}, nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/fsouza/go-dockerclient"
+	dtesting "github.com/fsouza/go-dockerclient/testing"
+	"gopkg.in/check.v1"
+)
+
+// addDockerHost starts another fake Docker host, configured after the
+// default one, with the image of the test plan.
+func (s *S) addDockerHost(c *check.C) *dtesting.DockerServer {
+	server, err := dtesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	client, err := docker.NewClient(server.URL())
+	c.Assert(err, check.IsNil)
+	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
+	c.Assert(err, check.IsNil)
+	config.DockerHosts = append(dockerHosts(), DockerHost{Address: server.URL()})
+	return server
+}
+
+func (*S) TestDockerHostName(c *check.C) {
+	var tests = []struct {
+		host DockerHost
+		name string
+	}{
+		{DockerHost{Address: "tcp://10.0.0.1:2376"}, "10.0.0.1:2376"},
+		{DockerHost{Address: "tcp://10.0.0.1:2376", Name: "docker1"}, "docker1"},
+		{DockerHost{Address: "unix:///var/run/docker.sock"}, "unix:///var/run/docker.sock"},
+	}
+	for _, t := range tests {
+		c.Check(t.host.name(), check.Equals, t.name)
+	}
+}
+
+func (s *S) TestChooseHost(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	s.createTestInstance(c, "first")
+	defer DestroyInstance(context.Background(), "first")
+	s.createTestInstance(c, "second")
+	defer DestroyInstance(context.Background(), "second")
+	first, err := GetInstance(context.Background(), "first")
+	c.Assert(err, check.IsNil)
+	c.Assert(first.DockerHost, check.Equals, config.DockerHost)
+	second, err := GetInstance(context.Background(), "second")
+	c.Assert(err, check.IsNil)
+	c.Assert(second.DockerHost, check.Equals, other.URL())
+	err = CordonHost(context.Background(), config.DockerHosts[1].name())
+	c.Assert(err, check.IsNil)
+	host, release, err := chooseHost(context.Background(), &config.Plans[0], "")
+	c.Assert(err, check.IsNil)
+	release()
+	c.Assert(host, check.Equals, config.DockerHost)
+	err = CordonHost(context.Background(), config.DockerHosts[0].name())
+	c.Assert(err, check.IsNil)
+	err = CreateInstance(context.Background(), "third", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.Equals, ErrNoHostAvailable)
+	err = UncordonHost(context.Background(), config.DockerHosts[0].name())
+	c.Assert(err, check.IsNil)
+	host, release, err = chooseHost(context.Background(), &config.Plans[0], "")
+	c.Assert(err, check.IsNil)
+	release()
+	c.Assert(host, check.Equals, config.DockerHost)
+}
+
+func (s *S) TestCreateInstanceFromSourcePlacement(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	err := CreateInstance(context.Background(), "mycopy", &config.Plans[0], CreateOptions{Source: "mycache"})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycopy")
+	clone, err := GetInstance(context.Background(), "mycopy")
+	c.Assert(err, check.IsNil)
+	c.Assert(clone.DockerHost, check.Equals, config.DockerHost)
+	err = CordonHost(context.Background(), config.DockerHosts[0].name())
+	c.Assert(err, check.IsNil)
+	err = CreateInstance(context.Background(), "othercopy", &config.Plans[0], CreateOptions{Source: "mycache"})
+	c.Assert(err, check.Equals, ErrSourceHostCordoned)
+}
+
+func (s *S) TestCordonUnknownHost(c *check.C) {
+	err := CordonHost(context.Background(), "10.0.0.1:2375")
+	c.Assert(err, check.Equals, ErrHostNotFound)
+}
+
+func (s *S) TestHostHandlers(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	name := config.DockerHosts[0].name()
+	handler := buildMuxer()
+	request, err := http.NewRequest("POST", "/admin/hosts/"+name+"/cordon", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNoContent)
+	request, err = http.NewRequest("GET", "/admin/hosts", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var hosts []HostInfo
+	err = json.NewDecoder(recorder.Body).Decode(&hosts)
+	c.Assert(err, check.IsNil)
+	c.Assert(hosts, check.HasLen, 2)
+	c.Assert(hosts[0].Name, check.Equals, name)
+	c.Assert(hosts[0].Cordoned, check.Equals, true)
+	c.Assert(hosts[0].Instances, check.Equals, 1)
+	c.Assert(hosts[1].Cordoned, check.Equals, false)
+	c.Assert(hosts[1].Instances, check.Equals, 0)
+	request, err = http.NewRequest("DELETE", "/admin/hosts/"+name+"/cordon", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNoContent)
+	request, err = http.NewRequest("GET", "/admin/hosts/"+name, nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var host HostInfo
+	err = json.NewDecoder(recorder.Body).Decode(&host)
+	c.Assert(err, check.IsNil)
+	c.Assert(host.Address, check.Equals, config.DockerHost)
+	c.Assert(host.Cordoned, check.Equals, false)
+	events, err := ListEvents(EventFilter{DockerHost: config.DockerHost, Kind: EventCordon})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 1)
+	request, err = http.NewRequest("POST", "/admin/hosts/unknown/cordon", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
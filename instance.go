@@ -5,43 +5,248 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
 var (
 	ErrInstanceAlreadyExists = errors.New("instance already exists")
 	ErrInstanceNotFound      = errors.New("instance not found")
+	ErrInstanceCreating      = errors.New("instance is being created")
+
+	// ErrConflict is returned by the storage when a record was changed
+	// since it was read.
+	ErrConflict = errors.New("record changed concurrently")
+)
+
+// States of an instance.
+const (
+	StateCreating = "creating"
+	StateRunning  = "running"
 )
 
 type Instance struct {
-	Name        string
-	DockerHost  string
-	ContainerID string
-	HostPorts   []string
-	Envs        []string
-	Plan        Plan
+	// ID identifies the instance uniquely, unlike its name, which may be
+	// reused after the instance is removed. Instances created before IDs
+	// were introduced have none.
+	ID           string
+	Name         string
+	Revision     int
+	DockerHost   string
+	ContainerID  string
+	Containers   []InstanceContainer
+	Network      string
+	NetworkScope string
+	HostPorts    []string
+	Ports        []InstancePort
+	Envs         []string
+	Plan         Plan
+	Team         string
+	State        string
+	CreatedAt    time.Time
+
+	// Provisioner is the provisioner that created the instance, and
+	// Services are the Swarm services of instances created by the swarm
+	// provisioner, which have no containers.
+	Provisioner string
+	Services    []InstanceService
+
+	// Source is the instance the instance was cloned from, as given to
+	// resolveSource.
+	Source    string
+	Snapshots []Snapshot
+
+	// Images are the images run by the containers of the instance.
+	Images []InstanceImage
+
+	// MaintenanceWindow is when disruptive operations may run on the
+	// instance, as accepted by parseWindow, and Operations are the ones
+	// waiting for it.
+	MaintenanceWindow string
+	Operations        []Operation
+
+	// UnhealthySince is when the health monitor first saw the instance
+	// unhealthy, or zero if it's healthy.
+	UnhealthySince time.Time
 }
 
-// Endpoints returns a list of endpoints to this instance.
-func (i *Instance) Endpoints() []string {
-	url_, err := url.Parse(i.DockerHost)
+// CreateOptions holds the optional settings of a new instance.
+type CreateOptions struct {
+	// Team is the tsuru team that owns the instance.
+	Team string
+
+	// Source is the instance or snapshot the new instance is cloned from,
+	// as accepted by resolveSource.
+	Source string
+
+	// MaintenanceWindow is when disruptive operations may run on the
+	// instance, as accepted by parseWindow.
+	MaintenanceWindow string
+}
+
+// instanceSortFields maps the fields accepted by InstanceFilter.Sort to
+// their names in the storage.
+var instanceSortFields = map[string]string{
+	"name":       "name",
+	"plan":       "plan.name",
+	"dockerHost": "dockerhost",
+	"state":      "state",
+	"team":       "team",
+	"createdAt":  "createdat",
+}
+
+// InstanceFilter restricts and paginates the instances returned by
+// ListInstances. Zero values match everything. DockerHost matches the
+// instances with any container in the host.
+type InstanceFilter struct {
+	Plan         string
+	DockerHost   string
+	State        string
+	Team         string
+	CreatedSince time.Time
+	CreatedUntil time.Time
+
+	// Sort is one of the keys of instanceSortFields, optionally prefixed
+	// by "-" for descending order. Defaults to "name".
+	Sort   string
+	Offset int
+	Limit  int
+}
+
+func (f *InstanceFilter) query() bson.M {
+	query := bson.M{}
+	if f.Plan != "" {
+		query["plan.name"] = f.Plan
+	}
+	if f.DockerHost != "" {
+		query["$or"] = []bson.M{{"dockerhost": f.DockerHost}, {"containers.dockerhost": f.DockerHost}}
+	}
+	if f.State != "" {
+		query["state"] = f.State
+	}
+	if f.Team != "" {
+		query["team"] = f.Team
+	}
+	createdRange := bson.M{}
+	if !f.CreatedSince.IsZero() {
+		createdRange["$gte"] = f.CreatedSince
+	}
+	if !f.CreatedUntil.IsZero() {
+		createdRange["$lte"] = f.CreatedUntil
+	}
+	if len(createdRange) > 0 {
+		query["createdat"] = createdRange
+	}
+	return query
+}
+
+func (f *InstanceFilter) match(i *Instance) bool {
+	if f.Plan != "" && i.Plan.Name != f.Plan {
+		return false
+	}
+	if f.DockerHost != "" && !i.runsIn(f.DockerHost) {
+		return false
+	}
+	if f.State != "" && i.State != f.State {
+		return false
+	}
+	if f.Team != "" && i.Team != f.Team {
+		return false
+	}
+	if !f.CreatedSince.IsZero() && i.CreatedAt.Before(f.CreatedSince) {
+		return false
+	}
+	if !f.CreatedUntil.IsZero() && i.CreatedAt.After(f.CreatedUntil) {
+		return false
+	}
+	return true
+}
+
+// sortField returns the storage name of the field used to sort the
+// instances and whether the order is descending.
+func (f *InstanceFilter) sortField() (string, bool, error) {
+	key, desc := strings.TrimPrefix(f.Sort, "-"), strings.HasPrefix(f.Sort, "-")
+	if key == "" {
+		key = "name"
+	}
+	field, ok := instanceSortFields[key]
+	if !ok {
+		return "", false, fmt.Errorf("invalid sort field %q", key)
+	}
+	return field, desc, nil
+}
+
+// less reports whether a sorts before b, according to the sort field.
+func (f *InstanceFilter) less(a, b *Instance) bool {
+	field, desc, _ := f.sortField()
+	var cmp int
+	switch field {
+	case "name":
+		cmp = strings.Compare(a.Name, b.Name)
+	case "plan.name":
+		cmp = strings.Compare(a.Plan.Name, b.Plan.Name)
+	case "dockerhost":
+		cmp = strings.Compare(a.DockerHost, b.DockerHost)
+	case "state":
+		cmp = strings.Compare(a.State, b.State)
+	case "team":
+		cmp = strings.Compare(a.Team, b.Team)
+	case "createdat":
+		cmp = a.CreatedAt.Compare(b.CreatedAt)
+	}
+	if cmp == 0 {
+		return a.Name < b.Name
+	}
+	if desc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// host returns the address of the Docker host of the instance, without the
+// port of the Docker API.
+func (i *Instance) host() string {
+	return i.hostName(i.DockerHost)
+}
+
+// hostName returns the address of the given Docker host of the instance,
+// without the port of the Docker API.
+func (i *Instance) hostName(dockerHost string) string {
+	url_, err := url.Parse(dockerHost)
 	if err != nil {
-		log.Printf("ERROR - failed to parse instance Docker host: %s", err)
-		return nil
+		logger.Error("failed to parse instance Docker host", "instance", i.Name, "error", err)
+		return ""
 	}
 	host, _, err := net.SplitHostPort(url_.Host)
 	if err != nil {
 		host = url_.Host
 	}
+	return host
+}
+
+// Endpoints returns a list of endpoints to this instance. The endpoints of
+// instances spread across hosts are the ones of their client-facing
+// containers, in the host of each container.
+func (i *Instance) Endpoints() []string {
+	if i.isSpread() {
+		var result []string
+		for _, port := range i.portEndpoints() {
+			result = append(result, port.endpoint)
+		}
+		return result
+	}
+	host := i.host()
+	if host == "" {
+		return nil
+	}
 	result := make([]string, len(i.HostPorts))
 	for i, port := range i.HostPorts {
 		result[i] = host + ":" + port
@@ -62,91 +267,182 @@ func (i *Instance) EnvMap() map[string]string {
 	return result
 }
 
-// CreateInstance creates a new instance using the given name and plan.
-func CreateInstance(name string, plan *Plan) error {
-	instance := Instance{
-		Name:       name,
-		Plan:       *plan,
-		DockerHost: config.DockerHost,
-	}
-	if _, err := GetInstance(name); err == nil {
-		return ErrInstanceAlreadyExists
-	}
-	collection, err := connect()
+// CreateInstance creates a new instance using the given name and plan, in
+// the Docker host chosen by placeInstance or, with the swarm provisioner, as
+// Swarm services.
+//
+// The instance is created by running provisionSteps. If any of them fails,
+// everything created by the previous steps is removed, so creating the
+// instance again may succeed.
+func CreateInstance(ctx context.Context, name string, plan *Plan, opts CreateOptions) error {
+	done, err := trackOperation()
 	if err != nil {
 		return err
 	}
-	defer collection.Close()
-	opts := docker.CreateContainerOptions{
-		Name:       fmt.Sprintf("diaats-%s-%s", plan.Name, name),
-		Config:     &docker.Config{Cmd: plan.Args, Image: plan.Image},
-		HostConfig: config.HostConfig,
-	}
-	client, err := docker.NewClient(instance.DockerHost)
-	if err != nil {
-		return err
+	defer done()
+	if config.Provisioner == ProvisionerSwarm {
+		return createServiceInstance(ctx, name, plan, opts)
 	}
-	container, err := client.CreateContainer(opts)
-	if err != nil {
+	specs := plan.containerSpecs(name)
+	var host string
+	var hosts []string
+	var release func()
+	if plan.isSpread() {
+		if opts.Source != "" {
+			return ErrSpreadInstance
+		}
+		if hosts, release, err = spreadContainers(ctx, plan, opts.Team); err != nil {
+			return err
+		}
+		// The instance lives in the host of its primary container.
+		for i, spec := range specs {
+			if spec.member.Name == plan.primaryMember().Name {
+				host = hosts[i]
+				break
+			}
+		}
+	} else if host, release, err = placeInstance(ctx, plan, opts); err != nil {
 		return err
 	}
-	err = client.StartContainer(container.ID, config.HostConfig)
+	defer release()
+	client, err := dockerClient(host)
 	if err != nil {
 		return err
 	}
-	container, err = client.InspectContainer(container.ID)
-	if err != nil {
-		return err
+	p := provisioning{
+		client: client,
+		specs:  specs,
+		hosts:  hosts,
+		source: opts.Source,
+		instance: &Instance{
+			ID:         bson.NewObjectId().Hex(),
+			Name:       name,
+			Plan:       *plan,
+			DockerHost: host,
+			Team:       opts.Team,
+			Source:     opts.Source,
+			State:      StateCreating,
+			CreatedAt:  time.Now().UTC(),
+
+			MaintenanceWindow: opts.MaintenanceWindow,
+		},
+		plan:          plan,
+		log:           loggerFromContext(ctx).With("instance", name, "plan", plan.Name),
+		releaseMemory: release,
 	}
-	instance.ContainerID = container.ID
-	instance.HostPorts = make([]string, 0, len(container.NetworkSettings.Ports))
-	for _, ports := range container.NetworkSettings.Ports {
-		for _, p := range ports {
-			instance.HostPorts = append(instance.HostPorts, p.HostPort)
+	if hosts != nil {
+		// The hosts of the containers are recorded with the instance, so
+		// their memory is accounted for while they're created.
+		p.instance.Containers = make([]InstanceContainer, len(specs))
+		for i, spec := range specs {
+			p.instance.Containers[i] = InstanceContainer{Name: spec.name, Member: spec.member.Name}
+			if hosts[i] != host {
+				p.instance.Containers[i].DockerHost = hosts[i]
+			}
 		}
 	}
-	instance.Envs = container.Config.Env
-	err = collection.Insert(instance)
-	if err != nil {
-		client.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true})
+	if err = runSteps(ctx, provisionSteps, &p); err != nil {
+		return err
 	}
-	return err
+	p.log.Info("instance created", "container", p.instance.ContainerID, "docker_host", p.instance.DockerHost)
+	return nil
 }
 
 // DestroyInstance destroys the instance identified by the given name.
-func DestroyInstance(name string) error {
-	instance, err := GetInstance(name)
+func DestroyInstance(ctx context.Context, name string) error {
+	done, err := trackOperation()
 	if err != nil {
 		return err
 	}
-	client, err := docker.NewClient(instance.DockerHost)
+	defer done()
+	instance, err := GetInstance(ctx, name)
 	if err != nil {
 		return err
 	}
-	coll, err := connect()
+	log := loggerFromContext(ctx).With("instance", name, "plan", instance.Plan.Name)
+	client, err := dockerClient(instance.DockerHost)
 	if err != nil {
+		log.Error("failed to create Docker client", "docker_host", instance.DockerHost, "error", err)
 		return err
 	}
-	defer coll.Close()
-	opts := docker.RemoveContainerOptions{ID: instance.ContainerID, Force: true}
-	err = client.RemoveContainer(opts)
+	if instance.isService() {
+		removeInstanceServices(ctx, client, instance)
+	} else {
+		for _, id := range instance.containerIDs() {
+			client, err := dockerClient(instance.hostOf(id))
+			if err == nil {
+				err = client.RemoveContainer(docker.RemoveContainerOptions{ID: id, Force: true})
+			}
+			if err != nil {
+				log.Error("failed to remove Docker container", "container", id, "error", err)
+			}
+		}
+		for n := range instance.Containers {
+			container := &instance.Containers[n]
+			client, err := dockerClient(instance.containerHost(container))
+			if err == nil {
+				err = removeVolumeList(client, container.Volumes)
+			}
+			if err != nil {
+				log.Error("failed to remove volumes", "container", container.ID, "error", err)
+			}
+		}
+	}
+	err = storage.DeleteInstance(instance.Name)
 	if err != nil {
-		log.Printf("ERROR - failed to remove Docker container %q: %s", instance.ContainerID, err)
+		log.Error("failed to remove instance", "error", err)
+		return err
+	}
+	if err = releaseNetwork(client, instance); err != nil {
+		log.Error("failed to remove Docker network", "network", instance.Network, "error", err)
+	}
+	for i := range instance.Snapshots {
+		removeSnapshotData(ctx, client, &instance.Snapshots[i])
 	}
-	return coll.Remove(bson.M{"name": instance.Name})
+	log.Info("instance removed", "container", instance.ContainerID)
+	return nil
 }
 
-// GetInstance returns the instance identified by the given name.
-func GetInstance(name string) (*Instance, error) {
-	var instance Instance
-	coll, err := connect()
-	if err != nil {
-		return nil, err
+// errNoChange is returned by the functions given to modifyInstance to leave
+// the instance unchanged.
+var errNoChange = errors.New("no change")
+
+// maxModifyAttempts is how many times modifyInstance and modifyHost apply
+// their functions to records that keep changing before giving up.
+const maxModifyAttempts = 10
+
+// modifyInstance applies fn to the stored instance and saves it, unless fn
+// fails or returns errNoChange. When the instance is changed in the
+// meantime, possibly by another replica of the API, fn is applied again to
+// the new version.
+func modifyInstance(name string, fn func(instance *Instance) error) (*Instance, error) {
+	for attempt := 1; ; attempt++ {
+		instance, err := storage.GetInstance(name)
+		if err != nil {
+			return nil, err
+		}
+		if err = fn(instance); err == errNoChange {
+			return instance, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = storage.UpdateInstance(instance)
+		if err == ErrConflict && attempt < maxModifyAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return instance, nil
 	}
-	defer coll.Close()
-	err = coll.Find(bson.M{"name": name}).One(&instance)
-	if err == mgo.ErrNotFound {
-		return nil, ErrInstanceNotFound
+}
+
+// GetInstance returns the instance identified by the given name.
+func GetInstance(ctx context.Context, name string) (*Instance, error) {
+	instance, err := storage.GetInstance(name)
+	if err != nil && err != ErrInstanceNotFound {
+		loggerFromContext(ctx).Error("failed to find instance", "instance", name, "error", err)
 	}
-	return &instance, err
+	return instance, err
 }
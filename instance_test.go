@@ -5,10 +5,9 @@
 package main
 
 import (
+	"context"
 	"github.com/fsouza/go-dockerclient"
 	"gopkg.in/check.v1"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
 func (*S) TestInstanceEndpoints(c *check.C) {
@@ -30,14 +29,10 @@ func (s *S) TestCreateInstance(c *check.C) {
 	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
 	c.Assert(err, check.IsNil)
 	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached", Args: []string{"-m", "64"}}}
-	err = CreateInstance("mycache", &config.Plans[0])
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
 	c.Assert(err, check.IsNil)
-	defer DestroyInstance("mycache")
-	coll, err := connect()
-	c.Assert(err, check.IsNil)
-	defer coll.Close()
-	var instance Instance
-	err = coll.Find(bson.M{"name": "mycache"}).One(&instance)
+	defer DestroyInstance(context.Background(), "mycache")
+	instance, err := storage.GetInstance("mycache")
 	c.Assert(err, check.IsNil)
 	c.Assert(instance.Name, check.Equals, "mycache")
 	c.Assert(instance.Plan, check.DeepEquals, config.Plans[0])
@@ -54,40 +49,66 @@ func (s *S) TestCreateInstanceDuplicate(c *check.C) {
 	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
 	c.Assert(err, check.IsNil)
 	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached"}}
-	err = CreateInstance("mycache", &config.Plans[0])
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
 	c.Assert(err, check.IsNil)
-	defer DestroyInstance("mycache")
-	err = CreateInstance("mycache", &config.Plans[0])
+	defer DestroyInstance(context.Background(), "mycache")
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
 	c.Assert(err, check.Equals, ErrInstanceAlreadyExists)
 }
 
-func (s *S) TestDestroyInstance(c *check.C) {
+func (s *S) TestCreateInstanceDuplicateDifferentPlan(c *check.C) {
 	client, err := docker.NewClient(config.DockerHost)
 	c.Assert(err, check.IsNil)
 	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
 	c.Assert(err, check.IsNil)
+	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached"}, {Name: "hipermemcached", Image: "memcached"}}
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycache")
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[1], CreateOptions{})
+	c.Assert(err, check.Equals, ErrInstanceAlreadyExists)
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(containers, check.HasLen, 1)
+}
+
+func (s *S) TestCreateInstanceContainerFailure(c *check.C) {
 	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached"}}
-	err = CreateInstance("mycache", &config.Plans[0])
+	err := CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.NotNil)
+	_, err = GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
+	events, err := ListEvents(EventFilter{Kind: EventStatusChange})
 	c.Assert(err, check.IsNil)
-	var instance Instance
-	coll, err := connect()
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].Status, check.Equals, StatusFailed)
+	c.Assert(events[0].Success, check.Equals, false)
+	c.Assert(events[0].Error, check.Not(check.Equals), "")
+}
+
+func (s *S) TestDestroyInstance(c *check.C) {
+	client, err := docker.NewClient(config.DockerHost)
 	c.Assert(err, check.IsNil)
-	defer coll.Close()
-	err = coll.Find(bson.M{"name": "mycache"}).One(&instance)
+	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
 	c.Assert(err, check.IsNil)
-	err = DestroyInstance("mycache")
+	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached"}}
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	instance, err := storage.GetInstance("mycache")
+	c.Assert(err, check.IsNil)
+	err = DestroyInstance(context.Background(), "mycache")
 	c.Assert(err, check.IsNil)
 	_, err = client.InspectContainer(instance.ContainerID)
 	c.Assert(err, check.NotNil)
 	e, ok := err.(*docker.NoSuchContainer)
 	c.Assert(ok, check.Equals, true)
 	c.Assert(e.ID, check.Equals, instance.ContainerID)
-	err = coll.Find(bson.M{"name": "mycache"}).One(&instance)
-	c.Assert(err, check.Equals, mgo.ErrNotFound)
+	_, err = storage.GetInstance("mycache")
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
 }
 
 func (s *S) TestDestroyInstanceNotFound(c *check.C) {
-	err := DestroyInstance("watcache")
+	err := DestroyInstance(context.Background(), "watcache")
 	c.Assert(err, check.Equals, ErrInstanceNotFound)
 }
 
@@ -97,22 +118,18 @@ func (s *S) TestGetInstance(c *check.C) {
 	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
 	c.Assert(err, check.IsNil)
 	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached"}}
-	err = CreateInstance("mycache", &config.Plans[0])
-	c.Assert(err, check.IsNil)
-	defer DestroyInstance("mycache")
-	var dbInstance Instance
-	coll, err := connect()
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
 	c.Assert(err, check.IsNil)
-	defer coll.Close()
-	err = coll.Find(bson.M{"name": "mycache"}).One(&dbInstance)
+	defer DestroyInstance(context.Background(), "mycache")
+	dbInstance, err := storage.GetInstance("mycache")
 	c.Assert(err, check.IsNil)
-	instance, err := GetInstance("mycache")
+	instance, err := GetInstance(context.Background(), "mycache")
 	c.Assert(err, check.IsNil)
-	c.Assert(*instance, check.DeepEquals, dbInstance)
+	c.Assert(instance, check.DeepEquals, dbInstance)
 }
 
 func (s *S) TestGetInstanceNotFound(c *check.C) {
-	instance, err := GetInstance("watcache")
+	instance, err := GetInstance(context.Background(), "watcache")
 	c.Assert(err, check.Equals, ErrInstanceNotFound)
 	c.Assert(instance, check.IsNil)
 }
@@ -0,0 +1,47 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"gopkg.in/check.v1"
+)
+
+func (*S) TestNewLoggerLevel(c *check.C) {
+	var buf bytes.Buffer
+	l := newLogger(&buf, "warn")
+	l.Info("hidden")
+	c.Assert(buf.Len(), check.Equals, 0)
+	l.Warn("shown")
+	var entry map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	c.Assert(err, check.IsNil)
+	c.Assert(entry["level"], check.Equals, "WARN")
+	c.Assert(entry["msg"], check.Equals, "shown")
+}
+
+func (*S) TestNewLoggerInvalidLevel(c *check.C) {
+	var buf bytes.Buffer
+	l := newLogger(&buf, "verbose")
+	c.Assert(l.Enabled(context.Background(), slog.LevelInfo), check.Equals, true)
+	c.Assert(l.Enabled(context.Background(), slog.LevelDebug), check.Equals, false)
+}
+
+func (*S) TestLoggerFromContext(c *check.C) {
+	var buf bytes.Buffer
+	old := logger
+	defer func() { logger = old }()
+	logger = newLogger(&buf, "info")
+	ctx := withRequestID(context.Background(), "abc123")
+	loggerFromContext(ctx).Info("hello")
+	var entry map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	c.Assert(err, check.IsNil)
+	c.Assert(entry["request_id"], check.Equals, "abc123")
+}
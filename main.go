@@ -5,21 +5,16 @@
 package main
 
 import (
-	"flag"
-	"log"
-	"net/http"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
 )
 
-var listen string
-
-func init() {
-	flag.StringVar(&listen, "l", "0.0.0.0:8080", "Address to bind")
-}
-
 func main() {
-	flag.Parse()
-	loadConfig()
-	handler := buildMuxer()
-	log.Printf("Binding on %q", listen)
-	http.ListenAndServe(listen, handler)
+	slog.SetDefault(logger)
+	if err := runCommand(context.Background(), os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
 }
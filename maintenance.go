@@ -0,0 +1,256 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Kinds of disruptive operations, queued by QueueOperation and run by the
+// scheduler inside the maintenance window of the instance.
+const (
+	OperationRecreate = "recreate"
+	OperationMove     = "move"
+)
+
+const (
+	schedulerActor         = "diaats-scheduler"
+	operationCheckInterval = time.Minute
+	operationRetryDelay    = 10 * time.Minute
+)
+
+var ErrOperationNotFound = errors.New("operation not found")
+
+// operationRunners run each kind of operation.
+var operationRunners = map[string]func(ctx context.Context, instance *Instance) error{
+	OperationRecreate: RecreateInstance,
+	OperationMove:     moveInstance,
+}
+
+// Operation is a disruptive operation waiting for the maintenance window of
+// an instance.
+type Operation struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"`
+	Reason      string    `json:"reason,omitempty"`
+	QueuedAt    time.Time `json:"queuedAt"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// maintenanceWindow returns the maintenance window of the instance, which
+// defaults to the update window of its plan. Operations may run at any time
+// when it's empty.
+func (i *Instance) maintenanceWindow() string {
+	if i.MaintenanceWindow != "" {
+		return i.MaintenanceWindow
+	}
+	if i.Plan.Updates != nil {
+		return i.Plan.Updates.Window
+	}
+	return ""
+}
+
+// inMaintenanceWindow reports whether operations may run on the instance at
+// the given time.
+func (i *Instance) inMaintenanceWindow(t time.Time) bool {
+	window := i.maintenanceWindow()
+	if window == "" {
+		return true
+	}
+	w, err := parseWindow(window)
+	return err == nil && w.contains(t)
+}
+
+// SetMaintenanceWindow changes the maintenance window of the instance,
+// clearing it when window is empty.
+func SetMaintenanceWindow(ctx context.Context, name, window string) error {
+	if window != "" {
+		if _, err := parseWindow(window); err != nil {
+			return err
+		}
+	}
+	_, err := modifyInstance(name, func(instance *Instance) error {
+		instance.MaintenanceWindow = window
+		return nil
+	})
+	return err
+}
+
+// QueueOperation queues an operation of the given kind for the instance.
+// When an operation of the same kind is already queued, it's returned
+// instead. Moves of instances that can't be moved aren't queued.
+func QueueOperation(ctx context.Context, name, kind, reason string) (*Operation, error) {
+	if operationRunners[kind] == nil {
+		return nil, fmt.Errorf("invalid operation %q", kind)
+	}
+	instance, err := storage.GetInstance(name)
+	if err != nil {
+		return nil, err
+	}
+	if instance.isService() {
+		return nil, ErrNotSupportedBySwarm
+	}
+	if instance.isSpread() {
+		return nil, ErrSpreadInstance
+	}
+	if kind == OperationMove {
+		if err = checkMovable(instance); err != nil {
+			return nil, err
+		}
+	}
+	var op Operation
+	_, err = modifyInstance(name, func(instance *Instance) error {
+		for _, queued := range instance.Operations {
+			if queued.Kind == kind {
+				op = queued
+				return errNoChange
+			}
+		}
+		op = Operation{ID: bson.NewObjectId().Hex(), Kind: kind, Reason: reason, QueuedAt: time.Now().UTC()}
+		instance.Operations = append(instance.Operations, op)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	loggerFromContext(ctx).Info("operation queued", "instance", name, "operation", op.ID, "kind", kind, "reason", reason)
+	return &op, nil
+}
+
+// CancelOperation removes a queued operation of the instance.
+func CancelOperation(ctx context.Context, name, id string) error {
+	_, err := modifyInstance(name, func(instance *Instance) error {
+		for n, op := range instance.Operations {
+			if op.ID == id {
+				instance.Operations = append(instance.Operations[:n:n], instance.Operations[n+1:]...)
+				return nil
+			}
+		}
+		return ErrOperationNotFound
+	})
+	return err
+}
+
+// QueuedOperation is an operation in the queue returned by ListOperations.
+type QueuedOperation struct {
+	Operation
+	Instance string `json:"instance"`
+	Window   string `json:"window,omitempty"`
+}
+
+// ListOperations returns the operations queued for all instances, oldest
+// first.
+func ListOperations() ([]QueuedOperation, error) {
+	instances, _, err := storage.ListInstances(InstanceFilter{})
+	if err != nil {
+		return nil, err
+	}
+	result := []QueuedOperation{}
+	for _, instance := range instances {
+		for _, op := range instance.Operations {
+			result = append(result, QueuedOperation{Operation: op, Instance: instance.Name, Window: instance.maintenanceWindow()})
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].QueuedAt.Before(result[j].QueuedAt)
+	})
+	return result, nil
+}
+
+// runOperations runs the queued operations every interval until ctx is
+// canceled.
+func runOperations(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			scheduleOperations(ctx, time.Now())
+		}
+	}
+}
+
+// scheduleOperations runs the queued operations of the instances inside
+// their maintenance windows, one at a time, oldest first. Failed operations
+// stay in the queue, recording their errors, and are retried after
+// operationRetryDelay, while the remaining operations carry on. The
+// operations of an instance are claimed with a lease, so replicas of the API
+// don't run them twice.
+func scheduleOperations(ctx context.Context, now time.Time) {
+	log := loggerFromContext(ctx)
+	queue, err := ListOperations()
+	if err != nil {
+		log.Error("failed to list queued operations", "error", err)
+		return
+	}
+	for _, queued := range queue {
+		if now.Sub(queued.LastAttempt) < operationRetryDelay {
+			continue
+		}
+		release, ok := claimWork(ctx, "operations-"+queued.Instance)
+		if !ok {
+			continue
+		}
+		err = runOperation(ctx, queued, now)
+		release()
+		if err != nil {
+			log.Error("operation failed", "instance", queued.Instance, "operation", queued.ID, "kind", queued.Kind, "error", err)
+		}
+	}
+}
+
+// runOperation runs the queued operation when it's still due, recording
+// its outcome. It returns the error of the operation.
+func runOperation(ctx context.Context, queued QueuedOperation, now time.Time) error {
+	log := loggerFromContext(ctx)
+	instance, err := storage.GetInstance(queued.Instance)
+	if err != nil {
+		log.Error("failed to find instance", "instance", queued.Instance, "error", err)
+		return nil
+	}
+	// The operation may have run in another replica since it was listed.
+	var due bool
+	for _, op := range instance.Operations {
+		due = due || op.ID == queued.ID && now.Sub(op.LastAttempt) >= operationRetryDelay
+	}
+	if !due || instance.State != StateRunning || !instance.inMaintenanceWindow(now) {
+		return nil
+	}
+	// Operations are recorded as events of the same kind.
+	evt := startEvent(ctx, queued.Kind, instance.Name, schedulerActor)
+	evt.Plan = instance.Plan.Name
+	evt.DockerHost = instance.DockerHost
+	err = operationRunners[queued.Kind](ctx, instance)
+	evt.Done(ctx, err)
+	_, updateErr := modifyInstance(instance.Name, func(instance *Instance) error {
+		for n := range instance.Operations {
+			op := &instance.Operations[n]
+			if op.ID != queued.ID {
+				continue
+			}
+			if err == nil {
+				instance.Operations = append(instance.Operations[:n:n], instance.Operations[n+1:]...)
+			} else {
+				op.LastAttempt = now
+				op.LastError = err.Error()
+			}
+			return nil
+		}
+		return errNoChange
+	})
+	if updateErr != nil {
+		log.Error("failed to update operation", "instance", instance.Name, "operation", queued.ID, "error", updateErr)
+	}
+	return err
+}
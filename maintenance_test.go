@@ -0,0 +1,244 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestSetMaintenanceWindow(c *check.C) {
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	err := SetMaintenanceWindow(context.Background(), "mycache", "sun 02:00-04:00")
+	c.Assert(err, check.IsNil)
+	instance, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.MaintenanceWindow, check.Equals, "sun 02:00-04:00")
+	err = SetMaintenanceWindow(context.Background(), "mycache", "sometime")
+	c.Assert(err, check.ErrorMatches, `invalid maintenance window "sometime"`)
+	err = SetMaintenanceWindow(context.Background(), "unknown", "")
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
+}
+
+func (*S) TestInstanceMaintenanceWindow(c *check.C) {
+	instance := Instance{Plan: Plan{Updates: &UpdatePolicy{Policy: UpdateRecreate, Window: "02:00-04:00"}}}
+	c.Assert(instance.maintenanceWindow(), check.Equals, "02:00-04:00")
+	c.Assert(instance.inMaintenanceWindow(time.Date(2016, 1, 3, 3, 0, 0, 0, time.UTC)), check.Equals, true)
+	instance.MaintenanceWindow = "10:00-11:00"
+	c.Assert(instance.inMaintenanceWindow(time.Date(2016, 1, 3, 3, 0, 0, 0, time.UTC)), check.Equals, false)
+	c.Assert(instance.inMaintenanceWindow(time.Date(2016, 1, 3, 10, 30, 0, 0, time.UTC)), check.Equals, true)
+	instance = Instance{}
+	c.Assert(instance.inMaintenanceWindow(time.Now()), check.Equals, true)
+}
+
+func (s *S) TestQueueAndCancelOperation(c *check.C) {
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	op, err := QueueOperation(context.Background(), "mycache", OperationRecreate, "testing")
+	c.Assert(err, check.IsNil)
+	c.Assert(op.Kind, check.Equals, OperationRecreate)
+	again, err := QueueOperation(context.Background(), "mycache", OperationRecreate, "testing again")
+	c.Assert(err, check.IsNil)
+	c.Assert(again.ID, check.Equals, op.ID)
+	_, err = QueueOperation(context.Background(), "mycache", "explode", "")
+	c.Assert(err, check.ErrorMatches, `invalid operation "explode"`)
+	_, err = QueueOperation(context.Background(), "unknown", OperationRecreate, "")
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
+	operations, err := ListOperations()
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 1)
+	c.Assert(operations[0].Instance, check.Equals, "mycache")
+	c.Assert(operations[0].Reason, check.Equals, "testing")
+	err = CancelOperation(context.Background(), "mycache", op.ID)
+	c.Assert(err, check.IsNil)
+	err = CancelOperation(context.Background(), "mycache", op.ID)
+	c.Assert(err, check.Equals, ErrOperationNotFound)
+	operations, err = ListOperations()
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 0)
+}
+
+func (s *S) TestScheduleOperationsFailure(c *check.C) {
+	first := s.createTestInstance(c, "first")
+	defer DestroyInstance(context.Background(), "first")
+	second := s.createTestInstance(c, "second")
+	defer DestroyInstance(context.Background(), "second")
+	_, err := QueueOperation(context.Background(), "first", OperationRecreate, "testing")
+	c.Assert(err, check.IsNil)
+	_, err = QueueOperation(context.Background(), "second", OperationRecreate, "testing")
+	c.Assert(err, check.IsNil)
+	s.server.PrepareFailure("pull-error", "/images/create")
+	now := time.Now()
+	scheduleOperations(context.Background(), now)
+	operations, err := ListOperations()
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 2)
+	for _, op := range operations {
+		c.Assert(op.LastError, check.Not(check.Equals), "")
+		c.Assert(op.LastAttempt.Equal(now), check.Equals, true)
+	}
+	s.server.ResetFailure("pull-error")
+	scheduleOperations(context.Background(), now.Add(time.Minute))
+	operations, err = ListOperations()
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 2)
+	scheduleOperations(context.Background(), now.Add(operationRetryDelay))
+	operations, err = ListOperations()
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 0)
+	instance, err := GetInstance(context.Background(), "first")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.ContainerID, check.Not(check.Equals), first.ContainerID)
+	instance, err = GetInstance(context.Background(), "second")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.ContainerID, check.Not(check.Equals), second.ContainerID)
+	events, err := ListEvents(EventFilter{Kind: EventRecreate})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 4)
+}
+
+func (s *S) TestScheduleOperationsWindow(c *check.C) {
+	instance := s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	err := SetMaintenanceWindow(context.Background(), "mycache", "02:00-04:00")
+	c.Assert(err, check.IsNil)
+	_, err = QueueOperation(context.Background(), "mycache", OperationRecreate, "testing")
+	c.Assert(err, check.IsNil)
+	scheduleOperations(context.Background(), time.Date(2016, 1, 3, 12, 0, 0, 0, time.UTC))
+	updated, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(updated.ContainerID, check.Equals, instance.ContainerID)
+	c.Assert(updated.Operations, check.HasLen, 1)
+	scheduleOperations(context.Background(), time.Date(2016, 1, 3, 2, 30, 0, 0, time.UTC))
+	updated, err = GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(updated.ContainerID, check.Not(check.Equals), instance.ContainerID)
+	c.Assert(updated.Operations, check.HasLen, 0)
+	c.Assert(updated.MaintenanceWindow, check.Equals, "02:00-04:00")
+}
+
+func (s *S) TestOperationHandlers(c *check.C) {
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	handler := buildMuxer()
+	request, err := http.NewRequest("PUT", "/admin/instances/mycache/maintenance-window", strings.NewReader("window=sun+02:00-04:00"))
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNoContent)
+	request, err = http.NewRequest("POST", "/admin/instances/mycache/operations", strings.NewReader("kind=recreate"))
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	var op Operation
+	err = json.NewDecoder(recorder.Body).Decode(&op)
+	c.Assert(err, check.IsNil)
+	request, err = http.NewRequest("GET", "/admin/operations", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var operations []QueuedOperation
+	err = json.NewDecoder(recorder.Body).Decode(&operations)
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 1)
+	c.Assert(operations[0].ID, check.Equals, op.ID)
+	c.Assert(operations[0].Window, check.Equals, "sun 02:00-04:00")
+	request, err = http.NewRequest("DELETE", "/admin/instances/mycache/operations/"+op.ID, nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNoContent)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestOperationHandlersErrors(c *check.C) {
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	var tests = []struct {
+		method, path, body string
+		code               int
+	}{
+		{"PUT", "/admin/instances/mycache/maintenance-window", "window=whenever", http.StatusBadRequest},
+		{"PUT", "/admin/instances/unknown/maintenance-window", "window=", http.StatusNotFound},
+		{"POST", "/admin/instances/mycache/operations", "kind=explode", http.StatusBadRequest},
+		{"POST", "/admin/instances/unknown/operations", "kind=recreate", http.StatusNotFound},
+		{"POST", "/resources", "name=other&plan=supermemcached&parameters.maintenance-window=whenever", http.StatusBadRequest},
+	}
+	handler := buildMuxer()
+	for _, t := range tests {
+		request, err := http.NewRequest(t.method, t.path, strings.NewReader(t.body))
+		c.Assert(err, check.IsNil)
+		request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, t.code, check.Commentf("%s %s %s", t.method, t.path, t.body))
+	}
+}
+
+func (s *S) TestCreateInstanceHandlerMaintenanceWindow(c *check.C) {
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	body := strings.NewReader("name=other&plan=supermemcached&parameters.maintenance-window=sat,sun+22:00-02:00")
+	request, err := http.NewRequest("POST", "/resources", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	buildMuxer().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	defer DestroyInstance(context.Background(), "other")
+	instance, err := GetInstance(context.Background(), "other")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.MaintenanceWindow, check.Equals, "sat,sun 22:00-02:00")
+}
+
+func (s *S) TestScheduleOperationsClaimedElsewhere(c *check.C) {
+	instance := s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	_, err := QueueOperation(context.Background(), "mycache", OperationRecreate, "testing")
+	c.Assert(err, check.IsNil)
+	ok, err := storage.AcquireLease("operations-mycache", "other-process", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, true)
+	scheduleOperations(context.Background(), time.Now())
+	updated, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(updated.ContainerID, check.Equals, instance.ContainerID)
+	c.Assert(updated.Operations, check.HasLen, 1)
+	err = storage.ReleaseLease("operations-mycache", "other-process")
+	c.Assert(err, check.IsNil)
+	scheduleOperations(context.Background(), time.Now())
+	updated, err = GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(updated.ContainerID, check.Not(check.Equals), instance.ContainerID)
+	c.Assert(updated.Operations, check.HasLen, 0)
+}
+
+func (s *S) TestQueueMoveStateful(c *check.C) {
+	s.createTestInstance(c, "mydb")
+	defer DestroyInstance(context.Background(), "mydb")
+	_, err := modifyInstance("mydb", func(instance *Instance) error {
+		instance.Source = "othercache"
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	_, err = QueueOperation(context.Background(), "mydb", OperationMove, "testing")
+	c.Assert(err, check.Equals, ErrStatefulInstance)
+	operations, err := ListOperations()
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 0)
+}
@@ -0,0 +1,275 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+var memberNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// PlanMember is a set of identical containers in a multi-container plan,
+// like the nodes of a cluster or a sidecar.
+type PlanMember struct {
+	Name     string   `json:"name"`
+	Image    string   `json:"image"`
+	Args     []string `json:"args,omitempty"`
+	Replicas int      `json:"replicas,omitempty"`
+
+	// Memory is the memory limit of each container of the member, in
+	// bytes, overriding the one in DOCKER_CONFIG.
+	Memory int64 `json:"memory,omitempty"`
+
+	// Ports are the container ports published by the member. When empty,
+	// client-facing members publish every port exposed by the image, and
+	// other members don't publish any port.
+	Ports []PlanPort `json:"ports,omitempty"`
+
+	// ClientFacing members are the ones whose endpoints are returned on
+	// bind.
+	ClientFacing bool `json:"clientFacing,omitempty"`
+}
+
+func (m *PlanMember) replicas() int {
+	if m.Replicas < 1 {
+		return 1
+	}
+	return m.Replicas
+}
+
+// hostConfig returns the configuration of the containers of the member,
+// connected to the given network when it's not empty.
+func (m *PlanMember) hostConfig(network string) *docker.HostConfig {
+	if len(m.Ports) == 0 && m.ClientFacing && network == "" && m.Memory == 0 {
+		return config.HostConfig
+	}
+	var hostConfig docker.HostConfig
+	if config.HostConfig != nil {
+		hostConfig = *config.HostConfig
+	}
+	if m.Memory > 0 {
+		hostConfig.Memory = m.Memory
+	}
+	if network != "" {
+		hostConfig.NetworkMode = network
+	}
+	if len(m.Ports) == 0 {
+		hostConfig.PublishAllPorts = m.ClientFacing
+		return &hostConfig
+	}
+	hostConfig.PublishAllPorts = false
+	hostConfig.PortBindings = make(map[docker.Port][]docker.PortBinding, len(m.Ports))
+	for _, port := range m.Ports {
+		bindings := []docker.PortBinding{{}}
+		if config.HostConfig != nil && len(config.HostConfig.PortBindings[port.dockerPort()]) > 0 {
+			bindings = config.HostConfig.PortBindings[port.dockerPort()]
+		}
+		hostConfig.PortBindings[port.dockerPort()] = bindings
+	}
+	return &hostConfig
+}
+
+// exposedPorts returns the ports of the member, so they're published even if
+// the image doesn't expose them.
+func (m *PlanMember) exposedPorts() map[docker.Port]struct{} {
+	if len(m.Ports) == 0 {
+		return nil
+	}
+	ports := make(map[docker.Port]struct{}, len(m.Ports))
+	for _, port := range m.Ports {
+		ports[port.dockerPort()] = struct{}{}
+	}
+	return ports
+}
+
+// publishes reports whether the member publishes the given container port.
+func (m *PlanMember) publishes(port string) bool {
+	if len(m.Ports) == 0 {
+		return m.ClientFacing
+	}
+	for _, planPort := range m.Ports {
+		if planPort.dockerPort() == dockerPort(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// isGroup reports whether the plan has multiple containers.
+func (p *Plan) isGroup() bool {
+	return len(p.Members) > 0
+}
+
+// members returns the members of the plan. Single container plans have one
+// client-facing member, running Image with Args.
+func (p *Plan) members() []PlanMember {
+	if p.isGroup() {
+		return p.Members
+	}
+	return []PlanMember{{Image: p.Image, Args: p.Args, Memory: p.Memory, Ports: p.Ports, ClientFacing: true}}
+}
+
+// primaryMember returns the first client-facing member of the plan. Its
+// first container is the one checked for readiness and health.
+func (p *Plan) primaryMember() *PlanMember {
+	members := p.members()
+	for i := range members {
+		if members[i].ClientFacing {
+			return &members[i]
+		}
+	}
+	return &members[0]
+}
+
+// publishes reports whether the primary member of the plan publishes the
+// given container port.
+func (p *Plan) publishes(port string) bool {
+	return p.primaryMember().publishes(port)
+}
+
+// containerSpec is a container to be created for an instance.
+type containerSpec struct {
+	name   string
+	member PlanMember
+}
+
+// containerSpecs returns the containers of an instance of the plan. The
+// container of single container plans is named after the plan and the
+// instance, and the containers of multi-container plans also have the name
+// of the member and a sequential number.
+func (p *Plan) containerSpecs(instanceName string) []containerSpec {
+	if !p.isGroup() {
+		return []containerSpec{{name: containerName(p, instanceName), member: p.members()[0]}}
+	}
+	var specs []containerSpec
+	for _, member := range p.Members {
+		for n := 1; n <= member.replicas(); n++ {
+			name := fmt.Sprintf("%s-%s-%d", containerName(p, instanceName), member.Name, n)
+			specs = append(specs, containerSpec{name: name, member: member})
+		}
+	}
+	return specs
+}
+
+func validateMembers(members []PlanMember) []error {
+	var errs []error
+	names := make(map[string]bool, len(members))
+	var clientFacing bool
+	for i, member := range members {
+		if !memberNameRegexp.MatchString(member.Name) {
+			errs = append(errs, fmt.Errorf("member #%d: invalid name %q", i, member.Name))
+		} else if names[member.Name] {
+			errs = append(errs, fmt.Errorf("member %q: duplicate name", member.Name))
+		}
+		names[member.Name] = true
+		if member.Image == "" {
+			errs = append(errs, fmt.Errorf("member %q: missing image", member.Name))
+		}
+		if member.Replicas < 0 {
+			errs = append(errs, fmt.Errorf("member %q: invalid number of replicas", member.Name))
+		}
+		if member.Memory < 0 {
+			errs = append(errs, fmt.Errorf("member %q: invalid memory limit", member.Name))
+		}
+		for _, err := range validatePorts(member.Ports) {
+			errs = append(errs, fmt.Errorf("member %q: %s", member.Name, err))
+		}
+		clientFacing = clientFacing || member.ClientFacing
+	}
+	if !clientFacing {
+		errs = append(errs, errors.New("no client-facing member"))
+	}
+	return errs
+}
+
+// InstanceContainer is one of the containers of an instance.
+type InstanceContainer struct {
+	ID           string
+	Name         string
+	Member       string
+	ClientFacing bool
+	Ports        []InstancePort
+	Volumes      []InstanceVolume `json:",omitempty"`
+
+	// DockerHost is the host of the container when it isn't the host of
+	// the instance, in instances whose containers are spread across hosts.
+	DockerHost string `json:",omitempty"`
+}
+
+// containerHost returns the Docker host of the given container of the
+// instance.
+func (i *Instance) containerHost(c *InstanceContainer) string {
+	if c.DockerHost != "" {
+		return c.DockerHost
+	}
+	return i.DockerHost
+}
+
+// hostOf returns the Docker host of the container of the instance with the
+// given ID.
+func (i *Instance) hostOf(id string) string {
+	for n := range i.Containers {
+		if i.Containers[n].ID == id {
+			return i.containerHost(&i.Containers[n])
+		}
+	}
+	return i.DockerHost
+}
+
+// isSpread reports whether the containers of the instance are spread across
+// hosts.
+func (i *Instance) isSpread() bool {
+	for n := range i.Containers {
+		if i.Containers[n].DockerHost != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// runsIn reports whether any container of the instance runs in the Docker
+// host at address.
+func (i *Instance) runsIn(address string) bool {
+	if i.DockerHost == address {
+		return true
+	}
+	for n := range i.Containers {
+		if i.Containers[n].DockerHost == address {
+			return true
+		}
+	}
+	return false
+}
+
+// containerIDs returns the IDs of all containers of the instance. Instances
+// created before multi-container plans only have ContainerID.
+func (i *Instance) containerIDs() []string {
+	if len(i.Containers) == 0 {
+		return []string{i.ContainerID}
+	}
+	ids := make([]string, len(i.Containers))
+	for n, container := range i.Containers {
+		ids[n] = container.ID
+	}
+	return ids
+}
+
+// describeMembers returns a description of the members of a plan, like
+// "node (3), exporter".
+func describeMembers(members []PlanMember) string {
+	parts := make([]string, len(members))
+	for i, member := range members {
+		parts[i] = member.Name
+		if member.replicas() > 1 {
+			parts[i] += fmt.Sprintf(" (%d)", member.replicas())
+		}
+	}
+	return strings.Join(parts, ", ")
+}
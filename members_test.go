@@ -0,0 +1,170 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	dtesting "github.com/fsouza/go-dockerclient/testing"
+	"gopkg.in/check.v1"
+)
+
+// handleNetworks fills the gaps between the network API of the fake Docker
+// server and the one used by the client: it creates networks at
+// /networks/create and accepts their removal, returning the names of the
+// removed networks.
+func (s *S) handleNetworks() *[]string {
+	return handleServerNetworks(s.server)
+}
+
+// handleServerNetworks is like handleNetworks, for the given fake server.
+func handleServerNetworks(server *dtesting.DockerServer) *[]string {
+	var removed []string
+	server.CustomHandler("/networks/.+", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			removed = append(removed, strings.TrimPrefix(r.URL.Path, "/networks/"))
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Path == "/networks/create":
+			r.URL.Path = "/networks"
+			server.DefaultHandler().ServeHTTP(w, r)
+		default:
+			server.DefaultHandler().ServeHTTP(w, r)
+		}
+	}))
+	return &removed
+}
+
+func (s *S) setClusterPlan(c *check.C) {
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	for _, image := range []string{"elasticsearch", "exporter"} {
+		err = client.PullImage(docker.PullImageOptions{Repository: image}, docker.AuthConfiguration{})
+		c.Assert(err, check.IsNil)
+	}
+	config.Plans = []Plan{{
+		Name: "es",
+		Members: []PlanMember{
+			{Name: "node", Image: "elasticsearch", Replicas: 3, Ports: []PlanPort{{Name: "http", Port: "9200"}}, ClientFacing: true},
+			{Name: "exporter", Image: "exporter"},
+		},
+	}}
+}
+
+func (*S) TestMemberHostConfig(c *check.C) {
+	config.HostConfig = &docker.HostConfig{
+		Memory:          256 << 20,
+		PublishAllPorts: true,
+		PortBindings:    map[docker.Port][]docker.PortBinding{"9300/tcp": {{HostIP: "10.0.0.1"}}},
+	}
+	member := PlanMember{Image: "elasticsearch", ClientFacing: true}
+	c.Assert(member.hostConfig(""), check.Equals, config.HostConfig)
+	hostConfig := member.hostConfig("mynet")
+	c.Assert(hostConfig.NetworkMode, check.Equals, "mynet")
+	c.Assert(hostConfig.PublishAllPorts, check.Equals, true)
+	member.ClientFacing = false
+	c.Assert(member.hostConfig("mynet").PublishAllPorts, check.Equals, false)
+	member.Ports = []PlanPort{{Name: "http", Port: "9200"}, {Name: "transport", Port: "9300"}}
+	hostConfig = member.hostConfig("")
+	c.Assert(hostConfig.Memory, check.Equals, int64(256<<20))
+	c.Assert(hostConfig.PublishAllPorts, check.Equals, false)
+	c.Assert(hostConfig.PortBindings, check.DeepEquals, map[docker.Port][]docker.PortBinding{
+		"9200/tcp": {{}},
+		"9300/tcp": {{HostIP: "10.0.0.1"}},
+	})
+	c.Assert(config.HostConfig.PublishAllPorts, check.Equals, true)
+}
+
+func (s *S) TestPlanContainerSpecs(c *check.C) {
+	plan := Plan{Name: "memcached", Image: "memcached", Args: []string{"-m", "64"}}
+	specs := plan.containerSpecs("mycache")
+	c.Assert(specs, check.DeepEquals, []containerSpec{
+		{name: "diaats-memcached-mycache", member: PlanMember{Image: "memcached", Args: []string{"-m", "64"}, ClientFacing: true}},
+	})
+	s.setClusterPlan(c)
+	specs = config.Plans[0].containerSpecs("mysearch")
+	names := make([]string, len(specs))
+	for i, spec := range specs {
+		names[i] = spec.name
+	}
+	c.Assert(names, check.DeepEquals, []string{
+		"diaats-es-mysearch-node-1",
+		"diaats-es-mysearch-node-2",
+		"diaats-es-mysearch-node-3",
+		"diaats-es-mysearch-exporter-1",
+	})
+	c.Assert(config.Plans[0].ToMap()["description"], check.Equals, "Run a group of containers: node (3), exporter")
+}
+
+func (*S) TestValidatePlansMembers(c *check.C) {
+	plans := []Plan{{
+		Name: "es",
+		Members: []PlanMember{
+			{Name: "node", Image: "elasticsearch"},
+			{Name: "node", Replicas: -1},
+			{Name: "-exporter", Image: "exporter"},
+		},
+	}}
+	errs := validatePlans(plans)
+	c.Assert(errs, check.HasLen, 5)
+	c.Assert(errs[0], check.ErrorMatches, `plan "es": member "node": duplicate name`)
+	c.Assert(errs[1], check.ErrorMatches, `plan "es": member "node": missing image`)
+	c.Assert(errs[2], check.ErrorMatches, `plan "es": member "node": invalid number of replicas`)
+	c.Assert(errs[3], check.ErrorMatches, `plan "es": member #2: invalid name "-exporter"`)
+	c.Assert(errs[4], check.ErrorMatches, `plan "es": no client-facing member`)
+}
+
+func (s *S) TestCreateInstanceMultiContainer(c *check.C) {
+	removed := s.handleNetworks()
+	s.setClusterPlan(c)
+	err := CreateInstance(context.Background(), "mysearch", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	instance, err := GetInstance(context.Background(), "mysearch")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.Network, check.Equals, "diaats-es-mysearch")
+	c.Assert(instance.Containers, check.HasLen, 4)
+	c.Assert(instance.ContainerID, check.Equals, instance.Containers[0].ID)
+	c.Assert(instance.Endpoints(), check.HasLen, 3)
+	c.Assert(instance.Containers[3].Member, check.Equals, "exporter")
+	c.Assert(instance.Containers[3].ClientFacing, check.Equals, false)
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	network, err := client.NetworkInfo("diaats-es-mysearch")
+	c.Assert(err, check.IsNil)
+	c.Assert(network.Driver, check.Equals, "bridge")
+	container, err := client.InspectContainer(instance.Containers[3].ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(container.Name, check.Equals, "diaats-es-mysearch-exporter-1")
+	c.Assert(container.HostConfig.NetworkMode, check.Equals, "diaats-es-mysearch")
+	c.Assert(container.Config.Env, check.DeepEquals, []string{
+		"DIAATS_MEMBERS=diaats-es-mysearch-node-1,diaats-es-mysearch-node-2,diaats-es-mysearch-node-3,diaats-es-mysearch-exporter-1",
+	})
+	err = DestroyInstance(context.Background(), "mysearch")
+	c.Assert(err, check.IsNil)
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(containers, check.HasLen, 0)
+	c.Assert(*removed, check.DeepEquals, []string{"diaats-es-mysearch"})
+}
+
+func (s *S) TestCreateInstanceMultiContainerRollsBack(c *check.C) {
+	removed := s.handleNetworks()
+	s.setClusterPlan(c)
+	s.server.PrepareFailure("start-failure", "/containers/.*/start")
+	defer s.server.ResetFailure("start-failure")
+	err := CreateInstance(context.Background(), "mysearch", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.NotNil)
+	_, err = GetInstance(context.Background(), "mysearch")
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(containers, check.HasLen, 0)
+	c.Assert(*removed, check.DeepEquals, []string{"diaats-es-mysearch"})
+}
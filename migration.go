@@ -0,0 +1,164 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// migration is a change to the data stored in MongoDB. Migrations run in
+// the order they're declared in the migrations slice, and each one runs only
+// once: the names of the applied migrations are stored in the migrations
+// collection.
+type migration struct {
+	Name string
+	Run  func(db *mgo.Database) error
+}
+
+// migrations is the ordered list of migrations. New migrations must be
+// appended to the end of the list, and existing migrations must never be
+// renamed.
+var migrations = []migration{
+	{Name: "001-indexes-and-missing-fields", Run: migrateIndexesAndMissingFields},
+	{Name: "002-instance-state", Run: migrateInstanceState},
+	{Name: "003-unique-host-address", Run: migrateUniqueHostAddress},
+	{Name: "004-container-hosts", Run: migrateContainerHosts},
+}
+
+type appliedMigration struct {
+	Name      string    `bson:"_id"`
+	AppliedAt time.Time `bson:"appliedat"`
+}
+
+// migrationsLease is the lease held while migrations run, so replicas of the
+// API starting together don't run them concurrently. migrationsLeaseTTL
+// bounds how long a replica that died while migrating blocks the others.
+const (
+	migrationsLease    = "migrations"
+	migrationsLeaseTTL = 10 * time.Minute
+)
+
+// runMigrations applies the pending migrations in the MongoDB storage,
+// returning the names of the migrations that ran. Other storages don't need
+// migrations, so it's a no-op for them. When another process is running the
+// migrations, it waits for it to finish.
+func runMigrations(ctx context.Context, s Storage) ([]string, error) {
+	if _, ok := s.(*mongoStorage); !ok {
+		return nil, nil
+	}
+	for {
+		ok, err := s.AcquireLease(migrationsLease, leaseOwner, migrationsLeaseTTL)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		loggerFromContext(ctx).Info("waiting for migrations running in another process")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	defer s.ReleaseLease(migrationsLease, leaseOwner)
+	coll, err := connectTo("migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer coll.Close()
+	var applied []string
+	for _, m := range migrations {
+		n, err := coll.FindId(m.Name).Count()
+		if err != nil {
+			return applied, err
+		}
+		if n > 0 {
+			continue
+		}
+		loggerFromContext(ctx).Info("running migration", "migration", m.Name)
+		if err = m.Run(coll.Database); err != nil {
+			return applied, err
+		}
+		err = coll.Insert(appliedMigration{Name: m.Name, AppliedAt: time.Now().UTC()})
+		if mgo.IsDup(err) {
+			// Applied by a process that lost its lease while running
+			// it. Migrations are idempotent, so there's nothing to undo.
+			continue
+		}
+		if err != nil {
+			return applied, err
+		}
+		applied = append(applied, m.Name)
+	}
+	return applied, nil
+}
+
+// migrateIndexesAndMissingFields creates the indexes used by the API and
+// fills fields that documents created by older versions lack.
+func migrateIndexesAndMissingFields(db *mgo.Database) error {
+	instances := db.C("instances")
+	err := instances.EnsureIndex(mgo.Index{Key: []string{"name"}, Unique: true})
+	if err != nil {
+		return err
+	}
+	events := db.C("events")
+	for _, key := range [][]string{{"instance", "-starttime"}, {"-starttime"}} {
+		if err = events.EnsureIndex(mgo.Index{Key: key}); err != nil {
+			return err
+		}
+	}
+	for _, field := range []string{"hostports", "envs"} {
+		_, err = instances.UpdateAll(
+			bson.M{field: nil},
+			bson.M{"$set": bson.M{field: []string{}}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if config.DockerHost != "" {
+		_, err = instances.UpdateAll(
+			bson.M{"dockerhost": bson.M{"$in": []interface{}{nil, ""}}},
+			bson.M{"$set": bson.M{"dockerhost": config.DockerHost}},
+		)
+	}
+	return err
+}
+
+// migrateInstanceState marks instances created before the state field
+// existed as running, and indexes the fields used to filter instances.
+func migrateInstanceState(db *mgo.Database) error {
+	instances := db.C("instances")
+	_, err := instances.UpdateAll(
+		bson.M{"state": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"state": StateRunning}},
+	)
+	if err != nil {
+		return err
+	}
+	for _, key := range []string{"plan.name", "dockerhost", "team", "createdat"} {
+		if err = instances.EnsureIndex(mgo.Index{Key: []string{key}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateUniqueHostAddress indexes the states of Docker hosts by address,
+// which conditional updates of the states rely on.
+func migrateUniqueHostAddress(db *mgo.Database) error {
+	return db.C("hosts").EnsureIndex(mgo.Index{Key: []string{"address"}, Unique: true})
+}
+
+// migrateContainerHosts indexes the hosts of the containers of instances
+// spread across hosts, which filters by Docker host also match.
+func migrateContainerHosts(db *mgo.Database) error {
+	return db.C("instances").EnsureIndex(mgo.Index{Key: []string{"containers.dockerhost"}})
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (*S) TestRunMigrationsNonMongoStorage(c *check.C) {
+	applied, err := runMigrations(context.Background(), newMemoryStorage())
+	c.Assert(err, check.IsNil)
+	c.Assert(applied, check.HasLen, 0)
+}
+
+func (*MongoSuite) TestRunMigrations(c *check.C) {
+	coll, err := connectTo("migrations")
+	c.Assert(err, check.IsNil)
+	defer coll.Close()
+	_, err = coll.RemoveAll(nil)
+	c.Assert(err, check.IsNil)
+	instances, err := connect()
+	c.Assert(err, check.IsNil)
+	defer instances.Close()
+	err = instances.Insert(bson.M{"name": "oldcache", "containerid": "abc123"})
+	c.Assert(err, check.IsNil)
+	old := migrations
+	defer func() { migrations = old }()
+	var calls int
+	migrations = append(migrations, migration{Name: "999-test", Run: func(db *mgo.Database) error {
+		calls++
+		return nil
+	}})
+	config.DockerHost = "tcp://192.168.50.4:2375"
+	s, err := newMongoStorage()
+	c.Assert(err, check.IsNil)
+	applied, err := runMigrations(context.Background(), s)
+	c.Assert(err, check.IsNil)
+	c.Assert(applied, check.DeepEquals, []string{"001-indexes-and-missing-fields", "002-instance-state", "003-unique-host-address", "004-container-hosts", "999-test"})
+	applied, err = runMigrations(context.Background(), s)
+	c.Assert(err, check.IsNil)
+	c.Assert(applied, check.HasLen, 0)
+	c.Assert(calls, check.Equals, 1)
+	instance, err := s.GetInstance("oldcache")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.HostPorts, check.DeepEquals, []string{})
+	c.Assert(instance.Envs, check.DeepEquals, []string{})
+	c.Assert(instance.DockerHost, check.Equals, "tcp://192.168.50.4:2375")
+	c.Assert(instance.State, check.Equals, StateRunning)
+}
+
+func (*MongoSuite) TestRunMigrationsLocked(c *check.C) {
+	s, err := newMongoStorage()
+	c.Assert(err, check.IsNil)
+	ok, err := s.AcquireLease(migrationsLease, "other-process", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, true)
+	defer s.ReleaseLease(migrationsLease, "other-process")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = runMigrations(ctx, s)
+	c.Assert(err, check.Equals, context.DeadlineExceeded)
+}
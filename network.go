@@ -0,0 +1,136 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Network isolation modes, set by NETWORK_ISOLATION. With "instance", each
+// instance gets its own Docker network; with "team", instances of the same
+// team share a network; and with "none", containers use the network
+// configured in DOCKER_CONFIG, usually the default bridge.
+const (
+	NetworkInstance = "instance"
+	NetworkTeam     = "team"
+	NetworkNone     = "none"
+)
+
+// NetworkShared is the scope of the networks named by plans, which are
+// shared by every instance of the plan.
+const NetworkShared = "shared"
+
+// networkFor returns the name and the scope of the network of a new instance
+// of the plan, or empty strings if the instance doesn't get a network.
+// Multi-container plans always need a network, so they get a network for
+// the instance when isolation is disabled.
+func networkFor(plan *Plan, instance *Instance) (string, string) {
+	if plan.Network != "" {
+		return plan.Network, NetworkShared
+	}
+	switch {
+	case config.NetworkIsolation == NetworkTeam && instance.Team != "":
+		return "diaats-team-" + instance.Team, NetworkTeam
+	case config.NetworkIsolation == NetworkInstance, config.NetworkIsolation == NetworkTeam, plan.isGroup():
+		return containerName(plan, instance.Name), NetworkInstance
+	}
+	return "", ""
+}
+
+// networkScope returns the scope of the network of the instance. Instances
+// created before network scopes were recorded only had networks of their
+// own.
+func (i *Instance) networkScope() string {
+	if i.NetworkScope == "" && i.Network != "" {
+		return NetworkInstance
+	}
+	return i.NetworkScope
+}
+
+// createNetwork creates the network of the instance. The network of an
+// instance is created with the instance; like containers, a network with
+// the same name can only be a leftover of a failed attempt to create it.
+// Team and shared networks are created when they don't exist yet. The
+// networks of Swarm services are overlay networks, spanning the cluster.
+func createNetwork(ctx context.Context, p *provisioning) error {
+	name, scope := networkFor(p.plan, p.instance)
+	if name == "" {
+		return nil
+	}
+	opts := docker.CreateNetworkOptions{Name: name, Driver: "bridge", CheckDuplicate: true}
+	if p.instance.isService() {
+		opts.Driver = "overlay"
+	}
+	var err error
+	if scope == NetworkInstance {
+		_, err = p.client.CreateNetwork(opts)
+		if err == docker.ErrNetworkAlreadyExists {
+			p.log.Warn("removing leftover network", "network", name)
+			if err = p.client.RemoveNetwork(name); err != nil {
+				return err
+			}
+			_, err = p.client.CreateNetwork(opts)
+		}
+	} else {
+		// The network is created in the host of every container of
+		// instances spread across hosts.
+		var clients []*docker.Client
+		if clients, err = p.hostClients(); err == nil {
+			for _, client := range clients {
+				if err = ensureNetwork(client, opts); err != nil {
+					break
+				}
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create network %s: %w", name, err)
+	}
+	p.instance.Network = name
+	p.instance.NetworkScope = scope
+	return nil
+}
+
+// ensureNetwork creates the network unless it already exists.
+func ensureNetwork(client *docker.Client, opts docker.CreateNetworkOptions) error {
+	_, err := client.NetworkInfo(opts.Name)
+	if _, ok := err.(*docker.NoSuchNetwork); !ok {
+		return err
+	}
+	_, err = client.CreateNetwork(opts)
+	if err == docker.ErrNetworkAlreadyExists {
+		return nil
+	}
+	return err
+}
+
+// removeNetwork removes the network created for the instance. Team and
+// shared networks are left alone, as other instances may be using them.
+func removeNetwork(ctx context.Context, p *provisioning) error {
+	if p.instance.networkScope() != NetworkInstance {
+		return nil
+	}
+	return p.client.RemoveNetwork(p.instance.Network)
+}
+
+// releaseNetwork removes the network of an instance that was destroyed or
+// moved to another host. The network of a team is removed with the last
+// instance of the team in the host, and shared networks are never removed.
+func releaseNetwork(client *docker.Client, instance *Instance) error {
+	switch instance.networkScope() {
+	case NetworkInstance:
+		return client.RemoveNetwork(instance.Network)
+	case NetworkTeam:
+		_, remaining, err := storage.ListInstances(InstanceFilter{Team: instance.Team, DockerHost: instance.DockerHost, Limit: 1})
+		if err != nil || remaining > 0 {
+			return err
+		}
+		return client.RemoveNetwork(instance.Network)
+	}
+	return nil
+}
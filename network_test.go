@@ -0,0 +1,104 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+func setMemcachedPlan(c *check.C, network string) {
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
+	c.Assert(err, check.IsNil)
+	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached", Network: network}}
+}
+
+func (*S) TestNetworkFor(c *check.C) {
+	plan := Plan{Name: "memcached", Image: "memcached"}
+	group := Plan{Name: "es", Members: []PlanMember{{Name: "node", Image: "elasticsearch", ClientFacing: true}}}
+	shared := Plan{Name: "shared", Image: "memcached", Network: "legacy"}
+	var tests = []struct {
+		isolation string
+		plan      *Plan
+		team      string
+		name      string
+		scope     string
+	}{
+		{"", &plan, "myteam", "", ""},
+		{NetworkNone, &plan, "myteam", "", ""},
+		{NetworkNone, &group, "myteam", "diaats-es-myinstance", NetworkInstance},
+		{NetworkInstance, &plan, "myteam", "diaats-memcached-myinstance", NetworkInstance},
+		{NetworkTeam, &plan, "myteam", "diaats-team-myteam", NetworkTeam},
+		{NetworkTeam, &plan, "", "diaats-memcached-myinstance", NetworkInstance},
+		{NetworkInstance, &shared, "myteam", "legacy", NetworkShared},
+	}
+	for _, t := range tests {
+		config.NetworkIsolation = t.isolation
+		name, scope := networkFor(t.plan, &Instance{Name: "myinstance", Team: t.team})
+		c.Check(name, check.Equals, t.name, check.Commentf("isolation %q, plan %s", t.isolation, t.plan.Name))
+		c.Check(scope, check.Equals, t.scope, check.Commentf("isolation %q, plan %s", t.isolation, t.plan.Name))
+	}
+}
+
+func (s *S) TestCreateInstanceNetworkPerInstance(c *check.C) {
+	removed := s.handleNetworks()
+	config.NetworkIsolation = NetworkInstance
+	setMemcachedPlan(c, "")
+	err := CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	instance, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.Network, check.Equals, "diaats-supermemcached-mycache")
+	c.Assert(instance.NetworkScope, check.Equals, NetworkInstance)
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	container, err := client.InspectContainer(instance.ContainerID)
+	c.Assert(err, check.IsNil)
+	c.Assert(container.HostConfig.NetworkMode, check.Equals, "diaats-supermemcached-mycache")
+	c.Assert(container.HostConfig.PublishAllPorts, check.Equals, true)
+	err = DestroyInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(*removed, check.DeepEquals, []string{"diaats-supermemcached-mycache"})
+}
+
+func (s *S) TestCreateInstanceNetworkPerTeam(c *check.C) {
+	removed := s.handleNetworks()
+	config.NetworkIsolation = NetworkTeam
+	setMemcachedPlan(c, "")
+	for _, name := range []string{"mycache", "othercache"} {
+		err := CreateInstance(context.Background(), name, &config.Plans[0], CreateOptions{Team: "myteam"})
+		c.Assert(err, check.IsNil)
+		instance, err := GetInstance(context.Background(), name)
+		c.Assert(err, check.IsNil)
+		c.Assert(instance.Network, check.Equals, "diaats-team-myteam")
+		c.Assert(instance.NetworkScope, check.Equals, NetworkTeam)
+	}
+	err := DestroyInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(*removed, check.HasLen, 0)
+	err = DestroyInstance(context.Background(), "othercache")
+	c.Assert(err, check.IsNil)
+	c.Assert(*removed, check.DeepEquals, []string{"diaats-team-myteam"})
+}
+
+func (s *S) TestCreateInstanceSharedNetwork(c *check.C) {
+	removed := s.handleNetworks()
+	config.NetworkIsolation = NetworkInstance
+	setMemcachedPlan(c, "legacy")
+	err := CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	network, err := client.NetworkInfo("legacy")
+	c.Assert(err, check.IsNil)
+	c.Assert(network.Name, check.Equals, "legacy")
+	err = DestroyInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(*removed, check.HasLen, 0)
+}
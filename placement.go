@@ -0,0 +1,186 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrNoMatchingHost        = errors.New("no Docker host matches the placement constraints of the plan")
+	ErrSourceHostConstraints = errors.New("the Docker host of the source instance doesn't match the placement constraints of the plan")
+	ErrSpreadInstance        = errors.New("operation not supported by instances spread across hosts")
+)
+
+// Groups of instances used by affinity rules. GroupInstance is only used by
+// anti-affinity, spreading the containers of an instance across hosts.
+const (
+	GroupPlan     = "plan"
+	GroupTeam     = "team"
+	GroupInstance = "instance"
+)
+
+// Placement restricts and ranks the Docker hosts of the instances of a plan.
+// The containers of an instance share a host, unless the anti-affinity of a
+// multi-container plan is GroupInstance.
+type Placement struct {
+	// Constraints are expressions on the labels of the hosts, in the
+	// format "key==value" or "key!=value", that every host of the
+	// instances must match. Hosts without the label don't match "==" and
+	// match "!=".
+	Constraints []string `json:"constraints,omitempty"`
+
+	// Affinity prefers the hosts with the most instances of the same
+	// group, which is either GroupPlan or GroupTeam.
+	Affinity string `json:"affinity,omitempty"`
+
+	// AntiAffinity prefers the hosts with the fewest instances of the same
+	// group, spreading them across hosts. With GroupInstance, each
+	// container of an instance prefers the hosts with the fewest containers
+	// of the same member of the instance, then of the instance.
+	AntiAffinity string `json:"antiAffinity,omitempty"`
+}
+
+func (p *Placement) validate() error {
+	for _, expr := range p.Constraints {
+		if _, err := parseConstraint(expr); err != nil {
+			return err
+		}
+	}
+	for _, group := range []string{p.Affinity, p.AntiAffinity} {
+		if group != "" && group != GroupPlan && group != GroupTeam && (group != GroupInstance || group == p.Affinity) {
+			return fmt.Errorf("invalid affinity group %q", group)
+		}
+	}
+	if p.Affinity != "" && p.Affinity == p.AntiAffinity {
+		return fmt.Errorf("affinity and anti-affinity to the same group %q", p.Affinity)
+	}
+	return nil
+}
+
+// constraint is a parsed placement constraint.
+type constraint struct {
+	key, value string
+	negate     bool
+}
+
+func parseConstraint(expr string) (*constraint, error) {
+	op, negate := "==", false
+	if strings.Contains(expr, "!=") {
+		op, negate = "!=", true
+	}
+	parts := strings.SplitN(expr, op, 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return nil, fmt.Errorf("invalid placement constraint %q", expr)
+	}
+	return &constraint{key: strings.TrimSpace(parts[0]), value: strings.TrimSpace(parts[1]), negate: negate}, nil
+}
+
+func (c *constraint) matches(labels map[string]string) bool {
+	value, ok := labels[c.key]
+	return (ok && value == c.value) != c.negate
+}
+
+// matches reports whether the host matches the constraints of the
+// placement. A nil placement matches every host.
+func (p *Placement) matches(host *DockerHost) bool {
+	if p == nil {
+		return true
+	}
+	for _, expr := range p.Constraints {
+		if c, err := parseConstraint(expr); err != nil || !c.matches(host.Labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// groupFilter returns the filter matching the instances of the given
+// affinity group of a new instance of the plan, owned by team. It returns
+// false when the rule doesn't apply to the instance, as for instances
+// without a team or anti-affinity between the containers of an instance.
+func groupFilter(group string, plan *Plan, team string) (InstanceFilter, bool) {
+	switch group {
+	case GroupTeam:
+		return InstanceFilter{Team: team, Limit: 1}, team != ""
+	case GroupPlan:
+		return InstanceFilter{Plan: plan.Name, Limit: 1}, true
+	}
+	return InstanceFilter{}, false
+}
+
+// isSpread reports whether the containers of the instances of the plan are
+// spread across hosts.
+func (p *Plan) isSpread() bool {
+	return p.isGroup() && p.Placement != nil && p.Placement.AntiAffinity == GroupInstance
+}
+
+// validateSpread validates the plans whose containers are spread across
+// hosts. Their containers reach each other through the network of the plan,
+// which must span the hosts, like an attachable overlay network, and they
+// don't support the operations that need the containers of an instance in
+// the same host.
+func validateSpread(plan *Plan) []error {
+	if plan.Placement == nil || plan.Placement.AntiAffinity != GroupInstance {
+		return nil
+	}
+	if !plan.isGroup() {
+		return []error{errors.New("anti-affinity between the containers of an instance requires a multi-container plan")}
+	}
+	var errs []error
+	if plan.Network == "" {
+		errs = append(errs, errors.New("anti-affinity between the containers of an instance requires a network spanning the hosts"))
+	}
+	if plan.Backup != nil {
+		errs = append(errs, errors.New("backups aren't supported by instances spread across hosts"))
+	}
+	if plan.Updates != nil && plan.Updates.Policy == UpdateRecreate {
+		errs = append(errs, errors.New("recreate updates aren't supported by instances spread across hosts"))
+	}
+	return errs
+}
+
+// hostScore ranks a host for a new instance. Hosts with lower scores are
+// preferred, comparing affinity, then anti-affinity, then the total number
+// of instances.
+type hostScore [3]int
+
+func (s hostScore) less(o hostScore) bool {
+	for i := range s {
+		if s[i] != o[i] {
+			return s[i] < o[i]
+		}
+	}
+	return false
+}
+
+// scoreHost returns the score of the host at address for a new instance of
+// the plan, owned by team.
+func scoreHost(address string, plan *Plan, team string) (hostScore, error) {
+	var score hostScore
+	count := func(filter InstanceFilter) (int, error) {
+		filter.DockerHost = address
+		_, total, err := storage.ListInstances(filter)
+		return total, err
+	}
+	var err error
+	if p := plan.Placement; p != nil {
+		if filter, ok := groupFilter(p.Affinity, plan, team); ok {
+			if score[0], err = count(filter); err != nil {
+				return score, err
+			}
+			score[0] = -score[0]
+		}
+		if filter, ok := groupFilter(p.AntiAffinity, plan, team); ok {
+			if score[1], err = count(filter); err != nil {
+				return score, err
+			}
+		}
+	}
+	score[2], err = count(InstanceFilter{Limit: 1})
+	return score, err
+}
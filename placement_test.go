@@ -0,0 +1,230 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+func (*S) TestParseConstraint(c *check.C) {
+	var tests = []struct {
+		expr       string
+		constraint *constraint
+		err        string
+	}{
+		{"disk==ssd", &constraint{key: "disk", value: "ssd"}, ""},
+		{"dc != east", &constraint{key: "dc", value: "east", negate: true}, ""},
+		{"disk==", &constraint{key: "disk"}, ""},
+		{"==ssd", nil, `invalid placement constraint "==ssd"`},
+		{"disk", nil, `invalid placement constraint "disk"`},
+		{"disk=ssd", nil, `invalid placement constraint "disk=ssd"`},
+	}
+	for _, t := range tests {
+		constraint, err := parseConstraint(t.expr)
+		if t.err != "" {
+			c.Check(err, check.ErrorMatches, t.err)
+			continue
+		}
+		c.Check(err, check.IsNil)
+		c.Check(constraint, check.DeepEquals, t.constraint, check.Commentf(t.expr))
+	}
+}
+
+func (*S) TestPlacementMatches(c *check.C) {
+	host := DockerHost{Address: "tcp://10.0.0.1:2375", Labels: map[string]string{"disk": "ssd", "dc": "west"}}
+	var tests = []struct {
+		placement *Placement
+		matches   bool
+	}{
+		{nil, true},
+		{&Placement{}, true},
+		{&Placement{Constraints: []string{"disk==ssd"}}, true},
+		{&Placement{Constraints: []string{"disk==ssd", "dc!=east"}}, true},
+		{&Placement{Constraints: []string{"disk==hdd"}}, false},
+		{&Placement{Constraints: []string{"dc!=west"}}, false},
+		{&Placement{Constraints: []string{"rack==1"}}, false},
+		{&Placement{Constraints: []string{"rack!=1"}}, true},
+	}
+	for _, t := range tests {
+		c.Check(t.placement.matches(&host), check.Equals, t.matches, check.Commentf("%#v", t.placement))
+	}
+}
+
+func (*S) TestValidatePlansPlacement(c *check.C) {
+	plans := []Plan{
+		{Name: "p1", Image: "memcached", Placement: &Placement{Constraints: []string{"disk"}}},
+		{Name: "p2", Image: "memcached", Placement: &Placement{Affinity: "host"}},
+		{Name: "p3", Image: "memcached", Placement: &Placement{Affinity: GroupTeam, AntiAffinity: GroupTeam}},
+		{Name: "p4", Image: "memcached", Placement: &Placement{Constraints: []string{"disk==ssd"}, Affinity: GroupTeam, AntiAffinity: GroupPlan}},
+		{Name: "p5", Members: []PlanMember{{Name: "node", Image: "elasticsearch", Replicas: 3, ClientFacing: true}}, Placement: &Placement{AntiAffinity: GroupPlan}},
+		{Name: "p6", Members: []PlanMember{{Name: "node", Image: "elasticsearch", Replicas: 3, ClientFacing: true}}, Network: "es", Placement: &Placement{AntiAffinity: GroupInstance}},
+		{Name: "p7", Members: []PlanMember{{Name: "node", Image: "elasticsearch", Replicas: 3, ClientFacing: true}}, Network: "es", Placement: &Placement{Affinity: GroupInstance}},
+		{Name: "p8", Image: "memcached", Placement: &Placement{AntiAffinity: GroupInstance}},
+		{Name: "p9", Members: []PlanMember{{Name: "node", Image: "elasticsearch", Replicas: 3, ClientFacing: true}}, Placement: &Placement{AntiAffinity: GroupInstance}},
+	}
+	errs := validatePlans(plans)
+	c.Assert(errs, check.HasLen, 6)
+	c.Assert(errs[0], check.ErrorMatches, `plan "p1": invalid placement constraint "disk"`)
+	c.Assert(errs[1], check.ErrorMatches, `plan "p2": invalid affinity group "host"`)
+	c.Assert(errs[2], check.ErrorMatches, `plan "p3": affinity and anti-affinity to the same group "team"`)
+	c.Assert(errs[3], check.ErrorMatches, `plan "p7": invalid affinity group "instance"`)
+	c.Assert(errs[4], check.ErrorMatches, `plan "p8": anti-affinity between the containers of an instance requires a multi-container plan`)
+	c.Assert(errs[5], check.ErrorMatches, `plan "p9": anti-affinity between the containers of an instance requires a network spanning the hosts`)
+}
+
+func (s *S) TestChooseHostConstraints(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	config.DockerHosts[1].Labels = map[string]string{"disk": "ssd"}
+	plan := Plan{Name: "fast", Image: "memcached", Placement: &Placement{Constraints: []string{"disk==ssd"}}}
+	err := storage.InsertInstance(&Instance{Name: "mycache", DockerHost: other.URL(), Plan: plan})
+	c.Assert(err, check.IsNil)
+	host, release, err := chooseHost(context.Background(), &plan, "")
+	c.Assert(err, check.IsNil)
+	release()
+	c.Assert(host, check.Equals, other.URL())
+	err = CordonHost(context.Background(), config.DockerHosts[1].name())
+	c.Assert(err, check.IsNil)
+	_, _, err = chooseHost(context.Background(), &plan, "")
+	c.Assert(err, check.Equals, ErrNoMatchingHost)
+	plan.Placement = nil
+	host, release, err = chooseHost(context.Background(), &plan, "")
+	c.Assert(err, check.IsNil)
+	release()
+	c.Assert(host, check.Equals, config.DockerHost)
+}
+
+func (s *S) TestChooseHostAffinity(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	plan := Plan{Name: "memcached", Image: "memcached"}
+	for _, instance := range []Instance{
+		{Name: "a", DockerHost: config.DockerHost, Plan: plan, Team: "team1"},
+		{Name: "b", DockerHost: other.URL(), Plan: Plan{Name: "redis"}, Team: "team2"},
+		{Name: "c", DockerHost: other.URL(), Plan: Plan{Name: "redis"}, Team: "team2"},
+	} {
+		err := storage.InsertInstance(&instance)
+		c.Assert(err, check.IsNil)
+	}
+	var tests = []struct {
+		placement *Placement
+		team      string
+		host      string
+	}{
+		{nil, "team1", config.DockerHost},
+		{&Placement{AntiAffinity: GroupPlan}, "team1", other.URL()},
+		{&Placement{AntiAffinity: GroupTeam}, "team1", other.URL()},
+		{&Placement{AntiAffinity: GroupTeam}, "team2", config.DockerHost},
+		{&Placement{Affinity: GroupTeam}, "team2", other.URL()},
+		{&Placement{Affinity: GroupPlan}, "team2", config.DockerHost},
+		{&Placement{Affinity: GroupTeam, AntiAffinity: GroupPlan}, "team3", other.URL()},
+		{&Placement{Affinity: GroupTeam}, "", config.DockerHost},
+	}
+	for _, t := range tests {
+		plan.Placement = t.placement
+		host, release, err := chooseHost(context.Background(), &plan, t.team)
+		c.Assert(err, check.IsNil)
+		release()
+		c.Check(host, check.Equals, t.host, check.Commentf("%#v %s", t.placement, t.team))
+	}
+}
+
+func (s *S) TestCreateInstanceFromSourceConstraints(c *check.C) {
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	plan := config.Plans[0]
+	plan.Placement = &Placement{Constraints: []string{"disk==ssd"}}
+	err := CreateInstance(context.Background(), "mycopy", &plan, CreateOptions{Source: "mycache"})
+	c.Assert(err, check.Equals, ErrSourceHostConstraints)
+}
+
+func spreadPlan() Plan {
+	return Plan{
+		Name: "es",
+		Members: []PlanMember{
+			{Name: "node", Image: "memcached", Replicas: 3, ClientFacing: true},
+			{Name: "exporter", Image: "memcached"},
+		},
+		Network:   "diaats-es",
+		Placement: &Placement{AntiAffinity: GroupInstance},
+	}
+}
+
+func (s *S) TestSpreadContainers(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	plan := spreadPlan()
+	hosts, release, err := spreadContainers(context.Background(), &plan, "")
+	c.Assert(err, check.IsNil)
+	release()
+	c.Assert(hosts, check.DeepEquals, []string{config.DockerHost, other.URL(), config.DockerHost, other.URL()})
+	err = CordonHost(context.Background(), config.DockerHosts[1].name())
+	c.Assert(err, check.IsNil)
+	hosts, release, err = spreadContainers(context.Background(), &plan, "")
+	c.Assert(err, check.IsNil)
+	release()
+	c.Assert(hosts, check.DeepEquals, []string{config.DockerHost, config.DockerHost, config.DockerHost, config.DockerHost})
+}
+
+func (s *S) TestCreateSpreadInstance(c *check.C) {
+	other := s.addDockerHost(c)
+	defer other.Stop()
+	s.handleNetworks()
+	handleServerNetworks(other)
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
+	c.Assert(err, check.IsNil)
+	config.Plans = []Plan{spreadPlan()}
+	err = CreateInstance(context.Background(), "mycluster", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycluster")
+	instance, err := storage.GetInstance("mycluster")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.DockerHost, check.Equals, config.DockerHost)
+	c.Assert(instance.Containers, check.HasLen, 4)
+	c.Assert(instance.isSpread(), check.Equals, true)
+	var hosts []string
+	for i := range instance.Containers {
+		hosts = append(hosts, instance.containerHost(&instance.Containers[i]))
+	}
+	c.Assert(hosts, check.DeepEquals, []string{config.DockerHost, other.URL(), config.DockerHost, other.URL()})
+	client, err = docker.NewClient(other.URL())
+	c.Assert(err, check.IsNil)
+	container, err := client.InspectContainer(instance.Containers[1].ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(container.HostConfig.NetworkMode, check.Equals, "diaats-es")
+	instances, _, err := storage.ListInstances(InstanceFilter{DockerHost: other.URL()})
+	c.Assert(err, check.IsNil)
+	c.Assert(instances, check.HasLen, 1)
+	report, err := Reconcile(context.Background(), true)
+	c.Assert(err, check.IsNil)
+	c.Assert(report.OrphanContainers, check.HasLen, 0)
+	c.Assert(report.MissingContainers, check.HasLen, 0)
+	_, err = SnapshotInstance(context.Background(), instance)
+	c.Assert(err, check.Equals, ErrSpreadInstance)
+	_, err = QueueOperation(context.Background(), "mycluster", OperationRecreate, "testing")
+	c.Assert(err, check.Equals, ErrSpreadInstance)
+	err = DestroyInstance(context.Background(), "mycluster")
+	c.Assert(err, check.IsNil)
+	_, err = client.InspectContainer(instance.Containers[1].ID)
+	c.Assert(err, check.FitsTypeOf, &docker.NoSuchContainer{})
+}
+
+func (s *S) TestSpreadInstanceEndpoints(c *check.C) {
+	instance := Instance{
+		DockerHost: "tcp://10.0.0.1:2376",
+		Containers: []InstanceContainer{
+			{ClientFacing: true, Ports: []InstancePort{{Name: "http", ContainerPort: "9200/tcp", HostPort: "32001"}}},
+			{ClientFacing: true, Ports: []InstancePort{{Name: "http", ContainerPort: "9200/tcp", HostPort: "32002"}}, DockerHost: "tcp://10.0.0.2:2376"},
+			{Ports: []InstancePort{{Name: "metrics", ContainerPort: "9108/tcp", HostPort: "32003"}}, DockerHost: "tcp://10.0.0.2:2376"},
+		},
+	}
+	c.Assert(instance.Endpoints(), check.DeepEquals, []string{"10.0.0.1:32001", "10.0.0.2:32002"})
+	c.Assert(instance.NamedEndpoints(), check.DeepEquals, map[string]string{"http": "10.0.0.1:32001,10.0.0.2:32002"})
+}
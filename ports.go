@@ -0,0 +1,163 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+var (
+	portRegexp    = regexp.MustCompile(`^[0-9]{1,5}(/(tcp|udp))?$`)
+	envNameRegexp = regexp.MustCompile(`[^A-Z0-9]+`)
+)
+
+// PlanPort is a container port published by the instances of a plan. Name
+// identifies the port in the environment variables returned on bind.
+type PlanPort struct {
+	Name string `json:"name"`
+	Port string `json:"port"`
+}
+
+// dockerPort returns the port in the format used by Docker, defaulting to
+// TCP.
+func (p *PlanPort) dockerPort() docker.Port {
+	return dockerPort(p.Port)
+}
+
+func dockerPort(port string) docker.Port {
+	if !strings.Contains(port, "/") {
+		port += "/tcp"
+	}
+	return docker.Port(port)
+}
+
+// InstancePort is a published port of an instance, bound to HostPort in its
+// Docker host. Name is empty for ports that aren't named by the plan.
+type InstancePort struct {
+	Name          string
+	ContainerPort string
+	HostPort      string
+}
+
+func validatePorts(ports []PlanPort) []error {
+	var errs []error
+	names := make(map[string]bool, len(ports))
+	for i, port := range ports {
+		if port.Name == "" {
+			errs = append(errs, fmt.Errorf("port #%d: missing name", i))
+		} else if names[envName(port.Name)] {
+			errs = append(errs, fmt.Errorf("port %q: duplicate name", port.Name))
+		}
+		names[envName(port.Name)] = true
+		if !portRegexp.MatchString(port.Port) {
+			errs = append(errs, fmt.Errorf("port %q: invalid port %q", port.Name, port.Port))
+		}
+	}
+	return errs
+}
+
+// publishedPorts returns the host ports bound to the container, sorted by
+// container port, and the ports named by the member.
+func publishedPorts(container *docker.Container, member *PlanMember) ([]string, []InstancePort) {
+	bindings := container.NetworkSettings.Ports
+	containerPorts := make([]docker.Port, 0, len(bindings))
+	for port := range bindings {
+		containerPorts = append(containerPorts, port)
+	}
+	sort.Slice(containerPorts, func(a, b int) bool {
+		na, _ := strconv.Atoi(containerPorts[a].Port())
+		nb, _ := strconv.Atoi(containerPorts[b].Port())
+		if na != nb {
+			return na < nb
+		}
+		return containerPorts[a].Proto() < containerPorts[b].Proto()
+	})
+	names := make(map[docker.Port]string, len(member.Ports))
+	for _, port := range member.Ports {
+		names[port.dockerPort()] = port.Name
+	}
+	hostPorts := make([]string, 0, len(bindings))
+	ports := make([]InstancePort, 0, len(bindings))
+	for _, port := range containerPorts {
+		for _, binding := range bindings[port] {
+			hostPorts = append(hostPorts, binding.HostPort)
+		}
+		if len(bindings[port]) > 0 {
+			ports = append(ports, InstancePort{Name: names[port], ContainerPort: string(port), HostPort: bindings[port][0].HostPort})
+		}
+	}
+	return hostPorts, ports
+}
+
+// hostPort returns the host port bound to the given container port, which
+// may also be referenced by its name in the plan.
+func (i *Instance) hostPort(port string) (string, bool) {
+	for _, p := range i.Ports {
+		if (p.Name != "" && p.Name == port) || p.ContainerPort == string(dockerPort(port)) {
+			return p.HostPort, true
+		}
+	}
+	return "", false
+}
+
+// NamedEndpoints returns the endpoints of the named ports of the instance,
+// in the format host:port, keyed by the name of the port. The endpoints of
+// replicas sharing a port name are separated by commas, in the order of the
+// containers.
+func (i *Instance) NamedEndpoints() map[string]string {
+	result := make(map[string]string, len(i.Ports))
+	for _, port := range i.portEndpoints() {
+		if port.name == "" {
+			continue
+		}
+		endpoint := port.endpoint
+		if previous, ok := result[port.name]; ok {
+			endpoint = previous + "," + endpoint
+		}
+		result[port.name] = endpoint
+	}
+	return result
+}
+
+// portEndpoint is the endpoint of a published port of an instance.
+type portEndpoint struct {
+	name     string
+	endpoint string
+}
+
+// portEndpoints returns the endpoints of the published ports of the
+// client-facing containers of the instance, in the host of each container.
+func (i *Instance) portEndpoints() []portEndpoint {
+	var result []portEndpoint
+	if !i.isSpread() {
+		host := i.host()
+		for _, port := range i.Ports {
+			result = append(result, portEndpoint{name: port.Name, endpoint: host + ":" + port.HostPort})
+		}
+		return result
+	}
+	for n := range i.Containers {
+		container := &i.Containers[n]
+		if !container.ClientFacing {
+			continue
+		}
+		host := i.hostName(i.containerHost(container))
+		for _, port := range container.Ports {
+			result = append(result, portEndpoint{name: port.Name, endpoint: host + ":" + port.HostPort})
+		}
+	}
+	return result
+}
+
+// envName converts name to the format used in environment variables.
+func envName(name string) string {
+	return strings.Trim(envNameRegexp.ReplaceAllString(strings.ToUpper(name), "_"), "_")
+}
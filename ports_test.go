@@ -0,0 +1,110 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+func (*S) TestValidatePlansPorts(c *check.C) {
+	plans := []Plan{{
+		Name:      "es",
+		Image:     "elasticsearch",
+		Ports:     []PlanPort{{Name: "http", Port: "9200"}, {Name: "HTTP", Port: "9300/tcp"}, {Name: "", Port: "abc"}},
+		Readiness: &ReadinessCheck{Type: ReadinessTCP, Port: "9400"},
+	}}
+	errs := validatePlans(plans)
+	c.Assert(errs, check.HasLen, 4)
+	c.Assert(errs[0], check.ErrorMatches, `plan "es": port "HTTP": duplicate name`)
+	c.Assert(errs[1], check.ErrorMatches, `plan "es": port #2: missing name`)
+	c.Assert(errs[2], check.ErrorMatches, `plan "es": port "": invalid port "abc"`)
+	c.Assert(errs[3], check.ErrorMatches, `plan "es": readiness check port 9400 is not published`)
+}
+
+func (*S) TestPublishedPorts(c *check.C) {
+	member := PlanMember{Ports: []PlanPort{{Name: "transport", Port: "9300"}, {Name: "http", Port: "9200"}}}
+	container := docker.Container{NetworkSettings: &docker.NetworkSettings{
+		Ports: map[docker.Port][]docker.PortBinding{
+			"9300/tcp":  {{HostPort: "32001"}},
+			"10000/tcp": {{HostPort: "32003"}},
+			"9200/tcp":  {{HostPort: "32002"}},
+		},
+	}}
+	hostPorts, ports := publishedPorts(&container, &member)
+	c.Assert(hostPorts, check.DeepEquals, []string{"32002", "32001", "32003"})
+	c.Assert(ports, check.DeepEquals, []InstancePort{
+		{Name: "http", ContainerPort: "9200/tcp", HostPort: "32002"},
+		{Name: "transport", ContainerPort: "9300/tcp", HostPort: "32001"},
+		{ContainerPort: "10000/tcp", HostPort: "32003"},
+	})
+	instance := Instance{Ports: ports}
+	port, ok := instance.hostPort("transport")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(port, check.Equals, "32001")
+	port, ok = instance.hostPort("10000")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(port, check.Equals, "32003")
+	_, ok = instance.hostPort("11211")
+	c.Assert(ok, check.Equals, false)
+}
+
+func (*S) TestEnvName(c *check.C) {
+	c.Assert(envName("es"), check.Equals, "ES")
+	c.Assert(envName("memcached-1.4"), check.Equals, "MEMCACHED_1_4")
+	c.Assert(envName("-http-"), check.Equals, "HTTP")
+}
+
+func (*S) TestNamedEndpointsReplicas(c *check.C) {
+	instance := Instance{
+		DockerHost: "tcp://10.0.0.5:2375",
+		Ports: []InstancePort{
+			{Name: "http", ContainerPort: "9200/tcp", HostPort: "32768"},
+			{ContainerPort: "9300/tcp", HostPort: "32769"},
+			{Name: "http", ContainerPort: "9200/tcp", HostPort: "32770"},
+		},
+	}
+	c.Assert(instance.NamedEndpoints(), check.DeepEquals, map[string]string{
+		"http": "10.0.0.5:32768,10.0.0.5:32770",
+	})
+}
+
+func (*S) TestBindAppHandlerNamedPorts(c *check.C) {
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	err = client.PullImage(docker.PullImageOptions{Repository: "elasticsearch"}, docker.AuthConfiguration{})
+	c.Assert(err, check.IsNil)
+	config.Plans = []Plan{{
+		Name:  "es",
+		Image: "elasticsearch",
+		Ports: []PlanPort{{Name: "http", Port: "9200"}, {Name: "transport", Port: "9300"}},
+	}}
+	err = CreateInstance(context.Background(), "mysearch", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mysearch")
+	instance, err := GetInstance(context.Background(), "mysearch")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.Ports, check.HasLen, 2)
+	container, err := client.InspectContainer(instance.ContainerID)
+	c.Assert(err, check.IsNil)
+	c.Assert(container.HostConfig.PublishAllPorts, check.Equals, false)
+	request, err := http.NewRequest("POST", "/resources/mysearch/bind-app", strings.NewReader(""))
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	buildMuxer().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var envs map[string]string
+	err = json.NewDecoder(recorder.Body).Decode(&envs)
+	c.Assert(err, check.IsNil)
+	c.Assert(envs["DIAATS_ES_HTTP_ENDPOINT"], check.Equals, "127.0.0.1:"+instance.Ports[0].HostPort)
+	c.Assert(envs["DIAATS_ES_TRANSPORT_ENDPOINT"], check.Equals, "127.0.0.1:"+instance.Ports[1].HostPort)
+	c.Assert(envs["DIAATS_ES_INSTANCE"], check.Equals, `["127.0.0.1:`+instance.Ports[0].HostPort+`","127.0.0.1:`+instance.Ports[1].HostPort+`"]`)
+}
@@ -0,0 +1,430 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// provisioning holds the state shared by the steps that create an instance.
+type provisioning struct {
+	instance *Instance
+	plan     *Plan
+	client   *docker.Client
+	log      *slog.Logger
+
+	// releaseMemory releases the memory reserved for the instance in its
+	// host, which its record accounts for once it's stored.
+	releaseMemory func()
+
+	// hosts are the Docker hosts of the containers of instances spread
+	// across hosts, in the same order as specs. The containers of other
+	// instances run in the host of the instance.
+	hosts []string
+
+	// specs are the containers of the instance, and containers are the
+	// ones already created, in the same order.
+	specs      []containerSpec
+	containers []*docker.Container
+
+	// source is the instance or snapshot the instance is cloned from, and
+	// images are the images of its containers, in the same order as specs.
+	// snapshot is the snapshot of the source, which is temporary when the
+	// source is a live instance.
+	source            string
+	images            []string
+	snapshot          *Snapshot
+	temporarySnapshot bool
+
+	// volumes are the named volumes of the containers, in the same order
+	// as specs.
+	volumes [][]InstanceVolume
+
+	// pinnedPorts are the ports of the containers being recreated, bound
+	// to the same host ports by the new containers, and replaced are the
+	// old containers.
+	pinnedPorts [][]InstancePort
+	replaced    []replacedContainer
+
+	// container is the primary container of the instance, used by the
+	// readiness check.
+	container *docker.Container
+
+	// from is the instance being moved to another host, as it is in its old
+	// host, reached through fromClient, and stopped are its containers
+	// stopped to copy their volumes.
+	from       *Instance
+	fromClient *docker.Client
+	stopped    []string
+
+	// services are the IDs of the Swarm services already created, in the
+	// same order as specs.
+	services []string
+}
+
+// step is a reversible part of the creation of an instance. When a step
+// fails, the steps that already ran are rolled back in reverse order.
+type step struct {
+	name string
+
+	// forward runs the step. When it fails, it must leave nothing behind.
+	forward func(ctx context.Context, p *provisioning) error
+
+	// backward undoes what forward did. It may be nil for steps that
+	// don't create anything.
+	backward func(ctx context.Context, p *provisioning) error
+}
+
+// provisionSteps are the steps executed by CreateInstance, in order. Host
+// firewall rules are out of their scope: instances are isolated from each
+// other by Docker networks, as described in networkFor, and access to the
+// published ports must be restricted by the operator.
+var provisionSteps = []step{
+	{name: "reserve instance", forward: reserveInstance, backward: releaseInstance},
+	{name: "resolve source", forward: resolveSourceImages, backward: removeTemporarySnapshot},
+	{name: "create volumes", forward: createVolumes, backward: removeVolumes},
+	{name: "create network", forward: createNetwork, backward: removeNetwork},
+	{name: "create containers", forward: createContainers, backward: removeContainers},
+	{name: "restore volumes", forward: restoreSnapshotVolumes},
+	{name: "start containers", forward: startContainers},
+	{name: "inspect containers", forward: inspectContainers},
+	{name: "record images", forward: recordImages},
+	{name: "wait for readiness", forward: waitContainerReady},
+	{name: "save instance", forward: saveInstance},
+	{name: "remove temporary snapshot", forward: removeTemporarySnapshot},
+}
+
+// runSteps runs the given steps in order. If one of them fails, the steps
+// that already ran are rolled back, and the error of the failed step is
+// returned.
+func runSteps(ctx context.Context, steps []step, p *provisioning) error {
+	for i, s := range steps {
+		err := s.forward(ctx, p)
+		if err == nil {
+			continue
+		}
+		if err != ErrInstanceAlreadyExists {
+			p.log.Error("provisioning failed", "step", s.name, "error", err)
+		}
+		if err != ErrInstanceAlreadyExists && p.instance != nil && p.instance.State == StateCreating {
+			recordStatusChange(ctx, p.instance, StatusFailed, "", err)
+		}
+		// The rollback runs even when ctx is canceled, which may be what
+		// made the step fail.
+		rollbackCtx := context.WithoutCancel(ctx)
+		for j := i - 1; j >= 0; j-- {
+			if steps[j].backward == nil {
+				continue
+			}
+			if rollbackErr := steps[j].backward(rollbackCtx, p); rollbackErr != nil {
+				p.log.Error("failed to roll back provisioning", "step", steps[j].name, "error", rollbackErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// reserveInstance stores the instance before anything is created, so the
+// storage prevents concurrent requests from creating two containers for the
+// same instance.
+func reserveInstance(ctx context.Context, p *provisioning) error {
+	if err := storage.InsertInstance(p.instance); err != nil {
+		return err
+	}
+	if p.releaseMemory != nil {
+		p.releaseMemory()
+	}
+	return nil
+}
+
+func releaseInstance(ctx context.Context, p *provisioning) error {
+	return storage.DeleteInstance(p.instance.Name)
+}
+
+// resolveSourceImages finds the snapshot and the images of the containers
+// of clones, snapshotting the source instance when needed.
+func resolveSourceImages(ctx context.Context, p *provisioning) error {
+	if p.source == "" {
+		return nil
+	}
+	snapshot, err := resolveSource(ctx, p.source, p.plan, p.instance.Team)
+	if err != nil {
+		return err
+	}
+	p.snapshot = snapshot
+	_, id := splitSource(p.source)
+	p.temporarySnapshot = id == ""
+	if len(snapshot.Images) != len(p.specs) {
+		removeTemporarySnapshot(ctx, p)
+		return fmt.Errorf("snapshot %s has %d containers, expected %d", snapshot.ID, len(snapshot.Images), len(p.specs))
+	}
+	p.images = snapshot.Images
+	return nil
+}
+
+func containerName(plan *Plan, instanceName string) string {
+	return fmt.Sprintf("diaats-%s-%s", plan.Name, instanceName)
+}
+
+// createContainers creates the containers of the instance. A container with
+// the same name can only be a leftover of a failed attempt to create the
+// instance, as the instance was reserved, so it's removed.
+func createContainers(ctx context.Context, p *provisioning) error {
+	for i := range p.specs {
+		container, err := p.createContainer(ctx, i)
+		if err != nil {
+			if rollbackErr := removeContainers(ctx, p); rollbackErr != nil {
+				p.log.Error("failed to remove containers", "error", rollbackErr)
+			}
+			return err
+		}
+		p.containers = append(p.containers, container)
+	}
+	return nil
+}
+
+// createContainer creates the i-th container of the instance, removing a
+// leftover container with the same name.
+func (p *provisioning) createContainer(ctx context.Context, i int) (*docker.Container, error) {
+	spec := p.specs[i]
+	opts := docker.CreateContainerOptions{
+		Name: spec.name,
+		Config: &docker.Config{
+			Cmd:          spec.member.Args,
+			Image:        p.image(i),
+			ExposedPorts: spec.member.exposedPorts(),
+		},
+		HostConfig: p.hostConfig(i),
+	}
+	if p.plan.isGroup() {
+		names := make([]string, len(p.specs))
+		for n, spec := range p.specs {
+			names[n] = spec.name
+		}
+		opts.Config.Env = []string{"DIAATS_MEMBERS=" + strings.Join(names, ",")}
+	}
+	client, err := p.clientFor(i)
+	if err != nil {
+		return nil, err
+	}
+	primary := spec.member.Name == p.plan.primaryMember().Name
+	container, err := p.create(ctx, client, opts, primary)
+	if err == docker.ErrContainerAlreadyExists {
+		p.log.Warn("removing leftover container", "container", opts.Name)
+		err = client.RemoveContainer(docker.RemoveContainerOptions{ID: opts.Name, Force: true})
+		if err == nil {
+			container, err = p.create(ctx, client, opts, primary)
+		}
+	}
+	return container, err
+}
+
+// image returns the image of the i-th container of the instance.
+func (p *provisioning) image(i int) string {
+	if p.images != nil {
+		return p.images[i]
+	}
+	return p.specs[i].member.Image
+}
+
+// hostConfig returns the host configuration of the i-th container of the
+// instance, mounting its volumes and binding its pinned ports to the same
+// host ports. Containers replacing the ones of instances created before
+// named volumes mount the volumes of the replaced containers.
+func (p *provisioning) hostConfig(i int) *docker.HostConfig {
+	hostConfig := p.specs[i].member.hostConfig(p.instance.Network)
+	var volumes []InstanceVolume
+	if i < len(p.volumes) {
+		volumes = p.volumes[i]
+	}
+	var volumesFrom string
+	if i < len(p.replaced) && len(volumes) == 0 {
+		volumesFrom = p.replaced[i].id
+	}
+	var pinnedPorts []InstancePort
+	if i < len(p.pinnedPorts) {
+		pinnedPorts = p.pinnedPorts[i]
+	}
+	if len(volumes) == 0 && volumesFrom == "" && len(pinnedPorts) == 0 {
+		return hostConfig
+	}
+	var custom docker.HostConfig
+	if hostConfig != nil {
+		custom = *hostConfig
+	}
+	if len(volumes) > 0 {
+		custom.Binds = append(append([]string(nil), custom.Binds...), binds(volumes)...)
+	}
+	if volumesFrom != "" {
+		custom.VolumesFrom = append(append([]string(nil), custom.VolumesFrom...), volumesFrom)
+	}
+	if len(pinnedPorts) == 0 {
+		return &custom
+	}
+	custom.PortBindings = make(map[docker.Port][]docker.PortBinding, len(pinnedPorts))
+	if hostConfig != nil {
+		for port, bindings := range hostConfig.PortBindings {
+			custom.PortBindings[port] = bindings
+		}
+	}
+	for _, port := range pinnedPorts {
+		custom.PortBindings[docker.Port(port.ContainerPort)] = []docker.PortBinding{{HostPort: port.HostPort}}
+	}
+	return &custom
+}
+
+// create creates a container with the given client, overriding the health
+// check of the image of the primary member when the plan defines one.
+func (p *provisioning) create(ctx context.Context, client *docker.Client, opts docker.CreateContainerOptions, primary bool) (*docker.Container, error) {
+	if hc := p.plan.Healthcheck; primary && hc != nil && len(hc.Test) > 0 {
+		return createContainerWithHealthcheck(ctx, client, opts, hc.apiConfig())
+	}
+	return client.CreateContainer(opts)
+}
+
+// clientFor returns the client of the Docker host of the i-th container.
+func (p *provisioning) clientFor(i int) (*docker.Client, error) {
+	if i >= len(p.hosts) || p.hosts[i] == p.instance.DockerHost {
+		return p.client, nil
+	}
+	return dockerClient(p.hosts[i])
+}
+
+// hostClients returns the clients of the Docker hosts of the containers,
+// starting with the host of the instance.
+func (p *provisioning) hostClients() ([]*docker.Client, error) {
+	clients := []*docker.Client{p.client}
+	seen := map[string]bool{p.instance.DockerHost: true}
+	for _, host := range p.hosts {
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+		client, err := dockerClient(host)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// removeContainers removes the containers created by createContainers, in
+// reverse order.
+func removeContainers(ctx context.Context, p *provisioning) error {
+	var lastErr error
+	for i := len(p.containers) - 1; i >= 0; i-- {
+		client, err := p.clientFor(i)
+		if err == nil {
+			err = client.RemoveContainer(docker.RemoveContainerOptions{ID: p.containers[i].ID, Force: true})
+		}
+		if err != nil {
+			p.log.Error("failed to remove container", "container", p.containers[i].ID, "error", err)
+			lastErr = err
+		}
+	}
+	p.containers = nil
+	return lastErr
+}
+
+func startContainers(ctx context.Context, p *provisioning) error {
+	for i, container := range p.containers {
+		client, err := p.clientFor(i)
+		if err != nil {
+			return err
+		}
+		if err = client.StartContainer(container.ID, p.hostConfig(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inspectContainers fills the instance with the details of its containers.
+// The endpoints of the instance are the ones of its client-facing
+// containers, and ContainerID and Envs come from the primary container.
+func inspectContainers(ctx context.Context, p *provisioning) error {
+	p.instance.Containers = make([]InstanceContainer, len(p.containers))
+	p.instance.HostPorts = []string{}
+	p.instance.Ports = nil
+	p.container = nil
+	for i := range p.containers {
+		client, err := p.clientFor(i)
+		if err != nil {
+			return err
+		}
+		container, err := client.InspectContainer(p.containers[i].ID)
+		if err != nil {
+			return err
+		}
+		p.containers[i] = container
+		member := &p.specs[i].member
+		hostPorts, ports := publishedPorts(container, member)
+		p.instance.Containers[i] = InstanceContainer{
+			ID:           container.ID,
+			Name:         p.specs[i].name,
+			Member:       member.Name,
+			ClientFacing: member.ClientFacing,
+			Ports:        ports,
+		}
+		if i < len(p.volumes) {
+			p.instance.Containers[i].Volumes = p.volumes[i]
+		}
+		if i < len(p.hosts) && p.hosts[i] != p.instance.DockerHost {
+			p.instance.Containers[i].DockerHost = p.hosts[i]
+		}
+		if !member.ClientFacing {
+			continue
+		}
+		p.instance.HostPorts = append(p.instance.HostPorts, hostPorts...)
+		p.instance.Ports = append(p.instance.Ports, ports...)
+		if p.container == nil {
+			p.container = container
+			p.instance.ContainerID = container.ID
+			p.instance.Envs = container.Config.Env
+		}
+	}
+	return nil
+}
+
+func waitContainerReady(ctx context.Context, p *provisioning) error {
+	return waitReady(ctx, p.client, p.instance, p.container)
+}
+
+// saveInstance records the outcome of the provisioning in the stored
+// instance, changing only the fields owned by the provisioning, so changes
+// made in the meantime, like queued operations, aren't lost.
+func saveInstance(ctx context.Context, p *provisioning) error {
+	var previous string
+	saved, err := modifyInstance(p.instance.Name, func(instance *Instance) error {
+		previous = instance.State
+		instance.DockerHost = p.instance.DockerHost
+		instance.ContainerID = p.instance.ContainerID
+		instance.Containers = p.instance.Containers
+		instance.Services = p.instance.Services
+		instance.Network = p.instance.Network
+		instance.NetworkScope = p.instance.NetworkScope
+		instance.HostPorts = p.instance.HostPorts
+		instance.Ports = p.instance.Ports
+		instance.Envs = p.instance.Envs
+		instance.Images = p.instance.Images
+		instance.State = StateRunning
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*p.instance = *saved
+	if previous != StateRunning {
+		recordStatusChange(ctx, saved, StateRunning, "", nil)
+	}
+	return nil
+}
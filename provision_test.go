@@ -0,0 +1,78 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestCreateInstanceStartFailureRollsBack(c *check.C) {
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
+	c.Assert(err, check.IsNil)
+	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached"}}
+	s.server.PrepareFailure("start-failure", "/containers/.*/start")
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	s.server.ResetFailure("start-failure")
+	c.Assert(err, check.NotNil)
+	_, err = GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(containers, check.HasLen, 0)
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycache")
+	instance, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.State, check.Equals, StateRunning)
+}
+
+func (s *S) TestCreateInstanceRemovesLeftoverContainer(c *check.C) {
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
+	c.Assert(err, check.IsNil)
+	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached"}}
+	leftover, err := client.CreateContainer(docker.CreateContainerOptions{
+		Name:   "diaats-supermemcached-mycache",
+		Config: &docker.Config{Image: "memcached"},
+	})
+	c.Assert(err, check.IsNil)
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycache")
+	instance, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.ContainerID, check.Not(check.Equals), leftover.ID)
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(containers, check.HasLen, 1)
+}
+
+func (s *S) TestRunStepsRollsBackInReverseOrder(c *check.C) {
+	var calls []string
+	record := func(name string) func(context.Context, *provisioning) error {
+		return func(context.Context, *provisioning) error {
+			calls = append(calls, name)
+			return nil
+		}
+	}
+	errFail := errors.New("failed")
+	steps := []step{
+		{name: "a", forward: record("a"), backward: record("undo a")},
+		{name: "b", forward: record("b")},
+		{name: "c", forward: record("c"), backward: record("undo c")},
+		{name: "d", forward: func(context.Context, *provisioning) error { return errFail }, backward: record("undo d")},
+	}
+	err := runSteps(context.Background(), steps, &provisioning{log: logger})
+	c.Assert(err, check.Equals, errFail)
+	c.Assert(calls, check.DeepEquals, []string{"a", "b", "c", "undo c", "undo a"})
+}
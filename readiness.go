@@ -0,0 +1,245 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Types of readiness checks.
+const (
+	ReadinessTCP  = "tcp"
+	ReadinessHTTP = "http"
+	ReadinessExec = "exec"
+)
+
+const (
+	defaultReadinessTimeout = time.Minute
+	readinessInterval       = time.Second
+	readinessProbeTimeout   = 5 * time.Second
+
+	// readinessReadTimeout is how long the TCP check waits for the host to
+	// close the connection, which docker-proxy does when the service in
+	// the container isn't listening yet.
+	readinessReadTimeout = 200 * time.Millisecond
+)
+
+// ReadinessCheck tells when the service running in the container of an
+// instance is ready to accept connections. The TCP check connects to the
+// host port bound to Port, the HTTP check sends a GET request to Path on
+// that port and expects a status lower than 400, and the exec check runs
+// Command in the container and expects it to exit with status 0. Containers
+// in Docker hosts reached through a unix socket, which have no address, are
+// probed in Port on their IP address in the network of the instance.
+type ReadinessCheck struct {
+	Type    string   `json:"type"`
+	Port    string   `json:"port,omitempty"`
+	Path    string   `json:"path,omitempty"`
+	Command []string `json:"command,omitempty"`
+
+	// Timeout is how long provisioning waits for the instance to become
+	// ready, as accepted by time.ParseDuration. Defaults to one minute.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+func (c *ReadinessCheck) validate() error {
+	switch c.Type {
+	case ReadinessTCP, ReadinessHTTP:
+		if c.Port == "" {
+			return fmt.Errorf("%s readiness check requires a port", c.Type)
+		}
+	case ReadinessExec:
+		if len(c.Command) == 0 {
+			return errors.New("exec readiness check requires a command")
+		}
+	default:
+		return fmt.Errorf("invalid readiness check type %q", c.Type)
+	}
+	if c.Timeout != "" {
+		if d, err := time.ParseDuration(c.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid readiness check timeout %q", c.Timeout)
+		}
+	}
+	return nil
+}
+
+func (c *ReadinessCheck) timeout() time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return defaultReadinessTimeout
+}
+
+// probe runs the check once against the given container. Instances without
+// containers, like Swarm services, are probed in their published ports.
+func (c *ReadinessCheck) probe(ctx context.Context, client *docker.Client, instance *Instance, container *docker.Container) error {
+	if c.Type == ReadinessExec && container == nil {
+		return ErrNotSupportedBySwarm
+	}
+	if c.Type == ReadinessExec {
+		return c.probeExec(ctx, client, container)
+	}
+	port := dockerPort(c.Port)
+	if container != nil && instance.host() == "" {
+		ip := containerIP(instance, container)
+		if ip == "" {
+			return errors.New("container has no IP address")
+		}
+		return c.probeAddr(ctx, net.JoinHostPort(ip, port.Port()), false)
+	}
+	var hostPort string
+	if container != nil {
+		if bindings := container.NetworkSettings.Ports[port]; len(bindings) > 0 {
+			hostPort = bindings[0].HostPort
+		}
+	} else {
+		for _, published := range instance.Ports {
+			if dockerPort(published.ContainerPort) == port {
+				hostPort = published.HostPort
+				break
+			}
+		}
+	}
+	if hostPort == "" {
+		return fmt.Errorf("port %s is not published", port)
+	}
+	return c.probeAddr(ctx, net.JoinHostPort(instance.host(), hostPort), true)
+}
+
+// probeAddr runs the TCP or HTTP check against addr. When proxied is true,
+// addr is a host port, which docker-proxy accepts connections to before
+// the service in the container listens, closing them right away.
+func (c *ReadinessCheck) probeAddr(ctx context.Context, addr string, proxied bool) error {
+	if c.Type == ReadinessHTTP {
+		return c.probeHTTP(ctx, addr)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !proxied {
+		return nil
+	}
+	conn.SetReadDeadline(time.Now().Add(readinessReadTimeout))
+	_, err = conn.Read(make([]byte, 1))
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("connection to %s closed: %w", addr, err)
+	}
+	return nil
+}
+
+// containerIP returns the IP address of the container in the network of
+// the instance, or in the default network.
+func containerIP(instance *Instance, container *docker.Container) string {
+	if container.NetworkSettings == nil {
+		return ""
+	}
+	if network, ok := container.NetworkSettings.Networks[instance.Network]; ok && network.IPAddress != "" {
+		return network.IPAddress
+	}
+	return container.NetworkSettings.IPAddress
+}
+
+func (c *ReadinessCheck) probeHTTP(ctx context.Context, addr string) error {
+	url := "http://" + addr + "/" + strings.TrimPrefix(c.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("GET %s returned status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+func (c *ReadinessCheck) probeExec(ctx context.Context, client *docker.Client, container *docker.Container) error {
+	exec, err := client.CreateExec(docker.CreateExecOptions{Container: container.ID, Cmd: c.Command})
+	if err != nil {
+		return err
+	}
+	err = client.StartExec(exec.ID, docker.StartExecOptions{Detach: true})
+	if err != nil {
+		return err
+	}
+	for {
+		result, err := client.InspectExec(exec.ID)
+		if err != nil {
+			return err
+		}
+		if !result.Running {
+			if result.ExitCode != 0 {
+				return fmt.Errorf("%s exited with status %d", strings.Join(c.Command, " "), result.ExitCode)
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// waitReady runs the readiness check of the plan of the instance until it
+// succeeds or its timeout expires. Instances of plans without a readiness
+// check are always ready.
+func waitReady(ctx context.Context, client *docker.Client, instance *Instance, container *docker.Container) error {
+	check := instance.Plan.Readiness
+	if check == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, check.timeout())
+	defer cancel()
+	for {
+		err := check.probe(ctx, client, instance, container)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("instance not ready after %s: %w", check.timeout(), err)
+		case <-time.After(readinessInterval):
+		}
+	}
+}
+
+// checkReady runs the readiness check of the plan of the instance once.
+func checkReady(ctx context.Context, instance *Instance) error {
+	check := instance.Plan.Readiness
+	if check == nil {
+		return nil
+	}
+	client, err := dockerClient(instance.DockerHost)
+	if err != nil {
+		return err
+	}
+	var container *docker.Container
+	if !instance.isService() {
+		if container, err = client.InspectContainer(instance.ContainerID); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, readinessProbeTimeout)
+	defer cancel()
+	return check.probe(ctx, client, instance, container)
+}
@@ -0,0 +1,192 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+// setReadinessPlan pulls memcached and configures a plan with the given
+// readiness check, publishing the container port 11211 on hostPort.
+func setReadinessPlan(c *check.C, readiness *ReadinessCheck, hostPort string) {
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
+	c.Assert(err, check.IsNil)
+	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached", Readiness: readiness}}
+	config.HostConfig = &docker.HostConfig{
+		PortBindings: map[docker.Port][]docker.PortBinding{
+			"11211/tcp": {{HostPort: hostPort}},
+		},
+	}
+}
+
+func listenerPort(c *check.C, addr net.Addr) string {
+	_, port, err := net.SplitHostPort(addr.String())
+	c.Assert(err, check.IsNil)
+	return port
+}
+
+func (*S) TestReadinessCheckValidate(c *check.C) {
+	var tests = []struct {
+		check ReadinessCheck
+		err   string
+	}{
+		{ReadinessCheck{Type: ReadinessTCP, Port: "11211"}, ""},
+		{ReadinessCheck{Type: ReadinessHTTP, Port: "9200", Path: "/", Timeout: "90s"}, ""},
+		{ReadinessCheck{Type: ReadinessExec, Command: []string{"true"}}, ""},
+		{ReadinessCheck{Type: ReadinessTCP}, "tcp readiness check requires a port"},
+		{ReadinessCheck{Type: ReadinessExec}, "exec readiness check requires a command"},
+		{ReadinessCheck{Type: "udp"}, `invalid readiness check type "udp"`},
+		{ReadinessCheck{Type: ReadinessTCP, Port: "11211", Timeout: "soon"}, `invalid readiness check timeout "soon"`},
+	}
+	for _, t := range tests {
+		err := t.check.validate()
+		if t.err == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, t.err)
+		}
+	}
+}
+
+func (*S) TestValidatePlansReadiness(c *check.C) {
+	plans := []Plan{{Name: "memcached", Image: "memcached", Readiness: &ReadinessCheck{Type: "udp"}}}
+	errs := validatePlans(plans)
+	c.Assert(errs, check.HasLen, 1)
+	c.Assert(errs[0], check.ErrorMatches, `plan "memcached": invalid readiness check type "udp"`)
+}
+
+func (*S) TestCreateInstanceWaitsForTCPReadiness(c *check.C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+	setReadinessPlan(c, &ReadinessCheck{Type: ReadinessTCP, Port: "11211", Timeout: "5s"}, listenerPort(c, listener.Addr()))
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycache")
+	instance, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.State, check.Equals, StateRunning)
+}
+
+func (*S) TestCreateInstanceNotReadyRollsBack(c *check.C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	port := listenerPort(c, listener.Addr())
+	listener.Close()
+	setReadinessPlan(c, &ReadinessCheck{Type: ReadinessTCP, Port: "11211", Timeout: "10ms"}, port)
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.ErrorMatches, "instance not ready after 10ms: .*")
+	_, err = GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(containers, check.HasLen, 0)
+}
+
+func (*S) TestCreateInstanceWaitsForHTTPReadiness(c *check.C) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/health" || requests < 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr()
+	setReadinessPlan(c, &ReadinessCheck{Type: ReadinessHTTP, Port: "11211", Path: "/health", Timeout: "5s"}, listenerPort(c, addr))
+	err := CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycache")
+	c.Assert(requests, check.Equals, 2)
+}
+
+func (s *S) TestCreateInstanceExecReadiness(c *check.C) {
+	setReadinessPlan(c, &ReadinessCheck{Type: ReadinessExec, Command: []string{"memcached-tool", "localhost", "stats"}}, "")
+	var ran bool
+	s.server.PrepareExec("*", func() { ran = true })
+	err := CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycache")
+	c.Assert(ran, check.Equals, true)
+}
+
+func (s *S) TestInstanceStatusHandlerCreating(c *check.C) {
+	config.Plans = []Plan{{Name: "supermemcached", Image: "memcached"}}
+	err := storage.InsertInstance(&Instance{Name: "mycache", Plan: config.Plans[0], State: StateCreating})
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("GET", "/resources/mycache/status", strings.NewReader(""))
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	buildMuxer().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusAccepted)
+	c.Assert(recorder.Body.String(), check.Equals, "instance is being created\n")
+	request, err = http.NewRequest("POST", "/resources/mycache/bind-app", strings.NewReader(""))
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	buildMuxer().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusPreconditionFailed)
+}
+
+func (s *S) TestInstanceStatusHandlerNotReady(c *check.C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	setReadinessPlan(c, &ReadinessCheck{Type: ReadinessTCP, Port: "11211"}, listenerPort(c, listener.Addr()))
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycache")
+	listener.Close()
+	request, err := http.NewRequest("GET", "/resources/mycache/status", strings.NewReader(""))
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	buildMuxer().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusInternalServerError)
+}
+
+func (*S) TestReadinessProbeClosedConnection(c *check.C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	instance := Instance{DockerHost: "tcp://127.0.0.1:2375", Ports: []InstancePort{{ContainerPort: "11211/tcp", HostPort: listenerPort(c, listener.Addr())}}}
+	readiness := ReadinessCheck{Type: ReadinessTCP, Port: "11211"}
+	err = readiness.probe(context.Background(), nil, &instance, nil)
+	c.Assert(err, check.ErrorMatches, "connection to .* closed: .*")
+}
+
+func (*S) TestReadinessProbeUnixHost(c *check.C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+	instance := Instance{DockerHost: "unix:///var/run/docker.sock", Network: "diaats-mycache"}
+	container := docker.Container{NetworkSettings: &docker.NetworkSettings{
+		IPAddress: "127.0.0.2",
+		Networks:  map[string]docker.ContainerNetwork{"diaats-mycache": {IPAddress: "127.0.0.1"}},
+	}}
+	readiness := ReadinessCheck{Type: ReadinessTCP, Port: listenerPort(c, listener.Addr())}
+	err = readiness.probe(context.Background(), nil, &instance, &container)
+	c.Assert(err, check.IsNil)
+	listener.Close()
+	err = readiness.probe(context.Background(), nil, &instance, &container)
+	c.Assert(err, check.NotNil)
+}
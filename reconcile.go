@@ -0,0 +1,152 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// ReconcileReport describes the differences between the stored instances and
+// the containers running in the Docker hosts.
+type ReconcileReport struct {
+	// OrphanContainers are containers created by diaats that don't belong
+	// to any instance.
+	OrphanContainers []OrphanContainer
+
+	// MissingContainers are the names of the running instances whose
+	// container doesn't exist anymore.
+	MissingContainers []string
+
+	// UnhealthyInstances are the names of the instances whose container is
+	// reported as unhealthy by Docker.
+	UnhealthyInstances []string
+
+	// StaleInstances are the names of the instances that have been in
+	// StateCreating for longer than staleCreatingAge, usually because the
+	// process that created them died.
+	StaleInstances []string
+
+	// RemoveFailures is the number of orphan containers that couldn't be
+	// removed.
+	RemoveFailures int
+}
+
+// staleCreatingAge is how long an instance may stay in StateCreating before
+// Reconcile reports it as stale.
+const staleCreatingAge = time.Hour
+
+// OrphanContainer is a container that doesn't belong to any instance.
+type OrphanContainer struct {
+	DockerHost string
+	ID         string
+	Name       string
+}
+
+// Reconcile compares the stored instances with the containers in the Docker
+// hosts, removing the orphan containers unless dryRun is true. Instances
+// being created aren't checked for missing containers.
+func Reconcile(ctx context.Context, dryRun bool) (*ReconcileReport, error) {
+	log := loggerFromContext(ctx)
+	instances, _, err := storage.ListInstances(InstanceFilter{})
+	if err != nil {
+		return nil, err
+	}
+	var report ReconcileReport
+	hosts := []string{config.DockerHost}
+	byHost := map[string]map[string]string{config.DockerHost: {}}
+	// names holds the names of the containers of every instance, which
+	// protect the containers of instances that are still being created or
+	// moved, whose IDs aren't stored yet.
+	names := make(map[string]bool)
+	addHost := func(host string) {
+		if _, ok := byHost[host]; !ok {
+			hosts = append(hosts, host)
+			byHost[host] = map[string]string{}
+		}
+	}
+	for _, instance := range instances {
+		addHost(instance.DockerHost)
+		if instance.State == StateCreating && time.Since(instance.CreatedAt) > staleCreatingAge {
+			report.StaleInstances = append(report.StaleInstances, instance.Name)
+		}
+		if instance.isService() {
+			continue
+		}
+		for _, spec := range instance.Plan.containerSpecs(instance.Name) {
+			names[spec.name] = true
+		}
+		if instance.State == StateCreating {
+			continue
+		}
+		for _, id := range instance.containerIDs() {
+			if id != "" {
+				host := instance.hostOf(id)
+				addHost(host)
+				byHost[host][id] = instance.Name
+			}
+		}
+	}
+	for _, host := range hosts {
+		client, err := dockerClient(host)
+		if err != nil {
+			return nil, err
+		}
+		containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool, len(containers))
+		for _, container := range containers {
+			seen[container.ID] = true
+			if name, ok := byHost[host][container.ID]; ok {
+				if strings.Contains(container.Status, "("+HealthUnhealthy+")") {
+					report.UnhealthyInstances = append(report.UnhealthyInstances, name)
+				}
+				continue
+			}
+			if !isDiaatsContainer(container) || names[strings.TrimPrefix(container.Names[0], "/")] {
+				continue
+			}
+			orphan := OrphanContainer{DockerHost: host, ID: container.ID, Name: strings.TrimPrefix(container.Names[0], "/")}
+			report.OrphanContainers = append(report.OrphanContainers, orphan)
+			if dryRun {
+				continue
+			}
+			err = client.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true})
+			if err != nil {
+				log.Error("failed to remove orphan container", "docker_host", host, "container", container.ID, "error", err)
+				report.RemoveFailures++
+			}
+		}
+		for id, name := range byHost[host] {
+			if !seen[id] {
+				report.MissingContainers = append(report.MissingContainers, name)
+			}
+		}
+	}
+	sort.Strings(report.MissingContainers)
+	sort.Strings(report.UnhealthyInstances)
+	sort.Strings(report.StaleInstances)
+	return &report, nil
+}
+
+// isDiaatsContainer reports whether the container was created by diaats.
+// The tasks of Swarm services are managed by Swarm.
+func isDiaatsContainer(container docker.APIContainers) bool {
+	if container.Labels["com.docker.swarm.service.id"] != "" {
+		return false
+	}
+	for _, name := range container.Names {
+		if strings.HasPrefix(name, "/diaats-") {
+			return true
+		}
+	}
+	return false
+}
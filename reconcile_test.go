@@ -0,0 +1,73 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestReconcile(c *check.C) {
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	instance := s.createTestInstance(c, "mycache")
+	s.createTestInstance(c, "othercache")
+	orphan, err := client.CreateContainer(docker.CreateContainerOptions{
+		Name:   "diaats-supermemcached-ghost",
+		Config: &docker.Config{Image: "memcached"},
+	})
+	c.Assert(err, check.IsNil)
+	other, err := client.CreateContainer(docker.CreateContainerOptions{
+		Name:   "someone-else",
+		Config: &docker.Config{Image: "memcached"},
+	})
+	c.Assert(err, check.IsNil)
+	err = client.RemoveContainer(docker.RemoveContainerOptions{ID: instance.ContainerID, Force: true})
+	c.Assert(err, check.IsNil)
+	report, err := Reconcile(context.Background(), false)
+	c.Assert(err, check.IsNil)
+	c.Assert(report.OrphanContainers, check.DeepEquals, []OrphanContainer{
+		{DockerHost: config.DockerHost, ID: orphan.ID, Name: "diaats-supermemcached-ghost"},
+	})
+	c.Assert(report.MissingContainers, check.DeepEquals, []string{"mycache"})
+	c.Assert(report.RemoveFailures, check.Equals, 0)
+	_, err = client.InspectContainer(orphan.ID)
+	c.Assert(err, check.FitsTypeOf, &docker.NoSuchContainer{})
+	_, err = client.InspectContainer(other.ID)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestReconcileStaleInstances(c *check.C) {
+	err := storage.InsertInstance(&Instance{Name: "stale", DockerHost: config.DockerHost, State: StateCreating, CreatedAt: time.Now().Add(-2 * time.Hour)})
+	c.Assert(err, check.IsNil)
+	err = storage.InsertInstance(&Instance{Name: "fresh", DockerHost: config.DockerHost, State: StateCreating, CreatedAt: time.Now()})
+	c.Assert(err, check.IsNil)
+	report, err := Reconcile(context.Background(), true)
+	c.Assert(err, check.IsNil)
+	c.Assert(report.StaleInstances, check.DeepEquals, []string{"stale"})
+}
+
+func (s *S) TestReconcileKeepsInstancesBeingCreated(c *check.C) {
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	s.createTestInstance(c, "mycache")
+	plan := config.Plans[0]
+	err = storage.InsertInstance(&Instance{Name: "newcache", Plan: plan, DockerHost: config.DockerHost, State: StateCreating, CreatedAt: time.Now()})
+	c.Assert(err, check.IsNil)
+	container, err := client.CreateContainer(docker.CreateContainerOptions{
+		Name:   plan.containerSpecs("newcache")[0].name,
+		Config: &docker.Config{Image: "memcached"},
+	})
+	c.Assert(err, check.IsNil)
+	report, err := Reconcile(context.Background(), false)
+	c.Assert(err, check.IsNil)
+	c.Assert(report.OrphanContainers, check.HasLen, 0)
+	c.Assert(report.MissingContainers, check.HasLen, 0)
+	_, err = client.InspectContainer(container.ID)
+	c.Assert(err, check.IsNil)
+}
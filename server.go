@@ -0,0 +1,125 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// ErrShuttingDown is returned by operations started after the server began
+// shutting down.
+var ErrShuttingDown = errors.New("server is shutting down")
+
+var (
+	// operations tracks the calls to CreateInstance and DestroyInstance,
+	// so the server doesn't exit in the middle of them. No operations are
+	// added once shuttingDown is set, so Wait never races with Add.
+	operations    sync.WaitGroup
+	operationsMut sync.Mutex
+	shuttingDown  bool
+
+	// workers tracks the background workers started with startWorker.
+	workers sync.WaitGroup
+)
+
+// trackOperation registers an operation that must finish before the server
+// exits. The returned function must be called when the operation is done.
+// It returns ErrShuttingDown once the server is waiting for operations.
+func trackOperation() (func(), error) {
+	operationsMut.Lock()
+	defer operationsMut.Unlock()
+	if shuttingDown {
+		return nil, ErrShuttingDown
+	}
+	operations.Add(1)
+	return operations.Done, nil
+}
+
+// stopOperations makes trackOperation refuse new operations.
+func stopOperations() {
+	operationsMut.Lock()
+	shuttingDown = true
+	operationsMut.Unlock()
+}
+
+// startWorker runs fn in a new goroutine. The context passed to fn is
+// canceled when the server starts shutting down, and the server waits for fn
+// to return before exiting.
+func startWorker(ctx context.Context, fn func(ctx context.Context)) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		fn(ctx)
+	}()
+}
+
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       2 * config.ReadTimeout,
+		TLSConfig:         &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+}
+
+// serve runs the server on the given listener until it fails or ctx is
+// canceled. On cancellation, it stops accepting connections and waits up to
+// config.ShutdownTimeout for in-flight requests, operations and workers.
+func serve(ctx context.Context, srv *http.Server, listener net.Listener) error {
+	errCh := make(chan error, 1)
+	go func() {
+		if config.TLSCertFile != "" {
+			errCh <- srv.ServeTLS(listener, config.TLSCertFile, config.TLSKeyFile)
+		} else {
+			errCh <- srv.Serve(listener)
+		}
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	logger.Info("shutting down", "timeout", config.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	if err != nil {
+		return err
+	}
+	if err = <-errCh; err != http.ErrServerClosed {
+		return err
+	}
+	stopOperations()
+	done := make(chan struct{})
+	go func() {
+		operations.Wait()
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logger.Info("shutdown complete")
+		return nil
+	case <-shutdownCtx.Done():
+		return errors.New("timed out waiting for operations to finish")
+	}
+}
+
+// listenAndServe binds to addr and serves the API until ctx is canceled.
+func listenAndServe(ctx context.Context, addr string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	logger.Info("binding", "address", listener.Addr().String(), "tls", config.TLSCertFile != "", "read_timeout", config.ReadTimeout, "write_timeout", config.WriteTimeout)
+	return serve(ctx, newServer(handler), listener)
+}
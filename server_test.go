@@ -0,0 +1,143 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (*S) TestServeWaitsForInFlightRequests(c *check.C) {
+	config.ShutdownTimeout = 5 * time.Second
+	config.ReadTimeout = time.Second
+	config.WriteTimeout = 5 * time.Second
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		done, err := trackOperation()
+		c.Check(err, check.IsNil)
+		defer done()
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, newServer(h), listener)
+	}()
+	respCh := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Post("http://"+listener.Addr().String()+"/", "text/plain", nil)
+		c.Check(err, check.IsNil)
+		respCh <- resp
+	}()
+	<-started
+	cancel()
+	select {
+	case <-serveErr:
+		c.Fatal("serve returned before the request finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	resp := <-respCh
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+	c.Assert(<-serveErr, check.IsNil)
+	_, err = net.Dial("tcp", listener.Addr().String())
+	c.Assert(err, check.NotNil)
+}
+
+func (*S) TestServeWaitsForWorkers(c *check.C) {
+	config.ShutdownTimeout = 5 * time.Second
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	var finished bool
+	startWorker(ctx, func(ctx context.Context) {
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		finished = true
+	})
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, newServer(http.NotFoundHandler()), listener)
+	}()
+	cancel()
+	c.Assert(<-serveErr, check.IsNil)
+	c.Assert(finished, check.Equals, true)
+}
+
+func (*S) TestServeShutdownTimeout(c *check.C) {
+	config.ShutdownTimeout = 50 * time.Millisecond
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	done, err := trackOperation()
+	c.Assert(err, check.IsNil)
+	defer done()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = serve(ctx, newServer(http.NotFoundHandler()), listener)
+	c.Assert(err, check.ErrorMatches, "timed out waiting for operations to finish")
+}
+
+func (*S) TestServeTLS(c *check.C) {
+	dir := c.MkDir()
+	writeTestCerts(c, dir)
+	config.ShutdownTimeout = 5 * time.Second
+	config.TLSCertFile = filepath.Join(dir, "server-cert.pem")
+	config.TLSKeyFile = filepath.Join(dir, "server-key.pem")
+	defer func() { config.TLSCertFile, config.TLSKeyFile = "", "" }()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, newServer(http.NotFoundHandler()), listener)
+	}()
+	defer func() {
+		cancel()
+		c.Check(<-serveErr, check.IsNil)
+	}()
+	caData, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	c.Assert(err, check.IsNil)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caData)
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://" + listener.Addr().String() + "/")
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNotFound)
+	c.Assert(resp.TLS, check.NotNil)
+}
+
+func (*S) TestListenAndServeBindFailure(c *check.C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+	err = listenAndServe(context.Background(), listener.Addr().String(), http.NotFoundHandler())
+	c.Assert(err, check.NotNil)
+}
+
+func (*S) TestTrackOperationShuttingDown(c *check.C) {
+	config.ShutdownTimeout = 5 * time.Second
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = serve(ctx, newServer(http.NotFoundHandler()), listener)
+	c.Assert(err, check.IsNil)
+	_, err = trackOperation()
+	c.Assert(err, check.Equals, ErrShuttingDown)
+}
@@ -0,0 +1,283 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+var (
+	ErrSnapshotNotFound   = errors.New("snapshot not found")
+	ErrSourceNotFound     = errors.New("source instance not found")
+	ErrSourceForbidden    = errors.New("source instance belongs to another team")
+	ErrSourcePlanMismatch = errors.New("source instance uses another plan")
+)
+
+// Snapshot is a copy of the containers of an instance, committed as Docker
+// images in the host of the instance, and of their volumes, copied to new
+// volumes. Images and Volumes are in the same order as the containers of the
+// instance.
+type Snapshot struct {
+	ID        string             `json:"id"`
+	Images    []string           `json:"images"`
+	Volumes   [][]InstanceVolume `json:"volumes,omitempty"`
+	CreatedAt time.Time          `json:"createdAt"`
+}
+
+// snapshotImage returns the name of the image of the n-th container of the
+// instance in the given snapshot.
+func snapshotImage(instance, id string, n int) (repository, tag string) {
+	return "diaats-snapshot-" + instance, fmt.Sprintf("%s-%d", id, n)
+}
+
+// snapshotVolume returns the name of the copy of the k-th volume of the n-th
+// container of the instance in the given snapshot.
+func snapshotVolume(instance, id string, n, k int) string {
+	return volumeName(fmt.Sprintf("diaats-snapshot-%s-%s-%d", instance, id, n), k)
+}
+
+// SnapshotInstance commits the containers of the instance as images and
+// copies their volumes, recording them in the instance.
+func SnapshotInstance(ctx context.Context, instance *Instance) (*Snapshot, error) {
+	done, err := trackOperation()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if instance.isService() {
+		return nil, ErrNotSupportedBySwarm
+	}
+	if instance.isSpread() {
+		return nil, ErrSpreadInstance
+	}
+	log := loggerFromContext(ctx).With("instance", instance.Name)
+	client, err := dockerClient(instance.DockerHost)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	snapshot := Snapshot{ID: now.Format(backupIDFormat), CreatedAt: now}
+	for n, id := range instance.containerIDs() {
+		repository, tag := snapshotImage(instance.Name, snapshot.ID, n)
+		_, err = client.CommitContainer(docker.CommitContainerOptions{
+			Container:  id,
+			Repository: repository,
+			Tag:        tag,
+			Message:    "diaats snapshot of " + instance.Name,
+		})
+		if err != nil {
+			log.Error("failed to commit container", "container", id, "error", err)
+			removeSnapshotData(ctx, client, &snapshot)
+			return nil, err
+		}
+		snapshot.Images = append(snapshot.Images, repository+":"+tag)
+		if n >= len(instance.Containers) || len(instance.Containers[n].Volumes) == 0 {
+			continue
+		}
+		if snapshot.Volumes == nil {
+			snapshot.Volumes = make([][]InstanceVolume, len(instance.Containers))
+		}
+		snapshot.Volumes[n], err = snapshotVolumes(client, instance, &snapshot, n)
+		if err != nil {
+			log.Error("failed to copy volumes", "container", id, "error", err)
+			removeSnapshotData(ctx, client, &snapshot)
+			return nil, err
+		}
+	}
+	_, err = modifyInstance(instance.Name, func(instance *Instance) error {
+		instance.Snapshots = append(instance.Snapshots, snapshot)
+		return nil
+	})
+	if err != nil {
+		removeSnapshotData(ctx, client, &snapshot)
+		return nil, err
+	}
+	log.Info("instance snapshot created", "snapshot", snapshot.ID)
+	return &snapshot, nil
+}
+
+// snapshotVolumes copies the volumes of the n-th container of the instance to
+// new volumes, pausing the container while it runs so the copies are
+// consistent. The copies are written through a container of the committed
+// image, which is created but never started.
+func snapshotVolumes(client *docker.Client, instance *Instance, snapshot *Snapshot, n int) ([]InstanceVolume, error) {
+	container := instance.Containers[n]
+	var volumes []InstanceVolume
+	for k, volume := range container.Volumes {
+		copied := InstanceVolume{Name: snapshotVolume(instance.Name, snapshot.ID, n, k), Path: volume.Path}
+		if _, err := client.CreateVolume(docker.CreateVolumeOptions{Name: copied.Name}); err != nil {
+			return volumes, err
+		}
+		volumes = append(volumes, copied)
+	}
+	helper, err := createVolumeContainer(client, snapshot.Images[n], volumes)
+	if err != nil {
+		return volumes, err
+	}
+	defer client.RemoveContainer(docker.RemoveContainerOptions{ID: helper, Force: true})
+	source, err := client.InspectContainer(container.ID)
+	if err != nil {
+		return volumes, err
+	}
+	if source.State.Running && !source.State.Paused {
+		if err = client.PauseContainer(container.ID); err != nil {
+			return volumes, err
+		}
+		defer client.UnpauseContainer(container.ID)
+	}
+	for _, volume := range volumes {
+		if err = copyVolume(client, container.ID, helper, volume.Path); err != nil {
+			return volumes, err
+		}
+	}
+	return volumes, nil
+}
+
+// restoreSnapshotVolumes copies the volumes of the snapshot of a clone into
+// its containers, which are created but not started yet.
+func restoreSnapshotVolumes(ctx context.Context, p *provisioning) error {
+	if p.snapshot == nil {
+		return nil
+	}
+	for i, volumes := range p.snapshot.Volumes {
+		if len(volumes) == 0 || i >= len(p.containers) {
+			continue
+		}
+		helper, err := createVolumeContainer(p.client, p.image(i), volumes)
+		if err != nil {
+			return err
+		}
+		for _, volume := range volumes {
+			if err = copyVolume(p.client, helper, p.containers[i].ID, volume.Path); err != nil {
+				break
+			}
+		}
+		p.client.RemoveContainer(docker.RemoveContainerOptions{ID: helper, Force: true})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeTemporarySnapshot removes the snapshot taken to clone a live
+// instance, which is only needed while the clone is created. It never fails,
+// so it may run as the last step of the creation of the clone.
+func removeTemporarySnapshot(ctx context.Context, p *provisioning) error {
+	if !p.temporarySnapshot {
+		return nil
+	}
+	name, _ := splitSource(p.source)
+	if err := deleteSnapshot(ctx, name, p.snapshot.ID); err != nil {
+		p.log.Warn("failed to remove temporary snapshot", "source", name, "snapshot", p.snapshot.ID, "error", err)
+	}
+	p.temporarySnapshot = false
+	return nil
+}
+
+// RemoveSnapshot removes the given snapshot of the instance, along with its
+// images and volumes.
+func RemoveSnapshot(ctx context.Context, name, id string) error {
+	done, err := trackOperation()
+	if err != nil {
+		return err
+	}
+	defer done()
+	return deleteSnapshot(ctx, name, id)
+}
+
+func deleteSnapshot(ctx context.Context, name, id string) error {
+	var snapshot Snapshot
+	instance, err := modifyInstance(name, func(instance *Instance) error {
+		for n, s := range instance.Snapshots {
+			if s.ID == id {
+				snapshot = s
+				instance.Snapshots = append(instance.Snapshots[:n:n], instance.Snapshots[n+1:]...)
+				return nil
+			}
+		}
+		return ErrSnapshotNotFound
+	})
+	if err != nil {
+		return err
+	}
+	client, err := dockerClient(instance.DockerHost)
+	if err != nil {
+		return err
+	}
+	removeSnapshotData(ctx, client, &snapshot)
+	return nil
+}
+
+// removeSnapshotData removes the images and volumes of the snapshot. Images
+// used by the containers of clones are only untagged, so the clones keep
+// running, and their volumes are copies.
+func removeSnapshotData(ctx context.Context, client *docker.Client, snapshot *Snapshot) {
+	for _, image := range snapshot.Images {
+		err := client.RemoveImageExtended(image, docker.RemoveImageOptions{Force: true})
+		if err != nil && err != docker.ErrNoSuchImage {
+			loggerFromContext(ctx).Error("failed to remove snapshot image", "image", image, "error", err)
+		}
+	}
+	for _, volumes := range snapshot.Volumes {
+		if err := removeVolumeList(client, volumes); err != nil {
+			loggerFromContext(ctx).Error("failed to remove snapshot volumes", "snapshot", snapshot.ID, "error", err)
+		}
+	}
+}
+
+// snapshot returns the snapshot of the instance with the given ID, or nil.
+func (i *Instance) snapshot(id string) *Snapshot {
+	for n := range i.Snapshots {
+		if i.Snapshots[n].ID == id {
+			return &i.Snapshots[n]
+		}
+	}
+	return nil
+}
+
+// splitSource splits a source, as accepted by resolveSource, into the name
+// of the instance and the ID of the snapshot, which may be empty.
+func splitSource(source string) (name, id string) {
+	if i := strings.Index(source, "@"); i >= 0 {
+		return source[:i], source[i+1:]
+	}
+	return source, ""
+}
+
+// resolveSource returns the snapshot used to create a clone of the instance
+// in source, which is either the name of an instance, cloned as it is now,
+// or the name of an instance and the ID of one of its snapshots, separated
+// by "@". The source must use the same plan and belong to the same team as
+// the new instance.
+func resolveSource(ctx context.Context, source string, plan *Plan, team string) (*Snapshot, error) {
+	name, id := splitSource(source)
+	instance, err := GetInstance(ctx, name)
+	if err == ErrInstanceNotFound {
+		return nil, ErrSourceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if instance.Team != team {
+		return nil, ErrSourceForbidden
+	}
+	if instance.Plan.Name != plan.Name {
+		return nil, ErrSourcePlanMismatch
+	}
+	if id == "" {
+		return SnapshotInstance(ctx, instance)
+	}
+	if snapshot := instance.snapshot(id); snapshot != nil {
+		return snapshot, nil
+	}
+	return nil, ErrSnapshotNotFound
+}
@@ -0,0 +1,282 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/fsouza/go-dockerclient"
+	dtesting "github.com/fsouza/go-dockerclient/testing"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestSnapshotInstance(c *check.C) {
+	instance := s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	snapshot, err := SnapshotInstance(context.Background(), instance)
+	c.Assert(err, check.IsNil)
+	c.Assert(snapshot.Images, check.DeepEquals, []string{"diaats-snapshot-mycache:" + snapshot.ID + "-0"})
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	_, err = client.InspectImage(snapshot.Images[0])
+	c.Assert(err, check.IsNil)
+	instance, err = GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.Snapshots, check.HasLen, 1)
+	c.Assert(instance.Snapshots[0].ID, check.Equals, snapshot.ID)
+}
+
+// recordArchives handles the archive endpoints of the fake Docker server,
+// returning the copies made, as "GET <container> <path>" and
+// "PUT <container> <path> <contents>".
+func (s *S) recordArchives() func() []string {
+	return recordServerArchives(s.server)
+}
+
+// recordServerArchives is like recordArchives, for the given fake server.
+func recordServerArchives(server *dtesting.DockerServer) func() []string {
+	var mut sync.Mutex
+	var copies []string
+	server.CustomHandler("/containers/.*/archive", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/archive")
+		path := r.URL.Query().Get("path")
+		entry := fmt.Sprintf("GET %s %s", id, path)
+		if r.Method == "PUT" {
+			data, _ := io.ReadAll(r.Body)
+			entry = fmt.Sprintf("PUT %s %s %s", id, path, data)
+		}
+		mut.Lock()
+		copies = append(copies, entry)
+		mut.Unlock()
+		if r.Method == "GET" {
+			fmt.Fprintf(w, "contents of %s", path)
+		}
+	}))
+	return func() []string {
+		mut.Lock()
+		defer mut.Unlock()
+		return copies
+	}
+}
+
+func (s *S) TestSnapshotInstanceVolumes(c *check.C) {
+	s.createDataImage(c)
+	config.Plans = []Plan{{Name: "datacache", Image: "memcached-data"}}
+	err := CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycache")
+	instance, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	copies := s.recordArchives()
+	snapshot, err := SnapshotInstance(context.Background(), instance)
+	c.Assert(err, check.IsNil)
+	prefix := "diaats-snapshot-mycache-" + snapshot.ID + "-0-data-"
+	c.Assert(snapshot.Volumes, check.DeepEquals, [][]InstanceVolume{{
+		{Name: prefix + "0", Path: "/data"},
+		{Name: prefix + "1", Path: "/logs"},
+	}})
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	for _, volume := range snapshot.Volumes[0] {
+		_, err = client.InspectVolume(volume.Name)
+		c.Assert(err, check.IsNil)
+	}
+	c.Assert(copies(), check.HasLen, 4)
+	c.Assert(copies()[0], check.Equals, "GET "+instance.ContainerID+" /data")
+	c.Assert(copies()[1], check.Matches, "PUT [^ ]+ / contents of /data")
+	c.Assert(copies()[2], check.Equals, "GET "+instance.ContainerID+" /logs")
+	c.Assert(copies()[3], check.Matches, "PUT [^ ]+ / contents of /logs")
+	container, err := client.InspectContainer(instance.ContainerID)
+	c.Assert(err, check.IsNil)
+	c.Assert(container.State.Paused, check.Equals, false)
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(containers, check.HasLen, 1)
+	err = CreateInstance(context.Background(), "mycopy", &config.Plans[0], CreateOptions{Source: "mycache@" + snapshot.ID})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycopy")
+	clone, err := GetInstance(context.Background(), "mycopy")
+	c.Assert(err, check.IsNil)
+	c.Assert(copies(), check.HasLen, 8)
+	c.Assert(copies()[4], check.Matches, "GET [^ ]+ /data")
+	c.Assert(copies()[5], check.Equals, "PUT "+clone.ContainerID+" / contents of /data")
+	c.Assert(copies()[7], check.Equals, "PUT "+clone.ContainerID+" / contents of /logs")
+	removed := s.recordVolumeRemovals()
+	err = RemoveSnapshot(context.Background(), "mycache", snapshot.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(removed(), check.DeepEquals, []string{prefix + "0", prefix + "1"})
+}
+
+func (s *S) TestRemoveSnapshot(c *check.C) {
+	instance := s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	snapshot, err := SnapshotInstance(context.Background(), instance)
+	c.Assert(err, check.IsNil)
+	err = RemoveSnapshot(context.Background(), "mycache", snapshot.ID)
+	c.Assert(err, check.IsNil)
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	_, err = client.InspectImage(snapshot.Images[0])
+	c.Assert(err, check.Equals, docker.ErrNoSuchImage)
+	instance, err = GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.Snapshots, check.HasLen, 0)
+	err = RemoveSnapshot(context.Background(), "mycache", snapshot.ID)
+	c.Assert(err, check.Equals, ErrSnapshotNotFound)
+}
+
+func (s *S) TestDestroyInstanceRemovesSnapshots(c *check.C) {
+	instance := s.createTestInstance(c, "mycache")
+	snapshot, err := SnapshotInstance(context.Background(), instance)
+	c.Assert(err, check.IsNil)
+	err = DestroyInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	_, err = client.InspectImage(snapshot.Images[0])
+	c.Assert(err, check.Equals, docker.ErrNoSuchImage)
+}
+
+func (s *S) TestCreateInstanceFromSource(c *check.C) {
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	err := CreateInstance(context.Background(), "mycopy", &config.Plans[0], CreateOptions{Source: "mycache"})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycopy")
+	source, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(source.Snapshots, check.HasLen, 0)
+	clone, err := GetInstance(context.Background(), "mycopy")
+	c.Assert(err, check.IsNil)
+	c.Assert(clone.Source, check.Equals, "mycache")
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	container, err := client.InspectContainer(clone.ContainerID)
+	c.Assert(err, check.IsNil)
+	c.Assert(container.Config.Image, check.Matches, "diaats-snapshot-mycache:.*-0")
+}
+
+func (s *S) TestCreateInstanceFromSourceFailureRemovesSnapshot(c *check.C) {
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	s.server.PrepareFailure("start-failure", "/containers/.*/start")
+	defer s.server.ResetFailure("start-failure")
+	err := CreateInstance(context.Background(), "mycopy", &config.Plans[0], CreateOptions{Source: "mycache"})
+	c.Assert(err, check.NotNil)
+	source, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(source.Snapshots, check.HasLen, 0)
+}
+
+func (s *S) TestCreateInstanceFromSnapshot(c *check.C) {
+	instance := s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	snapshot, err := SnapshotInstance(context.Background(), instance)
+	c.Assert(err, check.IsNil)
+	err = CreateInstance(context.Background(), "mycopy", &config.Plans[0], CreateOptions{Source: "mycache@" + snapshot.ID})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycopy")
+	source, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(source.Snapshots, check.HasLen, 1)
+	clone, err := GetInstance(context.Background(), "mycopy")
+	c.Assert(err, check.IsNil)
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	container, err := client.InspectContainer(clone.ContainerID)
+	c.Assert(err, check.IsNil)
+	c.Assert(container.Config.Image, check.Equals, snapshot.Images[0])
+}
+
+func (s *S) TestCreateInstanceFromSourceErrors(c *check.C) {
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	otherPlan := Plan{Name: "othermemcached", Image: "memcached"}
+	var tests = []struct {
+		plan *Plan
+		opts CreateOptions
+		err  error
+	}{
+		{&config.Plans[0], CreateOptions{Source: "unknown"}, ErrSourceNotFound},
+		{&config.Plans[0], CreateOptions{Source: "mycache@20160102T150405.000000Z"}, ErrSnapshotNotFound},
+		{&config.Plans[0], CreateOptions{Source: "mycache", Team: "otherteam"}, ErrSourceForbidden},
+		{&otherPlan, CreateOptions{Source: "mycache"}, ErrSourcePlanMismatch},
+	}
+	for _, t := range tests {
+		err := CreateInstance(context.Background(), "mycopy", t.plan, t.opts)
+		c.Check(err, check.Equals, t.err, check.Commentf("source %q", t.opts.Source))
+		_, err = GetInstance(context.Background(), "mycopy")
+		c.Check(err, check.Equals, ErrInstanceNotFound)
+	}
+}
+
+func (s *S) TestSnapshotHandlers(c *check.C) {
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	handler := buildMuxer()
+	request, err := http.NewRequest("POST", "/admin/instances/mycache/snapshots", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	var snapshot Snapshot
+	err = json.NewDecoder(recorder.Body).Decode(&snapshot)
+	c.Assert(err, check.IsNil)
+	c.Assert(snapshot.Images, check.HasLen, 1)
+	request, err = http.NewRequest("GET", "/admin/instances/mycache/snapshots", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var snapshots []Snapshot
+	err = json.NewDecoder(recorder.Body).Decode(&snapshots)
+	c.Assert(err, check.IsNil)
+	c.Assert(snapshots, check.HasLen, 1)
+	c.Assert(snapshots[0].ID, check.Equals, snapshot.ID)
+	body := strings.NewReader("name=mycopy&plan=supermemcached&parameters.source=mycache@" + snapshot.ID)
+	request, err = http.NewRequest("POST", "/resources", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	defer DestroyInstance(context.Background(), "mycopy")
+	request, err = http.NewRequest("DELETE", "/admin/instances/mycache/snapshots/"+snapshot.ID, nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNoContent)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestCreateInstanceHandlerSourceErrors(c *check.C) {
+	s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	var tests = []struct {
+		body string
+		code int
+	}{
+		{"name=mycopy&plan=supermemcached&parameters.source=unknown", http.StatusBadRequest},
+		{"name=mycopy&plan=supermemcached&team=otherteam&parameters.source=mycache", http.StatusForbidden},
+	}
+	handler := buildMuxer()
+	for _, t := range tests {
+		request, err := http.NewRequest("POST", "/resources", strings.NewReader(t.body))
+		c.Assert(err, check.IsNil)
+		request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, t.code, check.Commentf(t.body))
+	}
+}
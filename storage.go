@@ -0,0 +1,348 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Storage persists instances and the history of operations on them.
+type Storage interface {
+	// GetInstance returns the instance with the given name, or
+	// ErrInstanceNotFound.
+	GetInstance(name string) (*Instance, error)
+
+	// InsertInstance stores a new instance. It returns
+	// ErrInstanceAlreadyExists if there's already an instance with the
+	// same name.
+	InsertInstance(instance *Instance) error
+
+	// UpdateInstance replaces the stored instance with the same name and
+	// increments the revision of instance. It returns ErrInstanceNotFound,
+	// or ErrConflict when the stored instance has another revision.
+	UpdateInstance(instance *Instance) error
+
+	// DeleteInstance removes the instance with the given name, or returns
+	// ErrInstanceNotFound.
+	DeleteInstance(name string) error
+
+	// ListInstances returns the page of instances matching the filter,
+	// and the total number of matching instances.
+	ListInstances(filter InstanceFilter) ([]Instance, int, error)
+
+	// ListHosts returns the stored states of Docker hosts, sorted by
+	// address.
+	ListHosts() ([]HostState, error)
+
+	// UpdateHost stores the state of a Docker host, replacing the previous
+	// one, and increments the revision of host. It returns ErrConflict when
+	// the stored state has another revision. Hosts without a stored state
+	// have revision 0.
+	UpdateHost(host *HostState) error
+
+	// InsertEvent stores an event.
+	InsertEvent(evt *Event) error
+
+	// ListEvents returns the events matching the filter, most recent first.
+	ListEvents(filter EventFilter) ([]Event, error)
+
+	// AcquireLease takes the named lease for owner until ttl elapses. It
+	// returns false when the lease is held by another owner. Owners renew
+	// their leases by acquiring them again.
+	AcquireLease(name, owner string, ttl time.Duration) (bool, error)
+
+	// ReleaseLease releases the named lease, if it's held by owner.
+	ReleaseLease(name, owner string) error
+
+	// Close releases resources held by the storage.
+	Close() error
+}
+
+var storage Storage
+
+// leaseOwner identifies this process in the leases it acquires, so replicas
+// of the API don't run the same work concurrently.
+var leaseOwner = newLeaseOwner()
+
+func newLeaseOwner() string {
+	host, _ := os.Hostname()
+	return host + "-" + newRequestID()
+}
+
+// workLeaseTTL is how long the leases taken by claimWork last without being
+// renewed, which bounds how long the work of a replica that died stays
+// claimed.
+const workLeaseTTL = time.Minute
+
+// claimWork acquires the named lease, so no other replica of the API does
+// the same work, and renews it until the returned function is called,
+// which releases it. It returns false when the lease is held by another
+// replica.
+func claimWork(ctx context.Context, name string) (func(), bool) {
+	s := storage
+	ok, err := s.AcquireLease(name, leaseOwner, workLeaseTTL)
+	if err != nil {
+		loggerFromContext(ctx).Error("failed to acquire lease", "lease", name, "error", err)
+	}
+	if !ok {
+		return nil, false
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(workLeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if ok, err := s.AcquireLease(name, leaseOwner, workLeaseTTL); err != nil || !ok {
+					loggerFromContext(ctx).Error("failed to renew lease", "lease", name, "error", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		if err := s.ReleaseLease(name, leaseOwner); err != nil {
+			loggerFromContext(ctx).Error("failed to release lease", "lease", name, "error", err)
+		}
+	}, true
+}
+
+// openStorage returns the storage backend selected in the configuration.
+func openStorage() (Storage, error) {
+	switch config.Storage {
+	case "", "mongodb":
+		return newMongoStorage()
+	case "memory":
+		return newMemoryStorage(), nil
+	case "file":
+		return newFileStorage(config.StoragePath)
+	}
+	return nil, fmt.Errorf("unknown storage %q", config.Storage)
+}
+
+// memoryStorage keeps instances, hosts and events in memory. It's meant for tests
+// and development.
+type memoryStorage struct {
+	mut       sync.RWMutex
+	instances map[string][]byte
+	hosts     map[string][]byte
+	events    [][]byte
+	leases    map[string]lease
+}
+
+type lease struct {
+	owner   string
+	expires time.Time
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		instances: make(map[string][]byte),
+		hosts:     make(map[string][]byte),
+		leases:    make(map[string]lease),
+	}
+}
+
+func (s *memoryStorage) GetInstance(name string) (*Instance, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	data, ok := s.instances[name]
+	if !ok {
+		return nil, ErrInstanceNotFound
+	}
+	var instance Instance
+	err := json.Unmarshal(data, &instance)
+	return &instance, err
+}
+
+func (s *memoryStorage) InsertInstance(instance *Instance) error {
+	data, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, ok := s.instances[instance.Name]; ok {
+		return ErrInstanceAlreadyExists
+	}
+	s.instances[instance.Name] = data
+	return nil
+}
+
+func (s *memoryStorage) UpdateInstance(instance *Instance) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	revision, ok := recordRevision(s.instances, instance.Name)
+	if !ok {
+		return ErrInstanceNotFound
+	}
+	if revision != instance.Revision {
+		return ErrConflict
+	}
+	updated := *instance
+	updated.Revision++
+	data, err := json.Marshal(&updated)
+	if err != nil {
+		return err
+	}
+	s.instances[instance.Name] = data
+	instance.Revision = updated.Revision
+	return nil
+}
+
+// recordRevision returns the revision of the record stored under key, and
+// whether it exists. The caller must hold mut.
+func recordRevision(records map[string][]byte, key string) (int, bool) {
+	data, ok := records[key]
+	if !ok {
+		return 0, false
+	}
+	var record struct{ Revision int }
+	json.Unmarshal(data, &record)
+	return record.Revision, true
+}
+
+func (s *memoryStorage) DeleteInstance(name string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, ok := s.instances[name]; !ok {
+		return ErrInstanceNotFound
+	}
+	delete(s.instances, name)
+	return nil
+}
+
+func (s *memoryStorage) ListInstances(filter InstanceFilter) ([]Instance, int, error) {
+	if _, _, err := filter.sortField(); err != nil {
+		return nil, 0, err
+	}
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	instances := make([]Instance, 0, len(s.instances))
+	for _, data := range s.instances {
+		var instance Instance
+		if err := json.Unmarshal(data, &instance); err != nil {
+			return nil, 0, err
+		}
+		if filter.match(&instance) {
+			instances = append(instances, instance)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return filter.less(&instances[i], &instances[j])
+	})
+	total := len(instances)
+	if filter.Offset > len(instances) {
+		filter.Offset = len(instances)
+	}
+	instances = instances[filter.Offset:]
+	if filter.Limit > 0 && len(instances) > filter.Limit {
+		instances = instances[:filter.Limit]
+	}
+	return instances, total, nil
+}
+
+func (s *memoryStorage) ListHosts() ([]HostState, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	hosts := make([]HostState, 0, len(s.hosts))
+	for _, data := range s.hosts {
+		var host HostState
+		if err := json.Unmarshal(data, &host); err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Address < hosts[j].Address
+	})
+	return hosts, nil
+}
+
+func (s *memoryStorage) UpdateHost(host *HostState) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if revision, _ := recordRevision(s.hosts, host.Address); revision != host.Revision {
+		return ErrConflict
+	}
+	updated := *host
+	updated.Revision++
+	data, err := json.Marshal(&updated)
+	if err != nil {
+		return err
+	}
+	s.hosts[host.Address] = data
+	host.Revision = updated.Revision
+	return nil
+}
+
+func (s *memoryStorage) InsertEvent(evt *Event) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.events = append(s.events, data)
+	return nil
+}
+
+func (s *memoryStorage) ListEvents(filter EventFilter) ([]Event, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	events := []Event{}
+	for i := len(s.events) - 1; i >= 0; i-- {
+		var evt Event
+		if err := json.Unmarshal(s.events[i], &evt); err != nil {
+			return nil, err
+		}
+		if filter.match(&evt) {
+			events = append(events, evt)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].StartTime.After(events[j].StartTime)
+	})
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+func (s *memoryStorage) AcquireLease(name, owner string, ttl time.Duration) (bool, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	now := time.Now()
+	if l, ok := s.leases[name]; ok && l.owner != owner && now.Before(l.expires) {
+		return false, nil
+	}
+	s.leases[name] = lease{owner: owner, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (s *memoryStorage) ReleaseLease(name, owner string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if l, ok := s.leases[name]; ok && l.owner == owner {
+		delete(s.leases, name)
+	}
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
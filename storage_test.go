@@ -0,0 +1,220 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// testStorage runs the checks that every Storage implementation must pass.
+// It expects s to be empty.
+func testStorage(c *check.C, s Storage) {
+	instance := Instance{
+		Name:        "mycache",
+		DockerHost:  "tcp://localhost:2375",
+		ContainerID: "abc123",
+		HostPorts:   []string{"49153"},
+		Plan:        Plan{Name: "memcached", Image: "memcached"},
+	}
+	_, err := s.GetInstance("mycache")
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
+	err = s.InsertInstance(&instance)
+	c.Assert(err, check.IsNil)
+	err = s.InsertInstance(&instance)
+	c.Assert(err, check.Equals, ErrInstanceAlreadyExists)
+	got, err := s.GetInstance("mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(*got, check.DeepEquals, instance)
+	instance.HostPorts = []string{"49153", "49154"}
+	err = s.UpdateInstance(&instance)
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.Revision, check.Equals, 1)
+	got, err = s.GetInstance("mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(got.HostPorts, check.DeepEquals, []string{"49153", "49154"})
+	c.Assert(got.Revision, check.Equals, 1)
+	stale := instance
+	stale.Revision = 0
+	err = s.UpdateInstance(&stale)
+	c.Assert(err, check.Equals, ErrConflict)
+	c.Assert(stale.Revision, check.Equals, 0)
+	err = s.UpdateInstance(&Instance{Name: "othercache"})
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
+	err = s.InsertInstance(&Instance{Name: "acache"})
+	c.Assert(err, check.IsNil)
+	instances, _, err := s.ListInstances(InstanceFilter{})
+	c.Assert(err, check.IsNil)
+	c.Assert(instances, check.HasLen, 2)
+	c.Assert(instances[0].Name, check.Equals, "acache")
+	c.Assert(instances[1].Name, check.Equals, "mycache")
+	err = s.DeleteInstance("acache")
+	c.Assert(err, check.IsNil)
+	err = s.DeleteInstance("acache")
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
+	testStorageListInstances(c, s)
+	hosts, err := s.ListHosts()
+	c.Assert(err, check.IsNil)
+	c.Assert(hosts, check.HasLen, 0)
+	err = s.UpdateHost(&HostState{Address: "tcp://10.0.0.2:2375", Cordoned: true})
+	c.Assert(err, check.IsNil)
+	host := HostState{Address: "tcp://10.0.0.1:2375"}
+	err = s.UpdateHost(&host)
+	c.Assert(err, check.IsNil)
+	c.Assert(host.Revision, check.Equals, 1)
+	err = s.UpdateHost(&HostState{Address: "tcp://10.0.0.1:2375", Cordoned: true})
+	c.Assert(err, check.Equals, ErrConflict)
+	host.Drain = &Drain{State: DrainRunning, Total: 2, Instances: []DrainedInstance{{Name: "mycache", Error: "failed"}}}
+	err = s.UpdateHost(&host)
+	c.Assert(err, check.IsNil)
+	hosts, err = s.ListHosts()
+	c.Assert(err, check.IsNil)
+	c.Assert(hosts, check.HasLen, 2)
+	c.Assert(hosts[0].Address, check.Equals, "tcp://10.0.0.1:2375")
+	c.Assert(hosts[0].Revision, check.Equals, 2)
+	c.Assert(hosts[0].Cordoned, check.Equals, false)
+	c.Assert(hosts[0].Drain.State, check.Equals, DrainRunning)
+	c.Assert(hosts[0].Drain.Instances, check.DeepEquals, []DrainedInstance{{Name: "mycache", Error: "failed"}})
+	c.Assert(hosts[1].Cordoned, check.Equals, true)
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	events := []Event{
+		{ID: bson.NewObjectId(), Kind: EventCreate, Instance: "mycache", Plan: "memcached", StartTime: now.Add(-time.Hour)},
+		{ID: bson.NewObjectId(), Kind: EventBind, Instance: "mycache", Plan: "memcached", StartTime: now},
+		{ID: bson.NewObjectId(), Kind: EventCreate, Instance: "othercache", Plan: "redis", StartTime: now.Add(-time.Minute)},
+	}
+	for i := range events {
+		err = s.InsertEvent(&events[i])
+		c.Assert(err, check.IsNil)
+	}
+	got2, err := s.ListEvents(EventFilter{})
+	c.Assert(err, check.IsNil)
+	c.Assert(got2, check.HasLen, 3)
+	c.Assert(got2[0].Kind, check.Equals, EventBind)
+	c.Assert(got2[1].Instance, check.Equals, "othercache")
+	got2, err = s.ListEvents(EventFilter{Instance: "mycache", Since: now.Add(-time.Minute)})
+	c.Assert(err, check.IsNil)
+	c.Assert(got2, check.HasLen, 1)
+	c.Assert(got2[0].Kind, check.Equals, EventBind)
+	got2, err = s.ListEvents(EventFilter{Kind: EventCreate, Limit: 1})
+	c.Assert(err, check.IsNil)
+	c.Assert(got2, check.HasLen, 1)
+	c.Assert(got2[0].Instance, check.Equals, "othercache")
+	testStorageLeases(c, s)
+}
+
+func testStorageLeases(c *check.C, s Storage) {
+	ok, err := s.AcquireLease("mylease", "owner1", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, true)
+	ok, err = s.AcquireLease("mylease", "owner2", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, false)
+	ok, err = s.AcquireLease("mylease", "owner1", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, true)
+	err = s.ReleaseLease("mylease", "owner2")
+	c.Assert(err, check.IsNil)
+	ok, err = s.AcquireLease("mylease", "owner2", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, false)
+	err = s.ReleaseLease("mylease", "owner1")
+	c.Assert(err, check.IsNil)
+	ok, err = s.AcquireLease("mylease", "owner2", time.Millisecond)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, true)
+	time.Sleep(5 * time.Millisecond)
+	ok, err = s.AcquireLease("mylease", "owner1", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, true)
+	err = s.ReleaseLease("mylease", "owner1")
+	c.Assert(err, check.IsNil)
+}
+
+func testStorageListInstances(c *check.C, s Storage) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for _, instance := range []Instance{
+		{Name: "cache1", Team: "team1", State: StateRunning, Plan: Plan{Name: "redis"}, CreatedAt: now.Add(-3 * time.Hour)},
+		{Name: "cache2", Team: "team2", State: StateRunning, Plan: Plan{Name: "redis"}, CreatedAt: now.Add(-time.Hour)},
+		{Name: "cache3", Team: "team1", State: StateCreating, Plan: Plan{Name: "memcached"}, CreatedAt: now.Add(-2 * time.Hour)},
+	} {
+		instance := instance
+		err := s.InsertInstance(&instance)
+		c.Assert(err, check.IsNil)
+	}
+	names := func(instances []Instance) []string {
+		result := make([]string, len(instances))
+		for i := range instances {
+			result[i] = instances[i].Name
+		}
+		return result
+	}
+	instances, total, err := s.ListInstances(InstanceFilter{Plan: "redis"})
+	c.Assert(err, check.IsNil)
+	c.Assert(total, check.Equals, 2)
+	c.Assert(names(instances), check.DeepEquals, []string{"cache1", "cache2"})
+	instances, total, err = s.ListInstances(InstanceFilter{Team: "team1", State: StateCreating})
+	c.Assert(err, check.IsNil)
+	c.Assert(total, check.Equals, 1)
+	c.Assert(names(instances), check.DeepEquals, []string{"cache3"})
+	instances, total, err = s.ListInstances(InstanceFilter{CreatedSince: now.Add(-150 * time.Minute), Sort: "-createdAt"})
+	c.Assert(err, check.IsNil)
+	c.Assert(total, check.Equals, 2)
+	c.Assert(names(instances), check.DeepEquals, []string{"cache2", "cache3"})
+	instances, total, err = s.ListInstances(InstanceFilter{Team: "team1", Sort: "-name", Offset: 1, Limit: 1})
+	c.Assert(err, check.IsNil)
+	c.Assert(total, check.Equals, 2)
+	c.Assert(names(instances), check.DeepEquals, []string{"cache1"})
+	_, _, err = s.ListInstances(InstanceFilter{Sort: "password"})
+	c.Assert(err, check.ErrorMatches, `invalid sort field "password"`)
+}
+
+func (*S) TestMemoryStorage(c *check.C) {
+	testStorage(c, newMemoryStorage())
+}
+
+func (*S) TestMemoryStorageCopiesInstances(c *check.C) {
+	s := newMemoryStorage()
+	instance := Instance{Name: "mycache", HostPorts: []string{"49153"}}
+	err := s.InsertInstance(&instance)
+	c.Assert(err, check.IsNil)
+	instance.HostPorts[0] = "1"
+	got, err := s.GetInstance("mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(got.HostPorts, check.DeepEquals, []string{"49153"})
+}
+
+func (*S) TestOpenStorage(c *check.C) {
+	defer func() { config.Storage, config.StoragePath = "", "" }()
+	config.Storage = "memory"
+	s, err := openStorage()
+	c.Assert(err, check.IsNil)
+	c.Assert(s, check.FitsTypeOf, &memoryStorage{})
+	config.Storage = "file"
+	config.StoragePath = c.MkDir()
+	s, err = openStorage()
+	c.Assert(err, check.IsNil)
+	c.Assert(s, check.FitsTypeOf, &fileStorage{})
+	config.Storage = "cassandra"
+	_, err = openStorage()
+	c.Assert(err, check.ErrorMatches, `unknown storage "cassandra"`)
+}
+
+func (*S) TestClaimWork(c *check.C) {
+	release, ok := claimWork(context.Background(), "mywork")
+	c.Assert(ok, check.Equals, true)
+	acquired, err := storage.AcquireLease("mywork", "other-process", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(acquired, check.Equals, false)
+	release()
+	acquired, err = storage.AcquireLease("mywork", "other-process", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(acquired, check.Equals, true)
+	defer storage.ReleaseLease("mywork", "other-process")
+	_, ok = claimWork(context.Background(), "mywork")
+	c.Assert(ok, check.Equals, false)
+}
@@ -0,0 +1,598 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Provisioners, set by PROVISIONER. The containers provisioner runs the
+// containers of the instances in the Docker hosts, and the swarm provisioner
+// runs the instances as Swarm mode services of the cluster managed by
+// DOCKER_HOST. Instances keep the provisioner they were created with.
+const (
+	ProvisionerContainers = "containers"
+	ProvisionerSwarm      = "swarm"
+)
+
+const serviceStartTimeout = 2 * time.Minute
+
+var ErrNotSupportedBySwarm = errors.New("operation not supported by the swarm provisioner")
+
+// ErrSwarmVolumes is returned when creating a swarm instance of a plan whose
+// images declare volumes, which would lose their data whenever Swarm
+// reschedules a task.
+var ErrSwarmVolumes = errors.New("images declaring volumes are not supported by the swarm provisioner")
+
+// InstanceService is one of the Swarm services of an instance, running the
+// replicas of a member of its plan.
+type InstanceService struct {
+	ID           string
+	Name         string
+	Member       string
+	ClientFacing bool
+	Ports        []InstancePort
+}
+
+// isService reports whether the instance was created by the swarm
+// provisioner. Instances created before provisioners were recorded run
+// containers.
+func (i *Instance) isService() bool {
+	return i.Provisioner == ProvisionerSwarm
+}
+
+// swarmServiceSpec is the part of the specification of a service used by
+// diaats, in the format of the Docker API.
+type swarmServiceSpec struct {
+	Name         string
+	TaskTemplate swarmTaskSpec
+	Mode         swarmServiceMode
+	EndpointSpec *swarmEndpointSpec `json:",omitempty"`
+}
+
+type swarmTaskSpec struct {
+	ContainerSpec swarmContainerSpec
+	Resources     *swarmResources      `json:",omitempty"`
+	RestartPolicy *swarmRestartPolicy  `json:",omitempty"`
+	Placement     *swarmPlacement      `json:",omitempty"`
+	Networks      []swarmNetworkConfig `json:",omitempty"`
+}
+
+type swarmContainerSpec struct {
+	Image       string
+	Args        []string      `json:",omitempty"`
+	Env         []string      `json:",omitempty"`
+	Healthcheck *healthConfig `json:",omitempty"`
+}
+
+type swarmResources struct {
+	Limits *swarmResourceLimits `json:",omitempty"`
+}
+
+type swarmResourceLimits struct {
+	MemoryBytes int64 `json:",omitempty"`
+}
+
+type swarmRestartPolicy struct {
+	Condition   string
+	MaxAttempts *uint64 `json:",omitempty"`
+}
+
+type swarmPlacement struct {
+	Constraints []string `json:",omitempty"`
+}
+
+type swarmNetworkConfig struct {
+	Target string
+}
+
+type swarmServiceMode struct {
+	Replicated *swarmReplicatedService `json:",omitempty"`
+}
+
+type swarmReplicatedService struct {
+	Replicas *uint64 `json:",omitempty"`
+}
+
+type swarmEndpointSpec struct {
+	Ports []swarmPortConfig `json:",omitempty"`
+}
+
+type swarmPortConfig struct {
+	Protocol      string `json:",omitempty"`
+	TargetPort    uint32
+	PublishedPort uint32 `json:",omitempty"`
+	PublishMode   string `json:",omitempty"`
+}
+
+// swarmService is a service, as returned by the Docker API.
+type swarmService struct {
+	ID       string
+	Spec     swarmServiceSpec
+	Endpoint struct {
+		Ports []swarmPortConfig
+	}
+}
+
+// swarmTask is a task of a service, as returned by the Docker API.
+type swarmTask struct {
+	ID     string
+	Status struct {
+		State string
+		Err   string
+	}
+}
+
+// validateSwarmPlan checks that the plan only uses features supported by the
+// swarm provisioner.
+func validateSwarmPlan(plan *Plan) []error {
+	var errs []error
+	if r := plan.Readiness; r != nil && r.Type == ReadinessExec {
+		errs = append(errs, errors.New("exec readiness checks are not supported by the swarm provisioner"))
+	}
+	if hc := plan.Healthcheck; hc != nil && hc.RestartAfter != "" {
+		errs = append(errs, errors.New("healthcheck restartAfter is not supported by the swarm provisioner, which replaces unhealthy tasks"))
+	}
+	if plan.Backup != nil {
+		errs = append(errs, errors.New("backups are not supported by the swarm provisioner"))
+	}
+	if u := plan.Updates; u != nil && u.Policy == UpdateRecreate {
+		errs = append(errs, errors.New("the recreate update policy is not supported by the swarm provisioner"))
+	}
+	if p := plan.Placement; p != nil && (p.Affinity != "" || p.AntiAffinity != "") {
+		errs = append(errs, errors.New("affinity rules are not supported by the swarm provisioner"))
+	}
+	return errs
+}
+
+// serviceSpecs returns the services of an instance of the plan: one for
+// each member, named like the containers of the instance, without the
+// sequential number.
+func (p *Plan) serviceSpecs(instanceName string) []containerSpec {
+	if !p.isGroup() {
+		return p.containerSpecs(instanceName)
+	}
+	specs := make([]containerSpec, len(p.Members))
+	for i, member := range p.Members {
+		specs[i] = containerSpec{name: containerName(p, instanceName) + "-" + member.Name, member: member}
+	}
+	return specs
+}
+
+// serviceSteps are the steps executed by CreateInstance with the swarm
+// provisioner, in order.
+var serviceSteps = []step{
+	{name: "reserve instance", forward: reserveInstance, backward: releaseInstance},
+	{name: "pull images", forward: pullImages},
+	{name: "check volumes", forward: checkServiceVolumes},
+	{name: "create network", forward: createNetwork, backward: removeNetwork},
+	{name: "create services", forward: createServices, backward: removeServices},
+	{name: "wait for tasks", forward: waitServices},
+	{name: "inspect services", forward: inspectServices},
+	{name: "record images", forward: recordImages},
+	{name: "wait for readiness", forward: waitContainerReady},
+	{name: "save instance", forward: saveInstance},
+}
+
+// createServiceInstance creates an instance as Swarm services of the cluster
+// managed by DOCKER_HOST, which places their tasks in its nodes.
+func createServiceInstance(ctx context.Context, name string, plan *Plan, opts CreateOptions) error {
+	if opts.Source != "" {
+		return ErrNotSupportedBySwarm
+	}
+	client, err := dockerClient(config.DockerHost)
+	if err != nil {
+		return err
+	}
+	p := provisioning{
+		client: client,
+		specs:  plan.serviceSpecs(name),
+		instance: &Instance{
+			ID:          bson.NewObjectId().Hex(),
+			Name:        name,
+			Plan:        *plan,
+			DockerHost:  config.DockerHost,
+			Provisioner: ProvisionerSwarm,
+			Team:        opts.Team,
+			State:       StateCreating,
+			CreatedAt:   time.Now().UTC(),
+
+			MaintenanceWindow: opts.MaintenanceWindow,
+		},
+		plan: plan,
+		log:  loggerFromContext(ctx).With("instance", name, "plan", plan.Name),
+	}
+	if err = runSteps(ctx, serviceSteps, &p); err != nil {
+		return err
+	}
+	p.log.Info("instance created", "services", len(p.services), "docker_host", p.instance.DockerHost)
+	return nil
+}
+
+// checkServiceVolumes refuses images declaring volumes: the tasks of a
+// service aren't tied to a node, so their data would be left behind on the
+// node of a task replaced by Swarm.
+func checkServiceVolumes(ctx context.Context, p *provisioning) error {
+	for i := range p.specs {
+		paths, err := imageVolumes(p.client, p.image(i))
+		if err != nil {
+			return err
+		}
+		if len(paths) > 0 {
+			return ErrSwarmVolumes
+		}
+	}
+	return nil
+}
+
+// createServices creates the services of the instance. Like containers, a
+// service with the same name can only be a leftover of a failed attempt to
+// create the instance, so it's removed.
+func createServices(ctx context.Context, p *provisioning) error {
+	for i := range p.specs {
+		id, err := p.createService(ctx, i)
+		if err != nil {
+			if rollbackErr := removeServices(ctx, p); rollbackErr != nil {
+				p.log.Error("failed to remove services", "error", rollbackErr)
+			}
+			return err
+		}
+		p.services = append(p.services, id)
+	}
+	return nil
+}
+
+// createService creates the i-th service of the instance, removing a
+// leftover service with the same name.
+func (p *provisioning) createService(ctx context.Context, i int) (string, error) {
+	spec, err := p.serviceSpec(i)
+	if err != nil {
+		return "", err
+	}
+	id, err := createService(ctx, p.client, spec)
+	if err == docker.ErrContainerAlreadyExists {
+		p.log.Warn("removing leftover service", "service", spec.Name)
+		if err = removeService(ctx, p.client, spec.Name); err == nil {
+			id, err = createService(ctx, p.client, spec)
+		}
+	}
+	return id, err
+}
+
+func createService(ctx context.Context, client *docker.Client, spec *swarmServiceSpec) (string, error) {
+	var result struct{ ID string }
+	err := dockerRequest(ctx, client, http.MethodPost, "/services/create", spec, &result)
+	if e, ok := err.(*docker.Error); ok && e.Status == http.StatusConflict {
+		return "", docker.ErrContainerAlreadyExists
+	}
+	return result.ID, err
+}
+
+// serviceSpec returns the specification of the i-th service of the
+// instance. Its tasks have the memory limit of the member, follow the
+// restart policy in DOCKER_CONFIG and publish the ports of the member in the
+// routing mesh, so they're reachable in every node of the cluster.
+func (p *provisioning) serviceSpec(i int) (*swarmServiceSpec, error) {
+	member := &p.specs[i].member
+	replicas := uint64(member.replicas())
+	spec := swarmServiceSpec{
+		Name: p.specs[i].name,
+		TaskTemplate: swarmTaskSpec{
+			ContainerSpec: swarmContainerSpec{Image: member.Image, Args: member.Args},
+			RestartPolicy: serviceRestartPolicy(),
+		},
+		Mode: swarmServiceMode{Replicated: &swarmReplicatedService{Replicas: &replicas}},
+	}
+	if p.plan.isGroup() {
+		names := make([]string, len(p.specs))
+		for n, spec := range p.specs {
+			names[n] = spec.name
+		}
+		spec.TaskTemplate.ContainerSpec.Env = []string{"DIAATS_MEMBERS=" + strings.Join(names, ",")}
+	}
+	if hc := p.plan.Healthcheck; hc != nil && len(hc.Test) > 0 && member.Name == p.plan.primaryMember().Name {
+		spec.TaskTemplate.ContainerSpec.Healthcheck = hc.apiConfig()
+	}
+	if memory := member.memoryLimit(); memory > 0 {
+		spec.TaskTemplate.Resources = &swarmResources{Limits: &swarmResourceLimits{MemoryBytes: memory}}
+	}
+	if pl := p.plan.Placement; pl != nil && len(pl.Constraints) > 0 {
+		spec.TaskTemplate.Placement = &swarmPlacement{}
+		for _, expr := range pl.Constraints {
+			c, err := parseConstraint(expr)
+			if err != nil {
+				return nil, err
+			}
+			op := "=="
+			if c.negate {
+				op = "!="
+			}
+			spec.TaskTemplate.Placement.Constraints = append(spec.TaskTemplate.Placement.Constraints, "node.labels."+c.key+op+c.value)
+		}
+	}
+	if p.instance.Network != "" {
+		spec.TaskTemplate.Networks = []swarmNetworkConfig{{Target: p.instance.Network}}
+	}
+	ports, err := p.servicePorts(member)
+	if err != nil {
+		return nil, err
+	}
+	if len(ports) > 0 {
+		spec.EndpointSpec = &swarmEndpointSpec{Ports: ports}
+	}
+	return &spec, nil
+}
+
+// servicePorts returns the ports published by the service of the member:
+// the ports of the member or, for client-facing members without ports, the
+// ports exposed by its image. Swarm chooses their published ports, unless
+// DOCKER_CONFIG binds them.
+func (p *provisioning) servicePorts(member *PlanMember) ([]swarmPortConfig, error) {
+	var ports []docker.Port
+	for _, port := range member.Ports {
+		ports = append(ports, port.dockerPort())
+	}
+	if len(member.Ports) == 0 && member.ClientFacing {
+		image, err := p.client.InspectImage(member.Image)
+		if err != nil {
+			return nil, err
+		}
+		if image.Config != nil {
+			for port := range image.Config.ExposedPorts {
+				ports = append(ports, port)
+			}
+		}
+	}
+	result := make([]swarmPortConfig, len(ports))
+	for i, port := range ports {
+		target, _ := strconv.Atoi(port.Port())
+		result[i] = swarmPortConfig{Protocol: port.Proto(), TargetPort: uint32(target), PublishMode: "ingress"}
+		if config.HostConfig != nil {
+			if bindings := config.HostConfig.PortBindings[port]; len(bindings) > 0 {
+				published, _ := strconv.Atoi(bindings[0].HostPort)
+				result[i].PublishedPort = uint32(published)
+			}
+		}
+	}
+	sort.Slice(result, func(a, b int) bool {
+		if result[a].TargetPort != result[b].TargetPort {
+			return result[a].TargetPort < result[b].TargetPort
+		}
+		return result[a].Protocol < result[b].Protocol
+	})
+	return result, nil
+}
+
+// serviceRestartPolicy returns the restart policy of the tasks, translated
+// from the one in DOCKER_CONFIG. Tasks are always restarted by default.
+func serviceRestartPolicy() *swarmRestartPolicy {
+	if config.HostConfig == nil {
+		return &swarmRestartPolicy{Condition: "any"}
+	}
+	switch policy := config.HostConfig.RestartPolicy; policy.Name {
+	case "no":
+		return &swarmRestartPolicy{Condition: "none"}
+	case "on-failure":
+		result := swarmRestartPolicy{Condition: "on-failure"}
+		if policy.MaximumRetryCount > 0 {
+			attempts := uint64(policy.MaximumRetryCount)
+			result.MaxAttempts = &attempts
+		}
+		return &result
+	}
+	return &swarmRestartPolicy{Condition: "any"}
+}
+
+// removeServices removes the services created by createServices, in reverse
+// order.
+func removeServices(ctx context.Context, p *provisioning) error {
+	var lastErr error
+	for i := len(p.services) - 1; i >= 0; i-- {
+		if err := removeService(ctx, p.client, p.services[i]); err != nil {
+			p.log.Error("failed to remove service", "service", p.services[i], "error", err)
+			lastErr = err
+		}
+	}
+	p.services = nil
+	return lastErr
+}
+
+// removeService removes the service with the given ID or name. Services that
+// don't exist are already removed.
+func removeService(ctx context.Context, client *docker.Client, id string) error {
+	err := dockerRequest(ctx, client, http.MethodDelete, "/services/"+url.PathEscape(id), nil, nil)
+	if e, ok := err.(*docker.Error); ok && e.Status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// waitServices waits until every replica of the services of the instance is
+// running.
+func waitServices(ctx context.Context, p *provisioning) error {
+	ctx, cancel := context.WithTimeout(ctx, serviceStartTimeout)
+	defer cancel()
+	for {
+		health, err := servicesHealth(ctx, p.client, p.services, p.specs)
+		if err == nil && health == "" {
+			return nil
+		}
+		if err == nil {
+			err = errors.New("tasks not running")
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("services not running: %w", err)
+		case <-time.After(readinessInterval):
+		}
+	}
+}
+
+// inspectServices fills the instance with the details of its services. The
+// endpoints of the instance are the ports of its client-facing services,
+// published in DOCKER_HOST, and Envs come from the image of the primary
+// member.
+func inspectServices(ctx context.Context, p *provisioning) error {
+	p.instance.Services = make([]InstanceService, len(p.services))
+	p.instance.HostPorts = []string{}
+	p.instance.Ports = nil
+	p.instance.Envs = nil
+	for i, id := range p.services {
+		var service swarmService
+		err := dockerRequest(ctx, p.client, http.MethodGet, "/services/"+url.PathEscape(id), nil, &service)
+		if err != nil {
+			return err
+		}
+		member := &p.specs[i].member
+		hostPorts, ports := servicePublishedPorts(&service, member)
+		p.instance.Services[i] = InstanceService{
+			ID:           service.ID,
+			Name:         p.specs[i].name,
+			Member:       member.Name,
+			ClientFacing: member.ClientFacing,
+			Ports:        ports,
+		}
+		if !member.ClientFacing {
+			continue
+		}
+		p.instance.HostPorts = append(p.instance.HostPorts, hostPorts...)
+		p.instance.Ports = append(p.instance.Ports, ports...)
+	}
+	image, err := p.client.InspectImage(p.plan.primaryMember().Image)
+	if err != nil {
+		return err
+	}
+	if image.Config != nil {
+		p.instance.Envs = image.Config.Env
+	}
+	if p.plan.isGroup() {
+		names := make([]string, len(p.specs))
+		for n, spec := range p.specs {
+			names[n] = spec.name
+		}
+		p.instance.Envs = append(p.instance.Envs, "DIAATS_MEMBERS="+strings.Join(names, ","))
+	}
+	return nil
+}
+
+// servicePublishedPorts returns the ports published by the service, sorted
+// by target port, and the ports named by the member, like publishedPorts.
+func servicePublishedPorts(service *swarmService, member *PlanMember) ([]string, []InstancePort) {
+	published := append([]swarmPortConfig(nil), service.Endpoint.Ports...)
+	sort.Slice(published, func(a, b int) bool {
+		if published[a].TargetPort != published[b].TargetPort {
+			return published[a].TargetPort < published[b].TargetPort
+		}
+		return published[a].Protocol < published[b].Protocol
+	})
+	names := make(map[docker.Port]string, len(member.Ports))
+	for _, port := range member.Ports {
+		names[port.dockerPort()] = port.Name
+	}
+	hostPorts := make([]string, 0, len(published))
+	ports := make([]InstancePort, 0, len(published))
+	for _, port := range published {
+		if port.PublishedPort == 0 {
+			continue
+		}
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		containerPort := docker.Port(fmt.Sprintf("%d/%s", port.TargetPort, protocol))
+		hostPort := strconv.Itoa(int(port.PublishedPort))
+		hostPorts = append(hostPorts, hostPort)
+		ports = append(ports, InstancePort{Name: names[containerPort], ContainerPort: string(containerPort), HostPort: hostPort})
+	}
+	return hostPorts, ports
+}
+
+// serviceTasks returns the tasks of the service that Swarm wants running.
+func serviceTasks(ctx context.Context, client *docker.Client, id string) ([]swarmTask, error) {
+	filters, err := json.Marshal(map[string]map[string]bool{
+		"service":       {id: true},
+		"desired-state": {"running": true},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var tasks []swarmTask
+	err = dockerRequest(ctx, client, http.MethodGet, "/tasks?filters="+url.QueryEscape(string(filters)), nil, &tasks)
+	return tasks, err
+}
+
+// servicesHealth returns the health state of the given services, created
+// from specs: an empty string when every replica is running, HealthStarting
+// when some are being started and HealthUnhealthy when Swarm isn't running
+// them.
+func servicesHealth(ctx context.Context, client *docker.Client, ids []string, specs []containerSpec) (string, error) {
+	var health string
+	for i, id := range ids {
+		tasks, err := serviceTasks(ctx, client, id)
+		if err != nil {
+			return "", err
+		}
+		var running, starting int
+		for _, task := range tasks {
+			switch task.Status.State {
+			case "running":
+				running++
+			case "new", "allocated", "pending", "assigned", "accepted", "preparing", "ready", "starting":
+				starting++
+			}
+		}
+		switch {
+		case running >= specs[i].member.replicas():
+		case running+starting >= specs[i].member.replicas():
+			health = HealthStarting
+		default:
+			return HealthUnhealthy, nil
+		}
+	}
+	return health, nil
+}
+
+// serviceInstanceHealth returns the health state of the services of the
+// instance, as servicesHealth does.
+func serviceInstanceHealth(ctx context.Context, instance *Instance) (string, error) {
+	client, err := dockerClient(instance.DockerHost)
+	if err != nil {
+		return "", err
+	}
+	ids := make([]string, len(instance.Services))
+	specs := make([]containerSpec, len(instance.Services))
+	members := instance.Plan.members()
+	for i, service := range instance.Services {
+		ids[i] = service.ID
+		for _, member := range members {
+			if member.Name == service.Member {
+				specs[i].member = member
+			}
+		}
+	}
+	return servicesHealth(ctx, client, ids, specs)
+}
+
+// removeInstanceServices removes the services of the instance, logging the
+// failures.
+func removeInstanceServices(ctx context.Context, client *docker.Client, instance *Instance) {
+	for _, service := range instance.Services {
+		if err := removeService(ctx, client, service.ID); err != nil {
+			loggerFromContext(ctx).Error("failed to remove service", "instance", instance.Name, "service", service.ID, "error", err)
+		}
+	}
+}
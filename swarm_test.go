@@ -0,0 +1,354 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+// fakeSwarm implements the services and tasks of the Docker API in the fake
+// Docker server. Services get published ports starting from port, and their
+// tasks are all in the given state.
+type fakeSwarm struct {
+	mut      sync.Mutex
+	services []*swarmService
+	port     uint32
+	state    string
+	lastID   int
+}
+
+func (s *S) startFakeSwarm() *fakeSwarm {
+	f := fakeSwarm{port: 30000, state: "running"}
+	s.server.CustomHandler("^/services", http.HandlerFunc(f.serveServices))
+	s.server.CustomHandler("^/tasks", http.HandlerFunc(f.serveTasks))
+	return &f
+}
+
+func (f *fakeSwarm) find(id string) (int, *swarmService) {
+	for i, service := range f.services {
+		if service.ID == id || service.Spec.Name == id {
+			return i, service
+		}
+	}
+	return -1, nil
+}
+
+func (f *fakeSwarm) get(id string) *swarmService {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	_, service := f.find(id)
+	return service
+}
+
+func (f *fakeSwarm) serveServices(w http.ResponseWriter, r *http.Request) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if r.Method == http.MethodPost && r.URL.Path == "/services/create" {
+		var spec swarmServiceSpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, service := f.find(spec.Name); service != nil {
+			http.Error(w, "service already exists", http.StatusConflict)
+			return
+		}
+		f.lastID++
+		service := swarmService{ID: fmt.Sprintf("service%d", f.lastID), Spec: spec}
+		if spec.EndpointSpec != nil {
+			for _, port := range spec.EndpointSpec.Ports {
+				if port.PublishedPort == 0 {
+					port.PublishedPort = f.port
+					f.port++
+				}
+				service.Endpoint.Ports = append(service.Endpoint.Ports, port)
+			}
+		}
+		f.services = append(f.services, &service)
+		json.NewEncoder(w).Encode(map[string]string{"ID": service.ID})
+		return
+	}
+	i, service := f.find(strings.TrimPrefix(r.URL.Path, "/services/"))
+	if service == nil {
+		http.Error(w, "service not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(service)
+	case http.MethodDelete:
+		f.services = append(f.services[:i], f.services[i+1:]...)
+	}
+}
+
+func (f *fakeSwarm) serveTasks(w http.ResponseWriter, r *http.Request) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	var filters map[string]map[string]bool
+	json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+	tasks := []swarmTask{}
+	for id := range filters["service"] {
+		_, service := f.find(id)
+		if service == nil || f.state == "" {
+			continue
+		}
+		for n := uint64(0); n < *service.Spec.Mode.Replicated.Replicas; n++ {
+			var task swarmTask
+			task.ID = fmt.Sprintf("%s.%d", service.ID, n)
+			task.Status.State = f.state
+			tasks = append(tasks, task)
+		}
+	}
+	json.NewEncoder(w).Encode(tasks)
+}
+
+func (s *S) TestCreateServiceInstance(c *check.C) {
+	swarm := s.startFakeSwarm()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	swarm.port = uint32(port)
+	config.Provisioner = ProvisionerSwarm
+	config.HostConfig = &docker.HostConfig{RestartPolicy: docker.RestartOnFailure(3)}
+	config.Plans = []Plan{{
+		Name:      "memcached",
+		Image:     "memcached",
+		Args:      []string{"-m", "64"},
+		Memory:    64 * mb,
+		Ports:     []PlanPort{{Name: "memcached", Port: "11211"}},
+		Readiness: &ReadinessCheck{Type: ReadinessTCP, Port: "11211"},
+		Placement: &Placement{Constraints: []string{"zone==a", "disk!=hdd"}},
+	}}
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{Team: "myteam"})
+	c.Assert(err, check.IsNil)
+	instance, err := storage.GetInstance("mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.Provisioner, check.Equals, ProvisionerSwarm)
+	c.Assert(instance.DockerHost, check.Equals, config.DockerHost)
+	c.Assert(instance.State, check.Equals, StateRunning)
+	c.Assert(instance.ContainerID, check.Equals, "")
+	c.Assert(instance.Network, check.Equals, "")
+	hostPort := strconv.Itoa(port)
+	c.Assert(instance.HostPorts, check.DeepEquals, []string{hostPort})
+	c.Assert(instance.Ports, check.DeepEquals, []InstancePort{{Name: "memcached", ContainerPort: "11211/tcp", HostPort: hostPort}})
+	c.Assert(instance.Endpoints(), check.DeepEquals, []string{"127.0.0.1:" + hostPort})
+	c.Assert(instance.Images, check.DeepEquals, []InstanceImage{{Image: "memcached"}})
+	c.Assert(instance.Services, check.HasLen, 1)
+	service := swarm.get(instance.Services[0].ID)
+	c.Assert(service, check.NotNil)
+	c.Assert(instance.Services[0], check.DeepEquals, InstanceService{
+		ID:           service.ID,
+		Name:         "diaats-memcached-mycache",
+		Member:       "",
+		ClientFacing: true,
+		Ports:        instance.Ports,
+	})
+	attempts := uint64(3)
+	replicas := uint64(1)
+	c.Assert(service.Spec, check.DeepEquals, swarmServiceSpec{
+		Name: "diaats-memcached-mycache",
+		TaskTemplate: swarmTaskSpec{
+			ContainerSpec: swarmContainerSpec{Image: "memcached", Args: []string{"-m", "64"}},
+			Resources:     &swarmResources{Limits: &swarmResourceLimits{MemoryBytes: 64 * mb}},
+			RestartPolicy: &swarmRestartPolicy{Condition: "on-failure", MaxAttempts: &attempts},
+			Placement:     &swarmPlacement{Constraints: []string{"node.labels.zone==a", "node.labels.disk!=hdd"}},
+		},
+		Mode:         swarmServiceMode{Replicated: &swarmReplicatedService{Replicas: &replicas}},
+		EndpointSpec: &swarmEndpointSpec{Ports: []swarmPortConfig{{Protocol: "tcp", TargetPort: 11211, PublishMode: "ingress"}}},
+	})
+	health, err := instanceHealth(context.Background(), instance)
+	c.Assert(err, check.IsNil)
+	c.Assert(health, check.Equals, "")
+	c.Assert(checkReady(context.Background(), instance), check.IsNil)
+	err = DestroyInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(swarm.get(service.ID), check.IsNil)
+	_, err = storage.GetInstance("mycache")
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
+}
+
+func (s *S) TestCreateServiceInstanceGroup(c *check.C) {
+	swarm := s.startFakeSwarm()
+	removed := s.handleNetworks()
+	config.Provisioner = ProvisionerSwarm
+	config.Plans = []Plan{{Name: "es", Members: []PlanMember{
+		{Name: "node", Image: "elasticsearch", Replicas: 3, Ports: []PlanPort{{Name: "http", Port: "9200"}}, ClientFacing: true},
+		{Name: "exporter", Image: "exporter"},
+	}}}
+	err := CreateInstance(context.Background(), "mysearch", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	instance, err := storage.GetInstance("mysearch")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.Network, check.Equals, "diaats-es-mysearch")
+	c.Assert(instance.NetworkScope, check.Equals, NetworkInstance)
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	network, err := client.NetworkInfo(instance.Network)
+	c.Assert(err, check.IsNil)
+	c.Assert(network.Driver, check.Equals, "overlay")
+	c.Assert(instance.Services, check.HasLen, 2)
+	c.Assert(instance.Services[0].Name, check.Equals, "diaats-es-mysearch-node")
+	c.Assert(instance.Services[1].Name, check.Equals, "diaats-es-mysearch-exporter")
+	c.Assert(instance.HostPorts, check.DeepEquals, []string{"30000"})
+	c.Assert(instance.Envs, check.DeepEquals, []string{"DIAATS_MEMBERS=diaats-es-mysearch-node,diaats-es-mysearch-exporter"})
+	node := swarm.get(instance.Services[0].ID)
+	c.Assert(*node.Spec.Mode.Replicated.Replicas, check.Equals, uint64(3))
+	c.Assert(node.Spec.TaskTemplate.Networks, check.DeepEquals, []swarmNetworkConfig{{Target: "diaats-es-mysearch"}})
+	c.Assert(node.Spec.TaskTemplate.ContainerSpec.Env, check.DeepEquals, []string{"DIAATS_MEMBERS=diaats-es-mysearch-node,diaats-es-mysearch-exporter"})
+	c.Assert(node.Spec.TaskTemplate.RestartPolicy, check.DeepEquals, &swarmRestartPolicy{Condition: "any"})
+	exporter := swarm.get(instance.Services[1].ID)
+	c.Assert(exporter.Spec.EndpointSpec, check.IsNil)
+	c.Assert(exporter.Spec.TaskTemplate.Resources, check.IsNil)
+	err = DestroyInstance(context.Background(), "mysearch")
+	c.Assert(err, check.IsNil)
+	c.Assert(swarm.services, check.HasLen, 0)
+	c.Assert(*removed, check.DeepEquals, []string{"diaats-es-mysearch"})
+}
+
+func (s *S) TestCreateServiceInstanceLeftover(c *check.C) {
+	swarm := s.startFakeSwarm()
+	config.Provisioner = ProvisionerSwarm
+	config.Plans = []Plan{{Name: "memcached", Image: "memcached", Ports: []PlanPort{{Name: "memcached", Port: "11211"}}}}
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	_, err = createService(context.Background(), client, &swarmServiceSpec{Name: "diaats-memcached-mycache"})
+	c.Assert(err, check.IsNil)
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycache")
+	c.Assert(swarm.services, check.HasLen, 1)
+	c.Assert(swarm.services[0].ID, check.Equals, "service2")
+	c.Assert(swarm.services[0].Spec.TaskTemplate.ContainerSpec.Image, check.Equals, "memcached")
+}
+
+func (s *S) TestCreateServiceInstanceVolumes(c *check.C) {
+	s.createDataImage(c)
+	swarm := s.startFakeSwarm()
+	config.Provisioner = ProvisionerSwarm
+	config.Plans = []Plan{{Name: "memcached", Image: "memcached-data", Ports: []PlanPort{{Name: "memcached", Port: "11211"}}}}
+	err := CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.Equals, ErrSwarmVolumes)
+	c.Assert(swarm.services, check.HasLen, 0)
+	_, err = storage.GetInstance("mycache")
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
+}
+
+func (s *S) TestCreateServiceInstanceTasksNotRunning(c *check.C) {
+	swarm := s.startFakeSwarm()
+	swarm.state = "rejected"
+	config.Provisioner = ProvisionerSwarm
+	config.Plans = []Plan{{Name: "memcached", Image: "memcached", Ports: []PlanPort{{Name: "memcached", Port: "11211"}}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	err := CreateInstance(ctx, "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.ErrorMatches, "services not running: tasks not running")
+	c.Assert(swarm.services, check.HasLen, 0)
+	_, err = storage.GetInstance("mycache")
+	c.Assert(err, check.Equals, ErrInstanceNotFound)
+}
+
+func (s *S) TestServiceInstanceStatus(c *check.C) {
+	swarm := s.startFakeSwarm()
+	config.Provisioner = ProvisionerSwarm
+	config.Plans = []Plan{{Name: "memcached", Image: "memcached", Ports: []PlanPort{{Name: "memcached", Port: "11211"}}}}
+	err := CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycache")
+	handler := buildMuxer()
+	var tests = []struct {
+		state  string
+		status int
+	}{
+		{"running", http.StatusNoContent},
+		{"preparing", http.StatusAccepted},
+		{"failed", http.StatusInternalServerError},
+		{"", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		swarm.mut.Lock()
+		swarm.state = tt.state
+		swarm.mut.Unlock()
+		request, err := http.NewRequest("GET", "/resources/mycache/status", nil)
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, tt.status, check.Commentf("state %q", tt.state))
+	}
+}
+
+func (s *S) TestServiceInstanceNotSupported(c *check.C) {
+	s.startFakeSwarm()
+	config.Provisioner = ProvisionerSwarm
+	config.Plans = []Plan{{Name: "memcached", Image: "memcached", Ports: []PlanPort{{Name: "memcached", Port: "11211"}}}}
+	err := CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycache")
+	instance, err := storage.GetInstance("mycache")
+	c.Assert(err, check.IsNil)
+	_, err = SnapshotInstance(context.Background(), instance)
+	c.Assert(err, check.Equals, ErrNotSupportedBySwarm)
+	c.Assert(RecreateInstance(context.Background(), instance), check.Equals, ErrNotSupportedBySwarm)
+	c.Assert(MoveInstance(context.Background(), instance, config.DockerHost), check.Equals, ErrNotSupportedBySwarm)
+	_, err = QueueOperation(context.Background(), "mycache", OperationRecreate, "")
+	c.Assert(err, check.Equals, ErrNotSupportedBySwarm)
+	err = CreateInstance(context.Background(), "mycache2", &config.Plans[0], CreateOptions{Source: "mycache"})
+	c.Assert(err, check.Equals, ErrNotSupportedBySwarm)
+	request, err := http.NewRequest("POST", "/resources/mycache/snapshots", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	buildMuxer().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (*S) TestValidatePlansSwarm(c *check.C) {
+	plans := []Plan{{
+		Name:        "memcached",
+		Image:       "memcached",
+		Readiness:   &ReadinessCheck{Type: ReadinessExec, Command: []string{"true"}},
+		Healthcheck: &Healthcheck{RestartAfter: "1m"},
+		Backup:      &BackupConfig{Command: []string{"dump"}},
+		Updates:     &UpdatePolicy{Policy: UpdateRecreate},
+		Placement:   &Placement{AntiAffinity: GroupTeam},
+	}}
+	c.Assert(validatePlans(plans), check.HasLen, 0)
+	config.Provisioner = ProvisionerSwarm
+	errs := validatePlans(plans)
+	c.Assert(errs, check.HasLen, 5)
+	c.Assert(errs[0], check.ErrorMatches, `plan "memcached": exec readiness checks are not supported by the swarm provisioner`)
+	c.Assert(errs[1], check.ErrorMatches, `plan "memcached": healthcheck restartAfter is not supported .*`)
+	c.Assert(errs[2], check.ErrorMatches, `plan "memcached": backups are not supported .*`)
+	c.Assert(errs[3], check.ErrorMatches, `plan "memcached": the recreate update policy is not supported .*`)
+	c.Assert(errs[4], check.ErrorMatches, `plan "memcached": affinity rules are not supported .*`)
+}
+
+func (*S) TestServiceRestartPolicy(c *check.C) {
+	c.Assert(serviceRestartPolicy(), check.DeepEquals, &swarmRestartPolicy{Condition: "any"})
+	config.HostConfig = &docker.HostConfig{RestartPolicy: docker.NeverRestart()}
+	c.Assert(serviceRestartPolicy(), check.DeepEquals, &swarmRestartPolicy{Condition: "none"})
+	config.HostConfig = &docker.HostConfig{RestartPolicy: docker.RestartOnFailure(0)}
+	c.Assert(serviceRestartPolicy(), check.DeepEquals, &swarmRestartPolicy{Condition: "on-failure"})
+	config.HostConfig = &docker.HostConfig{RestartPolicy: docker.AlwaysRestart()}
+	c.Assert(serviceRestartPolicy(), check.DeepEquals, &swarmRestartPolicy{Condition: "any"})
+}
+
+func (*S) TestIsDiaatsContainerSwarmTask(c *check.C) {
+	container := docker.APIContainers{Names: []string{"/diaats-memcached-mycache.1.abc"}}
+	c.Assert(isDiaatsContainer(container), check.Equals, true)
+	container.Labels = map[string]string{"com.docker.swarm.service.id": "service1"}
+	c.Assert(isDiaatsContainer(container), check.Equals, false)
+}
@@ -0,0 +1,418 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Policies for updating the instances of a plan when the image of the plan
+// changes in the registry.
+const (
+	UpdateNever    = "never"
+	UpdateNotify   = "notify"
+	UpdateRecreate = "recreate"
+)
+
+const updateActor = "diaats-image-updater"
+
+// UpdatePolicy defines what happens to the instances of a plan when the
+// image of the plan is updated in the registry. With UpdateNotify, outdated
+// instances are only reported; with UpdateRecreate, the recreation of their
+// containers from the new image is also queued for their maintenance
+// windows.
+type UpdatePolicy struct {
+	Policy string `json:"policy"`
+
+	// Window is the default maintenance window of the instances of the
+	// plan, as accepted by parseWindow.
+	Window string `json:"window,omitempty"`
+}
+
+func (u *UpdatePolicy) validate() error {
+	switch u.Policy {
+	case UpdateNever, UpdateNotify, UpdateRecreate:
+	default:
+		return fmt.Errorf("invalid update policy %q", u.Policy)
+	}
+	if u.Window != "" {
+		if _, err := parseWindow(u.Window); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InstanceImage is an image used by the containers of an instance. Digest
+// is the registry digest of the image the containers run, empty when it's
+// unknown, and Latest is the digest of the image in the registry, when it
+// differs from Digest.
+type InstanceImage struct {
+	Image  string
+	Digest string
+	Latest string `json:",omitempty"`
+}
+
+// images returns the images of the instance. Instances created before
+// digests were recorded get the images of their plan, with unknown digests.
+func (i *Instance) images() []InstanceImage {
+	if len(i.Images) > 0 {
+		return i.Images
+	}
+	var images []InstanceImage
+	for _, image := range planImages(&i.Plan) {
+		images = append(images, InstanceImage{Image: image})
+	}
+	return images
+}
+
+// UpdateAvailable reports whether the registry has a newer version of any
+// of the images of the instance.
+func (i *Instance) UpdateAvailable() bool {
+	for _, image := range i.Images {
+		if image.Latest != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// planImages returns the distinct images of the members of the plan.
+func planImages(plan *Plan) []string {
+	var images []string
+	seen := make(map[string]bool)
+	for _, member := range plan.members() {
+		if !seen[member.Image] {
+			seen[member.Image] = true
+			images = append(images, member.Image)
+		}
+	}
+	return images
+}
+
+// imageDigest returns the registry digest of the local copy of the image,
+// or an empty string when it wasn't pulled from a registry.
+func imageDigest(ctx context.Context, client *docker.Client, image string) (string, error) {
+	var result struct{ RepoDigests []string }
+	err := dockerRequest(ctx, client, http.MethodGet, "/images/"+image+"/json", nil, &result)
+	if err != nil {
+		return "", err
+	}
+	repository, _ := docker.ParseRepositoryTag(image)
+	for _, repoDigest := range result.RepoDigests {
+		if i := strings.LastIndex(repoDigest, "@"); i >= 0 && repoDigest[:i] == repository {
+			return repoDigest[i+1:], nil
+		}
+	}
+	if len(result.RepoDigests) == 1 {
+		return result.RepoDigests[0][strings.LastIndex(result.RepoDigests[0], "@")+1:], nil
+	}
+	return "", nil
+}
+
+// registryDigest returns the digest of the image in the registry, as seen
+// by the Docker host, which requires Docker 17.06 or newer.
+func registryDigest(ctx context.Context, client *docker.Client, image string) (string, error) {
+	var result struct {
+		Descriptor struct{ Digest string }
+	}
+	err := dockerRequest(ctx, client, http.MethodGet, "/distribution/"+image+"/json", nil, &result)
+	return result.Descriptor.Digest, err
+}
+
+// recordImages records the digests of the images of the instance. Unknown
+// digests aren't an error, as they only make the instance look outdated.
+func recordImages(ctx context.Context, p *provisioning) error {
+	p.instance.Images = nil
+	for _, image := range planImages(p.plan) {
+		digest, err := imageDigest(ctx, p.client, image)
+		if err != nil {
+			p.log.Warn("failed to get image digest", "image", image, "error", err)
+		}
+		p.instance.Images = append(p.instance.Images, InstanceImage{Image: image, Digest: digest})
+	}
+	return nil
+}
+
+// pullImages pulls the images of the plan, so the containers are recreated
+// from their latest versions. Clones keep the images of their snapshots.
+func pullImages(ctx context.Context, p *provisioning) error {
+	if p.images != nil {
+		return nil
+	}
+	for _, image := range planImages(p.plan) {
+		repository, tag := docker.ParseRepositoryTag(image)
+		err := p.client.PullImage(docker.PullImageOptions{Repository: repository, Tag: tag}, docker.AuthConfiguration{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replacedSuffix is appended to the names of the containers being replaced,
+// so the new containers can take their names.
+const replacedSuffix = "-replaced"
+
+// replacedContainer is a container being replaced by RecreateInstance. Its
+// ID is empty when the container was already gone.
+type replacedContainer struct {
+	id   string
+	name string
+}
+
+// stopContainers stops the containers of the instance and renames them, so
+// the new containers can take their names and host ports. The old
+// containers are kept, with their data, until the new ones are ready.
+func stopContainers(ctx context.Context, p *provisioning) error {
+	for _, id := range p.instance.containerIDs() {
+		container, err := p.client.InspectContainer(id)
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			p.replaced = append(p.replaced, replacedContainer{})
+			continue
+		}
+		if err == nil {
+			err = p.client.StopContainer(id, 10)
+			if _, ok := err.(*docker.ContainerNotRunning); ok {
+				err = nil
+			}
+		}
+		if err == nil {
+			name := strings.TrimPrefix(container.Name, "/")
+			p.replaced = append(p.replaced, replacedContainer{id: id, name: name})
+			err = p.client.RenameContainer(docker.RenameContainerOptions{ID: id, Name: name + replacedSuffix})
+		}
+		if err != nil {
+			restoreContainers(ctx, p)
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreContainers gives the replaced containers their names back and
+// starts them, after the new containers failed.
+func restoreContainers(ctx context.Context, p *provisioning) error {
+	var lastErr error
+	for _, old := range p.replaced {
+		if old.id == "" {
+			continue
+		}
+		err := p.client.RenameContainer(docker.RenameContainerOptions{ID: old.id, Name: old.name})
+		if err != nil {
+			p.log.Error("failed to rename replaced container", "container", old.id, "error", err)
+		}
+		err = p.client.StartContainer(old.id, nil)
+		if _, ok := err.(*docker.ContainerAlreadyRunning); err != nil && !ok {
+			p.log.Error("failed to start replaced container", "container", old.id, "error", err)
+			lastErr = err
+		}
+	}
+	p.replaced = nil
+	return lastErr
+}
+
+// removeReplacedContainers removes the replaced containers, keeping their
+// volumes, which are mounted by the new containers. It never fails, as the
+// instance is already saved with the new containers.
+func removeReplacedContainers(ctx context.Context, p *provisioning) error {
+	for _, old := range p.replaced {
+		if old.id == "" {
+			continue
+		}
+		err := p.client.RemoveContainer(docker.RemoveContainerOptions{ID: old.id, Force: true})
+		if err != nil {
+			p.log.Error("failed to remove replaced container", "container", old.id, "error", err)
+		}
+	}
+	p.replaced = nil
+	return nil
+}
+
+// recreateSteps are the steps executed by RecreateInstance, in order. The
+// old containers are only removed once the new ones are ready, and are
+// restored when any of the steps fails.
+var recreateSteps = []step{
+	{name: "pull images", forward: pullImages},
+	{name: "stop containers", forward: stopContainers, backward: restoreContainers},
+	{name: "create containers", forward: createContainers, backward: removeContainers},
+	{name: "start containers", forward: startContainers},
+	{name: "inspect containers", forward: inspectContainers},
+	{name: "record images", forward: recordImages},
+	{name: "wait for readiness", forward: waitContainerReady},
+	{name: "save instance", forward: saveInstance},
+	{name: "remove replaced containers", forward: removeReplacedContainers},
+}
+
+// RecreateInstance replaces the containers of the instance with new ones,
+// running the latest versions of the images of its plan, or the images of
+// their snapshot for clones. The published ports and the volumes of the
+// instance don't change, but data not stored in volumes is lost.
+func RecreateInstance(ctx context.Context, instance *Instance) error {
+	done, err := trackOperation()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if instance.isService() {
+		return ErrNotSupportedBySwarm
+	}
+	if instance.isSpread() {
+		return ErrSpreadInstance
+	}
+	client, err := dockerClient(instance.DockerHost)
+	if err != nil {
+		return err
+	}
+	p := provisioning{
+		client:   client,
+		instance: instance,
+		plan:     &instance.Plan,
+		specs:    instance.Plan.containerSpecs(instance.Name),
+		log:      loggerFromContext(ctx).With("instance", instance.Name, "plan", instance.Plan.Name),
+	}
+	for _, container := range instance.Containers {
+		p.pinnedPorts = append(p.pinnedPorts, container.Ports)
+		p.volumes = append(p.volumes, container.Volumes)
+	}
+	if len(instance.Containers) == 0 {
+		p.pinnedPorts = [][]InstancePort{instance.Ports}
+	}
+	if instance.Source != "" {
+		if p.images, err = containerImages(client, instance); err != nil {
+			return err
+		}
+	}
+	if err = runSteps(ctx, recreateSteps, &p); err != nil {
+		return err
+	}
+	p.log.Info("instance recreated", "container", instance.ContainerID)
+	return nil
+}
+
+// containerImages returns the images run by the containers of the instance,
+// which clones keep when they're recreated.
+func containerImages(client *docker.Client, instance *Instance) ([]string, error) {
+	var images []string
+	for _, id := range instance.containerIDs() {
+		container, err := client.InspectContainer(id)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, container.Image)
+	}
+	return images, nil
+}
+
+// imageUpdater checks the registry for new versions of the images of the
+// plans, applying their update policies.
+type imageUpdater struct {
+	// digests caches the registry digests of the images during a check.
+	digests map[string]string
+}
+
+// run checks for updates every interval until ctx is canceled.
+func (u *imageUpdater) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			u.check(ctx)
+		}
+	}
+}
+
+// check compares the images of the running instances of plans with an
+// update policy with the registry, recording and reporting the outdated
+// ones and queueing their recreation when the policy allows it. Only the
+// replica of the API holding the image updates lease checks.
+func (u *imageUpdater) check(ctx context.Context) {
+	release, ok := claimWork(ctx, "image-updates")
+	if !ok {
+		return
+	}
+	defer release()
+	u.digests = make(map[string]string)
+	log := loggerFromContext(ctx)
+	for _, plan := range config.Plans {
+		policy := plan.Updates
+		if policy == nil || policy.Policy == UpdateNever {
+			continue
+		}
+		instances, _, err := storage.ListInstances(InstanceFilter{Plan: plan.Name, State: StateRunning})
+		if err != nil {
+			log.Error("failed to list instances for image updates", "plan", plan.Name, "error", err)
+			continue
+		}
+		for i := range instances {
+			instance := &instances[i]
+			if instance.Source != "" {
+				// clones run the images of their snapshots.
+				continue
+			}
+			if !u.refresh(ctx, instance) || policy.Policy != UpdateRecreate {
+				continue
+			}
+			if _, err = QueueOperation(ctx, instance.Name, OperationRecreate, "image update"); err != nil {
+				log.Error("failed to queue image update", "instance", instance.Name, "error", err)
+			}
+		}
+	}
+}
+
+// refresh records the latest digests of the images of the instance,
+// reporting new updates, and returns whether the instance is outdated.
+func (u *imageUpdater) refresh(ctx context.Context, instance *Instance) bool {
+	log := loggerFromContext(ctx)
+	client, err := dockerClient(instance.DockerHost)
+	if err != nil {
+		log.Error("failed to create Docker client", "docker_host", instance.DockerHost, "error", err)
+		return false
+	}
+	images := instance.images()
+	var outdated, changed bool
+	for n := range images {
+		image := &images[n]
+		if strings.Contains(image.Image, "@") {
+			continue
+		}
+		latest, ok := u.digests[image.Image]
+		if !ok {
+			if latest, err = registryDigest(ctx, client, image.Image); err != nil {
+				log.Error("failed to get registry digest", "image", image.Image, "error", err)
+			}
+			u.digests[image.Image] = latest
+		}
+		if latest == "" || latest == image.Digest {
+			continue
+		}
+		outdated = true
+		if image.Latest != latest {
+			image.Latest = latest
+			changed = true
+			log.Warn("image update available", "instance", instance.Name, "image", image.Image, "digest", latest)
+		}
+	}
+	if changed {
+		evt := startEvent(ctx, EventUpdateAvailable, instance.Name, updateActor)
+		evt.Plan = instance.Plan.Name
+		evt.DockerHost = instance.DockerHost
+		_, err = modifyInstance(instance.Name, func(instance *Instance) error {
+			instance.Images = images
+			return nil
+		})
+		evt.Done(ctx, err)
+	}
+	return outdated
+}
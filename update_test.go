@@ -0,0 +1,223 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+// setImageDigests makes the fake Docker server report local as the
+// digest for local images, and registry as the digest of images in the
+// registry.
+func (s *S) setImageDigests(local, registry *string) {
+	s.server.CustomHandler("/images/.+/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"RepoDigests": []string{name + "@" + *local}})
+	}))
+	s.server.CustomHandler("/distribution/.+/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"Descriptor": map[string]string{"digest": *registry}})
+	}))
+}
+
+// updatablePlan returns a plan with the given update policy.
+func updatablePlan(policy *UpdatePolicy) Plan {
+	return Plan{
+		Name:    "supermemcached",
+		Image:   "memcached",
+		Ports:   []PlanPort{{Name: "cache", Port: "11211"}},
+		Updates: policy,
+	}
+}
+
+func (*S) TestUpdatePolicyValidate(c *check.C) {
+	policy := UpdatePolicy{Policy: UpdateRecreate, Window: "sun 02:00-04:00"}
+	c.Assert(policy.validate(), check.IsNil)
+	policy = UpdatePolicy{Policy: "sometimes"}
+	c.Assert(policy.validate(), check.ErrorMatches, `invalid update policy "sometimes"`)
+	policy = UpdatePolicy{Policy: UpdateNotify, Window: "weekends"}
+	c.Assert(policy.validate(), check.ErrorMatches, `invalid maintenance window "weekends"`)
+}
+
+func (s *S) TestCreateInstanceRecordsImages(c *check.C) {
+	local, registry := "sha256:abc", "sha256:abc"
+	s.setImageDigests(&local, &registry)
+	instance := s.createInstanceWithPlan(c, "mycache", updatablePlan(nil))
+	defer DestroyInstance(context.Background(), "mycache")
+	c.Assert(instance.Images, check.DeepEquals, []InstanceImage{{Image: "memcached", Digest: "sha256:abc"}})
+	c.Assert(instance.UpdateAvailable(), check.Equals, false)
+}
+
+func (s *S) TestImageUpdaterNotify(c *check.C) {
+	local, registry := "sha256:abc", "sha256:abc"
+	s.setImageDigests(&local, &registry)
+	instance := s.createInstanceWithPlan(c, "mycache", updatablePlan(&UpdatePolicy{Policy: UpdateNotify}))
+	defer DestroyInstance(context.Background(), "mycache")
+	updater := imageUpdater{}
+	updater.check(context.Background())
+	events, err := ListEvents(EventFilter{Kind: EventUpdateAvailable})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 0)
+	registry = "sha256:def"
+	updater.check(context.Background())
+	updater.check(context.Background())
+	events, err = ListEvents(EventFilter{Kind: EventUpdateAvailable})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].Actor, check.Equals, updateActor)
+	updated, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(updated.ContainerID, check.Equals, instance.ContainerID)
+	c.Assert(updated.Images, check.DeepEquals, []InstanceImage{{Image: "memcached", Digest: "sha256:abc", Latest: "sha256:def"}})
+	c.Assert(updated.UpdateAvailable(), check.Equals, true)
+	c.Assert(updated.Operations, check.HasLen, 0)
+}
+
+func (s *S) TestImageUpdaterRecreate(c *check.C) {
+	local, registry := "sha256:abc", "sha256:abc"
+	s.setImageDigests(&local, &registry)
+	instance := s.createInstanceWithPlan(c, "mycache", updatablePlan(&UpdatePolicy{Policy: UpdateRecreate, Window: "02:00-04:00"}))
+	defer DestroyInstance(context.Background(), "mycache")
+	var bindings []interface{}
+	s.server.CustomHandler("/containers/create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		var body struct {
+			HostConfig struct {
+				PortBindings map[string][]interface{}
+			}
+		}
+		json.Unmarshal(data, &body)
+		bindings = body.HostConfig.PortBindings["11211/tcp"]
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		s.server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	registry = "sha256:def"
+	updater := imageUpdater{}
+	updater.check(context.Background())
+	updater.check(context.Background())
+	operations, err := ListOperations()
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 1)
+	c.Assert(operations[0].Kind, check.Equals, OperationRecreate)
+	c.Assert(operations[0].Reason, check.Equals, "image update")
+	c.Assert(operations[0].Window, check.Equals, "02:00-04:00")
+	scheduleOperations(context.Background(), time.Date(2016, 1, 3, 12, 0, 0, 0, time.UTC))
+	updated, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(updated.ContainerID, check.Equals, instance.ContainerID)
+	local = "sha256:def"
+	scheduleOperations(context.Background(), time.Date(2016, 1, 3, 3, 0, 0, 0, time.UTC))
+	updated, err = GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(updated.ContainerID, check.Not(check.Equals), instance.ContainerID)
+	c.Assert(updated.Images, check.DeepEquals, []InstanceImage{{Image: "memcached", Digest: "sha256:def"}})
+	c.Assert(bindings, check.DeepEquals, []interface{}{map[string]interface{}{"HostPort": instance.Ports[0].HostPort}})
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	_, err = client.InspectContainer(instance.ContainerID)
+	c.Assert(err, check.FitsTypeOf, &docker.NoSuchContainer{})
+	c.Assert(updated.Operations, check.HasLen, 0)
+	events, err := ListEvents(EventFilter{Kind: EventRecreate})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].Actor, check.Equals, schedulerActor)
+	c.Assert(events[0].Success, check.Equals, true)
+}
+
+func (s *S) TestRecreateInstanceKeepsVolumes(c *check.C) {
+	s.createDataImage(c)
+	config.Plans = []Plan{{Name: "datacache", Image: "memcached-data"}}
+	err := CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycache")
+	instance, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	old, volumes := instance.ContainerID, instance.Containers[0].Volumes
+	removed := s.recordVolumeRemovals()
+	err = RecreateInstance(context.Background(), instance)
+	c.Assert(err, check.IsNil)
+	c.Assert(removed(), check.HasLen, 0)
+	updated, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(updated.ContainerID, check.Not(check.Equals), old)
+	c.Assert(updated.Containers[0].Volumes, check.DeepEquals, volumes)
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	container, err := client.InspectContainer(updated.ContainerID)
+	c.Assert(err, check.IsNil)
+	c.Assert(container.Name, check.Equals, "diaats-datacache-mycache")
+	c.Assert(container.HostConfig.Binds, check.DeepEquals, binds(volumes))
+	c.Assert(container.HostConfig.VolumesFrom, check.HasLen, 0)
+	_, err = client.InspectContainer(old)
+	c.Assert(err, check.FitsTypeOf, &docker.NoSuchContainer{})
+}
+
+func (s *S) TestRecreateInstanceWithoutNamedVolumes(c *check.C) {
+	instance := s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	old := instance.ContainerID
+	err := RecreateInstance(context.Background(), instance)
+	c.Assert(err, check.IsNil)
+	updated, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	container, err := client.InspectContainer(updated.ContainerID)
+	c.Assert(err, check.IsNil)
+	c.Assert(container.HostConfig.VolumesFrom, check.DeepEquals, []string{old})
+}
+
+func (s *S) TestRecreateInstanceFailureRestoresContainers(c *check.C) {
+	instance := s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	s.server.PrepareFailure("create-failure", "/containers/create")
+	defer s.server.ResetFailure("create-failure")
+	err := RecreateInstance(context.Background(), instance)
+	c.Assert(err, check.NotNil)
+	updated, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(updated.ContainerID, check.Equals, instance.ContainerID)
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	container, err := client.InspectContainer(instance.ContainerID)
+	c.Assert(err, check.IsNil)
+	c.Assert(container.Name, check.Equals, "diaats-supermemcached-mycache")
+	c.Assert(container.State.Running, check.Equals, true)
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(containers, check.HasLen, 1)
+}
+
+func (s *S) TestRecreateClone(c *check.C) {
+	instance := s.createTestInstance(c, "mycache")
+	defer DestroyInstance(context.Background(), "mycache")
+	snapshot, err := SnapshotInstance(context.Background(), instance)
+	c.Assert(err, check.IsNil)
+	err = CreateInstance(context.Background(), "mycopy", &config.Plans[0], CreateOptions{Source: "mycache@" + snapshot.ID})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycopy")
+	clone, err := GetInstance(context.Background(), "mycopy")
+	c.Assert(err, check.IsNil)
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	old, err := client.InspectContainer(clone.ContainerID)
+	c.Assert(err, check.IsNil)
+	err = RecreateInstance(context.Background(), clone)
+	c.Assert(err, check.IsNil)
+	updated, err := GetInstance(context.Background(), "mycopy")
+	c.Assert(err, check.IsNil)
+	c.Assert(updated.ContainerID, check.Not(check.Equals), old.ID)
+	container, err := client.InspectContainer(updated.ContainerID)
+	c.Assert(err, check.IsNil)
+	c.Assert(container.Config.Image, check.Equals, old.Image)
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var placeholderRegexp = regexp.MustCompile(`\{\{\s*([^{}\s]*)\s*\}\}`)
+
+// URLCredentials names the environment variables of the container holding
+// the credentials of the instance, referenced by {{username}} and
+// {{password}} in URL templates.
+type URLCredentials struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// validateURLTemplate checks that every placeholder in the template of the
+// connection URL of the plan is supported by renderURL.
+func validateURLTemplate(plan *Plan) error {
+	creds := plan.URLCredentials
+	if creds == nil {
+		creds = &URLCredentials{}
+	}
+	for _, match := range placeholderRegexp.FindAllStringSubmatch(plan.URL, -1) {
+		key := match[1]
+		switch {
+		case key == "host", key == "name":
+		case key == "username" && creds.Username != "":
+		case key == "password" && creds.Password != "":
+		case key == "username", key == "password":
+			return fmt.Errorf("placeholder %q in URL template requires urlCredentials.%s", match[0], key)
+		case strings.HasPrefix(key, "port.") && len(key) > len("port."):
+		case strings.HasPrefix(key, "env.") && len(key) > len("env."):
+		default:
+			return fmt.Errorf("invalid placeholder %q in URL template", match[0])
+		}
+	}
+	return nil
+}
+
+// renderURL renders the connection URL of the instance from the template
+// of its plan. The template may reference the address of the Docker host
+// ({{host}}), the name of the instance ({{name}}), the host port bound to a
+// container port, by number or by name ({{port.6379}} or {{port.http}}), the
+// environment variables of the container ({{env.REDIS_PASSWORD}}), and the
+// credentials named by the URLCredentials of the plan ({{username}} and
+// {{password}}). Environment variables and credentials are escaped for use
+// in URLs.
+func renderURL(instance *Instance) (string, error) {
+	var err error
+	envs := instance.EnvMap()
+	creds := instance.Plan.URLCredentials
+	if creds == nil {
+		creds = &URLCredentials{}
+	}
+	env := func(name string) (string, bool) {
+		value, ok := envs[name]
+		return strings.ReplaceAll(url.QueryEscape(value), "+", "%20"), ok && name != ""
+	}
+	result := placeholderRegexp.ReplaceAllStringFunc(instance.Plan.URL, func(placeholder string) string {
+		key := placeholderRegexp.FindStringSubmatch(placeholder)[1]
+		switch {
+		case key == "host":
+			return instance.host()
+		case key == "name":
+			return instance.Name
+		case key == "username":
+			if value, ok := env(creds.Username); ok {
+				return value
+			}
+		case key == "password":
+			if value, ok := env(creds.Password); ok {
+				return value
+			}
+		case strings.HasPrefix(key, "port."):
+			if port, ok := instance.hostPort(strings.TrimPrefix(key, "port.")); ok {
+				return port
+			}
+		case strings.HasPrefix(key, "env."):
+			if value, ok := env(strings.TrimPrefix(key, "env.")); ok {
+				return value
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("no value for %s in URL template", placeholder)
+		}
+		return ""
+	})
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+func (*S) TestValidateURLTemplate(c *check.C) {
+	c.Assert(validateURLTemplate(&Plan{URL: "redis://:{{env.REDIS_PASSWORD}}@{{host}}:{{port.6379}}/0"}), check.IsNil)
+	c.Assert(validateURLTemplate(&Plan{URL: "mongodb://{{ host }}:{{port.db}}/{{name}}"}), check.IsNil)
+	c.Assert(validateURLTemplate(&Plan{URL: "redis://:{{password}}@{{host}}"}), check.ErrorMatches, `placeholder "{{password}}" in URL template requires urlCredentials.password`)
+	c.Assert(validateURLTemplate(&Plan{
+		URL:            "mongodb://{{username}}:{{password}}@{{host}}",
+		URLCredentials: &URLCredentials{Username: "MONGO_USER", Password: "MONGO_PASSWORD"},
+	}), check.IsNil)
+	c.Assert(validateURLTemplate(&Plan{URL: "redis://{{host}}:{{port.}}"}), check.ErrorMatches, `invalid placeholder "{{port.}}" in URL template`)
+	c.Assert(validateURLTemplate(&Plan{URL: "redis://{{secret}}@{{host}}"}), check.ErrorMatches, `invalid placeholder "{{secret}}" in URL template`)
+}
+
+func (*S) TestRenderURL(c *check.C) {
+	instance := Instance{
+		Name:       "mycache",
+		DockerHost: "tcp://10.0.0.5:2375",
+		Envs:       []string{"REDIS_PASSWORD=p@ss word"},
+		Ports:      []InstancePort{{Name: "redis", ContainerPort: "6379/tcp", HostPort: "32768"}},
+		Plan:       Plan{URL: "redis://:{{env.REDIS_PASSWORD}}@{{host}}:{{port.6379}}/{{name}}?port={{ port.redis }}"},
+	}
+	result, err := renderURL(&instance)
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.Equals, "redis://:p%40ss%20word@10.0.0.5:32768/mycache?port=32768")
+	instance.Plan.URL = "redis://:{{password}}@{{host}}:{{port.6379}}/0"
+	instance.Plan.URLCredentials = &URLCredentials{Password: "REDIS_PASSWORD"}
+	result, err = renderURL(&instance)
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.Equals, "redis://:p%40ss%20word@10.0.0.5:32768/0")
+	instance.Plan.URL = "redis://{{host}}:{{port.6380}}/{{env.MISSING}}"
+	_, err = renderURL(&instance)
+	c.Assert(err, check.ErrorMatches, `no value for {{port.6380}} in URL template`)
+	instance.Plan.URL = "redis://{{username}}@{{host}}"
+	_, err = renderURL(&instance)
+	c.Assert(err, check.ErrorMatches, `no value for {{username}} in URL template`)
+}
+
+func (*S) TestBindAppHandlerURL(c *check.C) {
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	err = client.PullImage(docker.PullImageOptions{Repository: "redis"}, docker.AuthConfiguration{})
+	c.Assert(err, check.IsNil)
+	config.Plans = []Plan{{
+		Name:  "redis",
+		Image: "redis",
+		Ports: []PlanPort{{Name: "redis", Port: "6379"}},
+		URL:   "redis://{{host}}:{{port.6379}}/0",
+	}}
+	err = CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	defer DestroyInstance(context.Background(), "mycache")
+	instance, err := GetInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("POST", "/resources/mycache/bind-app", strings.NewReader(""))
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	buildMuxer().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var envs map[string]string
+	err = json.NewDecoder(recorder.Body).Decode(&envs)
+	c.Assert(err, check.IsNil)
+	c.Assert(envs["DIAATS_REDIS_URL"], check.Equals, "redis://127.0.0.1:"+instance.Ports[0].HostPort+"/0")
+}
+
+func (*S) TestBindAppHandlerURLFailure(c *check.C) {
+	config.Plans = []Plan{{Name: "redis", Image: "redis", URL: "redis://{{host}}:{{port.6379}}/0"}}
+	err := storage.InsertInstance(&Instance{Name: "mycache", Plan: config.Plans[0], DockerHost: config.DockerHost, State: StateRunning})
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("POST", "/resources/mycache/bind-app", strings.NewReader(""))
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	buildMuxer().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusInternalServerError)
+	c.Assert(recorder.Body.String(), check.Equals, "no value for {{port.6379}} in URL template\n")
+	events, err := ListEvents(EventFilter{Instance: "mycache", Kind: EventBind})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].Success, check.Equals, false)
+}
@@ -0,0 +1,151 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// InstanceVolume is a named volume of a container of an instance, mounted
+// at Path.
+type InstanceVolume struct {
+	Name string
+	Path string
+}
+
+// volumeName returns the name of the n-th volume of the given container.
+func volumeName(container string, n int) string {
+	return fmt.Sprintf("%s-data-%d", container, n)
+}
+
+// imageVolumes returns the paths of the volumes declared by the image,
+// sorted. A missing image has no volumes, as creating its container fails
+// anyway.
+func imageVolumes(client *docker.Client, name string) ([]string, error) {
+	image, err := client.InspectImage(name)
+	if err == docker.ErrNoSuchImage {
+		return nil, nil
+	}
+	if err != nil || image.Config == nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(image.Config.Volumes))
+	for path := range image.Config.Volumes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// createVolumes creates a named volume for each volume declared by the
+// images of the containers, so the data of the instance isn't tied to its
+// containers, and is removed along with the instance. Volumes defined by
+// binds in DOCKER_CONFIG are left to the operator.
+func createVolumes(ctx context.Context, p *provisioning) error {
+	p.volumes = make([][]InstanceVolume, len(p.specs))
+	for i, spec := range p.specs {
+		client, err := p.clientFor(i)
+		if err != nil {
+			removeVolumes(ctx, p)
+			return err
+		}
+		paths, err := imageVolumes(client, p.image(i))
+		if err != nil {
+			removeVolumes(ctx, p)
+			return err
+		}
+		for n, path := range paths {
+			volume := InstanceVolume{Name: volumeName(spec.name, n), Path: path}
+			_, err = client.CreateVolume(docker.CreateVolumeOptions{Name: volume.Name})
+			if err != nil {
+				removeVolumes(ctx, p)
+				return err
+			}
+			p.volumes[i] = append(p.volumes[i], volume)
+		}
+	}
+	return nil
+}
+
+// removeVolumes removes the volumes created by createVolumes.
+func removeVolumes(ctx context.Context, p *provisioning) error {
+	var lastErr error
+	for i, volumes := range p.volumes {
+		client, err := p.clientFor(i)
+		if err == nil {
+			err = removeVolumeList(client, volumes)
+		}
+		if err != nil {
+			p.log.Error("failed to remove volumes", "error", err)
+			lastErr = err
+		}
+	}
+	p.volumes = nil
+	return lastErr
+}
+
+// removeVolumeList removes the given volumes, ignoring the ones that don't
+// exist anymore, and returns the last error.
+func removeVolumeList(client *docker.Client, volumes []InstanceVolume) error {
+	var lastErr error
+	for _, volume := range volumes {
+		if err := client.RemoveVolume(volume.Name); err != nil && err != docker.ErrNoSuchVolume {
+			lastErr = fmt.Errorf("volume %s: %s", volume.Name, err)
+		}
+	}
+	return lastErr
+}
+
+// binds returns the binds mounting the volumes in their containers.
+func binds(volumes []InstanceVolume) []string {
+	binds := make([]string, len(volumes))
+	for i, volume := range volumes {
+		binds[i] = volume.Name + ":" + volume.Path
+	}
+	return binds
+}
+
+// createVolumeContainer creates a container of the image mounting the given
+// volumes, without starting it, so data can be copied from or into them.
+func createVolumeContainer(client *docker.Client, image string, volumes []InstanceVolume) (string, error) {
+	container, err := client.CreateContainer(docker.CreateContainerOptions{
+		Config:     &docker.Config{Image: image},
+		HostConfig: &docker.HostConfig{Binds: binds(volumes)},
+	})
+	if err != nil {
+		return "", err
+	}
+	return container.ID, nil
+}
+
+// copyVolume copies the directory at the given path of the container from to
+// the same path of the container to, which don't need to be running.
+func copyVolume(client *docker.Client, from, to, dir string) error {
+	return copyVolumeAcross(client, from, client, to, dir)
+}
+
+// copyVolumeAcross is like copyVolume, for containers in different Docker
+// hosts, reached through fromClient and toClient.
+func copyVolumeAcross(fromClient *docker.Client, from string, toClient *docker.Client, to, dir string) error {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(fromClient.DownloadFromContainer(from, docker.DownloadFromContainerOptions{
+			Path:         dir,
+			OutputStream: w,
+		}))
+	}()
+	err := toClient.UploadToContainer(to, docker.UploadToContainerOptions{
+		Path:        path.Dir(dir),
+		InputStream: r,
+	})
+	r.Close()
+	return err
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+// createDataImage creates the image "memcached-data", which declares the
+// volumes /data and /logs. The fake Docker server ignores the configuration
+// of committed images, so inspecting the image is handled here.
+func (s *S) createDataImage(c *check.C) {
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	err = client.PullImage(docker.PullImageOptions{Repository: "memcached"}, docker.AuthConfiguration{})
+	c.Assert(err, check.IsNil)
+	container, err := client.CreateContainer(docker.CreateContainerOptions{
+		Name:   "data-image-builder",
+		Config: &docker.Config{Image: "memcached"},
+	})
+	c.Assert(err, check.IsNil)
+	image, err := client.CommitContainer(docker.CommitContainerOptions{
+		Container:  container.ID,
+		Repository: "memcached-data",
+	})
+	c.Assert(err, check.IsNil)
+	err = client.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID})
+	c.Assert(err, check.IsNil)
+	s.server.CustomHandler("/images/memcached-data/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(docker.Image{
+			ID:     image.ID,
+			Config: &docker.Config{Volumes: map[string]struct{}{"/logs": {}, "/data": {}}},
+		})
+	}))
+}
+
+// recordVolumeRemovals replaces the removal of volumes in the fake Docker
+// server, returning the names of the removed volumes.
+func (s *S) recordVolumeRemovals() func() []string {
+	var mut sync.Mutex
+	var removed []string
+	s.server.CustomHandler("/volumes/diaats-.*", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		removed = append(removed, strings.TrimPrefix(r.URL.Path, "/volumes/"))
+		mut.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return func() []string {
+		mut.Lock()
+		defer mut.Unlock()
+		return removed
+	}
+}
+
+func (s *S) TestCreateInstanceVolumes(c *check.C) {
+	s.createDataImage(c)
+	config.Plans = []Plan{{Name: "datacache", Image: "memcached-data"}}
+	err := CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.IsNil)
+	instance, err := storage.GetInstance("mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.Containers, check.HasLen, 1)
+	c.Assert(instance.Containers[0].Volumes, check.DeepEquals, []InstanceVolume{
+		{Name: "diaats-datacache-mycache-data-0", Path: "/data"},
+		{Name: "diaats-datacache-mycache-data-1", Path: "/logs"},
+	})
+	client, err := docker.NewClient(config.DockerHost)
+	c.Assert(err, check.IsNil)
+	for _, volume := range instance.Containers[0].Volumes {
+		_, err = client.InspectVolume(volume.Name)
+		c.Assert(err, check.IsNil)
+	}
+	container, err := client.InspectContainer(instance.ContainerID)
+	c.Assert(err, check.IsNil)
+	c.Assert(container.HostConfig.Binds, check.DeepEquals, []string{
+		"diaats-datacache-mycache-data-0:/data",
+		"diaats-datacache-mycache-data-1:/logs",
+	})
+	removed := s.recordVolumeRemovals()
+	err = DestroyInstance(context.Background(), "mycache")
+	c.Assert(err, check.IsNil)
+	c.Assert(removed(), check.DeepEquals, []string{"diaats-datacache-mycache-data-0", "diaats-datacache-mycache-data-1"})
+}
+
+func (s *S) TestCreateInstanceFailureRemovesVolumes(c *check.C) {
+	s.createDataImage(c)
+	config.Plans = []Plan{{Name: "datacache", Image: "memcached-data"}}
+	removed := s.recordVolumeRemovals()
+	s.server.PrepareFailure("start-failure", "/containers/.*/start")
+	defer s.server.ResetFailure("start-failure")
+	err := CreateInstance(context.Background(), "mycache", &config.Plans[0], CreateOptions{})
+	c.Assert(err, check.NotNil)
+	c.Assert(removed(), check.DeepEquals, []string{"diaats-datacache-mycache-data-0", "diaats-datacache-mycache-data-1"})
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// maintenanceWindow is a weekly period in which disruptive operations may
+// run.
+type maintenanceWindow struct {
+	// days are the days in which the window starts. The window starts
+	// every day when it's empty.
+	days map[time.Weekday]bool
+
+	// start and end are offsets from midnight, in UTC. The window ends in
+	// the next day when end is before start.
+	start, end time.Duration
+}
+
+// parseWindow parses a maintenance window in the format "[days] HH:MM-HH:MM",
+// in UTC, where days is an optional comma separated list of weekdays, like
+// "sat,sun 22:00-02:00" or "03:00-05:00".
+func parseWindow(s string) (*maintenanceWindow, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid maintenance window %q", s)
+	}
+	var w maintenanceWindow
+	if len(fields) == 2 {
+		w.days = make(map[time.Weekday]bool)
+		for _, day := range strings.Split(fields[0], ",") {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("invalid day %q in maintenance window %q", day, s)
+			}
+			w.days[weekday] = true
+		}
+	}
+	times := strings.Split(fields[len(fields)-1], "-")
+	if len(times) != 2 {
+		return nil, fmt.Errorf("invalid maintenance window %q", s)
+	}
+	var err error
+	if w.start, err = parseClock(times[0]); err != nil {
+		return nil, fmt.Errorf("invalid maintenance window %q: %s", s, err)
+	}
+	if w.end, err = parseClock(times[1]); err != nil {
+		return nil, fmt.Errorf("invalid maintenance window %q: %s", s, err)
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("invalid maintenance window %q: empty period", s)
+	}
+	return &w, nil
+}
+
+// parseClock parses a time of the day in the format HH:MM, returning its
+// offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// contains reports whether t is inside the window.
+func (w *maintenanceWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	offset := t.Sub(midnight)
+	if w.start < w.end {
+		return w.startsOn(t.Weekday()) && offset >= w.start && offset < w.end
+	}
+	if offset >= w.start {
+		return w.startsOn(t.Weekday())
+	}
+	return offset < w.end && w.startsOn((t.Weekday()+6)%7)
+}
+
+func (w *maintenanceWindow) startsOn(day time.Weekday) bool {
+	return len(w.days) == 0 || w.days[day]
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 diaats authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (*S) TestParseWindowInvalid(c *check.C) {
+	var tests = []struct {
+		window string
+		err    string
+	}{
+		{"", `invalid maintenance window ""`},
+		{"sunday 02:00-04:00", `invalid day "sunday" in maintenance window "sunday 02:00-04:00"`},
+		{"02:00", `invalid maintenance window "02:00"`},
+		{"02:00-25:00", `invalid maintenance window "02:00-25:00": invalid time "25:00"`},
+		{"02:00-02:00", `invalid maintenance window "02:00-02:00": empty period`},
+		{"sun 02:00-04:00 UTC", `invalid maintenance window "sun 02:00-04:00 UTC"`},
+	}
+	for _, t := range tests {
+		_, err := parseWindow(t.window)
+		c.Check(err, check.ErrorMatches, t.err)
+	}
+}
+
+func (*S) TestMaintenanceWindowContains(c *check.C) {
+	// 2016-01-03 is a Sunday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2016, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+	var tests = []struct {
+		window   string
+		t        time.Time
+		expected bool
+	}{
+		{"02:00-04:00", at(3, 2, 0), true},
+		{"02:00-04:00", at(5, 3, 59), true},
+		{"02:00-04:00", at(5, 4, 0), false},
+		{"02:00-04:00", at(5, 1, 59), false},
+		{"sun 02:00-04:00", at(3, 3, 0), true},
+		{"sun 02:00-04:00", at(4, 3, 0), false},
+		{"SAT,sun 02:00-04:00", at(2, 3, 0), true},
+		{"sat 22:00-02:00", at(2, 23, 0), true},
+		{"sat 22:00-02:00", at(3, 1, 0), true},
+		{"sat 22:00-02:00", at(3, 23, 0), false},
+		{"sat 22:00-02:00", at(2, 1, 0), false},
+		{"sat 22:00-02:00", at(3, 2, 0), false},
+		{"03:00-05:00", time.Date(2016, 1, 5, 1, 0, 0, 0, time.FixedZone("BRT", -2*3600)), true},
+	}
+	for _, t := range tests {
+		w, err := parseWindow(t.window)
+		c.Assert(err, check.IsNil)
+		c.Check(w.contains(t.t), check.Equals, t.expected, check.Commentf("%s at %s", t.window, t.t))
+	}
+}